@@ -0,0 +1,85 @@
+package fetchurl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/repository"
+)
+
+// fetchCached serves the content from f.CacheDir, or fetches it and stores
+// it there once verified. Failing to store it does not fail the fetch.
+//
+// Cached content was verified when stored, so only the digests besides Hash
+// are checked again when serving it.
+func (f *Fetcher) fetchCached(ctx context.Context, opts FetchOptions, cw *countingWriter) error {
+	repo := repository.NewLocalRepository(f.CacheDir, nil)
+	reader, size, err := repo.Get(ctx, opts.Algo, opts.Hash)
+	if err == nil {
+		defer func() {
+			errutil.LogMsg(reader.Close(), "Failed to close cached file")
+		}()
+		hasher, err := newMultiHasher(opts.digests()[1:])
+		if err != nil {
+			return err
+		}
+		cw.Total = size
+		if _, err := io.Copy(io.MultiWriter(cw, hasher), reader); err != nil {
+			return fmt.Errorf("failed to read from cache: %w", err)
+		}
+		cw.Served = FetchResult{Source: f.CacheDir, CacheHit: true}
+		meta, err := repo.GetMetadata(opts.Algo, opts.Hash)
+		errutil.LogMsg(err, "Failed to read cached metadata", "algo", opts.Algo, "hash", opts.Hash)
+		if meta != nil {
+			cw.Served.Filename = dispositionFilename(meta.ContentDisposition)
+		}
+		return hasher.verify()
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		errutil.LogMsg(err, "Failed to read from cache", "algo", opts.Algo, "hash", opts.Hash)
+	}
+
+	if err := os.MkdirAll(f.CacheDir, 0755); err != nil {
+		errutil.LogMsg(err, "Failed to create cache directory", "path", f.CacheDir)
+		return f.fetch(ctx, opts, cw)
+	}
+	tmpFile, commit, err := repo.BeginWrite(opts.Algo, opts.Hash, -1)
+	if err != nil {
+		errutil.LogMsg(err, "Failed to start writing to cache", "algo", opts.Algo, "hash", opts.Hash)
+		return f.fetch(ctx, opts, cw)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			errutil.LogMsg(tmpFile.Close(), "Failed to close temp file")
+			if f, ok := tmpFile.(*os.File); ok {
+				errutil.LogMsg(os.Remove(f.Name()), "Failed to remove temp file", "path", f.Name())
+			}
+		}
+	}()
+
+	cw.Writer = io.MultiWriter(cw.Writer, tmpFile)
+	cw.Rewind = chainRewinders(cw.Rewind, seekRewinder(tmpFile))
+	if err := f.fetch(ctx, opts, cw); err != nil {
+		return err
+	}
+	if err := commit(); err != nil {
+		errutil.LogMsg(err, "Failed to store in cache", "algo", opts.Algo, "hash", opts.Hash)
+		return nil
+	}
+	committed = true
+	// Kept so that cache hits suggest the same file name, and cleared
+	// otherwise so an earlier copy's name isn't replayed
+	var meta repository.Metadata
+	if name := cw.Served.Filename; name != "" {
+		meta.ContentDisposition = mime.FormatMediaType("attachment", map[string]string{"filename": name})
+	}
+	errutil.LogMsg(repo.SetMetadata(opts.Algo, opts.Hash, meta), "Failed to store metadata", "algo", opts.Algo, "hash", opts.Hash)
+	return nil
+}
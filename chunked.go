@@ -0,0 +1,135 @@
+package fetchurl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+)
+
+// DefaultChunkConcurrency is how many chunks are downloaded at once when
+// ChunkConcurrency is not set.
+const DefaultChunkConcurrency = 4
+
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+// copyChunked writes the content whose first chunk is being served by first
+// to out, fetching the remaining chunks with parallel Range requests modeled
+// on req. Chunks are buffered in memory and written in order, so at most
+// ChunkConcurrency chunks are held at once.
+func (f *Fetcher) copyChunked(req *http.Request, first *http.Response, out io.Writer) error {
+	start, end, total, ok := parseContentRange(first.Header.Get("Content-Range"))
+	if !ok || start != 0 {
+		return fmt.Errorf("source returned unexpected range %q", first.Header.Get("Content-Range"))
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	concurrency := f.ChunkConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultChunkConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var chunks []chan chunkResult
+	for off := end + 1; off < total; off += f.ChunkSize {
+		chunks = append(chunks, make(chan chunkResult, 1))
+	}
+	go func() {
+		for i, ch := range chunks {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			chunkStart := end + 1 + int64(i)*f.ChunkSize
+			chunkEnd := min(chunkStart+f.ChunkSize, total) - 1
+			go func() {
+				data, err := f.fetchChunk(ctx, req, chunkStart, chunkEnd)
+				ch <- chunkResult{data: data, err: err}
+			}()
+		}
+	}()
+
+	if n, err := io.Copy(out, first.Body); err != nil {
+		return err
+	} else if n != end+1 {
+		return fmt.Errorf("first chunk is %d bytes, expected %d", n, end+1)
+	}
+	for _, ch := range chunks {
+		var res chunkResult
+		select {
+		case res = <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if res.err != nil {
+			return res.err
+		}
+		if _, err := out.Write(res.data); err != nil {
+			return err
+		}
+		<-sem
+	}
+	return nil
+}
+
+// fetchChunk downloads bytes start through end, inclusive, of req's target.
+func (f *Fetcher) fetchChunk(ctx context.Context, req *http.Request, start, end int64) ([]byte, error) {
+	chunkReq := req.Clone(ctx)
+	chunkReq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := f.do(chunkReq)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		errutil.LogMsg(resp.Body.Close(), "Failed to close response body")
+	}()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode}
+	}
+	if s, e, _, ok := parseContentRange(resp.Header.Get("Content-Range")); !ok || s != start || e != end {
+		return nil, fmt.Errorf("source returned unexpected range %q", resp.Header.Get("Content-Range"))
+	}
+
+	data := make([]byte, end-start+1)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("failed to read chunk at %d: %w", start, err)
+	}
+	return data, nil
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes start-end/total". An unknown total is rejected.
+func parseContentRange(header string) (start, end, total int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	rng, size, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	first, last, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+	var err1, err2, err3 error
+	start, err1 = strconv.ParseInt(first, 10, 64)
+	end, err2 = strconv.ParseInt(last, 10, 64)
+	total, err3 = strconv.ParseInt(size, 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || start > end || end >= total {
+		return 0, 0, 0, false
+	}
+	return start, end, total, true
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lucasew/fetchurl/internal/bundle"
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/repository"
+	"github.com/spf13/cobra"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export <bundle>",
+	Short: "Export the cache as a signed bundle for air-gapped transfer",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cacheDir, err := cmd.Flags().GetString("cache-dir")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get cache-dir flag")
+			os.Exit(1)
+		}
+		keyPath, err := cmd.Flags().GetString("key")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get key flag")
+			os.Exit(1)
+		}
+
+		key, err := bundle.LoadPrivateKey(keyPath)
+		if err != nil {
+			errutil.ReportError(err, "Failed to load signing key")
+			os.Exit(1)
+		}
+
+		var out io.Writer = os.Stdout
+		if args[0] != "-" {
+			file, err := os.Create(args[0])
+			if err != nil {
+				errutil.ReportError(err, "Failed to create bundle file")
+				os.Exit(1)
+			}
+			defer func() {
+				errutil.LogMsg(file.Close(), "Failed to close bundle file")
+			}()
+			out = file
+		}
+
+		repo, err := openLocalRepository(cmd, cacheDir)
+		if err != nil {
+			errutil.ReportError(err, "Failed to open cache")
+			os.Exit(1)
+		}
+		manifest, err := bundle.Export(cmd.Context(), out, repo, key)
+		if err != nil {
+			errutil.ReportError(err, "Export failed")
+			if args[0] != "-" {
+				errutil.LogMsg(os.Remove(args[0]), "Failed to remove bundle file after failed export", "path", args[0])
+			}
+			os.Exit(1)
+		}
+		if _, err := fmt.Fprintf(os.Stderr, "exported %d objects\n", len(manifest.Entries)); err != nil {
+			errutil.LogMsg(err, "Failed to print export summary")
+		}
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import <bundle>",
+	Short: "Verify a signed bundle and import its objects into the cache",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cacheDir, err := cmd.Flags().GetString("cache-dir")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get cache-dir flag")
+			os.Exit(1)
+		}
+		pubPath, err := cmd.Flags().GetString("pubkey")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get pubkey flag")
+			os.Exit(1)
+		}
+
+		pub, err := bundle.LoadPublicKey(pubPath)
+		if err != nil {
+			errutil.ReportError(err, "Failed to load public key")
+			os.Exit(1)
+		}
+		if err := os.MkdirAll(cacheDir, 0755); err != nil {
+			errutil.ReportError(err, "Failed to create cache directory")
+			os.Exit(1)
+		}
+
+		var in io.Reader = os.Stdin
+		if args[0] != "-" {
+			file, err := os.Open(args[0])
+			if err != nil {
+				errutil.ReportError(err, "Failed to open bundle file")
+				os.Exit(1)
+			}
+			defer func() {
+				errutil.LogMsg(file.Close(), "Failed to close bundle file")
+			}()
+			in = file
+		}
+
+		repo, err := openLocalRepository(cmd, cacheDir)
+		if err != nil {
+			errutil.ReportError(err, "Failed to open cache")
+			os.Exit(1)
+		}
+		manifest, err := bundle.Import(cmd.Context(), in, repo, pub)
+		if err != nil {
+			errutil.ReportError(err, "Import failed")
+			os.Exit(1)
+		}
+		if _, err := fmt.Fprintf(os.Stderr, "imported %d objects\n", len(manifest.Entries)); err != nil {
+			errutil.LogMsg(err, "Failed to print import summary")
+		}
+	},
+}
+
+var keygenCmd = &cobra.Command{
+	Use:   "keygen <path>",
+	Short: "Generate a bundle signing key pair (<path> and <path>.pub)",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		private, public, err := bundle.GenerateKey()
+		if err != nil {
+			errutil.ReportError(err, "Failed to generate key")
+			os.Exit(1)
+		}
+		if err := os.WriteFile(args[0], private, 0600); err != nil {
+			errutil.ReportError(err, "Failed to write private key")
+			os.Exit(1)
+		}
+		if err := os.WriteFile(args[0]+".pub", public, 0644); err != nil {
+			errutil.ReportError(err, "Failed to write public key")
+			os.Exit(1)
+		}
+	},
+}
+
+// openLocalRepository opens cacheDir, decrypting it with --cache-key-file if set.
+func openLocalRepository(cmd *cobra.Command, cacheDir string) (*repository.LocalRepository, error) {
+	repo := repository.NewLocalRepository(cacheDir, nil)
+	keyPath, err := cmd.Flags().GetString("cache-key-file")
+	if err != nil || keyPath == "" {
+		return repo, err
+	}
+	key, err := repository.LoadCacheKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return repo, repo.SetEncryptionKey(key)
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().String("cache-dir", "./cache", "Cache directory to export")
+	exportCmd.Flags().String("key", "", "Private key used to sign the bundle")
+	exportCmd.Flags().String("cache-key-file", "", "Key the cache is encrypted with, if any")
+	if err := exportCmd.MarkFlagRequired("key"); err != nil {
+		panic(fmt.Sprintf("failed to mark key flag required: %v", err))
+	}
+
+	rootCmd.AddCommand(importCmd)
+	importCmd.Flags().String("cache-dir", "./cache", "Cache directory to import into")
+	importCmd.Flags().String("pubkey", "", "Public key the bundle must be signed with")
+	importCmd.Flags().String("cache-key-file", "", "Key the cache is encrypted with, if any")
+	if err := importCmd.MarkFlagRequired("pubkey"); err != nil {
+		panic(fmt.Sprintf("failed to mark pubkey flag required: %v", err))
+	}
+
+	rootCmd.AddCommand(keygenCmd)
+}
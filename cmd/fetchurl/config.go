@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/lucasew/fetchurl"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// fileConfig holds the config file, if any. Its top-level keys set defaults
+// for the flags of every command but server, whose flags are set from the
+// server section instead. servers, token and ipfs-gateway stand in for the
+// FETCHURL_SERVER, FETCHURL_TOKEN and FETCHURL_IPFS_GATEWAY variables:
+//
+//	servers: [https://cache.example.com]
+//	token: secret
+//	cache-dir: /home/me/.cache/fetchurl
+//	algo: sha512
+//	server:
+//	  cache-dir: /var/cache/fetchurl
+//	  upstream: [https://upstream.example.com]
+//	  allow-hosts: [github.com]
+//	  auth-token-file: /etc/fetchurl/tokens
+var fileConfig = viper.New()
+
+// readConfig loads the file given with --config, or config.{yaml,toml,json}
+// from the fetchurl user config directory if there is one.
+func readConfig(path string) error {
+	if path != "" {
+		fileConfig.SetConfigFile(path)
+		return fileConfig.ReadInConfig()
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		// No home directory to look in
+		return nil
+	}
+	fileConfig.SetConfigName("config")
+	fileConfig.AddConfigPath(filepath.Join(dir, "fetchurl"))
+	err = fileConfig.ReadInConfig()
+	if errors.As(err, &viper.ConfigFileNotFoundError{}) {
+		return nil
+	}
+	return err
+}
+
+// applyConfig sets the flags of cmd that weren't given on the command line
+// from the config file. The flags stay unchanged as far as cobra and viper
+// are concerned, so environment variables bound to them still win.
+func applyConfig(cmd *cobra.Command) error {
+	section := fileConfig
+	if cmd == serverCmd {
+		section = fileConfig.Sub("server")
+		if section == nil {
+			return nil
+		}
+	}
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed || flag.Name == "config" || !section.IsSet(flag.Name) {
+			return
+		}
+		if _, nested := section.Get(flag.Name).(map[string]any); nested {
+			// A section, such as server, not a value
+			return
+		}
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			err = slice.Replace(section.GetStringSlice(flag.Name))
+		} else {
+			err = flag.Value.Set(section.GetString(flag.Name))
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid %s in config file: %w", flag.Name, err)
+		}
+	})
+	return err
+}
+
+// newFetcher is fetchurl.NewFetcher with the servers, token and IPFS gateway
+// of the config file where their environment variables are unset.
+func newFetcher(client *http.Client) *fetchurl.Fetcher {
+	f := fetchurl.NewFetcher(client)
+	if _, ok := os.LookupEnv("FETCHURL_SERVER"); !ok && fileConfig.IsSet("servers") {
+		f.Servers = fileConfig.GetStringSlice("servers")
+	}
+	if _, ok := os.LookupEnv("FETCHURL_TOKEN"); !ok && fileConfig.IsSet("token") {
+		f.Token = fileConfig.GetString("token")
+	}
+	if _, ok := os.LookupEnv("FETCHURL_IPFS_GATEWAY"); !ok && fileConfig.IsSet("ipfs-gateway") {
+		f.IPFSGateway = fileConfig.GetString("ipfs-gateway")
+	}
+	return f
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+
+	"github.com/lucasew/fetchurl"
+)
+
+// Exit codes of get, so wrappers can tell failures apart.
+const (
+	exitFailure              = 1 // anything not listed below, such as invalid arguments
+	exitHashMismatch         = 3
+	exitAllSourcesFailed     = 4
+	exitUnsupportedAlgorithm = 5
+	exitIO                   = 6 // reading or writing local files
+	exitSizeMismatch         = 7
+	exitTimeout              = 8 // --timeout ran out
+)
+
+// exitCode returns the exit code for a failed fetch. When every source
+// failed, the last failure decides if it was a mismatch or an I/O error.
+func exitCode(err error) int {
+	var pathErr *fs.PathError
+	switch {
+	case errors.Is(err, fetchurl.ErrUnsupportedAlgorithm):
+		return exitUnsupportedAlgorithm
+	case errors.Is(err, fetchurl.ErrHashMismatch):
+		return exitHashMismatch
+	case errors.Is(err, fetchurl.ErrSizeMismatch):
+		return exitSizeMismatch
+	case errors.As(err, &pathErr):
+		return exitIO
+	case errors.Is(err, context.DeadlineExceeded):
+		return exitTimeout
+	case errors.Is(err, fetchurl.ErrAllSourcesFailed):
+		return exitAllSourcesFailed
+	default:
+		return exitFailure
+	}
+}
+
+// exitCodeAll returns the exit code shared by all errs, or exitFailure if
+// they differ.
+func exitCodeAll(errs []error) int {
+	code := exitFailure
+	for i, err := range errs {
+		if c := exitCode(err); i == 0 {
+			code = c
+		} else if c != code {
+			return exitFailure
+		}
+	}
+	return code
+}
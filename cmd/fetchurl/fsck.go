@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/app"
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/repository"
+	"github.com/spf13/cobra"
+)
+
+var fsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "Check the cache for corrupt objects",
+	Long: `Re-hash every object in the cache and delete those that don't match
+their digest, or move them under .quarantine with --quarantine.
+
+Temp files left behind by interrupted writes, metadata of objects that are
+gone and eviction state of files that are gone are cleaned up as well.
+Running it next to a live server is safe, but it competes for disk bandwidth.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cacheDir, err := cmd.Flags().GetString("cache-dir")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get cache-dir flag")
+			os.Exit(1)
+		}
+		quarantine, err := cmd.Flags().GetBool("quarantine")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get quarantine flag")
+			os.Exit(1)
+		}
+		tempAge, err := cmd.Flags().GetDuration("temp-age")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get temp-age flag")
+			os.Exit(1)
+		}
+
+		local, err := openLocalRepository(cmd, cacheDir)
+		if err != nil {
+			errutil.ReportError(err, "Failed to open cache")
+			os.Exit(1)
+		}
+		res, err := local.Fsck(cmd.Context(), repository.FsckOptions{Quarantine: quarantine, TempAge: tempAge})
+		if err != nil {
+			errutil.ReportError(err, "Cache check failed")
+			os.Exit(1)
+		}
+
+		// Loading the eviction state from disk drops what was removed
+		mgr, err := app.NewEvictionManager(app.Config{CacheDir: cacheDir, EvictionStrategy: "lru"})
+		if err != nil {
+			errutil.ReportError(err, "Failed to initialize eviction")
+			os.Exit(1)
+		}
+		if err := mgr.LoadInitialState(); err != nil {
+			errutil.ReportError(err, "Failed to load cache state")
+			os.Exit(1)
+		}
+		errutil.LogMsg(mgr.SaveState(), "Failed to save eviction state")
+
+		asJSON, quiet := outputFlags(cmd)
+		if asJSON {
+			printJSON(cmd.OutOrStdout(), fsckResult{
+				Checked:     res.Checked,
+				CheckedSize: res.CheckedSize,
+				Corrupt:     res.Corrupt,
+				Quarantined: quarantine,
+				Temp:        res.Temp,
+				OrphanMeta:  res.OrphanMeta,
+			})
+			return
+		}
+		if quiet {
+			return
+		}
+		verb := "deleted"
+		if quarantine {
+			verb = "quarantined"
+		}
+		if _, err := fmt.Fprintf(cmd.OutOrStdout(), "checked %d objects (%d bytes), %s %d corrupt, removed %d temp files and %d orphaned metadata files\n",
+			res.Checked, res.CheckedSize, verb, res.Corrupt, res.Temp, res.OrphanMeta); err != nil {
+			errutil.LogMsg(err, "Failed to print fsck summary")
+		}
+	},
+}
+
+// fsckResult is what fsck prints with --json.
+type fsckResult struct {
+	Checked     int   `json:"checked"`
+	CheckedSize int64 `json:"checked_size"`
+	Corrupt     int   `json:"corrupt"`
+	// Quarantined tells whether corrupt objects were moved rather than deleted.
+	Quarantined bool `json:"quarantined"`
+	Temp        int  `json:"temp"`
+	OrphanMeta  int  `json:"orphan_meta"`
+}
+
+func init() {
+	rootCmd.AddCommand(fsckCmd)
+	fsckCmd.Flags().String("cache-dir", "./cache", "Cache directory to check")
+	fsckCmd.Flags().String("cache-key-file", "", "Key the cache is encrypted with, if any")
+	fsckCmd.Flags().Bool("quarantine", false, "Move corrupt objects under .quarantine instead of deleting them")
+	fsckCmd.Flags().Duration("temp-age", 24*time.Hour, "Remove temp files older than this, which are left behind by interrupted writes")
+	addOutputFlags(fsckCmd)
+}
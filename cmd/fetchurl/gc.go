@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lucasew/fetchurl/internal/app"
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/eviction"
+	"github.com/spf13/cobra"
+)
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Run one eviction sweep over the cache",
+	Long: `Run one eviction sweep over the cache with the same policies as the server.
+
+With --dry-run, print which files would be deleted and which policies asked
+for it, without deleting anything. A running server can be asked to do the
+same with POST /admin/gc, on --admin-listen or with a write token.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cacheDir, err := cmd.Flags().GetString("cache-dir")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get cache-dir flag")
+			os.Exit(1)
+		}
+		maxCacheSize, err := cmd.Flags().GetInt64("max-cache-size")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get max-cache-size flag")
+			os.Exit(1)
+		}
+		minFreeSpace, err := cmd.Flags().GetInt64("min-free-space")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get min-free-space flag")
+			os.Exit(1)
+		}
+		strategy, err := cmd.Flags().GetString("eviction-strategy")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get eviction-strategy flag")
+			os.Exit(1)
+		}
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get dry-run flag")
+			os.Exit(1)
+		}
+
+		cfg := app.Config{
+			CacheDir:         cacheDir,
+			MaxCacheSize:     maxCacheSize,
+			MinFreeSpace:     minFreeSpace,
+			EvictionStrategy: strategy,
+		}
+		mgr, err := app.NewEvictionManager(cfg)
+		if err != nil {
+			errutil.ReportError(err, "Failed to initialize eviction")
+			os.Exit(1)
+		}
+		if err := mgr.LoadInitialState(); err != nil {
+			errutil.ReportError(err, "Failed to load cache state")
+			os.Exit(1)
+		}
+
+		asJSON, quiet := outputFlags(cmd)
+
+		plan := mgr.Plan()
+		if !asJSON && !quiet {
+			if err := printPlan(cmd.OutOrStdout(), plan, dryRun); err != nil {
+				errutil.LogMsg(err, "Failed to print eviction plan")
+			}
+		}
+		if dryRun {
+			if asJSON {
+				printJSON(cmd.OutOrStdout(), gcResult{Plan: plan})
+			}
+			return
+		}
+		summary := mgr.RunEviction()
+		errutil.LogMsg(mgr.SaveState(), "Failed to save eviction state")
+		switch {
+		case asJSON:
+			printJSON(cmd.OutOrStdout(), gcResult{Plan: plan, Summary: &summary})
+		case !quiet:
+			if _, err := fmt.Fprintf(cmd.OutOrStdout(), "evicted %d files, freed %d bytes, %d failed\n", summary.Evicted, summary.FreedBytes, summary.Failed); err != nil {
+				errutil.LogMsg(err, "Failed to print gc summary")
+			}
+		}
+	},
+}
+
+// gcResult is what gc prints with --json. Summary is left out on dry runs.
+type gcResult struct {
+	Plan    eviction.Plan     `json:"plan"`
+	Summary *eviction.Summary `json:"summary,omitempty"`
+}
+
+func printPlan(w io.Writer, plan eviction.Plan, dryRun bool) error {
+	if _, err := fmt.Fprintf(w, "cache size: %d bytes\n", plan.CurrentBytes); err != nil {
+		return err
+	}
+	if len(plan.Demands) == 0 {
+		_, err := fmt.Fprintln(w, "no policy requires eviction")
+		return err
+	}
+	for _, d := range plan.Demands {
+		if _, err := fmt.Fprintf(w, "policy %s: free %d bytes\n", d.Policy, d.BytesToFree); err != nil {
+			return err
+		}
+	}
+	verb := "evicting"
+	if dryRun {
+		verb = "would evict"
+	}
+	var total int64
+	for _, v := range plan.Victims {
+		total += v.Size
+		if _, err := fmt.Fprintf(w, "%s %s (%d bytes)\n", verb, v.Key, v.Size); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%s %d files, %d bytes, target %d bytes\n", verb, len(plan.Victims), total, plan.TargetBytes)
+	return err
+}
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+	gcCmd.Flags().String("cache-dir", "./cache", "Directory to store cached files")
+	gcCmd.Flags().Int64("max-cache-size", 1024*1024*1024, "Max cache size in bytes (default 1GB)")
+	gcCmd.Flags().Int64("min-free-space", 0, "Min free disk space in bytes (if set, overrides max-cache-size)")
+	gcCmd.Flags().String("eviction-strategy", "lru", "Eviction strategy to use (lru, size)")
+	gcCmd.Flags().Bool("dry-run", false, "Only report what would be evicted")
+	addOutputFlags(gcCmd)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/lucasew/fetchurl"
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/hashutil"
+	"github.com/schollz/progressbar/v3"
+	"github.com/spf13/cobra"
+)
+
+// getItem is one file of a multi-file get, given as algo:hash:url[:output].
+type getItem struct {
+	Algo, Hash, URL, Output string
+	// NoClobber refuses to replace an existing Output.
+	NoClobber bool
+}
+
+// portPrefix matches what follows the last colon of a URL with a port, which
+// tells it apart from a trailing :output.
+var portPrefix = regexp.MustCompile(`^[0-9]+(/|$)`)
+
+// isGetItem reports whether arg looks like algo:hash:url rather than a hash.
+func isGetItem(arg string) bool {
+	algo, rest, ok := strings.Cut(arg, ":")
+	return ok && strings.Contains(rest, ":") && hashutil.IsSupported(algo)
+}
+
+// parseGetItem parses algo:hash:url[:output]. The output defaults to the
+// last element of the URL path.
+func parseGetItem(s string) (getItem, error) {
+	algo, rest, _ := strings.Cut(s, ":")
+	hash, rest, ok := strings.Cut(rest, ":")
+	if !ok || !hashutil.IsSupported(algo) || hash == "" {
+		return getItem{}, fmt.Errorf("invalid file %q, want algo:hash:url[:output]", s)
+	}
+	item := getItem{Algo: algo, Hash: hash, URL: rest}
+	if i := strings.LastIndex(rest, ":"); i >= 0 && !strings.HasPrefix(rest[i:], "://") && !portPrefix.MatchString(rest[i+1:]) {
+		item.URL, item.Output = rest[:i], rest[i+1:]
+	}
+	u, err := url.Parse(item.URL)
+	if err != nil || u.Scheme == "" {
+		return getItem{}, fmt.Errorf("invalid URL in %q", s)
+	}
+	if item.Output == "" {
+		item.Output = path.Base(u.Path)
+		if item.Output == "." || item.Output == "/" {
+			item.Output = hash
+		}
+	}
+	return item, nil
+}
+
+// readGetItems reads one algo:hash:url[:output] per line, skipping blank
+// lines and # comments.
+func readGetItems(r io.Reader) ([]getItem, error) {
+	var items []getItem
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		item, err := parseGetItem(line)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
+
+// getMany downloads items with f, jobs at a time, behind a single progress
+// bar for all of them unless quiet, and returns the errors of those that
+// failed. Outputs of failed downloads are removed. With asJSON, the result
+// of each file is printed once all are done, in order.
+func getMany(cmd *cobra.Command, f *fetchurl.Fetcher, items []getItem, jobs int, limitRate int64, asJSON, quiet bool) []error {
+	var bar *progressbar.ProgressBar
+	if !quiet {
+		bar = newProgressBar(fmt.Sprintf("downloading 0/%d", len(items)))
+	}
+
+	var mu sync.Mutex
+	written := make([]int64, len(items))
+	totals := make([]int64, len(items))
+	for i := range totals {
+		totals[i] = -1
+	}
+	results := make([]getResult, len(items))
+	var done int
+	var failed []error
+	// update redraws the bar, whose size is only known once every file's is
+	update := func() {
+		if bar == nil {
+			return
+		}
+		var sumWritten, sumTotal int64
+		for i := range items {
+			sumWritten += written[i]
+			if totals[i] < 0 {
+				sumTotal = -1
+			} else if sumTotal >= 0 {
+				sumTotal += totals[i]
+			}
+		}
+		if sumTotal != bar.GetMax64() {
+			bar.ChangeMax64(sumTotal)
+		}
+		bar.Describe(fmt.Sprintf("downloading %d/%d", done, len(items)))
+		errutil.LogMsg(bar.Set64(sumWritten), "Failed to update progress bar")
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, jobs)
+	for i, item := range items {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			result, err := getOne(cmd, f, item, limitRate, func(w, total int64) {
+				mu.Lock()
+				defer mu.Unlock()
+				written[i], totals[i] = w, total
+				update()
+			})
+			errutil.LogMsg(err, "Fetch failed", "url", item.URL, "output", item.Output)
+			mu.Lock()
+			defer mu.Unlock()
+			results[i] = newGetResult(item, result, err)
+			done++
+			if err != nil {
+				failed = append(failed, err)
+			}
+			// Failed and unsized files count as what they got to
+			totals[i] = written[i]
+			update()
+		}()
+	}
+	wg.Wait()
+	if bar != nil {
+		errutil.LogMsg(bar.Finish(), "Failed to finish progress bar")
+	}
+	if asJSON {
+		for _, r := range results {
+			printJSON(cmd.OutOrStdout(), r)
+		}
+	}
+	return failed
+}
+
+func getOne(cmd *cobra.Command, f *fetchurl.Fetcher, item getItem, limitRate int64, progress func(written, total int64)) (fetchurl.FetchResult, error) {
+	var result fetchurl.FetchResult
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if item.NoClobber {
+		flags |= os.O_EXCL
+	}
+	file, err := os.OpenFile(item.Output, flags, 0o666)
+	if err != nil {
+		return result, err
+	}
+	err = f.Fetch(cmd.Context(), fetchurl.FetchOptions{
+		Algo:              item.Algo,
+		Hash:              item.Hash,
+		URLs:              []string{item.URL},
+		Out:               file,
+		MaxBytesPerSecond: limitRate,
+		Progress:          progress,
+		Result:            &result,
+	})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		errutil.LogMsg(os.Remove(item.Output), "Failed to remove output file after failed fetch", "path", item.Output)
+	}
+	return result, err
+}
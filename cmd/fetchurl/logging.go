@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/lucasew/fetchurl/internal/requestid"
+	"github.com/spf13/cobra"
+)
+
+// setupLogging installs the slog handler chosen with --log-level and
+// --log-format as the default, which the log package is redirected to as
+// well. Records logged with a request's context carry its ID.
+//
+// The handler is always replaced: the default one can't be wrapped, as it
+// logs through the log package that SetDefault redirects to the new one.
+func setupLogging(cmd *cobra.Command) error {
+	levelName, err := cmd.Flags().GetString("log-level")
+	if err != nil {
+		return err
+	}
+	format, err := cmd.Flags().GetString("log-format")
+	if err != nil {
+		return err
+	}
+	handler, err := newLogHandler(os.Stderr, levelName, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(requestid.NewLogHandler(handler)))
+	return nil
+}
+
+// newLogHandler returns a handler writing records of at least levelName to w
+// in format, text or json.
+func newLogHandler(w io.Writer, levelName, format string) (slog.Handler, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(levelName)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", levelName)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, expected text or json", format)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lucasew/fetchurl"
+	"github.com/lucasew/fetchurl/internal/app"
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/hashutil"
+	"github.com/lucasew/fetchurl/internal/repository"
+	"github.com/spf13/cobra"
+)
+
+// lsPageSize is how many objects are listed at a time.
+const lsPageSize = 1000
+
+// lsEntry is a cached object as printed by ls.
+type lsEntry struct {
+	Algo       string     `json:"algo"`
+	Hash       string     `json:"hash"`
+	Size       int64      `json:"size"`
+	LastAccess *time.Time `json:"last_access,omitempty"`
+}
+
+var lsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List cached objects",
+	Long: `List the objects in a local cache directory, or on a server through
+GET /api/fetchurl/list, with their size and last access.
+
+The server defaults to the first in FETCHURL_SERVER and is authenticated with
+FETCHURL_TOKEN. With --json, each object is printed as a JSON object on its
+own line.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cacheDir, err := cmd.Flags().GetString("cache-dir")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get cache-dir flag")
+			os.Exit(1)
+		}
+		server, err := cmd.Flags().GetString("server")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get server flag")
+			os.Exit(1)
+		}
+		algos, err := cmd.Flags().GetStringSlice("algo")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get algo flag")
+			os.Exit(1)
+		}
+		asJSON, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get json flag")
+			os.Exit(1)
+		}
+		if len(algos) == 0 {
+			algos = hashutil.Names()
+		}
+		for i, algo := range algos {
+			algos[i] = hashutil.NormalizeAlgo(algo)
+			if !hashutil.IsSupported(algos[i]) {
+				errutil.ReportError(fmt.Errorf("unsupported hash algorithm: %s", algo), "Invalid arguments")
+				os.Exit(1)
+			}
+		}
+
+		print := func(e lsEntry) error {
+			if asJSON {
+				return json.NewEncoder(cmd.OutOrStdout()).Encode(e)
+			}
+			lastAccess := "-"
+			if e.LastAccess != nil {
+				lastAccess = e.LastAccess.Format(time.RFC3339)
+			}
+			_, err := fmt.Fprintf(cmd.OutOrStdout(), "%s/%s\t%d\t%s\n", e.Algo, e.Hash, e.Size, lastAccess)
+			return err
+		}
+
+		if cacheDir != "" {
+			err = listLocal(cmd, cacheDir, algos, print)
+		} else {
+			f := newFetcher(nil)
+			if server == "" && len(f.Servers) > 0 {
+				server = f.Servers[0]
+			}
+			if server == "" {
+				errutil.ReportError(fmt.Errorf("no server or cache dir given"), "Invalid arguments")
+				os.Exit(1)
+			}
+			err = listServer(cmd.Context(), f, server, algos, print)
+		}
+		if err != nil {
+			errutil.ReportError(err, "Failed to list objects")
+			os.Exit(1)
+		}
+	},
+}
+
+// listLocal prints the objects in cacheDir, with last access as the eviction manager knows it.
+func listLocal(cmd *cobra.Command, cacheDir string, algos []string, print func(lsEntry) error) error {
+	local, err := openLocalRepository(cmd, cacheDir)
+	if err != nil {
+		return err
+	}
+	mgr, err := app.NewEvictionManager(app.Config{CacheDir: cacheDir, EvictionStrategy: "lru"})
+	if err != nil {
+		return err
+	}
+	if err := mgr.LoadInitialState(); err != nil {
+		return err
+	}
+
+	for _, algo := range algos {
+		after := ""
+		for {
+			entries, err := local.List(algo, after, lsPageSize)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				entry := lsEntry{Algo: algo, Hash: e.Hash, Size: e.Size}
+				if t, ok := mgr.LastAccess(repository.LayoutSharded.RelPath(algo, e.Hash)); ok {
+					entry.LastAccess = &t
+				}
+				if err := print(entry); err != nil {
+					return err
+				}
+			}
+			if len(entries) < lsPageSize {
+				break
+			}
+			after = entries[len(entries)-1].Hash
+		}
+	}
+	return nil
+}
+
+// listServer prints the objects cached by server, page by page.
+func listServer(ctx context.Context, f *fetchurl.Fetcher, server string, algos []string, print func(lsEntry) error) error {
+	for _, algo := range algos {
+		after := ""
+		for {
+			query := url.Values{"algo": {algo}, "limit": {fmt.Sprint(lsPageSize)}}
+			if after != "" {
+				query.Set("after", after)
+			}
+			u := strings.TrimRight(server, "/") + "/api/fetchurl/list?" + query.Encode()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+			if err != nil {
+				return err
+			}
+			if f.Token != "" {
+				req.Header.Set("Authorization", "Bearer "+f.Token)
+			}
+			page, err := fetchListPage(f.Client, req)
+			if err != nil {
+				return err
+			}
+			for _, e := range page.Entries {
+				e.Algo = algo
+				if err := print(e); err != nil {
+					return err
+				}
+			}
+			if page.Next == "" {
+				break
+			}
+			after = page.Next
+		}
+	}
+	return nil
+}
+
+type listPage struct {
+	Entries []lsEntry `json:"entries"`
+	Next    string    `json:"next"`
+}
+
+func fetchListPage(client *http.Client, req *http.Request) (*listPage, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		errutil.LogMsg(resp.Body.Close(), "Failed to close response body")
+	}()
+	if resp.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		errutil.LogMsg(err, "Failed to read error response")
+		return nil, fmt.Errorf("server answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var page listPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("invalid list response: %w", err)
+	}
+	return &page, nil
+}
+
+func init() {
+	rootCmd.AddCommand(lsCmd)
+	lsCmd.Flags().String("cache-dir", "", "Cache directory to list instead of a server")
+	lsCmd.Flags().String("cache-key-file", "", "Key the cache is encrypted with, if any")
+	lsCmd.Flags().String("server", "", "Server to list (default: the first in FETCHURL_SERVER)")
+	lsCmd.Flags().StringSlice("algo", nil, "Only list objects under these algorithms (default: all)")
+	lsCmd.Flags().Bool("json", false, "Print one JSON object per line")
+}
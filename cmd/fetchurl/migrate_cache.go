@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/migrate"
+	"github.com/lucasew/fetchurl/internal/repository"
+	"github.com/spf13/cobra"
+)
+
+var migrateCacheCmd = &cobra.Command{
+	Use:   "migrate-cache",
+	Short: "Convert a cache directory between storage layouts",
+	Long: `Convert a cache directory between storage layouts, verifying hashes as it goes.
+
+Supported layouts:
+  flat     {hash}
+  algo     {algo}/{hash}
+  sharded  {algo}/{shard}/{hash} (used by the server)
+
+Objects of an encrypted cache are moved as they are and stay encrypted.
+Verifying them needs the key the cache was encrypted with (--cache-key-file).`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cacheDir, err := cmd.Flags().GetString("cache-dir")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get cache-dir flag")
+			os.Exit(1)
+		}
+		dest, err := cmd.Flags().GetString("dest")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get dest flag")
+			os.Exit(1)
+		}
+		fromName, err := cmd.Flags().GetString("from")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get from flag")
+			os.Exit(1)
+		}
+		toName, err := cmd.Flags().GetString("to")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get to flag")
+			os.Exit(1)
+		}
+		algo, err := cmd.Flags().GetString("algo")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get algo flag")
+			os.Exit(1)
+		}
+		noVerify, err := cmd.Flags().GetBool("no-verify")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get no-verify flag")
+			os.Exit(1)
+		}
+		keyPath, err := cmd.Flags().GetString("cache-key-file")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get cache-key-file flag")
+			os.Exit(1)
+		}
+		var key []byte
+		if keyPath != "" {
+			key, err = repository.LoadCacheKey(keyPath)
+			if err != nil {
+				errutil.ReportError(err, "Failed to load cache key")
+				os.Exit(1)
+			}
+		}
+
+		from, err := repository.ParseLayout(fromName)
+		if err != nil {
+			errutil.ReportError(err, "Invalid source layout")
+			os.Exit(1)
+		}
+		to, err := repository.ParseLayout(toName)
+		if err != nil {
+			errutil.ReportError(err, "Invalid target layout")
+			os.Exit(1)
+		}
+
+		res, err := migrate.Run(cmd.Context(), migrate.Options{
+			SrcDir:     cacheDir,
+			DstDir:     dest,
+			From:       from,
+			To:         to,
+			Algo:       algo,
+			SkipVerify: noVerify,
+			Key:        key,
+		})
+		if err != nil {
+			errutil.ReportError(err, "Migration failed")
+			os.Exit(1)
+		}
+		if _, err := fmt.Fprintf(os.Stdout, "migrated %d objects (%d bytes), skipped %d, corrupt %d\n", res.Migrated, res.Bytes, res.Skipped, res.Corrupt); err != nil {
+			errutil.LogMsg(err, "Failed to print migration summary")
+		}
+		if res.Corrupt > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCacheCmd)
+	migrateCacheCmd.Flags().String("cache-dir", "./cache", "Cache directory to migrate")
+	migrateCacheCmd.Flags().String("dest", "", "Destination directory (default: migrate in place)")
+	migrateCacheCmd.Flags().String("from", string(repository.LayoutFlat), "Source layout (flat, algo, sharded)")
+	migrateCacheCmd.Flags().String("to", string(repository.LayoutSharded), "Target layout (flat, algo, sharded)")
+	migrateCacheCmd.Flags().String("algo", "", "Algorithm of objects in a flat layout (default: guessed from hash length)")
+	migrateCacheCmd.Flags().Bool("no-verify", false, "Skip re-hashing objects before migrating them")
+	migrateCacheCmd.Flags().String("cache-key-file", "", "Key the cache is encrypted with, if any")
+}
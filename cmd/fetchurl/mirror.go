@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/lucasew/fetchurl"
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/hashutil"
+	"github.com/spf13/cobra"
+)
+
+var mirrorCmd = &cobra.Command{
+	Use:   "mirror --from <server> --to <server>",
+	Short: "Copy the objects one server has and another lacks",
+	Long: `Copy every object cached on the --from server that the --to server doesn't
+have, for example to promote a CI cache to a mirror.
+
+Both servers are listed through GET /api/fetchurl/list, and objects are
+copied with PUT, so --to needs uploads enabled. Objects are verified on the
+way. Both servers are authenticated with FETCHURL_TOKEN unless --from-token
+or --to-token is given.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		from, err := cmd.Flags().GetString("from")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get from flag")
+			os.Exit(1)
+		}
+		to, err := cmd.Flags().GetString("to")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get to flag")
+			os.Exit(1)
+		}
+		fromToken, err := cmd.Flags().GetString("from-token")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get from-token flag")
+			os.Exit(1)
+		}
+		toToken, err := cmd.Flags().GetString("to-token")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get to-token flag")
+			os.Exit(1)
+		}
+		algos, err := cmd.Flags().GetStringSlice("algo")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get algo flag")
+			os.Exit(1)
+		}
+		jobs, err := cmd.Flags().GetInt("jobs")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get jobs flag")
+			os.Exit(1)
+		}
+		if from == "" || to == "" {
+			errutil.ReportError(fmt.Errorf("both --from and --to are required"), "Invalid arguments")
+			os.Exit(1)
+		}
+		if jobs < 1 {
+			errutil.ReportError(fmt.Errorf("jobs must be at least 1, got %d", jobs), "Invalid arguments")
+			os.Exit(1)
+		}
+		if len(algos) == 0 {
+			algos = hashutil.Names()
+		}
+		for i, algo := range algos {
+			algos[i] = hashutil.NormalizeAlgo(algo)
+			if !hashutil.IsSupported(algos[i]) {
+				errutil.ReportError(fmt.Errorf("unsupported hash algorithm: %s", algo), "Invalid arguments")
+				os.Exit(1)
+			}
+		}
+
+		src := newFetcher(nil)
+		src.Servers = []string{from}
+		if fromToken != "" {
+			src.Token = fromToken
+		}
+		dst := newFetcher(nil)
+		if toToken != "" {
+			dst.Token = toToken
+		}
+
+		// Algorithms are mirrored one at a time so that aliases the
+		// destination adds on upload aren't copied again
+		var copied, total int
+		var failed []lsEntry
+		for _, algo := range algos {
+			missing, err := missingEntries(cmd.Context(), src, dst, from, to, algo)
+			if err != nil {
+				errutil.ReportError(err, "Failed to list servers", "algo", algo)
+				os.Exit(1)
+			}
+			algoFailed := mirror(cmd.Context(), src, dst, to, missing, jobs)
+			total += len(missing)
+			copied += len(missing) - len(algoFailed)
+			failed = append(failed, algoFailed...)
+		}
+
+		for _, e := range failed {
+			if _, err := fmt.Fprintf(os.Stderr, "failed %s/%s\n", e.Algo, e.Hash); err != nil {
+				errutil.LogMsg(err, "Failed to print mirror failure")
+			}
+		}
+		if _, err := fmt.Fprintf(os.Stderr, "copied %d of %d missing objects\n", copied, total); err != nil {
+			errutil.LogMsg(err, "Failed to print mirror summary")
+		}
+		if len(failed) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// missingEntries lists the algo objects on from that to doesn't have.
+func missingEntries(ctx context.Context, src, dst *fetchurl.Fetcher, from, to, algo string) ([]lsEntry, error) {
+	have := map[string]bool{}
+	if err := listServer(ctx, dst, to, []string{algo}, func(e lsEntry) error {
+		have[e.Hash] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	var missing []lsEntry
+	err := listServer(ctx, src, from, []string{algo}, func(e lsEntry) error {
+		if !have[e.Hash] {
+			missing = append(missing, e)
+		}
+		return nil
+	})
+	return missing, err
+}
+
+// mirror copies entries from src's server to the to server, jobs at a time,
+// and returns those that failed.
+func mirror(ctx context.Context, src, dst *fetchurl.Fetcher, to string, entries []lsEntry, jobs int) []lsEntry {
+	ok := make([]bool, len(entries))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, jobs)
+	for i, e := range entries {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := copyObject(ctx, src, dst, to, e)
+			errutil.LogMsg(err, "Failed to copy object", "algo", e.Algo, "hash", e.Hash)
+			ok[i] = err == nil
+		}()
+	}
+	wg.Wait()
+
+	var failed []lsEntry
+	for i, e := range entries {
+		if !ok[i] {
+			failed = append(failed, e)
+		}
+	}
+	return failed
+}
+
+// copyObject streams one object from src's server into a PUT to the to server.
+func copyObject(ctx context.Context, src, dst *fetchurl.Fetcher, to string, e lsEntry) error {
+	r, size, err := src.Open(ctx, fetchurl.FetchOptions{Algo: e.Algo, Hash: e.Hash, Size: e.Size})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errutil.LogMsg(r.Close(), "Failed to close object", "algo", e.Algo, "hash", e.Hash)
+	}()
+	_, err = dst.PutReader(ctx, to, e.Algo, e.Hash, r, size)
+	return err
+}
+
+func init() {
+	rootCmd.AddCommand(mirrorCmd)
+	mirrorCmd.Flags().String("from", "", "Server to copy objects from")
+	mirrorCmd.Flags().String("to", "", "Server to copy objects to")
+	mirrorCmd.Flags().String("from-token", "", "Token for the --from server (default: FETCHURL_TOKEN)")
+	mirrorCmd.Flags().String("to-token", "", "Token for the --to server (default: FETCHURL_TOKEN)")
+	mirrorCmd.Flags().StringSlice("algo", nil, "Only copy objects under these algorithms (default: all)")
+	mirrorCmd.Flags().IntP("jobs", "j", 4, "How many objects to copy at once")
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/spf13/cobra"
+)
+
+// addOutputFlags adds --json and --quiet to cmd, for use in scripts.
+func addOutputFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("json", false, "Print the result as JSON on stdout")
+	cmd.Flags().BoolP("quiet", "q", false, "Print no progress or summary, only errors and --json output")
+}
+
+// outputFlags returns the values of the flags added by addOutputFlags.
+func outputFlags(cmd *cobra.Command) (asJSON, quiet bool) {
+	asJSON, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		errutil.ReportError(err, "Failed to get json flag")
+		os.Exit(1)
+	}
+	quiet, err = cmd.Flags().GetBool("quiet")
+	if err != nil {
+		errutil.ReportError(err, "Failed to get quiet flag")
+		os.Exit(1)
+	}
+	return asJSON, quiet
+}
+
+// printJSON writes v to w as a line of JSON.
+func printJSON(w io.Writer, v any) {
+	errutil.LogMsg(json.NewEncoder(w).Encode(v), "Failed to print JSON result")
+}
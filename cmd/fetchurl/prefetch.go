@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/lucasew/fetchurl"
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/lockfile"
+	"github.com/spf13/cobra"
+)
+
+var prefetchCmd = &cobra.Command{
+	Use:   "prefetch <lockfile|manifest>",
+	Short: "Warm a server or cache with the files a lockfile pins",
+	Long: `Fetch every file pinned by a lockfile so later builds find it cached.
+
+Supported lockfiles are package-lock.json, npm-shrinkwrap.json, yarn.lock
+(Yarn 1), pnpm-lock.yaml, Cargo.lock and poetry.lock. Other files can be listed
+in a manifest: a .json array of {"url", "algo", "hash"} objects, or a .csv
+file of url,algo,hash rows. The hash may also be an SRI string.
+
+Files are fetched through the servers in FETCHURL_SERVER, which keep a copy,
+or into --cache-dir. Files that could not be fetched are listed at the end.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		jobs, err := cmd.Flags().GetInt("jobs")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get jobs flag")
+			os.Exit(1)
+		}
+		cacheDir, err := cmd.Flags().GetString("cache-dir")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get cache-dir flag")
+			os.Exit(1)
+		}
+		if jobs < 1 {
+			errutil.ReportError(fmt.Errorf("jobs must be at least 1, got %d", jobs), "Invalid arguments")
+			os.Exit(1)
+		}
+
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			errutil.ReportError(err, "Failed to read lockfile")
+			os.Exit(1)
+		}
+		artifacts, err := lockfile.Parse(args[0], data)
+		if err != nil {
+			errutil.ReportError(err, "Failed to parse lockfile")
+			os.Exit(1)
+		}
+
+		f := newFetcher(nil)
+		f.CacheDir = cacheDir
+		if len(f.Servers) == 0 && f.CacheDir == "" {
+			errutil.ReportError(fmt.Errorf("neither FETCHURL_SERVER nor --cache-dir is set"), "Nothing to prefetch into")
+			os.Exit(1)
+		}
+
+		failures := prefetch(cmd, f, artifacts, jobs)
+		for _, failure := range failures {
+			if _, err := fmt.Fprintf(os.Stderr, "failed %s (%s/%s): %v\n", failure.URL, failure.Algo, failure.Hash, failure.err); err != nil {
+				errutil.LogMsg(err, "Failed to print prefetch failure")
+			}
+		}
+		if _, err := fmt.Fprintf(os.Stderr, "prefetched %d of %d files\n", len(artifacts)-len(failures), len(artifacts)); err != nil {
+			errutil.LogMsg(err, "Failed to print prefetch summary")
+		}
+		if len(failures) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// prefetchFailure is an artifact that could not be fetched.
+type prefetchFailure struct {
+	lockfile.Artifact
+	err error
+}
+
+// prefetch fetches artifacts, jobs at a time, and returns those that failed
+// in the order they were given.
+func prefetch(cmd *cobra.Command, f *fetchurl.Fetcher, artifacts []lockfile.Artifact, jobs int) []prefetchFailure {
+	errs := make([]error, len(artifacts))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, jobs)
+	for i, a := range artifacts {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := f.Fetch(cmd.Context(), fetchurl.FetchOptions{
+				Algo: a.Algo,
+				Hash: a.Hash,
+				URLs: []string{a.URL},
+				Out:  io.Discard,
+			})
+			errutil.LogMsg(err, "Prefetch failed", "url", a.URL, "algo", a.Algo, "hash", a.Hash)
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+
+	var failures []prefetchFailure
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, prefetchFailure{artifacts[i], err})
+		}
+	}
+	return failures
+}
+
+func init() {
+	rootCmd.AddCommand(prefetchCmd)
+	prefetchCmd.Flags().IntP("jobs", "j", 4, "How many files to fetch at once")
+	prefetchCmd.Flags().String("cache-dir", "", "Local cache to fetch files into")
+}
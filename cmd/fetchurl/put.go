@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/lucasew/fetchurl"
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/hashutil"
+	"github.com/lucasew/fetchurl/internal/repository"
+	"github.com/spf13/cobra"
+)
+
+var putCmd = &cobra.Command{
+	Use:   "put <file>",
+	Short: "Publish a file to a server or cache",
+	Long: `Publish a file by its digest and print where it can be fetched from.
+
+The file is uploaded to --server, or to the first server in FETCHURL_SERVER,
+authenticating with FETCHURL_TOKEN; the server needs uploads enabled. With
+--cache-dir it is copied into a local cache instead.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		path := args[0]
+		algo, err := cmd.Flags().GetString("algo")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get algo flag")
+			os.Exit(1)
+		}
+		algo = hashutil.NormalizeAlgo(algo)
+		if !hashutil.IsSupported(algo) {
+			errutil.ReportError(fmt.Errorf("unsupported hash algorithm: %s", algo), "Invalid arguments")
+			os.Exit(1)
+		}
+		server, err := cmd.Flags().GetString("server")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get server flag")
+			os.Exit(1)
+		}
+		cacheDir, err := cmd.Flags().GetString("cache-dir")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get cache-dir flag")
+			os.Exit(1)
+		}
+
+		var location string
+		if cacheDir != "" {
+			local, err := openLocalRepository(cmd, cacheDir)
+			if err != nil {
+				errutil.ReportError(err, "Failed to open cache")
+				os.Exit(1)
+			}
+			location, err = putLocal(cmd.Context(), local, algo, path)
+			if err != nil {
+				errutil.ReportError(err, "Failed to store file", "path", path)
+				os.Exit(1)
+			}
+		} else {
+			f := newFetcher(nil)
+			if server == "" && len(f.Servers) > 0 {
+				server = f.Servers[0]
+			}
+			if server == "" {
+				errutil.ReportError(fmt.Errorf("no server given"), "Invalid arguments")
+				os.Exit(1)
+			}
+			location, err = f.Put(cmd.Context(), server, algo, path)
+			if err != nil {
+				errutil.ReportError(err, "Failed to upload file", "path", path)
+				os.Exit(1)
+			}
+		}
+		asJSON, quiet := outputFlags(cmd)
+		switch {
+		case asJSON:
+			info, err := os.Stat(path)
+			if err != nil {
+				errutil.ReportError(err, "Failed to stat file", "path", path)
+				os.Exit(1)
+			}
+			printJSON(cmd.OutOrStdout(), putResult{
+				Algo: algo,
+				// Both locations end with the hash
+				Hash:     location[strings.LastIndex(location, "/")+1:],
+				Size:     info.Size(),
+				Location: location,
+			})
+		case !quiet:
+			if _, err := fmt.Fprintln(cmd.OutOrStdout(), location); err != nil {
+				errutil.LogMsg(err, "Failed to print location")
+			}
+		}
+	},
+}
+
+// putResult is what put prints with --json.
+type putResult struct {
+	Algo     string `json:"algo"`
+	Hash     string `json:"hash"`
+	Size     int64  `json:"size"`
+	Location string `json:"location"`
+}
+
+// putLocal copies the file at path into local and returns where it landed.
+func putLocal(ctx context.Context, local *repository.LocalRepository, algo, path string) (string, error) {
+	hash, err := fetchurl.Digest(path, algo)
+	if err != nil {
+		return "", err
+	}
+	location := algo + "/" + hash
+	exists, err := local.Exists(ctx, algo, hash)
+	if err != nil || exists {
+		return location, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		errutil.LogMsg(file.Close(), "Failed to close file", "path", path)
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(local.CacheDir, 0755); err != nil {
+		return "", err
+	}
+	w, commit, err := local.BeginWrite(algo, hash, info.Size())
+	if err != nil {
+		return "", err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			errutil.LogMsg(w.Close(), "Failed to close temp file")
+			if f, ok := w.(*os.File); ok {
+				errutil.LogMsg(os.Remove(f.Name()), "Failed to remove temp file", "path", f.Name())
+			}
+		}
+	}()
+	// The file was hashed already, but may have changed since
+	hasher, err := hashutil.GetHasher(algo)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(io.MultiWriter(w, hasher), file); err != nil {
+		return "", err
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); actual != hash {
+		return "", fmt.Errorf("%s changed while being stored", path)
+	}
+	if err := commit(); err != nil {
+		return "", err
+	}
+	committed = true
+	return location, nil
+}
+
+func init() {
+	rootCmd.AddCommand(putCmd)
+	putCmd.Flags().String("algo", "sha256", "Hash algorithm to publish the file under")
+	putCmd.Flags().String("server", "", "Server to upload to (default: the first in FETCHURL_SERVER)")
+	putCmd.Flags().String("cache-dir", "", "Copy into this cache directory instead of uploading")
+	putCmd.Flags().String("cache-key-file", "", "Key the cache is encrypted with, if any")
+	addOutputFlags(putCmd)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/hashutil"
+	"github.com/spf13/cobra"
+)
+
+var rmCmd = &cobra.Command{
+	Use:   "rm <algo> <hash>",
+	Short: "Remove an object from the cache",
+	Long: `Remove an object from the cache, together with its aliases under the
+other algorithms and any partial download of it.
+
+A running server can be asked to do the same with
+DELETE /api/fetchurl/{algo}/{hash}.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		algo := hashutil.NormalizeAlgo(args[0])
+		hash := args[1]
+		if !hashutil.IsSupported(algo) {
+			errutil.ReportError(fmt.Errorf("unsupported hash algorithm: %s", args[0]), "Invalid arguments")
+			os.Exit(1)
+		}
+		cacheDir, err := cmd.Flags().GetString("cache-dir")
+		if err != nil {
+			errutil.ReportError(err, "Failed to get cache-dir flag")
+			os.Exit(1)
+		}
+
+		// Aliases are found by digesting the plaintext, so encrypted caches need the key
+		local, err := openLocalRepository(cmd, cacheDir)
+		if err != nil {
+			errutil.ReportError(err, "Failed to open cache")
+			os.Exit(1)
+		}
+		if err := local.Delete(cmd.Context(), algo, hash); err != nil {
+			errutil.ReportError(err, "Failed to remove object", "algo", algo, "hash", hash)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rmCmd)
+	rmCmd.Flags().String("cache-dir", "./cache", "Directory to store cached files")
+	rmCmd.Flags().String("cache-key-file", "", "Key the cache is encrypted with, if any")
+}
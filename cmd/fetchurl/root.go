@@ -12,7 +12,18 @@ import (
 var rootCmd = &cobra.Command{
 	Use:   "fetchurl",
 	Short: "A Content-Addressable Storage (CAS) proxy",
-	Long:  `fetchurl is a CLI tool that implements a Content-Addressable Storage (CAS) proxy.`,
+	Long: `fetchurl is a CLI tool that implements a Content-Addressable Storage (CAS) proxy.
+
+Flags default to the values in the config file, ~/.config/fetchurl/config.yaml
+or the one given with --config. Keys are flag names; the server command reads
+them from a server section instead. servers and token stand in for
+FETCHURL_SERVER and FETCHURL_TOKEN.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := applyConfig(cmd); err != nil {
+			return err
+		}
+		return setupLogging(cmd)
+	},
 }
 
 func Execute() {
@@ -26,9 +37,22 @@ func Execute() {
 
 func init() {
 	cobra.OnInitialize(initConfig)
+	rootCmd.PersistentFlags().String("config", "", "Config file (default: ~/.config/fetchurl/config.yaml)")
+	rootCmd.PersistentFlags().String("log-level", "info", "Minimum level of the messages logged: debug, info, warn or error")
+	rootCmd.PersistentFlags().String("log-format", "text", "Format of the log lines on stderr: text or json")
 }
 
 func initConfig() {
 	viper.SetEnvPrefix("FETCHURL")
 	viper.AutomaticEnv()
+
+	path, err := rootCmd.PersistentFlags().GetString("config")
+	if err != nil {
+		errutil.ReportError(err, "Failed to get config flag")
+		os.Exit(1)
+	}
+	if err := readConfig(path); err != nil {
+		errutil.ReportError(err, "Failed to read config file")
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+
+	"github.com/lucasew/fetchurl"
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/spf13/cobra"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify {<algo> <hash> | <sri>} <file>",
+	Short: "Check a file against a digest",
+	Long: `Check that a file on disk matches a digest, exiting non-zero if it
+doesn't, so scripts can skip fetching artifacts that are already present.
+
+The digest is either an algorithm and hex hash pair, or a single
+Subresource Integrity string such as sha256-<base64>.`,
+	Args: cobra.RangeArgs(2, 3),
+	Run: func(cmd *cobra.Command, args []string) {
+		var algo, hash, path string
+		if len(args) == 3 {
+			algo, hash, path = args[0], args[1], args[2]
+		} else {
+			hash, path = args[0], args[1]
+		}
+		if err := fetchurl.Verify(path, algo, hash); err != nil {
+			errutil.ReportError(err, "Verification failed", "path", path)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
@@ -0,0 +1,142 @@
+package fetchurl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+)
+
+// CredentialFunc returns the username and password to authenticate to u
+// with, if it knows any.
+type CredentialFunc func(ctx context.Context, u *url.URL) (username, password string, ok bool)
+
+// netrcEntry is a machine, or the default when machine is empty.
+type netrcEntry struct {
+	machine  string
+	login    string
+	password string
+}
+
+// DefaultNetrcPath returns the netrc file curl would read: $NETRC, or
+// .netrc in the home directory.
+func DefaultNetrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// Netrc reads the netrc file at path and returns a CredentialFunc that
+// looks hosts up in it, falling back to its default entry.
+func Netrc(path string) (CredentialFunc, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := parseNetrc(string(data))
+	return func(ctx context.Context, u *url.URL) (string, string, bool) {
+		for _, e := range entries {
+			if e.machine == u.Hostname() || e.machine == "" {
+				return e.login, e.password, e.login != "" || e.password != ""
+			}
+		}
+		return "", "", false
+	}, nil
+}
+
+func parseNetrc(data string) []netrcEntry {
+	var entries []netrcEntry
+	var current *netrcEntry
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		for j := 0; j < len(fields); j++ {
+			next := func() string {
+				if j+1 < len(fields) {
+					j++
+					return fields[j]
+				}
+				return ""
+			}
+			switch fields[j] {
+			case "machine":
+				entries = append(entries, netrcEntry{machine: next()})
+				current = &entries[len(entries)-1]
+			case "default":
+				entries = append(entries, netrcEntry{})
+				current = &entries[len(entries)-1]
+			case "login":
+				if login := next(); current != nil {
+					current.login = login
+				}
+			case "password":
+				if password := next(); current != nil {
+					current.password = password
+				}
+			case "account":
+				next()
+			case "macdef":
+				// Macro definitions run until the next blank line
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+				}
+				j = len(fields)
+			}
+		}
+	}
+	return entries
+}
+
+// CredentialHelper returns a CredentialFunc that asks command for
+// credentials using the git credential helper protocol, like git does with
+// "credential.helper". command is run by the shell with "get" appended.
+func CredentialHelper(command string) CredentialFunc {
+	return func(ctx context.Context, u *url.URL) (string, string, bool) {
+		var stdout bytes.Buffer
+		cmd := exec.CommandContext(ctx, "sh", "-c", command+" get")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("protocol=%s\nhost=%s\npath=%s\n\n", u.Scheme, u.Host, strings.TrimPrefix(u.Path, "/")))
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			errutil.LogMsg(err, "Credential helper failed", "command", command, "host", u.Host)
+			return "", "", false
+		}
+
+		var username, password string
+		scanner := bufio.NewScanner(&stdout)
+		for scanner.Scan() {
+			key, value, _ := strings.Cut(scanner.Text(), "=")
+			switch key {
+			case "username":
+				username = value
+			case "password":
+				password = value
+			}
+		}
+		return username, password, username != "" || password != ""
+	}
+}
+
+// ChainCredentials returns a CredentialFunc that asks each of funcs in turn.
+func ChainCredentials(funcs ...CredentialFunc) CredentialFunc {
+	return func(ctx context.Context, u *url.URL) (string, string, bool) {
+		for _, f := range funcs {
+			if username, password, ok := f(ctx, u); ok {
+				return username, password, true
+			}
+		}
+		return "", "", false
+	}
+}
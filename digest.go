@@ -0,0 +1,70 @@
+package fetchurl
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"maps"
+	"slices"
+
+	"github.com/lucasew/fetchurl/internal/hashutil"
+)
+
+// digest is a hex digest the content must match.
+type digest struct {
+	algo, hash string
+}
+
+// digests lists the digests the content of opts must match, Algo and Hash
+// first since they name the object.
+func (opts FetchOptions) digests() []digest {
+	want := []digest{{opts.Algo, opts.Hash}}
+	for _, algo := range slices.Sorted(maps.Keys(opts.Digests)) {
+		if algo != opts.Algo {
+			want = append(want, digest{algo, opts.Digests[algo]})
+		}
+	}
+	return want
+}
+
+// multiHasher hashes content with the algorithms of several digests at once.
+type multiHasher struct {
+	want    []digest
+	hashers []hash.Hash
+}
+
+func newMultiHasher(want []digest) (*multiHasher, error) {
+	m := &multiHasher{want: want}
+	for _, d := range want {
+		hasher, err := hashutil.GetHasher(d.algo)
+		if err != nil {
+			return nil, err
+		}
+		m.hashers = append(m.hashers, hasher)
+	}
+	return m, nil
+}
+
+func (m *multiHasher) Write(p []byte) (int, error) {
+	for _, h := range m.hashers {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+func (m *multiHasher) Reset() {
+	for _, h := range m.hashers {
+		h.Reset()
+	}
+}
+
+// verify returns an error matching ErrHashMismatch if any digest doesn't match.
+func (m *multiHasher) verify() error {
+	for i, h := range m.hashers {
+		expected := m.want[i].hash
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+			return fmt.Errorf("%w: expected %s digest %s, got %s", ErrHashMismatch, m.want[i].algo, expected, actual)
+		}
+	}
+	return nil
+}
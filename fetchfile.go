@@ -0,0 +1,198 @@
+package fetchurl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/ratelimit"
+)
+
+// partSuffix is appended to the destination path while a file is downloaded.
+const partSuffix = ".part"
+
+// FetchToFile fetches the content described by opts into the file at path,
+// ignoring opts.Out.
+//
+// The download goes to path.part and only replaces path once its hash has
+// been verified. If an attempt fails, the next one, whether a retry, another
+// source or another call, resumes from the bytes already in path.part with a
+// Range request. Concurrent calls for the same path are not supported.
+func (f *Fetcher) FetchToFile(ctx context.Context, opts FetchOptions, path string) error {
+	if err := normalizeOptions(&opts); err != nil {
+		return err
+	}
+
+	partPath := path + partSuffix
+	file, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	part := &partFile{
+		File:     file,
+		want:     opts.digests(),
+		size:     opts.Size,
+		limit:    ratelimit.NewBandwidth(opts.MaxBytesPerSecond),
+		progress: opts.Progress,
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			errutil.LogMsg(file.Close(), "Failed to close partial download", "path", partPath)
+		}
+	}()
+
+	if err := f.fillPart(ctx, opts, part); err != nil {
+		return err
+	}
+	if opts.Result != nil {
+		*opts.Result = part.result
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	closed = true
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partPath, path)
+}
+
+// fillPart tries the servers, then the sources, until one of them completes part.
+func (f *Fetcher) fillPart(ctx context.Context, opts FetchOptions, part *partFile) error {
+	retry := f.retryPolicy(opts)
+	fetchWith := func(newRequest func() (*http.Request, error)) error {
+		return retry.do(ctx, nil, func() error {
+			req, err := newRequest()
+			if err != nil {
+				return err
+			}
+			return part.fetch(f.do, req)
+		})
+	}
+
+	var lastErr error
+	for _, server := range f.Servers {
+		lastErr = fetchWith(func() (*http.Request, error) {
+			return f.newServerRequest(ctx, server, opts.Algo, opts.Hash, opts.Size, opts.sources())
+		})
+		if lastErr == nil {
+			return nil
+		}
+		errutil.LogMsg(lastErr, "Failed to fetch from server", "server", server)
+	}
+	for _, source := range opts.directSources() {
+		lastErr = fetchWith(func() (*http.Request, error) {
+			return f.newDirectRequest(ctx, source)
+		})
+		if lastErr == nil {
+			return nil
+		}
+		errutil.LogMsg(lastErr, "Failed to fetch from source", "url", source.URL)
+	}
+
+	if lastErr != nil {
+		return fmt.Errorf("%w: %w", ErrAllSourcesFailed, lastErr)
+	}
+	return ErrAllSourcesFailed
+}
+
+// partFile is a download in progress that attempts append to.
+type partFile struct {
+	*os.File
+	want     []digest
+	size     int64 // expected size, if positive
+	limit    *ratelimit.Bandwidth
+	progress func(written, total int64)
+	result   FetchResult // set once complete
+}
+
+// fetch continues the download with the content req returns and verifies it.
+//
+// The bytes already in the file are hashed again first, so whatever an
+// interrupted attempt left behind is accounted for.
+func (p *partFile) fetch(do func(*http.Request) (*http.Response, error), req *http.Request) error {
+	hasher, err := newMultiHasher(p.want)
+	if err != nil {
+		return err
+	}
+	size, err := p.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(hasher, io.NewSectionReader(p.File, 0, size)); err != nil {
+		return fmt.Errorf("failed to read partial download: %w", err)
+	}
+	if size > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", size))
+	}
+
+	resp, err := do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errutil.LogMsg(resp.Body.Close(), "Failed to close response body")
+	}()
+
+	var body io.Reader = resp.Body
+	total := int64(-1)
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && size > 0:
+		if start, _, _, ok := parseContentRange(resp.Header.Get("Content-Range")); !ok || start != size {
+			return fmt.Errorf("source returned unexpected range %q", resp.Header.Get("Content-Range"))
+		}
+		if resp.ContentLength >= 0 {
+			total = size + resp.ContentLength
+		}
+	case resp.StatusCode == http.StatusOK:
+		if size > 0 {
+			// The source ignored the Range header, start over
+			if err := p.reset(); err != nil {
+				return err
+			}
+			hasher.Reset()
+			size = 0
+		}
+		total = resp.ContentLength
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && size > 0 &&
+		resp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", size):
+		// Everything was downloaded already, only the verification is left
+		body = http.NoBody
+		total = size
+	default:
+		return &HTTPStatusError{StatusCode: resp.StatusCode}
+	}
+
+	out := &countingWriter{Writer: io.MultiWriter(p.File, hasher), N: size, Total: total, Limit: p.size, Progress: p.progress}
+	if err := checkSize(out.Limit, out.Total); err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, p.limit.Reader(req.Context(), body)); err != nil {
+		return err
+	}
+
+	if err := hasher.verify(); err != nil {
+		// Resuming from bad content would never verify
+		if err := p.reset(); err != nil {
+			errutil.LogMsg(err, "Failed to discard mismatched download", "path", p.Name())
+		}
+		return err
+	}
+	p.result = servedBy(req, resp)
+	p.result.Bytes = out.N
+	return nil
+}
+
+// reset empties the file.
+func (p *partFile) reset() error {
+	if err := p.Truncate(0); err != nil {
+		return err
+	}
+	_, err := p.Seek(0, io.SeekStart)
+	return err
+}
@@ -2,16 +2,24 @@ package fetchurl
 
 import (
 	"context"
-	"encoding/hex"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/lucasew/fetchurl/internal/errutil"
 	"github.com/lucasew/fetchurl/internal/hashutil"
+	"github.com/lucasew/fetchurl/internal/httpclient"
+	"github.com/lucasew/fetchurl/internal/ipfs"
+	"github.com/lucasew/fetchurl/internal/magnet"
+	"github.com/lucasew/fetchurl/internal/ratelimit"
+	"github.com/lucasew/fetchurl/internal/sourceurls"
+	"github.com/lucasew/fetchurl/internal/urltemplate"
 	"github.com/shogo82148/go-sfv"
 )
 
@@ -23,9 +31,13 @@ var (
 	ErrHashMismatch = errors.New("hash mismatch")
 
 	// ErrPartialWrite is returned when data was already written to Out before a failure occurred,
-	// making fallback to another source unsafe.
+	// making fallback to another source unsafe. Outs that implement io.WriteSeeker, such as
+	// files, are rewound instead, and truncated if they have a Truncate method.
 	ErrPartialWrite = errors.New("partial write")
 
+	// ErrSizeMismatch is returned when the content is not of the expected Size.
+	ErrSizeMismatch = errors.New("size mismatch")
+
 	// ErrAllSourcesFailed is returned when no server or direct source could provide the content.
 	ErrAllSourcesFailed = errors.New("all sources failed")
 )
@@ -40,15 +52,188 @@ func (e *HTTPStatusError) Error() string {
 }
 
 type Fetcher struct {
-	Client  *http.Client
+	Client *http.Client
+	// Servers are fetchurl servers to ask for the content before the sources.
+	// A URL template like https://mirror/{algo}/{hash:0:2}/{hash} is instead
+	// a static mirror, fetched from directly; {hash:start:end} slices the digest.
 	Servers []string
+	// IPFSGateway resolves ipfs:// and ipns:// source URLs. Defaults to
+	// FETCHURL_IPFS_GATEWAY, then to a public gateway.
+	IPFSGateway string
+	// Token is sent as a bearer token to Servers, never to sources.
+	// Defaults to FETCHURL_TOKEN.
+	Token string
+	// Credentials, if set, authenticates requests to servers without a Token
+	// and to sources without an Authorization header, e.g. with Netrc. The
+	// credentials of sources are not passed on to servers.
+	Credentials CredentialFunc
+	// ChunkSize, if positive, downloads content from sources that support
+	// Range requests in chunks of this many bytes, several at a time.
+	ChunkSize int64
+	// ChunkConcurrency is how many chunks are downloaded at once.
+	// Defaults to DefaultChunkConcurrency.
+	ChunkConcurrency int
+	// Retry is applied to every server and source unless FetchOptions overrides it.
+	Retry RetryPolicy
+	// HedgeDelay, if positive, races the next server or source whenever this
+	// long passes without a response, keeping whichever answers first.
+	// Retry does not apply to hedged fetches.
+	HedgeDelay time.Duration
+	// CacheDir, if set, is a local cache Fetch serves content from and stores
+	// fetched content in, laid out like a server's cache directory.
+	CacheDir string
 }
 
 type FetchOptions struct {
 	Algo string
+	// Hash is a hex digest, or a Subresource Integrity string such as
+	// "sha256-<base64>", in which case Algo may be left empty.
 	Hash string
+	// Digests maps more algorithms to hex digests the content must also
+	// match, e.g. a sha1 from a lockfile next to a sha256 from provenance.
+	// They are all computed from the same download.
+	Digests map[string]string
+	// Size, if positive, is the exact size of the content. Sources announcing
+	// another size are skipped and downloads are cut off as soon as they
+	// exceed it, before the digests can be checked.
+	Size int64
 	URLs []string
-	Out  io.Writer
+	// Sources are tried after URLs, and can carry headers and credentials.
+	Sources []Source
+	Out     io.Writer
+	// Retry, if set, replaces the Fetcher's retry policy for this fetch.
+	Retry *RetryPolicy
+	// MaxBytesPerSecond, if positive, caps how fast the content is downloaded.
+	MaxBytesPerSecond int64
+	// Progress, if set, is called as the content is written with the bytes
+	// written so far and the total size, or -1 if the source didn't tell.
+	// Both start over if a source fails before anything was written, or
+	// after, if Out is rewound.
+	Progress func(written, total int64)
+	// Result, if set, is filled in with how the content was served once the
+	// fetch succeeds.
+	Result *FetchResult
+}
+
+// FetchResult describes how a successful fetch was served.
+type FetchResult struct {
+	// Bytes is the size of the content.
+	Bytes int64
+	// Source is the URL the content came from, without credentials, or the
+	// cache directory.
+	Source string
+	// CacheHit reports whether the content came from the cache directory,
+	// or from the cache of the server it was fetched through.
+	CacheHit bool
+	// Filename is the file name suggested by the Content-Disposition the
+	// content was served with, if any. It never contains a path separator.
+	Filename string
+}
+
+// servedBy describes how resp, answering req, served the content, apart from its size.
+func servedBy(req *http.Request, resp *http.Response) FetchResult {
+	return FetchResult{
+		Source:   req.URL.Redacted(),
+		CacheHit: resp.Header.Get("X-Cache") == "HIT",
+		Filename: dispositionFilename(resp.Header.Get("Content-Disposition")),
+	}
+}
+
+// dispositionFilename returns the file name a Content-Disposition header
+// suggests, or "" if there is none that is safe to use as one.
+func dispositionFilename(header string) string {
+	if header == "" {
+		return ""
+	}
+	// filename* is decoded into filename as well
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+	name := params["filename"]
+	if name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return ""
+	}
+	return name
+}
+
+// Source is a URL to fetch the content from, along with what it takes to
+// access it.
+//
+// Header and credentials are passed on to Servers as X-Source-Urls
+// parameters, so they must be trusted with them. Keep in mind that a server
+// serves what it fetched to anyone asking for the hash.
+type Source struct {
+	URL string
+	// Header is sent with requests to URL, e.g. Authorization or User-Agent.
+	Header http.Header
+	// Username and Password, if Username is set, authenticate to URL with
+	// HTTP basic auth.
+	Username string
+	Password string
+}
+
+// header returns the headers to send to s, credentials included.
+func (s Source) header() http.Header {
+	h := s.Header.Clone()
+	if s.Username != "" {
+		if h == nil {
+			h = make(http.Header)
+		}
+		auth := base64.StdEncoding.EncodeToString([]byte(s.Username + ":" + s.Password))
+		h.Set("Authorization", "Basic "+auth)
+	}
+	return h
+}
+
+// sources lists the URLs and Sources of opts, as passed on to servers.
+func (opts FetchOptions) sources() []sourceurls.Source {
+	sources := make([]sourceurls.Source, 0, len(opts.URLs)+len(opts.Sources))
+	for _, url := range opts.URLs {
+		sources = append(sources, sourceurls.Source{URL: url})
+	}
+	for _, s := range opts.Sources {
+		sources = append(sources, sourceurls.Source{URL: s.URL, Header: s.header()})
+	}
+	return sources
+}
+
+// directSources lists the sources to download from directly. Magnet URIs
+// can only be fetched through their HTTP web seeds.
+func (opts FetchOptions) directSources() []sourceurls.Source {
+	var sources []sourceurls.Source
+	for _, s := range opts.sources() {
+		if !magnet.IsMagnet(s.URL) {
+			sources = append(sources, s)
+			continue
+		}
+		for _, url := range magnet.Sources(s.URL) {
+			sources = append(sources, sourceurls.Source{URL: url})
+		}
+	}
+	return sources
+}
+
+// candidate is a server or source to request the content from.
+type candidate struct {
+	name       string
+	newRequest func(ctx context.Context) (*http.Request, error)
+}
+
+// candidates lists the servers, then the sources, to request opts's content from.
+func (f *Fetcher) candidates(opts FetchOptions) []candidate {
+	var candidates []candidate
+	for _, server := range f.Servers {
+		candidates = append(candidates, candidate{server, func(ctx context.Context) (*http.Request, error) {
+			return f.newServerRequest(ctx, server, opts.Algo, opts.Hash, opts.Size, opts.sources())
+		}})
+	}
+	for _, source := range opts.directSources() {
+		candidates = append(candidates, candidate{source.URL, func(ctx context.Context) (*http.Request, error) {
+			return f.newDirectRequest(ctx, source)
+		}})
+	}
+	return candidates
 }
 
 func NewFetcher(client *http.Client) *Fetcher {
@@ -72,39 +257,69 @@ func NewFetcher(client *http.Client) *Fetcher {
 	}
 
 	return &Fetcher{
-		Client:  client,
-		Servers: servers,
+		Client:      client,
+		Servers:     servers,
+		IPFSGateway: os.Getenv("FETCHURL_IPFS_GATEWAY"),
+		Token:       os.Getenv("FETCHURL_TOKEN"),
 	}
 }
 
 func (f *Fetcher) Fetch(ctx context.Context, opts FetchOptions) error {
-	if !hashutil.IsSupported(opts.Algo) {
-		return fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, opts.Algo)
+	if err := normalizeOptions(&opts); err != nil {
+		return err
 	}
 
-	cw := &countingWriter{Writer: opts.Out}
+	cw := &countingWriter{
+		Writer:   ratelimit.NewBandwidth(opts.MaxBytesPerSecond).Writer(ctx, opts.Out),
+		Progress: opts.Progress,
+		Limit:    opts.Size,
+		Rewind:   seekRewinder(opts.Out),
+	}
+	var err error
+	if f.CacheDir != "" {
+		err = f.fetchCached(ctx, opts, cw)
+	} else {
+		err = f.fetch(ctx, opts, cw)
+	}
+	if err == nil && opts.Result != nil {
+		*opts.Result = cw.Served
+		opts.Result.Bytes = cw.N
+	}
+	return err
+}
+
+// fetch writes the content to cw from the first server or source that has it.
+func (f *Fetcher) fetch(ctx context.Context, opts FetchOptions, cw *countingWriter) error {
+	if f.HedgeDelay > 0 {
+		return f.fetchHedged(ctx, opts, cw)
+	}
+	retry := f.retryPolicy(opts)
 	var lastErr error
 
 	// 1. Try Servers
 	for _, server := range f.Servers {
-		lastErr = f.fetchFromServer(ctx, server, opts.Algo, opts.Hash, opts.URLs, cw)
+		lastErr = retry.do(ctx, cw, func() error {
+			return f.fetchFromServer(ctx, server, opts.digests(), opts.sources(), cw)
+		})
 		if lastErr == nil {
 			return nil
 		}
 		errutil.LogMsg(lastErr, "Failed to fetch from server", "server", server)
-		if cw.N > 0 {
+		if !cw.reset() {
 			return fmt.Errorf("%w: %w", ErrPartialWrite, lastErr)
 		}
 	}
 
 	// 2. Fallback to Direct Download
-	for _, url := range opts.URLs {
-		lastErr = f.fetchDirect(ctx, url, opts.Algo, opts.Hash, cw)
+	for _, source := range opts.directSources() {
+		lastErr = retry.do(ctx, cw, func() error {
+			return f.fetchDirect(ctx, source, opts.digests(), cw)
+		})
 		if lastErr == nil {
 			return nil
 		}
-		errutil.LogMsg(lastErr, "Failed to fetch from source", "url", url)
-		if cw.N > 0 {
+		errutil.LogMsg(lastErr, "Failed to fetch from source", "url", source.URL)
+		if !cw.reset() {
 			return fmt.Errorf("%w: %w", ErrPartialWrite, lastErr)
 		}
 	}
@@ -115,76 +330,308 @@ func (f *Fetcher) Fetch(ctx context.Context, opts FetchOptions) error {
 	return ErrAllSourcesFailed
 }
 
+// normalizeOptions turns an SRI Hash into Algo and a hex digest and checks
+// that the algorithm is supported.
+func normalizeOptions(opts *FetchOptions) error {
+	if algo, hash, ok := hashutil.ParseSRI(opts.Hash); ok {
+		if opts.Algo != "" && hashutil.NormalizeAlgo(opts.Algo) != algo {
+			return fmt.Errorf("integrity string is a %s digest, not %s", algo, opts.Algo)
+		}
+		opts.Algo, opts.Hash = algo, hash
+	}
+	if !hashutil.IsSupported(opts.Algo) {
+		return fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, opts.Algo)
+	}
+	digests := make(map[string]string, len(opts.Digests))
+	for algo, hash := range opts.Digests {
+		algo = hashutil.NormalizeAlgo(algo)
+		if !hashutil.IsSupported(algo) {
+			return fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, algo)
+		}
+		if algo == opts.Algo && hash != opts.Hash {
+			return fmt.Errorf("conflicting %s digests %s and %s", algo, opts.Hash, hash)
+		}
+		digests[algo] = hash
+	}
+	opts.Digests = digests
+	for _, s := range opts.Sources {
+		for name := range s.Header {
+			if !sourceurls.Allowed(name) {
+				return fmt.Errorf("header %s cannot be set for source %s", name, s.URL)
+			}
+		}
+	}
+	return nil
+}
+
+func (f *Fetcher) retryPolicy(opts FetchOptions) RetryPolicy {
+	if opts.Retry != nil {
+		return *opts.Retry
+	}
+	return f.Retry
+}
+
 type countingWriter struct {
 	Writer io.Writer
 	N      int64
+	// Total is the size of the content being written, or -1 if unknown.
+	Total int64
+	// Limit, if positive, is the size the content must have. Writes past it fail.
+	Limit int64
+	// Progress, if set, is told about every write.
+	Progress func(written, total int64)
+	// Rewind, if set, undoes everything written so a failed fetch can go on
+	// with another attempt.
+	Rewind func() error
+	// Served tells where the content came from. Its Bytes is not set.
+	Served FetchResult
+}
+
+// checkSize fails if the expected size and the size a source announced are
+// both known and differ.
+func checkSize(expected, announced int64) error {
+	if expected > 0 && announced >= 0 && announced != expected {
+		return fmt.Errorf("%w: expected %d bytes, source has %d", ErrSizeMismatch, expected, announced)
+	}
+	return nil
+}
+
+// reset rewinds what a failed attempt wrote, reporting whether another
+// attempt can still write from the start.
+func (c *countingWriter) reset() bool {
+	if c.N == 0 {
+		return true
+	}
+	if c.Rewind == nil {
+		return false
+	}
+	if err := c.Rewind(); err != nil {
+		errutil.LogMsg(err, "Failed to rewind output")
+		return false
+	}
+	c.N = 0
+	return true
+}
+
+// seekRewinder returns a Rewind function that seeks w back to where it is
+// now and truncates it there, or nil if w can't seek.
+func seekRewinder(w io.Writer) func() error {
+	ws, ok := w.(io.WriteSeeker)
+	if !ok {
+		return nil
+	}
+	start, err := ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		// Pipes and the like are Files too
+		return nil
+	}
+	return func() error {
+		if _, err := ws.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		if t, ok := ws.(interface{ Truncate(size int64) error }); ok {
+			return t.Truncate(start)
+		}
+		return nil
+	}
+}
+
+// chainRewinders returns a Rewind function calling every one of rewinds,
+// or nil if any is nil.
+func chainRewinders(rewinds ...func() error) func() error {
+	for _, r := range rewinds {
+		if r == nil {
+			return nil
+		}
+	}
+	return func() error {
+		for _, r := range rewinds {
+			if err := r(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 }
 
 func (c *countingWriter) Write(p []byte) (n int, err error) {
+	if c.Limit > 0 && c.N+int64(len(p)) > c.Limit {
+		return 0, fmt.Errorf("%w: content exceeds %d bytes", ErrSizeMismatch, c.Limit)
+	}
 	n, err = c.Writer.Write(p)
 	c.N += int64(n)
+	if c.Progress != nil && n > 0 {
+		c.Progress(c.N, c.Total)
+	}
 	return n, err
 }
 
-func (f *Fetcher) fetchFromServer(ctx context.Context, server, algo, hashStr string, sourceUrls []string, out io.Writer) error {
-	base := strings.TrimRight(server, "/")
-	u := fmt.Sprintf("%s/api/fetchurl/%s/%s", base, algo, hashStr)
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+// fetchFromServer fetches the object named by the first digest of want from server.
+func (f *Fetcher) fetchFromServer(ctx context.Context, server string, want []digest, sources []sourceurls.Source, out *countingWriter) error {
+	req, err := f.newServerRequest(ctx, server, want[0].algo, want[0].hash, out.Limit, sources)
 	if err != nil {
 		return err
 	}
+	return f.doRequest(req, want, out)
+}
 
-	if len(sourceUrls) > 0 {
-		list := make(sfv.List, len(sourceUrls))
-		for i, url := range sourceUrls {
-			list[i] = sfv.Item{Value: url}
+// newServerRequest builds the request for an object on a fetchurl server,
+// passing sources along for it to fetch from on a miss, and the expected size if positive.
+func (f *Fetcher) newServerRequest(ctx context.Context, server, algo, hashStr string, size int64, sources []sourceurls.Source) (*http.Request, error) {
+	// Templated servers are static mirrors, which have no use for the sources
+	mirror := urltemplate.IsTemplate(server)
+	var u string
+	if mirror {
+		u = urltemplate.Expand(server, algo, hashStr)
+	} else {
+		u = fmt.Sprintf("%s/api/fetchurl/%s/%s", strings.TrimRight(server, "/"), algo, hashStr)
+		if size > 0 {
+			u += fmt.Sprintf("?size=%d", size)
 		}
-		val, err := sfv.EncodeList(list)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sources) > 0 && !mirror {
+		val, err := sourceurls.Encode(sources)
 		if err != nil {
-			return fmt.Errorf("failed to encode X-Source-Urls: %w", err)
+			return nil, fmt.Errorf("failed to encode X-Source-Urls: %w", err)
 		}
-		req.Header.Set("X-Source-Urls", val)
+		req.Header.Set(sourceurls.Header, val)
 	}
-
-	return f.doRequest(req, algo, hashStr, out)
+	if f.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.Token)
+	}
+	f.authenticate(req)
+	return req, nil
 }
 
-func (f *Fetcher) fetchDirect(ctx context.Context, url, algo, hashStr string, out io.Writer) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+func (f *Fetcher) fetchDirect(ctx context.Context, source sourceurls.Source, want []digest, out *countingWriter) error {
+	req, err := f.newDirectRequest(ctx, source)
 	if err != nil {
 		return err
 	}
-	return f.doRequest(req, algo, hashStr, out)
+	return f.doRequest(req, want, out)
 }
 
-func (f *Fetcher) doRequest(req *http.Request, algo, expectedHash string, out io.Writer) error {
-	resp, err := f.Client.Do(req)
+func (f *Fetcher) newDirectRequest(ctx context.Context, source sourceurls.Source) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ipfs.ResolveURL(source.URL, f.IPFSGateway), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range source.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	f.authenticate(req)
+	return req, nil
+}
+
+// fileTransport reads file:// sources from the local filesystem.
+var fileTransport = httpclient.FileTransport("/", nil)
+
+// do sends req with Client, or reads it from disk if it is for a file:// URL.
+func (f *Fetcher) do(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "file" {
+		return fileTransport.RoundTrip(req)
+	}
+	return f.Client.Do(req)
+}
+
+// authenticate adds the credentials Credentials knows for req's host,
+// unless req is already authenticated.
+func (f *Fetcher) authenticate(req *http.Request) {
+	if f.Credentials == nil || req.Header.Get("Authorization") != "" {
+		return
+	}
+	if username, password, ok := f.Credentials(req.Context(), req.URL); ok {
+		req.SetBasicAuth(username, password)
+	}
+}
+
+func (f *Fetcher) doRequest(req *http.Request, want []digest, out *countingWriter) error {
+	resp, err := f.send(req)
 	if err != nil {
 		return err
 	}
 	defer func() {
 		errutil.LogMsg(resp.Body.Close(), "Failed to close response body")
 	}()
+	return f.readResponse(req, resp, want, out)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return &HTTPStatusError{StatusCode: resp.StatusCode}
+// send sends req and returns the response if it carries the content.
+func (f *Fetcher) send(req *http.Request) (*http.Response, error) {
+	if f.ChunkSize > 0 {
+		// Sources that answer with 206 get the remaining chunks requested in parallel
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", f.ChunkSize-1))
+	}
+	resp, err := f.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && !f.chunked(resp) && !f.empty(resp) {
+		errutil.LogMsg(resp.Body.Close(), "Failed to close response body")
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode}
 	}
+	return resp, nil
+}
+
+func (f *Fetcher) chunked(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusPartialContent && f.ChunkSize > 0
+}
+
+// empty reports whether resp says there is no content at all, as an empty
+// file has no bytes to satisfy the first chunk's range.
+func (f *Fetcher) empty(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && f.ChunkSize > 0 &&
+		resp.Header.Get("Content-Range") == "bytes */0"
+}
+
+// contentSize returns the size of the content resp carries, or -1 if unknown.
+func (f *Fetcher) contentSize(resp *http.Response) int64 {
+	switch {
+	case f.chunked(resp):
+		if _, _, total, ok := parseContentRange(resp.Header.Get("Content-Range")); ok {
+			return total
+		}
+		return -1
+	case f.empty(resp):
+		return 0
+	default:
+		return resp.ContentLength
+	}
+}
 
-	hasher, err := hashutil.GetHasher(algo)
+// readResponse writes the content of resp, answering req, to out and verifies it.
+func (f *Fetcher) readResponse(req *http.Request, resp *http.Response, want []digest, out *countingWriter) error {
+	hasher, err := newMultiHasher(want)
 	if err != nil {
 		return err
 	}
+	out.Total = f.contentSize(resp)
+	if err := checkSize(out.Limit, out.Total); err != nil {
+		return err
+	}
 	mw := io.MultiWriter(out, hasher)
 
-	if _, err := io.Copy(mw, resp.Body); err != nil {
+	switch {
+	case f.chunked(resp):
+		err = f.copyChunked(req, resp, mw)
+	case f.empty(resp):
+	default:
+		_, err = io.Copy(mw, resp.Body)
+	}
+	if err != nil {
 		return err
 	}
-
-	actualHash := hex.EncodeToString(hasher.Sum(nil))
-	if actualHash != expectedHash {
-		return fmt.Errorf("%w: expected %s, got %s", ErrHashMismatch, expectedHash, actualHash)
+	if err := hasher.verify(); err != nil {
+		return err
 	}
-
+	out.Served = servedBy(req, resp)
 	return nil
 }
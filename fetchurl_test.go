@@ -2,13 +2,24 @@ package fetchurl
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/shogo82148/go-sfv"
 )
@@ -193,6 +204,36 @@ func TestFetcher(t *testing.T) {
 		}
 	})
 
+	t.Run("SRI Digest", func(t *testing.T) {
+		// Servers are always addressed by the hex digest
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != fmt.Sprintf("/api/fetchurl/sha256/%s", hash) {
+				t.Errorf("unexpected path: %s", r.URL.Path)
+				w.WriteHeader(404)
+				return
+			}
+			if _, err := w.Write(content); err != nil {
+				t.Errorf("failed to write response: %v", err)
+			}
+		}))
+		defer server.Close()
+
+		sum := sha256.Sum256(content)
+		t.Setenv("FETCHURL_SERVER", fmt.Sprintf("\"%s\"", server.URL))
+		f := NewFetcher(nil)
+		var out bytes.Buffer
+		err := f.Fetch(t.Context(), FetchOptions{
+			Hash: "sha256-" + base64.StdEncoding.EncodeToString(sum[:]),
+			Out:  &out,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if out.String() != string(content) {
+			t.Errorf("got %q, want %q", out.String(), string(content))
+		}
+	})
+
 	t.Run("Unsupported Algorithm", func(t *testing.T) {
 		f := NewFetcher(nil)
 		var out bytes.Buffer
@@ -251,3 +292,929 @@ func TestFetcher(t *testing.T) {
 		}
 	})
 }
+
+func TestFetcherChunked(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	hash := sha256Sum(content)
+
+	var ranged atomic.Int32
+	rangeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := content
+		if r.URL.Path == "/empty" {
+			data = nil
+		}
+		if r.Header.Get("Range") != "" {
+			ranged.Add(1)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer rangeServer.Close()
+
+	plainServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write response: %v", err)
+		}
+	}))
+	defer plainServer.Close()
+
+	fetch := func(url, hash string) []byte {
+		t.Helper()
+		f := NewFetcher(nil)
+		f.ChunkSize = 100
+		f.ChunkConcurrency = 3
+		var out bytes.Buffer
+		if err := f.Fetch(t.Context(), FetchOptions{Algo: "sha256", Hash: hash, URLs: []string{url}, Out: &out}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return out.Bytes()
+	}
+
+	if got := fetch(rangeServer.URL, hash); !bytes.Equal(got, content) {
+		t.Error("chunked download does not match")
+	}
+	if want := int32((len(content) + 99) / 100); ranged.Load() != want {
+		t.Errorf("expected %d range requests, got %d", want, ranged.Load())
+	}
+	if got := fetch(plainServer.URL, hash); !bytes.Equal(got, content) {
+		t.Error("download from a source without ranges does not match")
+	}
+	if got := fetch(rangeServer.URL+"/empty", sha256Sum(nil)); len(got) != 0 {
+		t.Errorf("expected empty download, got %d bytes", len(got))
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	for header, want := range map[string][3]int64{
+		"bytes 0-99/1024":   {0, 99, 1024},
+		"bytes 100-199/200": {100, 199, 200},
+	} {
+		start, end, total, ok := parseContentRange(header)
+		if !ok || [3]int64{start, end, total} != want {
+			t.Errorf("%q: got %d-%d/%d (%v), want %v", header, start, end, total, ok, want)
+		}
+	}
+	for _, header := range []string{"", "bytes */1024", "bytes 0-99/*", "bytes 10-5/20", "bytes 0-20/20"} {
+		if _, _, _, ok := parseContentRange(header); ok {
+			t.Errorf("%q: expected parse failure", header)
+		}
+	}
+}
+
+func TestFetcherRetry(t *testing.T) {
+	content := []byte("flaky content")
+	hash := sha256Sum(content)
+
+	var attempts atomic.Int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			attempts.Add(1)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write response: %v", err)
+		}
+	}))
+	defer flaky.Close()
+
+	f := NewFetcher(nil)
+	f.Retry = RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+
+	var out bytes.Buffer
+	if err := f.Fetch(t.Context(), FetchOptions{Algo: "sha256", Hash: hash, URLs: []string{flaky.URL}, Out: &out}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.String() != string(content) {
+		t.Errorf("got %q, want %q", out.String(), content)
+	}
+	if attempts.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts.Load())
+	}
+
+	attempts.Store(0)
+	err := f.Fetch(t.Context(), FetchOptions{Algo: "sha256", Hash: hash, URLs: []string{flaky.URL + "/missing"}, Out: &out})
+	if !errors.Is(err, ErrAllSourcesFailed) {
+		t.Errorf("expected ErrAllSourcesFailed, got %v", err)
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("expected a 404 not to be retried, got %d attempts", attempts.Load())
+	}
+
+	attempts.Store(0)
+	err = f.Fetch(t.Context(), FetchOptions{Algo: "sha256", Hash: hash, URLs: []string{flaky.URL}, Out: &out, Retry: &RetryPolicy{}})
+	if err == nil || attempts.Load() != 1 {
+		t.Errorf("expected a single failed attempt with the override, got %d attempts and %v", attempts.Load(), err)
+	}
+}
+
+func TestFetcherFetchToFile(t *testing.T) {
+	content := bytes.Repeat([]byte("resumable "), 100)
+	hash := sha256Sum(content)
+
+	var requests atomic.Int32
+	var ranges []string
+	var mu sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		if requests.Add(1) == 1 {
+			// Drop the connection halfway through
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			if _, err := w.Write(content[:len(content)/2]); err != nil {
+				t.Errorf("failed to write response: %v", err)
+			}
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "file")
+	f := NewFetcher(nil)
+	opts := FetchOptions{Algo: "sha256", Hash: hash, URLs: []string{ts.URL}}
+
+	if err := f.FetchToFile(t.Context(), opts, path); err == nil {
+		t.Fatal("expected the interrupted fetch to fail")
+	}
+	if info, err := os.Stat(path + ".part"); err != nil || info.Size() != int64(len(content)/2) {
+		t.Fatalf("expected half the content kept in the part file, got %v, %v", info, err)
+	}
+
+	if err := f.FetchToFile(t.Context(), opts, path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("resumed file does not match")
+	}
+	if _, err := os.Stat(path + ".part"); !os.IsNotExist(err) {
+		t.Errorf("expected the part file to be gone, got %v", err)
+	}
+	if want := fmt.Sprintf("bytes=%d-", len(content)/2); ranges[1] != want {
+		t.Errorf("expected the second request to ask for %q, got %q", want, ranges[1])
+	}
+
+	// A mismatching source must not leave content to resume from
+	opts.Hash = sha256Sum([]byte("something else"))
+	if err := f.FetchToFile(t.Context(), opts, path+"2"); !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("expected ErrHashMismatch, got %v", err)
+	}
+	if info, err := os.Stat(path + "2.part"); err != nil || info.Size() != 0 {
+		t.Errorf("expected an empty part file, got %v, %v", info, err)
+	}
+}
+
+func TestFetcherHedged(t *testing.T) {
+	content := []byte("raced content")
+	hash := sha256Sum(content)
+
+	canceled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(5 * time.Second):
+			t.Error("slow source was not canceled")
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write response: %v", err)
+		}
+	}))
+	defer fast.Close()
+
+	f := NewFetcher(nil)
+	f.HedgeDelay = 20 * time.Millisecond
+
+	var out bytes.Buffer
+	if err := f.Fetch(t.Context(), FetchOptions{Algo: "sha256", Hash: hash, URLs: []string{slow.URL, fast.URL}, Out: &out}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.String() != string(content) {
+		t.Errorf("got %q, want %q", out.String(), content)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("expected the losing request to be canceled")
+	}
+
+	f.HedgeDelay = time.Hour
+	out.Reset()
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	if err := f.Fetch(t.Context(), FetchOptions{Algo: "sha256", Hash: hash, URLs: []string{notFound.URL, fast.URL}, Out: &out}); err != nil {
+		t.Fatalf("expected a failure to start the next source right away, got %v", err)
+	}
+}
+
+func TestFetcherHedgedBadContent(t *testing.T) {
+	content := []byte("verified content")
+	hash := sha256Sum(content)
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write response: %v", err)
+		}
+	}))
+	defer good.Close()
+	bogus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write(bytes.Repeat([]byte("x"), len(content))); err != nil {
+			t.Errorf("failed to write response: %v", err)
+		}
+	}))
+	defer bogus.Close()
+
+	f := NewFetcher(nil)
+	f.HedgeDelay = 20 * time.Millisecond
+
+	// The fastest mirror serves bad bytes, the output is rewound for the next one
+	out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := out.Close(); err != nil {
+			t.Errorf("failed to close output: %v", err)
+		}
+	}()
+	if err := f.Fetch(t.Context(), FetchOptions{Algo: "sha256", Hash: hash, URLs: []string{good.URL, bogus.URL}, Out: out}); err != nil {
+		t.Fatalf("expected to fall back to the slower mirror, got %v", err)
+	}
+	got, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(content) {
+		t.Errorf("got %q, want %q", got, content)
+	}
+
+	if err := out.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	err = f.Fetch(t.Context(), FetchOptions{Algo: "sha256", Hash: hash, URLs: []string{bogus.URL}, Out: out})
+	if !errors.Is(err, ErrAllSourcesFailed) {
+		t.Errorf("expected ErrAllSourcesFailed, got %v", err)
+	}
+}
+
+func TestFetcherMaxBytesPerSecond(t *testing.T) {
+	content := make([]byte, 1500)
+	hash := sha256Sum(content)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	start := time.Now()
+	var out bytes.Buffer
+	err := NewFetcher(nil).Fetch(t.Context(), FetchOptions{
+		Algo:              "sha256",
+		Hash:              hash,
+		URLs:              []string{ts.URL},
+		Out:               &out,
+		MaxBytesPerSecond: 1000,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The first 1000 bytes are the burst, the rest takes half a second
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected the download to be throttled, took %v", elapsed)
+	}
+}
+
+func TestFetcherSources(t *testing.T) {
+	content := []byte("private content")
+	hash := sha256Sum(content)
+
+	private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "user" || pass != "pass" || r.Header.Get("User-Agent") != "custom" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write response: %v", err)
+		}
+	}))
+	defer private.Close()
+
+	source := Source{URL: private.URL, Header: http.Header{"User-Agent": {"custom"}}, Username: "user", Password: "pass"}
+
+	t.Run("Direct", func(t *testing.T) {
+		f := NewFetcher(nil)
+		var out bytes.Buffer
+		if err := f.Fetch(t.Context(), FetchOptions{Algo: "sha256", Hash: hash, Sources: []Source{source}, Out: &out}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if out.String() != string(content) {
+			t.Errorf("got %q, want %q", out.String(), content)
+		}
+	})
+
+	t.Run("Through Server", func(t *testing.T) {
+		var sourceUrls string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sourceUrls = r.Header.Get("X-Source-Urls")
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer server.Close()
+
+		f := NewFetcher(nil)
+		f.Servers = []string{server.URL}
+		var out bytes.Buffer
+		if err := f.Fetch(t.Context(), FetchOptions{Algo: "sha256", Hash: hash, Sources: []Source{source}, Out: &out}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := fmt.Sprintf(`%q;h-authorization="Basic dXNlcjpwYXNz";h-user-agent="custom"`, private.URL)
+		if sourceUrls != want {
+			t.Errorf("got X-Source-Urls %s\nwant %s", sourceUrls, want)
+		}
+	})
+
+	t.Run("Forbidden Header", func(t *testing.T) {
+		bad := Source{URL: private.URL, Header: http.Header{"Range": {"bytes=0-1"}}}
+		err := NewFetcher(nil).Fetch(t.Context(), FetchOptions{Algo: "sha256", Hash: hash, Sources: []Source{bad}, Out: io.Discard})
+		if err == nil {
+			t.Error("expected Range to be refused")
+		}
+	})
+}
+
+func TestNetrc(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netrc")
+	data := `machine private.example login alice password secret
+macdef init
+machine fake.example login mallory password nope
+
+default
+	login anonymous password guest
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := Netrc(path)
+	if err != nil {
+		t.Fatalf("Netrc failed: %v", err)
+	}
+
+	for host, want := range map[string][2]string{
+		"private.example": {"alice", "secret"},
+		"fake.example":    {"anonymous", "guest"},
+		"other.example":   {"anonymous", "guest"},
+	} {
+		u := &url.URL{Scheme: "https", Host: host + ":8443"}
+		user, pass, ok := creds(t.Context(), u)
+		if !ok || [2]string{user, pass} != want {
+			t.Errorf("%s: got %q %q (%v), want %v", host, user, pass, ok, want)
+		}
+	}
+}
+
+func TestFetcherCredentials(t *testing.T) {
+	content := []byte("behind basic auth")
+	hash := sha256Sum(content)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "helper-user" || pass != "helper-pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write response: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	f := NewFetcher(nil)
+	f.Credentials = ChainCredentials(
+		func(ctx context.Context, u *url.URL) (string, string, bool) { return "", "", false },
+		CredentialHelper(`cat >/dev/null; printf 'username=helper-user\npassword=helper-pass\n' #`),
+	)
+	var out bytes.Buffer
+	if err := f.Fetch(t.Context(), FetchOptions{Algo: "sha256", Hash: hash, URLs: []string{ts.URL}, Out: &out}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.String() != string(content) {
+		t.Errorf("got %q, want %q", out.String(), content)
+	}
+}
+
+func TestFetcherProgress(t *testing.T) {
+	content := bytes.Repeat([]byte("progress "), 1000)
+	hash := sha256Sum(content)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	for _, chunkSize := range []int64{0, 1000} {
+		var lastWritten, lastTotal int64
+		calls := 0
+		f := NewFetcher(nil)
+		f.ChunkSize = chunkSize
+		err := f.Fetch(t.Context(), FetchOptions{
+			Algo: "sha256",
+			Hash: hash,
+			URLs: []string{ts.URL},
+			Out:  io.Discard,
+			Progress: func(written, total int64) {
+				if written < lastWritten {
+					t.Errorf("progress went backwards from %d to %d", lastWritten, written)
+				}
+				lastWritten, lastTotal = written, total
+				calls++
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if calls == 0 || lastWritten != int64(len(content)) || lastTotal != int64(len(content)) {
+			t.Errorf("chunk size %d: expected final progress %d/%d, got %d/%d after %d calls",
+				chunkSize, len(content), len(content), lastWritten, lastTotal, calls)
+		}
+	}
+}
+
+func TestFetcherOpen(t *testing.T) {
+	content := bytes.Repeat([]byte("stream "), 1000)
+	hash := sha256Sum(content)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		case "/bad":
+			w.Write([]byte("not the content"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	f := NewFetcher(nil)
+	f.Retry = RetryPolicy{MaxAttempts: 1}
+
+	t.Run("FallbackAndVerify", func(t *testing.T) {
+		rc, size, err := f.Open(t.Context(), FetchOptions{
+			Algo: "sha256",
+			Hash: hash,
+			URLs: []string{ts.URL + "/missing", ts.URL + "/ok"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if size != int64(len(content)) {
+			t.Errorf("expected size %d, got %d", len(content), size)
+		}
+		got, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("unexpected read error: %v", err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Error("content mismatch")
+		}
+		if err := rc.Close(); err != nil {
+			t.Errorf("unexpected close error: %v", err)
+		}
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		rc, _, err := f.Open(t.Context(), FetchOptions{
+			Algo: "sha256",
+			Hash: hash,
+			URLs: []string{ts.URL + "/bad"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := io.ReadAll(rc); !errors.Is(err, ErrHashMismatch) {
+			t.Errorf("expected ErrHashMismatch on read, got %v", err)
+		}
+		if err := rc.Close(); !errors.Is(err, ErrHashMismatch) {
+			t.Errorf("expected ErrHashMismatch on close, got %v", err)
+		}
+	})
+
+	t.Run("AllFail", func(t *testing.T) {
+		_, _, err := f.Open(t.Context(), FetchOptions{
+			Algo: "sha256",
+			Hash: hash,
+			URLs: []string{ts.URL + "/missing"},
+		})
+		if !errors.Is(err, ErrAllSourcesFailed) {
+			t.Errorf("expected ErrAllSourcesFailed, got %v", err)
+		}
+	})
+}
+
+func TestVerify(t *testing.T) {
+	content := []byte("already here")
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256Sum(content)
+
+	if err := Verify(path, "sha256", hash); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := Verify(path, "sha256", sha256Sum([]byte("other"))); !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("expected ErrHashMismatch, got %v", err)
+	}
+	if err := Verify(path+".missing", "sha256", hash); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestFetcherMirrorTemplate(t *testing.T) {
+	content := []byte("mirrored")
+	hash := sha256Sum(content)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sha256/"+hash[:2]+"/"+hash {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("X-Source-Urls") != "" {
+			t.Error("sources should not be sent to a static mirror")
+		}
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	f := NewFetcher(nil)
+	f.Servers = []string{ts.URL + "/{algo}/{hash:0:2}/{hash}"}
+	var buf bytes.Buffer
+	err := f.Fetch(t.Context(), FetchOptions{
+		Algo: "sha256",
+		Hash: hash,
+		URLs: []string{"http://127.0.0.1:1/unused"},
+		Out:  &buf,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Error("content mismatch")
+	}
+}
+
+func TestFetcherCacheDir(t *testing.T) {
+	content := []byte("cached locally")
+	hash := sha256Sum(content)
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	f := NewFetcher(nil)
+	f.Servers = nil
+	f.CacheDir = filepath.Join(t.TempDir(), "cache")
+	for range 2 {
+		var buf bytes.Buffer
+		err := f.Fetch(t.Context(), FetchOptions{
+			Algo: "sha256",
+			Hash: hash,
+			URLs: []string{ts.URL},
+			Out:  &buf,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !bytes.Equal(buf.Bytes(), content) {
+			t.Error("content mismatch")
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected 1 request, got %d", n)
+	}
+
+	// Mismatching content must not be cached
+	other := sha256Sum([]byte("other"))
+	err := f.Fetch(t.Context(), FetchOptions{Algo: "sha256", Hash: other, URLs: []string{ts.URL}, Out: io.Discard})
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("expected ErrHashMismatch, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(f.CacheDir, "sha256", other[:2], other)); !os.IsNotExist(err) {
+		t.Errorf("expected mismatching content not to be cached, got %v", err)
+	}
+}
+
+func TestFetcherDigests(t *testing.T) {
+	content := []byte("digested twice")
+	sha1Sum := sha1.Sum(content)
+	sha1Hex := hex.EncodeToString(sha1Sum[:])
+	hash := sha256Sum(content)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	f := NewFetcher(nil)
+	f.Servers = nil
+	f.Retry = RetryPolicy{MaxAttempts: 1}
+
+	var buf bytes.Buffer
+	err := f.Fetch(t.Context(), FetchOptions{
+		Algo:    "sha256",
+		Hash:    hash,
+		Digests: map[string]string{"sha1": sha1Hex},
+		URLs:    []string{ts.URL},
+		Out:     &buf,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Error("content mismatch")
+	}
+
+	err = f.Fetch(t.Context(), FetchOptions{
+		Algo:    "sha256",
+		Hash:    hash,
+		Digests: map[string]string{"sha1": strings.Repeat("0", 40)},
+		URLs:    []string{ts.URL},
+		Out:     io.Discard,
+	})
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("expected ErrHashMismatch, got %v", err)
+	}
+
+	err = f.Fetch(t.Context(), FetchOptions{
+		Algo:    "sha256",
+		Hash:    hash,
+		Digests: map[string]string{"crc32": "00000000"},
+		URLs:    []string{ts.URL},
+		Out:     io.Discard,
+	})
+	if !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Errorf("expected ErrUnsupportedAlgorithm, got %v", err)
+	}
+}
+
+func TestFetcherFileSource(t *testing.T) {
+	content := bytes.Repeat([]byte("seed "), 1000)
+	hash := sha256Sum(content)
+	path := filepath.Join(t.TempDir(), "seed")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileURL := (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+
+	for _, chunkSize := range []int64{0, 1000} {
+		f := NewFetcher(nil)
+		f.Servers = nil
+		f.ChunkSize = chunkSize
+		var buf bytes.Buffer
+		err := f.Fetch(t.Context(), FetchOptions{
+			Algo: "sha256",
+			Hash: hash,
+			URLs: []string{fileURL},
+			Out:  &buf,
+		})
+		if err != nil {
+			t.Fatalf("chunk size %d: unexpected error: %v", chunkSize, err)
+		}
+		if !bytes.Equal(buf.Bytes(), content) {
+			t.Errorf("chunk size %d: content mismatch", chunkSize)
+		}
+	}
+}
+
+func TestFetcherRewind(t *testing.T) {
+	content := []byte("the right content")
+	hash := sha256Sum(content)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			w.Write([]byte("the wrong content, and longer"))
+			return
+		}
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "out")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString("header:"); err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewFetcher(nil)
+	f.Servers = nil
+	err = f.Fetch(t.Context(), FetchOptions{
+		Algo: "sha256",
+		Hash: hash,
+		URLs: []string{ts.URL + "/bad", ts.URL + "/good"},
+		Out:  file,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "header:" + string(content); string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFetcherSize(t *testing.T) {
+	content := []byte("exactly this size")
+	hash := sha256Sum(content)
+	var serverQuery string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Write(bytes.Repeat([]byte("x"), 100))
+		case "/endless":
+			// Flushing early hides the length from the client
+			w.(http.Flusher).Flush()
+			for range 100 {
+				w.Write([]byte("endless "))
+			}
+		case "/api/fetchurl/sha256/" + hash:
+			serverQuery = r.URL.RawQuery
+			http.NotFound(w, r)
+		default:
+			w.Write(content)
+		}
+	}))
+	defer ts.Close()
+
+	f := NewFetcher(nil)
+	f.Servers = []string{ts.URL}
+	var buf bytes.Buffer
+	err := f.Fetch(t.Context(), FetchOptions{
+		Algo: "sha256",
+		Hash: hash,
+		Size: int64(len(content)),
+		URLs: []string{ts.URL + "/large", ts.URL + "/good"},
+		Out:  &buf,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Error("content mismatch")
+	}
+	if want := fmt.Sprintf("size=%d", len(content)); serverQuery != want {
+		t.Errorf("expected server query %q, got %q", want, serverQuery)
+	}
+
+	f.Servers = nil
+	err = f.Fetch(t.Context(), FetchOptions{
+		Algo: "sha256",
+		Hash: hash,
+		Size: int64(len(content)),
+		URLs: []string{ts.URL + "/endless"},
+		Out:  io.Discard,
+	})
+	if !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("expected ErrSizeMismatch, got %v", err)
+	}
+}
+
+func TestFetcherResult(t *testing.T) {
+	content := []byte("served from somewhere")
+	hash := sha256Sum(content)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/fetchurl/") {
+			w.Header().Set("X-Cache", "HIT")
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="served.txt"`)
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		servers  []string
+		cacheDir string
+		want     FetchResult
+	}{
+		{"Server", []string{ts.URL}, "", FetchResult{Bytes: int64(len(content)), Source: ts.URL + "/api/fetchurl/sha256/" + hash, CacheHit: true, Filename: "served.txt"}},
+		{"Source", nil, "", FetchResult{Bytes: int64(len(content)), Source: ts.URL + "/file", Filename: "served.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFetcher(nil)
+			f.Servers = tt.servers
+			var result FetchResult
+			err := f.Fetch(t.Context(), FetchOptions{Algo: "sha256", Hash: hash, URLs: []string{ts.URL + "/file"}, Out: io.Discard, Result: &result})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != tt.want {
+				t.Errorf("got %+v, want %+v", result, tt.want)
+			}
+
+			result = FetchResult{}
+			err = f.FetchToFile(t.Context(), FetchOptions{Algo: "sha256", Hash: hash, URLs: []string{ts.URL + "/file"}, Result: &result}, filepath.Join(t.TempDir(), "out"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != tt.want {
+				t.Errorf("FetchToFile got %+v, want %+v", result, tt.want)
+			}
+		})
+	}
+
+	t.Run("Cache Dir", func(t *testing.T) {
+		f := NewFetcher(nil)
+		f.Servers = nil
+		f.CacheDir = t.TempDir()
+		for _, want := range []FetchResult{
+			{Bytes: int64(len(content)), Source: ts.URL + "/file", Filename: "served.txt"},
+			// The file name is kept with the cached object
+			{Bytes: int64(len(content)), Source: f.CacheDir, CacheHit: true, Filename: "served.txt"},
+		} {
+			var result FetchResult
+			err := f.Fetch(t.Context(), FetchOptions{Algo: "sha256", Hash: hash, URLs: []string{ts.URL + "/file"}, Out: io.Discard, Result: &result})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != want {
+				t.Errorf("got %+v, want %+v", result, want)
+			}
+		}
+	})
+}
+
+func TestDispositionFilename(t *testing.T) {
+	tests := []struct {
+		header, want string
+	}{
+		{"", ""},
+		{"inline", ""},
+		{`attachment; filename="a.tar.gz"`, "a.tar.gz"},
+		{`attachment; filename*=UTF-8''%C3%A1.txt`, "\u00e1.txt"},
+		{`attachment; filename="../etc/passwd"`, ""},
+		{`attachment; filename="..\\x"`, ""},
+		{`attachment; filename=".."`, ""},
+	}
+	for _, tt := range tests {
+		if got := dispositionFilename(tt.header); got != tt.want {
+			t.Errorf("dispositionFilename(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestFetcherPut(t *testing.T) {
+	content := []byte("published")
+	hash := sha256Sum(content)
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/api/fetchurl/sha256/"+hash {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil || !bytes.Equal(body, content) {
+			t.Errorf("unexpected body %q: %v", body, err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	f := NewFetcher(nil)
+	if _, err := f.Put(t.Context(), ts.URL, "sha256", path); err == nil {
+		t.Error("expected an error without a token")
+	}
+	f.Token = "secret"
+	u, err := f.Put(t.Context(), ts.URL, "sha256", path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := ts.URL + "/api/fetchurl/sha256/" + hash; u != want {
+		t.Errorf("got %s, want %s", u, want)
+	}
+}
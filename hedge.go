@@ -0,0 +1,92 @@
+package fetchurl
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+)
+
+type hedgeResult struct {
+	idx  int
+	req  *http.Request
+	resp *http.Response
+	err  error
+}
+
+// fetchHedged tries the servers, then the sources, without waiting for slow
+// ones: whenever HedgeDelay passes without a response, or a candidate fails,
+// the next one starts racing the others. The first to respond is read while
+// the others keep going, so content failing verification falls back to them
+// as long as the output can be rewound. The rest are canceled on success.
+func (f *Fetcher) fetchHedged(ctx context.Context, opts FetchOptions, cw *countingWriter) error {
+	candidates := f.candidates(opts)
+	if len(candidates) == 0 {
+		return ErrAllSourcesFailed
+	}
+
+	results := make(chan hedgeResult, len(candidates))
+	var cancels []context.CancelFunc
+	running := 0
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+		// Close whatever the canceled candidates still return
+		go func(pending int) {
+			for range pending {
+				if r := <-results; r.resp != nil {
+					errutil.LogMsg(r.resp.Body.Close(), "Failed to close response body")
+				}
+			}
+		}(running)
+	}()
+	timer := time.NewTimer(f.HedgeDelay)
+	defer timer.Stop()
+
+	startNext := func() {
+		if len(cancels) == len(candidates) {
+			return
+		}
+		i := len(cancels)
+		reqCtx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		running++
+		timer.Reset(f.HedgeDelay)
+		go func() {
+			req, err := candidates[i].newRequest(reqCtx)
+			var resp *http.Response
+			if err == nil {
+				resp, err = f.send(req)
+			}
+			results <- hedgeResult{idx: i, req: req, resp: resp, err: err}
+		}()
+	}
+
+	var lastErr error
+	startNext()
+	for running > 0 {
+		select {
+		case <-timer.C:
+			startNext()
+		case res := <-results:
+			running--
+			if res.err == nil {
+				res.err = f.readResponse(res.req, res.resp, opts.digests(), cw)
+				errutil.LogMsg(res.resp.Body.Close(), "Failed to close response body")
+				if res.err == nil {
+					return nil
+				}
+				if !cw.reset() {
+					return fmt.Errorf("%w: %w", ErrPartialWrite, res.err)
+				}
+			}
+			errutil.LogMsg(res.err, "Failed to fetch", "url", candidates[res.idx].name)
+			lastErr = res.err
+			startNext()
+		}
+	}
+	return fmt.Errorf("%w: %w", ErrAllSourcesFailed, lastErr)
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/requestid"
+)
+
+// accessLogHandler tags every request with an ID and logs one line per
+// request once it is served. The ID comes from the X-Request-Id header if
+// the client sent a sane one, and is echoed back in the response.
+func accessLogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestid.Header)
+		if !requestid.Valid(id) {
+			id = requestid.New()
+		}
+		w.Header().Set(requestid.Header, id)
+		r = r.WithContext(requestid.NewContext(r.Context(), id))
+
+		lw := &loggingWriter{ResponseWriter: w}
+		defer func() {
+			// A handler that never wrote anything got an implicit 200
+			if lw.status == 0 {
+				lw.status = http.StatusOK
+			}
+			slog.Info("Request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", lw.status,
+				"bytes", lw.written,
+				"duration", time.Since(start),
+				"cache", w.Header().Get("X-Cache"),
+				"upstream", w.Header().Get("X-Fetch-Source"),
+				"remote", r.RemoteAddr,
+				"request_id", id,
+			)
+		}()
+		next.ServeHTTP(lw, r)
+	})
+}
+
+// loggingWriter records the status and body size of a response.
+type loggingWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *loggingWriter) WriteHeader(status int) {
+	// Informational responses such as 103 Early Hints precede the real one
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps sendfile working for cached files.
+func (w *loggingWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{w.ResponseWriter}, r)
+	}
+	w.written += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *loggingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
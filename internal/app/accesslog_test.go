@@ -0,0 +1,82 @@
+package app
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lucasew/fetchurl/internal/requestid"
+)
+
+func TestAccessLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	var seenID string
+	h := accessLogHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenID = requestid.FromContext(r.Context())
+		w.Header().Set("X-Cache", "UPSTREAM")
+		w.Header().Set("X-Fetch-Source", "https://upstream.example/api/fetchurl/sha256/abcd")
+		w.WriteHeader(http.StatusCreated)
+		if _, err := io.WriteString(w, "hello"); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+
+	t.Run("Generated ID", func(t *testing.T) {
+		buf.Reset()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/api/fetchurl/sha256/abcd", nil))
+
+		id := w.Header().Get(requestid.Header)
+		if !requestid.Valid(id) || id != seenID {
+			t.Fatalf("expected the handler to see the echoed ID, got %q and %q", id, seenID)
+		}
+		line := buf.String()
+		for _, want := range []string{
+			"msg=Request", "method=GET", "path=/api/fetchurl/sha256/abcd", "status=201", "bytes=5",
+			"cache=UPSTREAM", "upstream=https://upstream.example/api/fetchurl/sha256/abcd", "request_id=" + id,
+		} {
+			if !strings.Contains(line, want) {
+				t.Errorf("expected %q in %q", want, line)
+			}
+		}
+	})
+
+	t.Run("Client ID", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(requestid.Header, "ci-job-7")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if got := w.Header().Get(requestid.Header); got != "ci-job-7" || seenID != "ci-job-7" {
+			t.Errorf("expected the client's ID, got %q and %q", got, seenID)
+		}
+	})
+
+	t.Run("Invalid Client ID", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(requestid.Header, "has spaces")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if got := w.Header().Get(requestid.Header); got == "has spaces" || !requestid.Valid(got) {
+			t.Errorf("expected a generated ID, got %q", got)
+		}
+	})
+}
+
+func TestAccessLogImplicitStatus(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	h := accessLogHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("HEAD", "/healthz", nil))
+	if line := buf.String(); !strings.Contains(line, "status=200") || !strings.Contains(line, "bytes=0") {
+		t.Errorf("expected status 200 and no bytes in %q", line)
+	}
+}
@@ -0,0 +1,127 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/eviction"
+	"github.com/lucasew/fetchurl/internal/handler"
+	"github.com/lucasew/fetchurl/internal/hashutil"
+	"github.com/lucasew/fetchurl/internal/repository"
+)
+
+// gcHandler runs an eviction sweep on demand and reports what it freed.
+func gcHandler(mgr *eviction.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		summary := mgr.RunEviction()
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(summary); err != nil {
+			errutil.LogMsg(err, "Failed to write gc response")
+		}
+	}
+}
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listEntry is a cached object as reported by listHandler.
+type listEntry struct {
+	Hash       string     `json:"hash"`
+	Size       int64      `json:"size"`
+	LastAccess *time.Time `json:"last_access,omitempty"`
+}
+
+type listResponse struct {
+	Entries []listEntry `json:"entries"`
+	// Next is the value of after for the following page, empty on the last one.
+	Next string `json:"next,omitempty"`
+}
+
+// listHandler pages through the objects in the local cache in hash order.
+//
+// Query parameters are algo (default sha256), after (last hash of the
+// previous page) and limit (default 100, at most 1000).
+func listHandler(local *repository.LocalRepository, mgr *eviction.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		algo := hashutil.NormalizeAlgo(query.Get("algo"))
+		if algo == "" {
+			algo = "sha256"
+		}
+		if !hashutil.IsSupported(algo) {
+			http.Error(w, fmt.Sprintf("Unsupported hash algorithm: %s", algo), http.StatusBadRequest)
+			return
+		}
+		limit := defaultListLimit
+		if s := query.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxListLimit)
+		}
+
+		// Ask for one more to know whether there is a next page
+		entries, err := local.List(algo, query.Get("after"), limit+1)
+		if err != nil {
+			errutil.ReportError(err, "Failed to list cache", "algo", algo)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		resp := listResponse{Entries: make([]listEntry, 0, min(len(entries), limit))}
+		if len(entries) > limit {
+			entries = entries[:limit]
+			resp.Next = entries[limit-1].Hash
+		}
+		for _, e := range entries {
+			entry := listEntry{Hash: e.Hash, Size: e.Size}
+			if t, ok := mgr.LastAccess(repository.LayoutSharded.RelPath(algo, e.Hash)); ok {
+				entry.LastAccess = &t
+			}
+			resp.Entries = append(resp.Entries, entry)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			errutil.LogMsg(err, "Failed to write list response")
+		}
+	}
+}
+
+type statsResponse struct {
+	Cache    eviction.Stats `json:"cache"`
+	Requests handler.Stats  `json:"requests"`
+}
+
+// statsHandler reports cache usage and request counters since start.
+func statsHandler(cas *handler.CASHandler, mgr *eviction.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		resp := statsResponse{Cache: mgr.Stats(), Requests: cas.Stats()}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			errutil.LogMsg(err, "Failed to write stats response")
+		}
+	}
+}
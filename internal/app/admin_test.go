@@ -0,0 +1,67 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/eviction"
+	"github.com/lucasew/fetchurl/internal/repository"
+)
+
+func TestListHandler(t *testing.T) {
+	cacheDir := t.TempDir()
+	strat, err := eviction.GetStrategy("lru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr := eviction.NewManager(cacheDir, nil, time.Hour, strat)
+	local := repository.NewLocalRepository(cacheDir, mgr)
+	for _, hash := range []string{"aa01", "bb01"} {
+		w, commit, err := local.BeginWrite("sha256", hash, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if err := commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := listHandler(local, mgr)
+
+	get := func(query string) (int, listResponse) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/api/fetchurl/list"+query, nil))
+		var resp listResponse
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+		}
+		return w.Code, resp
+	}
+
+	code, resp := get("?limit=1")
+	if code != http.StatusOK || len(resp.Entries) != 1 || resp.Entries[0].Hash != "aa01" || resp.Next != "aa01" {
+		t.Fatalf("unexpected first page: %d %+v", code, resp)
+	}
+	if e := resp.Entries[0]; e.Size != 4 || e.LastAccess == nil {
+		t.Errorf("expected size and last access, got %+v", e)
+	}
+
+	code, resp = get("?limit=1&after=" + resp.Next)
+	if code != http.StatusOK || len(resp.Entries) != 1 || resp.Entries[0].Hash != "bb01" || resp.Next != "" {
+		t.Errorf("unexpected last page: %d %+v", code, resp)
+	}
+
+	if code, _ := get("?algo=md4"); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for unsupported algo, got %d", code)
+	}
+	if code, _ := get("?limit=0"); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for invalid limit, got %d", code)
+	}
+}
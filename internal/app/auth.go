@@ -0,0 +1,136 @@
+package app
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/handler"
+)
+
+// Role is what a bearer token allows its holder to do.
+type Role int
+
+const (
+	// RoleRead allows fetching objects and reading listings and stats.
+	RoleRead Role = iota + 1
+	// RoleWrite also allows uploading, deleting and verifying objects.
+	RoleWrite
+)
+
+// Tokens maps the SHA-256 of each accepted bearer token to its role, so
+// lookups don't leak through timing which tokens exist.
+type Tokens map[[sha256.Size]byte]Role
+
+// Add accepts token with role.
+func (t Tokens) Add(token string, role Role) {
+	t[sha256.Sum256([]byte(token))] = role
+}
+
+// role returns the role of the token sent with r, or 0 if it has none.
+//
+// Besides bearer tokens, the token is accepted as a basic auth password,
+// which is all some clients (e.g. Nix through netrc) can send.
+func (t Tokens) role(r *http.Request) Role {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, token, ok = r.BasicAuth()
+	}
+	if !ok {
+		return 0
+	}
+	sum := sha256.Sum256([]byte(token))
+	for known, role := range t {
+		if subtle.ConstantTimeCompare(sum[:], known[:]) == 1 {
+			return role
+		}
+	}
+	return 0
+}
+
+// CanWrite reports whether r carries a token with RoleWrite.
+func (t Tokens) CanWrite(r *http.Request) bool {
+	return t.role(r) >= RoleWrite
+}
+
+// LoadTokens reads one token per line, optionally followed by its role
+// ("read", the default, or "write"). Blank lines and # comments are ignored.
+func LoadTokens(path string) (Tokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+	defer func() {
+		errutil.LogMsg(f.Close(), "Failed to close token file", "path", path)
+	}()
+
+	tokens := Tokens{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		role := RoleRead
+		switch {
+		case len(fields) == 1, len(fields) == 2 && fields[1] == "read":
+		case len(fields) == 2 && fields[1] == "write":
+			role = RoleWrite
+		default:
+			return nil, fmt.Errorf("%s:%d: expected \"<token> [read|write]\"", path, line)
+		}
+		tokens.Add(fields[0], role)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("token file %s has no tokens", path)
+	}
+	return tokens, nil
+}
+
+// authHandler only lets requests with a known bearer token through to next.
+// Methods other than GET, HEAD and OPTIONS need RoleWrite, except batch
+// fetches, which only read.
+func authHandler(tokens Tokens, next http.Handler) http.Handler {
+	return roleHandler(tokens, func(r *http.Request) Role {
+		switch {
+		case r.Method == http.MethodGet, r.Method == http.MethodHead, r.Method == http.MethodOptions:
+			return RoleRead
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, handler.BatchPath):
+			return RoleRead
+		}
+		return RoleWrite
+	}, next)
+}
+
+// adminAuthHandler only lets requests with a RoleWrite token through to next,
+// whatever the method, as admin endpoints can be costly even to read.
+func adminAuthHandler(tokens Tokens, next http.Handler) http.Handler {
+	return roleHandler(tokens, func(*http.Request) Role { return RoleWrite }, next)
+}
+
+// roleHandler only lets requests whose token has at least the role required
+// by requiredRole through to next.
+func roleHandler(tokens Tokens, requiredRole func(r *http.Request) Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required := requiredRole(r)
+		role := tokens.role(r)
+		if role == 0 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="fetchurl"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if role < required {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadTokens(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "tokens")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tokens, err := LoadTokens(write("# ci jobs\nreader\n\nwriter write\nexplicit read\n"))
+	if err != nil {
+		t.Fatalf("LoadTokens failed: %v", err)
+	}
+	if len(tokens) != 3 {
+		t.Errorf("expected 3 tokens, got %d", len(tokens))
+	}
+
+	if _, err := LoadTokens(write("token admin\n")); err == nil {
+		t.Error("expected unknown role to be rejected")
+	}
+	if _, err := LoadTokens(write("# nothing\n")); err == nil {
+		t.Error("expected empty token file to be rejected")
+	}
+}
+
+func TestAuthHandler(t *testing.T) {
+	tokens := Tokens{}
+	tokens.Add("reader", RoleRead)
+	tokens.Add("writer", RoleWrite)
+	h := authHandler(tokens, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		auth   func(r *http.Request)
+		want   int
+	}{
+		{"No Token", "GET", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"Unknown Token", "GET", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+		{"Read", "GET", func(r *http.Request) { r.Header.Set("Authorization", "Bearer reader") }, http.StatusOK},
+		{"Read Cannot Write", "PUT", func(r *http.Request) { r.Header.Set("Authorization", "Bearer reader") }, http.StatusForbidden},
+		{"Write", "DELETE", func(r *http.Request) { r.Header.Set("Authorization", "Bearer writer") }, http.StatusOK},
+		{"Read Can Batch", "POST", func(r *http.Request) { r.Header.Set("Authorization", "Bearer reader") }, http.StatusOK},
+		{"Basic Auth Password", "GET", func(r *http.Request) { r.SetBasicAuth("nix", "reader") }, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/sha256/abcd"
+			if tt.method == "POST" {
+				target = "/batch"
+			}
+			req := httptest.NewRequest(tt.method, target, nil)
+			tt.auth(req)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("expected status %d, got %d", tt.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(tokenFile, []byte("reader\nwriter write\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	newServer := func(cfg Config) *Server {
+		t.Helper()
+		cfg.CacheDir = t.TempDir()
+		cfg.EvictionStrategy = "lru"
+		cfg.EvictionInterval = time.Hour
+		cfg.EnablePprof = true
+		server, cleanup, err := NewServer(t.Context(), cfg)
+		if err != nil {
+			t.Fatalf("NewServer failed: %v", err)
+		}
+		t.Cleanup(cleanup)
+		return server
+	}
+	status := func(server *Server, method, path, token string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		server.API.Handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("No Auth", func(t *testing.T) {
+		server := newServer(Config{})
+		for _, path := range []string{"/admin/gc", "/debug/vars"} {
+			if got := status(server, "POST", path, ""); got != http.StatusNotFound {
+				t.Errorf("expected %s to be missing from the API listener, got %d", path, got)
+			}
+		}
+	})
+
+	t.Run("Tokens", func(t *testing.T) {
+		server := newServer(Config{AuthTokenFile: tokenFile, NixSubstituter: "http://127.0.0.1:1", AuthNix: true})
+		if got := status(server, "POST", "/admin/gc", ""); got != http.StatusUnauthorized {
+			t.Errorf("expected anonymous gc to be refused, got %d", got)
+		}
+		if got := status(server, "GET", "/debug/vars", "reader"); got != http.StatusForbidden {
+			t.Errorf("expected read tokens to be refused, got %d", got)
+		}
+		if got := status(server, "POST", "/admin/gc", "writer"); got != http.StatusOK {
+			t.Errorf("expected gc with a write token, got %d", got)
+		}
+		if got := status(server, "GET", "/debug/vars", "writer"); got != http.StatusOK {
+			t.Errorf("expected expvars with a write token, got %d", got)
+		}
+		for _, path := range []string{"/healthz", "/nix/nix-cache-info", "/api/stats"} {
+			if got := status(server, "GET", path, ""); got != http.StatusUnauthorized {
+				t.Errorf("expected anonymous GET %s to be refused, got %d", path, got)
+			}
+		}
+		if got := status(server, "GET", "/healthz", "reader"); got != http.StatusOK {
+			t.Errorf("expected health check with a read token, got %d", got)
+		}
+	})
+
+	t.Run("Admin Listener", func(t *testing.T) {
+		server := newServer(Config{AdminListen: "127.0.0.1:0"})
+		if got := status(server, "POST", "/admin/gc", ""); got != http.StatusNotFound {
+			t.Errorf("expected gc to be missing from the API listener, got %d", got)
+		}
+		w := httptest.NewRecorder()
+		server.Admin.Handler.ServeHTTP(w, httptest.NewRequest("POST", "/admin/gc", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("expected gc on the admin listener, got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package app
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// corsExposedHeaders are the response headers browser tooling may read.
+var corsExposedHeaders = []string{"Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Link", "X-Cache", "X-Fetch-Source", "X-Request-Id", "Server-Timing"}
+
+// corsHandler adds CORS headers for requests from the allowed origins ("*" allows any)
+// and answers preflight requests. Requests without an Origin header pass through untouched.
+func corsHandler(origins, headers []string, next http.Handler) http.Handler {
+	anyOrigin := slices.Contains(origins, "*")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !anyOrigin && !slices.Contains(origins, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if anyOrigin {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		next.ServeHTTP(w, r)
+	})
+}
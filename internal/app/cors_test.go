@@ -0,0 +1,54 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSHandler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	h := corsHandler([]string{"https://app.example"}, []string{"X-Source-Urls", "Range"}, next)
+
+	t.Run("Allowed Origin", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/sha256/abcd", nil)
+		req.Header.Set("Origin", "https://app.example")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+			t.Errorf("expected allowed origin, got %q", got)
+		}
+		if w.Header().Get("Access-Control-Expose-Headers") == "" {
+			t.Error("expected exposed headers")
+		}
+	})
+
+	t.Run("Preflight", func(t *testing.T) {
+		req := httptest.NewRequest("OPTIONS", "/sha256/abcd", nil)
+		req.Header.Set("Origin", "https://app.example")
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNoContent {
+			t.Errorf("expected status 204, got %d", w.Code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Headers"); got != "X-Source-Urls, Range" {
+			t.Errorf("unexpected allowed headers %q", got)
+		}
+	})
+
+	t.Run("Other Origin", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/sha256/abcd", nil)
+		req.Header.Set("Origin", "https://evil.example")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("expected no CORS headers, got origin %q", got)
+		}
+	})
+}
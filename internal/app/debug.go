@@ -0,0 +1,36 @@
+package app
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lucasew/fetchurl/internal/handler"
+)
+
+// debugCAS is the handler whose in-flight work the fetchurl expvar reports.
+// expvar names are process-wide, so the last server built wins.
+var (
+	debugCAS         atomic.Pointer[handler.CASHandler]
+	publishDebugVars sync.Once
+)
+
+// registerDebug adds the net/http/pprof profiles under /debug/pprof/ and the
+// expvars, including cas's in-flight fetches, under /debug/vars to mux.
+func registerDebug(mux *http.ServeMux, cas *handler.CASHandler) {
+	debugCAS.Store(cas)
+	publishDebugVars.Do(func() {
+		expvar.Publish("fetchurl", expvar.Func(func() any {
+			return debugCAS.Load().Inflight()
+		}))
+	})
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/sdnotify"
+)
+
+// Server groups the HTTP servers making up a fetchurl instance.
+type Server struct {
+	// API serves the CAS endpoints.
+	API *http.Server
+	// Admin serves operational endpoints. It is nil when they share the API listener.
+	Admin *http.Server
+
+	listeners []net.Listener
+	servers   []*http.Server
+}
+
+// unixPrefix marks listen addresses that are unix socket paths.
+const unixPrefix = "unix://"
+
+// Listen binds every configured listener without serving yet, so callers
+// can signal readiness once all addresses are taken.
+//
+// Sockets passed by systemd socket activation are used instead, the first
+// for the API and the second for the admin server, if any; addresses with no
+// socket passed for them are bound as usual.
+func (s *Server) Listen() error {
+	activated, err := sdnotify.Listeners()
+	if err != nil {
+		return fmt.Errorf("failed to use activated sockets: %w", err)
+	}
+
+	servers := []*http.Server{s.API}
+	if s.Admin != nil {
+		servers = append(servers, s.Admin)
+	}
+	for i, srv := range servers {
+		var ln net.Listener
+		if i < len(activated) {
+			slog.Info("Using activated socket", "addr", activated[i].Addr(), "for", srv.Addr)
+			ln = activated[i]
+		} else if ln, err = listen(srv.Addr); err != nil {
+			s.closeListeners()
+			return fmt.Errorf("failed to listen on %s: %w", srv.Addr, err)
+		}
+		s.listeners = append(s.listeners, ln)
+		s.servers = append(s.servers, srv)
+	}
+	for _, ln := range activated[min(len(servers), len(activated)):] {
+		slog.Warn("Closing unused activated socket", "addr", ln.Addr())
+		errutil.LogMsg(ln.Close(), "Failed to close activated socket")
+	}
+	return nil
+}
+
+// listen binds addr, a TCP address or unix:// followed by a socket path.
+// A socket left behind by a previous run is replaced.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			errutil.LogMsg(conn.Close(), "Failed to close socket probe")
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+func (s *Server) closeListeners() {
+	for _, ln := range s.listeners {
+		if err := ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errutil.LogMsg(err, "Failed to close listener")
+		}
+	}
+	s.listeners = nil
+	s.servers = nil
+}
+
+// Serve runs every server on the listeners bound by Listen.
+// It returns as soon as one of them stops.
+func (s *Server) Serve() error {
+	errs := make(chan error, len(s.servers))
+	for i, srv := range s.servers {
+		go func(srv *http.Server, ln net.Listener) {
+			errs <- srv.Serve(ln)
+		}(srv, s.listeners[i])
+	}
+	return <-errs
+}
+
+// localURL builds a URL that reaches addr from the same host, through a
+// client from localClient.
+func localURL(addr, path string) (string, error) {
+	if _, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		return "http://localhost" + path, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return fmt.Sprintf("http://%s%s", net.JoinHostPort(host, port), path), nil
+}
+
+// localClient returns a client for URLs from localURL that gives up after timeout.
+func localClient(addr string, timeout time.Duration) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+	}
+	return client
+}
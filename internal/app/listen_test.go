@@ -0,0 +1,53 @@
+package app
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fetchurl.sock")
+	addr := unixPrefix + path
+
+	// A socket nobody listens on, as a crashed run leaves behind
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := stale.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	ln, err := listen(addr)
+	if err != nil {
+		t.Fatalf("listen over a stale socket failed: %v", err)
+	}
+	// Closing the server closes ln too
+	srv := &http.Server{Handler: http.HandlerFunc(healthHandler)}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			t.Errorf("serve failed: %v", err)
+		}
+	}()
+	defer func() {
+		if err := srv.Close(); err != nil {
+			t.Errorf("server close failed: %v", err)
+		}
+	}()
+
+	if _, err := listen(addr); err == nil {
+		t.Error("expected an error listening on a socket in use")
+	}
+
+	u, err := localURL(addr, "/healthz")
+	if err != nil {
+		t.Fatalf("localURL failed: %v", err)
+	}
+	if err := checkHealth(t.Context(), localClient(addr, time.Second), u, ""); err != nil {
+		t.Errorf("health check over the socket failed: %v", err)
+	}
+}
@@ -2,10 +2,14 @@ package app
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/lucasew/fetchurl/internal/errutil"
 	"time"
@@ -15,25 +19,72 @@ import (
 	"github.com/lucasew/fetchurl/internal/eviction/policy"
 	"github.com/lucasew/fetchurl/internal/eviction/policy/maxsize"
 	"github.com/lucasew/fetchurl/internal/eviction/policy/minfree"
+	_ "github.com/lucasew/fetchurl/internal/eviction/size"
 	"github.com/lucasew/fetchurl/internal/handler"
+	"github.com/lucasew/fetchurl/internal/hostfilter"
+	"github.com/lucasew/fetchurl/internal/httpclient"
+	"github.com/lucasew/fetchurl/internal/ipfs"
+	"github.com/lucasew/fetchurl/internal/nixcache"
+	"github.com/lucasew/fetchurl/internal/ratelimit"
 	"github.com/lucasew/fetchurl/internal/repository"
+	"github.com/lucasew/fetchurl/internal/schedule"
+	"github.com/lucasew/fetchurl/internal/sdnotify"
+	"github.com/lucasew/fetchurl/internal/urltemplate"
 )
 
+// trafficSaveInterval is how often the traffic totals are persisted.
+const trafficSaveInterval = time.Minute
+
+// staleTempAge is how old a temp file in the cache dir must be before it is
+// considered abandoned. Other processes sharing the dir may still be writing younger ones.
+const staleTempAge = 24 * time.Hour
+
 type Config struct {
-	Port             int
-	CacheDir         string
-	MaxCacheSize     int64
-	MinFreeSpace     int64
-	EvictionInterval time.Duration
-	EvictionStrategy string
-	Upstreams        []string
+	Port                 int
+	Listen               string
+	AdminListen          string
+	CacheDir             string
+	CacheKeyFile         string
+	Storage              string
+	MaxCacheSize         int64
+	MinFreeSpace         int64
+	MemoryCacheSize      int64
+	EvictionInterval     time.Duration
+	EvictionGrace        time.Duration
+	EvictionStrategy     string
+	Upstreams            []string
+	AllowHosts           []string
+	DenyHosts            []string
+	FileSourceRoot       string
+	OutboundProxy        string
+	OutboundCAFile       string
+	ProbeOnHead          bool
+	Compress             bool
+	RedirectMinSize      int64
+	RedirectExpiry       time.Duration
+	UploadTokenFile      string
+	AuthTokenFile        string
+	AuthNix              bool
+	CORSOrigins          []string
+	RateLimitRequests    float64
+	RateLimitBurst       int
+	RateLimitBytes       int64
+	MaxUpstreamBandwidth int64
+	CORSHeaders          []string
+	IPFSGateway          string
+	IPFSAPI              string
+	NixSubstituter       string
+	MaintenanceWindows   []string
+	AccessLog            bool
+	EnablePprof          bool
+	SlowSourceLatency    time.Duration
 }
 
-func NewServer(ctx context.Context, cfg Config) (*http.Server, func(), error) {
-	// Setup Eviction Manager
+// NewEvictionManager builds the eviction manager for cfg's cache dir, policies and strategy.
+func NewEvictionManager(cfg Config) (*eviction.Manager, error) {
 	strat, err := eviction.GetStrategy(cfg.EvictionStrategy)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to initialize eviction strategy: %w", err)
+		return nil, fmt.Errorf("failed to initialize eviction strategy: %w", err)
 	}
 
 	// Setup Policies
@@ -57,6 +108,37 @@ func NewServer(ctx context.Context, cfg Config) (*http.Server, func(), error) {
 	}
 
 	mgr := eviction.NewManager(cfg.CacheDir, policies, cfg.EvictionInterval, strat)
+	mgr.SetGracePeriod(cfg.EvictionGrace)
+	// Evicted objects must not leave their metadata behind
+	mgr.SetOnEvict(func(key string) {
+		errutil.LogMsg(repository.RemoveMetadata(cfg.CacheDir, key), "Failed to remove metadata", "key", key)
+	})
+	return mgr, nil
+}
+
+func NewServer(ctx context.Context, cfg Config) (*Server, func(), error) {
+	for _, u := range cfg.Upstreams {
+		if urltemplate.IsTemplate(u) {
+			if err := urltemplate.Validate(u); err != nil {
+				return nil, nil, fmt.Errorf("invalid upstream: %w", err)
+			}
+		}
+	}
+
+	// Setup Eviction Manager
+	mgr, err := NewEvictionManager(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	windows, err := schedule.Parse(cfg.MaintenanceWindows)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(windows) > 0 {
+		slog.Info("Restricting maintenance to windows", "windows", cfg.MaintenanceWindows)
+		mgr.SetSchedule(windows)
+	}
 
 	if err := mgr.LoadInitialState(); err != nil {
 		errutil.LogMsg(err, "Failed to load initial cache state")
@@ -73,27 +155,269 @@ func NewServer(ctx context.Context, cfg Config) (*http.Server, func(), error) {
 	}
 
 	// Create shared HTTP client for outbound requests
-	httpClientForRequests := http.DefaultClient
+	httpClientForRequests, err := httpclient.NewOutboundClient(cfg.OutboundProxy, cfg.OutboundCAFile)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if cfg.OutboundProxy != "" {
+		slog.Info("Sending outbound requests through a proxy")
+	}
+
+	local := repository.NewLocalRepository(cfg.CacheDir, mgr)
+	if removed, err := local.RemoveStaleTemp(staleTempAge); err != nil {
+		errutil.LogMsg(err, "Failed to clean up stale temp files")
+	} else if removed > 0 {
+		slog.Info("Removed stale temp files", "count", removed)
+	}
+	if cfg.CacheKeyFile != "" {
+		if cfg.Storage != "" {
+			cancel()
+			return nil, nil, fmt.Errorf("cache encryption is only supported with local storage")
+		}
+		key, err := repository.LoadCacheKey(cfg.CacheKeyFile)
+		if err == nil {
+			err = local.SetEncryptionKey(key)
+		}
+		if err != nil {
+			cancel()
+			return nil, nil, fmt.Errorf("failed to load cache key: %w", err)
+		}
+		slog.Info("Encrypting cache at rest")
+	}
 
-	localRepo := repository.NewLocalRepository(cfg.CacheDir, mgr)
+	var repo repository.WritableRepository = local
+	if cfg.Storage != "" {
+		u, err := url.Parse(cfg.Storage)
+		if err != nil {
+			cancel()
+			return nil, nil, fmt.Errorf("invalid storage URL: %w", err)
+		}
+		repo, err = repository.Open(u, httpClientForRequests)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		slog.Info("Using remote storage", "storage", u.Redacted())
+	}
+
+	if cfg.MemoryCacheSize > 0 {
+		slog.Info("Adding in-memory hot tier", "max_size", cfg.MemoryCacheSize)
+		repo = repository.NewTieredRepository(repo, cfg.MemoryCacheSize)
+	}
+
+	hosts, err := hostfilter.New(cfg.AllowHosts, cfg.DenyHosts)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	sourceClient := httpClientForRequests
+	if len(cfg.AllowHosts) > 0 || len(cfg.DenyHosts) > 0 {
+		slog.Info("Restricting source hosts", "allow", cfg.AllowHosts, "deny", cfg.DenyHosts)
+		base, ok := httpClientForRequests.Transport.(*http.Transport)
+		if !ok {
+			base = http.DefaultTransport.(*http.Transport)
+		}
+		var trusted []string
+		for _, u := range cfg.Upstreams {
+			trusted = append(trusted, strings.TrimPrefix(u, "dav+"))
+		}
+		// Redirects and hostnames resolving to denied ranges must not escape the host lists either
+		sourceClient = &http.Client{Transport: hosts.Transport(base, trusted), CheckRedirect: hosts.CheckRedirect}
+	}
+	if cfg.FileSourceRoot != "" {
+		slog.Info("Serving file:// sources", "root", cfg.FileSourceRoot)
+		sourceClient = httpclient.WithFileSources(sourceClient, cfg.FileSourceRoot)
+	}
 
-	casHandler := handler.NewCASHandler(localRepo, httpClientForRequests, cfg.Upstreams, appCtx)
+	casHandler := handler.NewCASHandler(repo, sourceClient, cfg.Upstreams, appCtx)
+	casHandler.Hosts = hosts
+	casHandler.ProbeOnHead = cfg.ProbeOnHead
+	casHandler.SlowSource = cfg.SlowSourceLatency
+	trafficPath := filepath.Join(cfg.CacheDir, handler.TrafficFileName)
+	if err := casHandler.LoadTraffic(trafficPath); err != nil {
+		errutil.LogMsg(err, "Starting traffic totals over")
+	}
+	go saveTraffic(appCtx, casHandler, trafficPath)
+	casHandler.Compress = cfg.Compress
+	if cfg.MaxUpstreamBandwidth > 0 {
+		slog.Info("Limiting upstream bandwidth", "bytes_per_second", cfg.MaxUpstreamBandwidth)
+		casHandler.UpstreamBandwidth = ratelimit.NewBandwidth(cfg.MaxUpstreamBandwidth)
+	}
+	casHandler.RedirectMinSize = cfg.RedirectMinSize
+	casHandler.RedirectExpiry = cfg.RedirectExpiry
+	if cfg.UploadTokenFile != "" {
+		token, err := loadToken(cfg.UploadTokenFile)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		slog.Info("Accepting authenticated uploads")
+		casHandler.UploadToken = token
+	}
+	var tokens Tokens
+	if cfg.AuthTokenFile != "" {
+		tokens, err = LoadTokens(cfg.AuthTokenFile)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		if casHandler.UploadToken != "" {
+			tokens.Add(casHandler.UploadToken, RoleWrite)
+		}
+		slog.Info("Requiring bearer tokens on the API", "tokens", len(tokens))
+		casHandler.AuthorizeWrite = tokens.CanWrite
+	}
+	// requireToken guards h with the configured tokens, if any
+	requireToken := func(h http.Handler) http.Handler {
+		if tokens == nil {
+			return h
+		}
+		return authHandler(tokens, h)
+	}
+	casHandler.IPFSGateway = cfg.IPFSGateway
+	if cfg.IPFSAPI != "" {
+		slog.Info("Publishing stored files to IPFS", "api", cfg.IPFSAPI)
+		node := ipfs.NewClient(cfg.IPFSAPI, httpClientForRequests)
+		casHandler.OnStored = func(algo, hash string) {
+			go func() {
+				if err := node.Publish(appCtx, repo, algo, hash); err != nil {
+					errutil.LogMsg(err, "Failed to publish to IPFS", "hash", hash)
+				}
+			}()
+		}
+	}
 
 	mux := http.NewServeMux()
 	// Mux handling: /api/fetchurl/{algo}/{hash}
-	mux.Handle("/api/fetchurl/", http.StripPrefix("/api/fetchurl", casHandler))
+	var apiHandler http.Handler = http.StripPrefix("/api/fetchurl", casHandler)
+	if cfg.RateLimitRequests > 0 || cfg.RateLimitBytes > 0 {
+		slog.Info("Rate limiting clients", "requests_per_second", cfg.RateLimitRequests, "burst", cfg.RateLimitBurst, "bytes_per_second", cfg.RateLimitBytes)
+		limiter := &ratelimit.Limiter{
+			RequestRate:  cfg.RateLimitRequests,
+			RequestBurst: cfg.RateLimitBurst,
+			ByteRate:     cfg.RateLimitBytes,
+		}
+		apiHandler = limiter.Handler(apiHandler)
+	}
+	apiHandler = requireToken(apiHandler)
+	if len(cfg.CORSOrigins) > 0 {
+		slog.Info("Enabling CORS", "origins", cfg.CORSOrigins)
+		apiHandler = corsHandler(cfg.CORSOrigins, cfg.CORSHeaders, apiHandler)
+	}
+	mux.Handle("/api/fetchurl/", apiHandler)
+	// More specific than the CAS pattern, and never a valid /{algo}/{hash}
+	mux.Handle("/api/fetchurl/list", requireToken(listHandler(local, mgr)))
+	mux.Handle("/api/stats", requireToken(statsHandler(casHandler, mgr)))
+	mux.Handle("/healthz", requireToken(http.HandlerFunc(healthHandler)))
+	if cfg.NixSubstituter != "" {
+		slog.Info("Serving Nix binary cache", "path", "/nix", "upstream", cfg.NixSubstituter)
+		var nixHandler http.Handler = http.StripPrefix("/nix", nixcache.NewHandler(casHandler, cfg.NixSubstituter, httpClientForRequests))
+		if cfg.AuthNix {
+			nixHandler = requireToken(nixHandler)
+		} else if tokens != nil {
+			slog.Warn("Serving the Nix binary cache without tokens")
+		}
+		mux.Handle("/nix/", nixHandler)
+	}
 
-	addr := fmt.Sprintf(":%d", cfg.Port)
+	addr := cfg.Listen
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", cfg.Port)
+	}
 	slog.Info("Starting server (CAS)", "addr", addr, "cache_dir", cfg.CacheDir, "upstreams", len(cfg.Upstreams))
 
-	server := &http.Server{
-		Addr:    addr,
-		Handler: mux,
+	// logRequests adds the access log to h if enabled
+	logRequests := func(h http.Handler) http.Handler {
+		if !cfg.AccessLog {
+			return h
+		}
+		return accessLogHandler(h)
+	}
+
+	server := &Server{
+		API: &http.Server{
+			Addr:    addr,
+			Handler: logRequests(mux),
+		},
+	}
+
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/admin/gc", gcHandler(mgr))
+	if cfg.EnablePprof {
+		slog.Info("Serving pprof and expvar", "path", "/debug")
+		registerDebug(adminMux, casHandler)
+	}
+	switch {
+	case cfg.AdminListen != "":
+		adminMux.HandleFunc("/healthz", healthHandler)
+		slog.Info("Starting admin server", "addr", cfg.AdminListen)
+		server.Admin = &http.Server{
+			Addr:    cfg.AdminListen,
+			Handler: logRequests(adminMux),
+		}
+	case tokens != nil:
+		// Sharing the API listener, admin endpoints need a write token
+		slog.Info("Serving admin endpoints on the API listener to write tokens")
+		guarded := adminAuthHandler(tokens, adminMux)
+		mux.Handle("/admin/", guarded)
+		mux.Handle("/debug/", guarded)
+	default:
+		slog.Info("Not serving admin endpoints, as there is neither --admin-listen nor --auth-token-file to keep them private")
+	}
+
+	watchdog, err := sdnotify.WatchdogInterval()
+	if err != nil {
+		errutil.LogMsg(err, "Failed to read systemd watchdog settings")
+	} else if watchdog > 0 {
+		healthURL, err := localURL(addr, "/healthz")
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		slog.Info("Enabling systemd watchdog", "timeout", watchdog)
+		// The health check goes through the token check like any other request
+		var healthToken string
+		if tokens != nil {
+			healthToken = rand.Text()
+			tokens.Add(healthToken, RoleRead)
+		}
+		go runWatchdog(appCtx, watchdog, healthURL, healthToken, localClient(addr, watchdog/2), mgr)
 	}
 
 	cleanup := func() {
 		cancel()
+		errutil.LogMsg(mgr.SaveState(), "Failed to save eviction state")
+		errutil.LogMsg(casHandler.SaveTraffic(trafficPath), "Failed to save traffic totals")
 	}
 
 	return server, cleanup, nil
 }
+
+// loadToken reads a secret token from path, ignoring surrounding whitespace.
+func loadToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// saveTraffic persists the traffic totals of cas to path every
+// trafficSaveInterval until ctx is done.
+func saveTraffic(ctx context.Context, cas *handler.CASHandler, path string) {
+	ticker := time.NewTicker(trafficSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			errutil.LogMsg(cas.SaveTraffic(path), "Failed to save traffic totals")
+		}
+	}
+}
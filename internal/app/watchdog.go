@@ -0,0 +1,65 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/eviction"
+	"github.com/lucasew/fetchurl/internal/sdnotify"
+)
+
+// healthHandler answers liveness probes, including the systemd watchdog self-check.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := w.Write([]byte("ok\n")); err != nil {
+		errutil.LogMsg(err, "Failed to write health response")
+	}
+}
+
+// runWatchdog pings the systemd watchdog while both the HTTP server and the
+// eviction loop are responsive. If either wedges the pings stop and systemd
+// restarts the service. token, if set, is sent with the health checks.
+func runWatchdog(ctx context.Context, timeout time.Duration, healthURL, token string, client *http.Client, mgr *eviction.Manager) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !mgr.Healthy() {
+				errutil.ReportError(fmt.Errorf("eviction loop stalled"), "Skipping watchdog ping")
+				continue
+			}
+			if err := checkHealth(ctx, client, healthURL, token); err != nil {
+				errutil.ReportError(err, "Skipping watchdog ping")
+				continue
+			}
+			if _, err := sdnotify.Notify(sdnotify.Watchdog); err != nil {
+				errutil.LogMsg(err, "Failed to ping systemd watchdog")
+			}
+		}
+	}
+}
+
+func checkHealth(ctx context.Context, client *http.Client, url, token string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("health check failed: %w", err)
+	}
+	errutil.LogMsg(resp.Body.Close(), "Failed to close health check body")
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+// Package bundle implements a signed archive format for moving cache
+// contents into networks without access to the sources.
+//
+// A bundle is a tar stream with the following entries, in order:
+//
+//	manifest.json      list of objects (algo, hash, size)
+//	manifest.json.sig  ed25519 signature of manifest.json
+//	blobs/{algo}/{hash} object payloads, one per manifest entry
+//
+// Only the manifest is signed; every blob is verified against its hash
+// on import, which transitively covers it with the signature.
+package bundle
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/hashutil"
+	"github.com/lucasew/fetchurl/internal/repository"
+)
+
+const (
+	manifestName  = "manifest.json"
+	signatureName = "manifest.json.sig"
+	formatVersion = 1
+)
+
+var (
+	// ErrBadSignature is returned when the manifest signature doesn't verify.
+	ErrBadSignature = errors.New("bundle signature verification failed")
+
+	// ErrMalformed is returned when the bundle doesn't follow the expected structure.
+	ErrMalformed = errors.New("malformed bundle")
+)
+
+// Entry is an object listed in a bundle manifest.
+type Entry struct {
+	Algo string `json:"algo"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// Manifest describes the contents of a bundle.
+type Manifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Entries []Entry   `json:"entries"`
+}
+
+// Export writes every object stored in repo as a bundle signed with key.
+func Export(ctx context.Context, w io.Writer, repo *repository.LocalRepository, key ed25519.PrivateKey) (*Manifest, error) {
+	manifest := &Manifest{Version: formatVersion, Created: time.Now().UTC()}
+
+	err := filepath.WalkDir(repo.CacheDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(repo.CacheDir, p)
+		if err != nil {
+			return err
+		}
+		algo, hash, ok := repository.LayoutSharded.Parse(rel)
+		if !ok || !hashutil.IsSupported(algo) {
+			return nil
+		}
+		// Sizes come from the repository, which knows about encryption overhead
+		rc, size, err := repo.Get(ctx, algo, hash)
+		if err != nil {
+			return err
+		}
+		errutil.LogMsg(rc.Close(), "Failed to close blob", "path", p)
+		manifest.Entries = append(manifest.Entries, Entry{Algo: algo, Hash: hash, Size: size})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk cache dir: %w", err)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writeEntry(tw, manifestName, data); err != nil {
+		return nil, err
+	}
+	if err := writeEntry(tw, signatureName, ed25519.Sign(key, data)); err != nil {
+		return nil, err
+	}
+	for _, e := range manifest.Entries {
+		if err := writeBlob(ctx, tw, repo, e); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func writeEntry(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func writeBlob(ctx context.Context, tw *tar.Writer, repo *repository.LocalRepository, e Entry) error {
+	rc, _, err := repo.Get(ctx, e.Algo, e.Hash)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errutil.LogMsg(rc.Close(), "Failed to close blob", "hash", e.Hash)
+	}()
+
+	if err := tw.WriteHeader(&tar.Header{Name: blobName(e.Algo, e.Hash), Mode: 0644, Size: e.Size}); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tw, rc, e.Size); err != nil {
+		return fmt.Errorf("failed to write blob %s/%s: %w", e.Algo, e.Hash, err)
+	}
+	return nil
+}
+
+func blobName(algo, hash string) string {
+	return path.Join("blobs", algo, hash)
+}
+
+// Import verifies a bundle signed by pub and stores its objects in repo.
+//
+// The manifest signature is checked before any blob is written and every
+// blob is hashed before it is committed. Objects already present are skipped.
+func Import(ctx context.Context, r io.Reader, repo *repository.LocalRepository, pub ed25519.PublicKey) (*Manifest, error) {
+	tr := tar.NewReader(r)
+
+	data, err := readEntry(tr, manifestName)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := readEntry(tr, signatureName)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(pub, data, sig) {
+		return nil, ErrBadSignature
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+	if manifest.Version != formatVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrMalformed, manifest.Version)
+	}
+
+	expected := make(map[string]Entry, len(manifest.Entries))
+	for _, e := range manifest.Entries {
+		expected[blobName(e.Algo, e.Hash)] = e
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		e, ok := expected[hdr.Name]
+		if !ok || hdr.Size != e.Size {
+			return nil, fmt.Errorf("%w: unexpected entry %s", ErrMalformed, hdr.Name)
+		}
+		delete(expected, hdr.Name)
+		if err := importBlob(ctx, tr, repo, e); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(expected) > 0 {
+		return nil, fmt.Errorf("%w: %d blobs missing", ErrMalformed, len(expected))
+	}
+	return &manifest, nil
+}
+
+func readEntry(tr *tar.Reader, name string) ([]byte, error) {
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+	if hdr.Name != name {
+		return nil, fmt.Errorf("%w: expected %s, got %s", ErrMalformed, name, hdr.Name)
+	}
+	return io.ReadAll(tr)
+}
+
+func importBlob(ctx context.Context, r io.Reader, repo *repository.LocalRepository, e Entry) error {
+	if !hashutil.IsSupported(e.Algo) {
+		return fmt.Errorf("%w: unsupported algorithm %s", ErrMalformed, e.Algo)
+	}
+	exists, err := repo.Exists(ctx, e.Algo, e.Hash)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	w, commit, err := repo.BeginWrite(e.Algo, e.Hash, e.Size)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			errutil.LogMsg(w.Close(), "Failed to close temp file")
+			if f, ok := w.(*os.File); ok {
+				errutil.LogMsg(os.Remove(f.Name()), "Failed to remove temp file", "path", f.Name())
+			}
+		}
+	}()
+
+	hasher, err := hashutil.GetHasher(e.Algo)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.MultiWriter(w, hasher), r); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); actual != e.Hash {
+		return fmt.Errorf("%w: %s/%s has hash %s", ErrMalformed, e.Algo, e.Hash, actual)
+	}
+	if err := commit(); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// GenerateKey creates a new signing key pair, PEM encoded.
+func GenerateKey() (private, public []byte, err error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	private = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+	public = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	return private, public, nil
+}
+
+// LoadPrivateKey reads a PEM encoded ed25519 private key.
+func LoadPrivateKey(p string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(p, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 private key", p)
+	}
+	return priv, nil
+}
+
+// LoadPublicKey reads a PEM encoded ed25519 public key.
+func LoadPublicKey(p string) (ed25519.PublicKey, error) {
+	der, err := readPEM(p, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 public key", p)
+	}
+	return pub, nil
+}
+
+func readPEM(p, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s does not contain a PEM %s", p, blockType)
+	}
+	return block.Bytes, nil
+}
@@ -0,0 +1,91 @@
+package bundle
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lucasew/fetchurl/internal/repository"
+)
+
+func TestBundle(t *testing.T) {
+	content := []byte("bundled content")
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	srcDir := t.TempDir()
+	path := filepath.Join(srcDir, repository.LayoutSharded.RelPath("sha256", hash))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	manifest, err := Export(t.Context(), &buf, repository.NewLocalRepository(srcDir, nil), priv)
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if len(manifest.Entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(manifest.Entries))
+	}
+
+	t.Run("Import Success", func(t *testing.T) {
+		repo := repository.NewLocalRepository(t.TempDir(), nil)
+		if _, err := Import(t.Context(), bytes.NewReader(buf.Bytes()), repo, pub); err != nil {
+			t.Fatalf("Import failed: %v", err)
+		}
+		rc, _, err := repo.Get(t.Context(), "sha256", hash)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		defer func() {
+			if err := rc.Close(); err != nil {
+				t.Errorf("failed to close rc: %v", err)
+			}
+		}()
+		got, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("got %q, want %q", got, content)
+		}
+	})
+
+	t.Run("Wrong Key", func(t *testing.T) {
+		otherPub, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo := repository.NewLocalRepository(t.TempDir(), nil)
+		_, err = Import(t.Context(), bytes.NewReader(buf.Bytes()), repo, otherPub)
+		if !errors.Is(err, ErrBadSignature) {
+			t.Errorf("expected ErrBadSignature, got %v", err)
+		}
+	})
+
+	t.Run("Tampered Blob", func(t *testing.T) {
+		tampered := bytes.Replace(buf.Bytes(), content, []byte("tampered contnt"), 1)
+		repo := repository.NewLocalRepository(t.TempDir(), nil)
+		_, err := Import(t.Context(), bytes.NewReader(tampered), repo, pub)
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf("expected ErrMalformed, got %v", err)
+		}
+		if exists, _ := repo.Exists(t.Context(), "sha256", hash); exists {
+			t.Error("tampered blob should not be stored")
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package cachelock
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// FileName is the lock file created in the cache root.
+const FileName = ".lock"
+
+// Shared acquires a shared advisory lock on the cache directory.
+//
+// Any number of shared holders may coexist; they exclude Exclusive holders.
+// Writers hold it while committing objects.
+func Shared(cacheDir string) (func() error, error) {
+	return acquire(cacheDir, false)
+}
+
+// Exclusive acquires an exclusive advisory lock on the cache directory.
+//
+// It is held by operations that delete or move many objects (eviction,
+// migration) so they never interleave with commits from any process
+// sharing the cache directory.
+func Exclusive(cacheDir string) (func() error, error) {
+	return acquire(cacheDir, true)
+}
+
+func acquire(cacheDir string, exclusive bool) (func() error, error) {
+	path := filepath.Join(cacheDir, FileName)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache lock: %w", err)
+	}
+	if err := lockFile(f, exclusive); err != nil {
+		if closeErr := f.Close(); closeErr != nil {
+			err = fmt.Errorf("%w (close: %v)", err, closeErr)
+		}
+		return nil, fmt.Errorf("failed to lock cache: %w", err)
+	}
+	return func() error {
+		err := unlockFile(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
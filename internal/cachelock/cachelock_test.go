@@ -0,0 +1,50 @@
+package cachelock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExclusiveWaitsForShared(t *testing.T) {
+	dir := t.TempDir()
+
+	unlockShared, err := Shared(dir)
+	if err != nil {
+		t.Fatalf("Shared failed: %v", err)
+	}
+	unlockShared2, err := Shared(dir)
+	if err != nil {
+		t.Fatalf("second Shared failed: %v", err)
+	}
+
+	acquired := make(chan func() error)
+	go func() {
+		unlock, err := Exclusive(dir)
+		if err != nil {
+			t.Errorf("Exclusive failed: %v", err)
+		}
+		acquired <- unlock
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("exclusive lock acquired while shared locks are held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := unlockShared(); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+	if err := unlockShared2(); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+
+	select {
+	case unlock := <-acquired:
+		if err := unlock(); err != nil {
+			t.Errorf("unlock failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("exclusive lock not acquired after shared locks were released")
+	}
+}
@@ -1,14 +1,21 @@
 package errutil
 
 import (
+	"context"
 	"log/slog"
 )
 
 // LogMsg logs the error with a custom message if it is not nil.
 func LogMsg(err error, msg string, args ...any) {
+	LogMsgContext(context.Background(), err, msg, args...)
+}
+
+// LogMsgContext is LogMsg for code serving a request, so the log handler
+// can tag the line with what ctx carries, such as the request ID.
+func LogMsgContext(ctx context.Context, err error, msg string, args ...any) {
 	if err != nil {
 		allArgs := append([]any{"error", err}, args...)
-		slog.Warn(msg, allArgs...)
+		slog.WarnContext(ctx, msg, allArgs...)
 	}
 }
 
@@ -16,8 +23,13 @@ func LogMsg(err error, msg string, args ...any) {
 // It funnels errors through a centralized reporting mechanism (currently slog).
 // Future integrations (e.g., Sentry) should be added here.
 func ReportError(err error, msg string, args ...any) {
+	ReportErrorContext(context.Background(), err, msg, args...)
+}
+
+// ReportErrorContext is ReportError for code serving a request.
+func ReportErrorContext(ctx context.Context, err error, msg string, args ...any) {
 	if err != nil {
 		allArgs := append([]any{"error", err}, args...)
-		slog.Error(msg, allArgs...)
+		slog.ErrorContext(ctx, msg, allArgs...)
 	}
 }
@@ -0,0 +1,134 @@
+package eviction
+
+import "os"
+
+// Link registers alias as another name for the object stored under key, such
+// as a hard link to the same file.
+//
+// Aliases add no bytes and are not eviction candidates of their own: touching
+// an alias refreshes key, and evicting key deletes its aliases with it.
+func (m *Manager) Link(key, alias string) {
+	if key == alias {
+		return
+	}
+	m.linksMu.Lock()
+	defer m.linksMu.Unlock()
+	if p, ok := m.primary[key]; ok {
+		key = p
+	}
+	if m.primary[alias] == key {
+		return
+	}
+	if m.links == nil {
+		m.links = make(map[string][]string)
+		m.primary = make(map[string]string)
+	}
+	m.links[key] = append(m.links[key], alias)
+	m.primary[alias] = key
+}
+
+// primaryKey returns the key the object reachable as key is tracked under.
+func (m *Manager) primaryKey(key string) string {
+	m.linksMu.Lock()
+	defer m.linksMu.Unlock()
+	if p, ok := m.primary[key]; ok {
+		return p
+	}
+	return key
+}
+
+// unlink forgets key as a name of its object. If key is an alias it is
+// dropped and true is returned. If key is the primary of an object with
+// aliases, the first alias is promoted and returned, so the object stays
+// tracked under a name that still exists.
+func (m *Manager) unlink(key string) (promoted string, isAlias bool) {
+	m.linksMu.Lock()
+	defer m.linksMu.Unlock()
+	if p, ok := m.primary[key]; ok {
+		delete(m.primary, key)
+		aliases := m.links[p]
+		for i, a := range aliases {
+			if a == key {
+				aliases = append(aliases[:i], aliases[i+1:]...)
+				break
+			}
+		}
+		if len(aliases) == 0 {
+			delete(m.links, p)
+		} else {
+			m.links[p] = aliases
+		}
+		return "", true
+	}
+	aliases, ok := m.links[key]
+	if !ok {
+		return "", false
+	}
+	delete(m.links, key)
+	promoted = aliases[0]
+	delete(m.primary, promoted)
+	if rest := aliases[1:]; len(rest) > 0 {
+		m.links[promoted] = rest
+		for _, a := range rest {
+			m.primary[a] = promoted
+		}
+	}
+	return promoted, false
+}
+
+// takeLinks forgets and returns the aliases of key.
+func (m *Manager) takeLinks(key string) []string {
+	m.linksMu.Lock()
+	defer m.linksMu.Unlock()
+	aliases := m.links[key]
+	delete(m.links, key)
+	for _, a := range aliases {
+		delete(m.primary, a)
+	}
+	return aliases
+}
+
+// groupLinks merges files that are hard links to the same inode, keeping the
+// most recently accessed name as the primary and returning the others as
+// aliases keyed by that primary.
+func groupLinks(files []loadedFile) ([]loadedFile, map[string][]string) {
+	type group struct {
+		info    os.FileInfo
+		primary int
+		aliases []string
+	}
+	bySize := make(map[int64][]*group)
+	var groups []*group
+	for i, f := range files {
+		var g *group
+		for _, candidate := range bySize[f.size] {
+			if os.SameFile(candidate.info, f.info) {
+				g = candidate
+				break
+			}
+		}
+		if g == nil {
+			g = &group{info: f.info, primary: i}
+			bySize[f.size] = append(bySize[f.size], g)
+			groups = append(groups, g)
+			continue
+		}
+		if f.ts > files[g.primary].ts {
+			g.aliases = append(g.aliases, files[g.primary].key)
+			g.primary = i
+		} else {
+			g.aliases = append(g.aliases, f.key)
+		}
+	}
+
+	objects := make([]loadedFile, 0, len(groups))
+	links := make(map[string][]string)
+	for _, g := range groups {
+		f := files[g.primary]
+		objects = append(objects, f)
+		if len(g.aliases) > 0 {
+			links[f.key] = g.aliases
+		}
+	}
+	return objects, links
+}
@@ -6,12 +6,17 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 
+	"github.com/lucasew/fetchurl/internal/cachelock"
 	"github.com/lucasew/fetchurl/internal/errutil"
 	"sync/atomic"
 	"time"
 
 	"github.com/lucasew/fetchurl/internal/eviction/policy"
+	"github.com/lucasew/fetchurl/internal/schedule"
 )
 
 // Manager manages cache eviction by coordinating between storage usage,
@@ -24,6 +29,27 @@ type Manager struct {
 	strategy     Strategy
 	currentBytes atomic.Int64
 	interval     time.Duration
+	schedule     schedule.Schedule
+	heartbeat    atomic.Int64
+
+	linksMu sync.Mutex
+	links   map[string][]string // primary key -> aliases
+	primary map[string]string   // alias -> primary key
+
+	accessMu      sync.Mutex
+	access        map[string]int64 // key -> last access, unix nanoseconds
+	accessVersion uint64           // bumped on every change to access
+	savedVersion  uint64           // accessVersion last persisted by SaveState
+	saveMu        sync.Mutex       // serializes SaveState
+
+	grace   time.Duration
+	addedMu sync.Mutex
+	added   map[string]time.Time // keys added within the grace period
+
+	evicted      atomic.Int64
+	evictedBytes atomic.Int64
+
+	onEvict func(key string)
 }
 
 // NewManager creates a new Manager instance.
@@ -41,24 +67,44 @@ func NewManager(cacheDir string, policies []policy.Policy, interval time.Duratio
 // LoadInitialState scans the cache directory to rebuild the in-memory strategy state.
 //
 // This method walks the entire cache directory to calculate current usage and
-// populate the eviction strategy (e.g., LRU list).
+// populate the eviction strategy (e.g., LRU list). Files are added in order of
+// last access as persisted by SaveState, falling back to their modification
+// time, so recency survives restarts. Persisted entries for files that are
+// gone are dropped on the next SaveState.
 //
 // Note: This operation can be I/O intensive for large caches and should be called
 // before starting the server or the eviction loop.
 func (m *Manager) LoadInitialState() error {
 	var totalSize int64
-	var count int
 
-	err := filepath.WalkDir(m.cacheDir, func(path string, d os.DirEntry, err error) error {
+	accessTimes, err := m.loadState()
+	if err != nil {
+		errutil.LogMsg(err, "Failed to load eviction state, falling back to modification times")
+		accessTimes = map[string]int64{}
+	}
+
+	var files []loadedFile
+	err = filepath.WalkDir(m.cacheDir, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			if os.IsNotExist(err) && path == m.cacheDir {
 				return nil
 			}
 			return err
 		}
+		// Hidden entries hold bookkeeping (partial downloads, locks), not cached objects
+		if path != m.cacheDir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		if d.IsDir() {
 			return nil
 		}
+		// Temp files are in-flight writes, possibly from another process
+		if strings.HasPrefix(d.Name(), "put-") {
+			return nil
+		}
 
 		info, err := d.Info()
 		if err != nil {
@@ -72,10 +118,11 @@ func (m *Manager) LoadInitialState() error {
 			return nil
 		}
 
-		size := info.Size()
-		totalSize += size
-		count++
-		m.strategy.OnAdd(rel, size)
+		ts, ok := accessTimes[rel]
+		if !ok {
+			ts = info.ModTime().UnixNano()
+		}
+		files = append(files, loadedFile{key: rel, size: info.Size(), ts: ts, info: info})
 		return nil
 	})
 
@@ -83,82 +130,290 @@ func (m *Manager) LoadInitialState() error {
 		return fmt.Errorf("failed to walk cache dir: %w", err)
 	}
 
+	// Hard-linked aliases share their bytes, track each object once
+	files, links := groupLinks(files)
+	m.linksMu.Lock()
+	m.links = links
+	m.primary = make(map[string]string)
+	for key, aliases := range links {
+		for _, a := range aliases {
+			m.primary[a] = key
+		}
+	}
+	m.linksMu.Unlock()
+
+	// Least recently used first, so the strategy ends up in access order
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].ts < files[j].ts
+	})
+	m.accessMu.Lock()
+	m.access = make(map[string]int64, len(files))
+	for _, f := range files {
+		totalSize += f.size
+		m.strategy.OnAdd(f.key, f.size)
+		m.access[f.key] = f.ts
+	}
+	for key := range accessTimes {
+		if _, ok := m.access[key]; !ok {
+			m.accessVersion++
+			break
+		}
+	}
+	m.accessMu.Unlock()
+
 	m.currentBytes.Store(totalSize)
-	slog.Info("Initial cache state loaded", "count", count, "size", totalSize)
+	slog.Info("Initial cache state loaded", "count", len(files), "size", totalSize)
 	return nil
 }
 
+// SetSchedule restricts background eviction sweeps to the given maintenance windows.
+//
+// An empty schedule (the default) allows sweeps at any time. Explicit calls to
+// RunEviction are not affected.
+func (m *Manager) SetSchedule(s schedule.Schedule) {
+	m.schedule = s
+}
+
+// SetGracePeriod keeps newly added entries out of eviction for d, so an object
+// isn't deleted while requests that waited for its download are still reading it.
+func (m *Manager) SetGracePeriod(d time.Duration) {
+	m.grace = d
+}
+
+// SetOnEvict sets fn to be called with the key of every file eviction
+// deletes, aliases included, e.g. to drop sidecars kept for it.
+func (m *Manager) SetOnEvict(fn func(key string)) {
+	m.onEvict = fn
+}
+
 // Start runs the background eviction loop.
 //
 // It blocks until the context is canceled. It should typically be run in a separate goroutine.
-// The loop triggers RunEviction() at the configured interval.
+// The loop triggers RunEviction() at the configured interval, skipping ticks
+// that fall outside the maintenance schedule.
 func (m *Manager) Start(ctx context.Context) {
 	ticker := time.NewTicker(m.interval)
 	defer ticker.Stop()
+	m.heartbeat.Store(time.Now().UnixNano())
 
 	for {
 		select {
 		case <-ctx.Done():
+			errutil.LogMsg(m.SaveState(), "Failed to save eviction state")
 			return
-		case <-ticker.C:
+		case now := <-ticker.C:
+			m.heartbeat.Store(now.UnixNano())
+			errutil.LogMsg(m.SaveState(), "Failed to save eviction state")
+			if !m.schedule.Allows(now) {
+				slog.Debug("Skipping eviction sweep outside maintenance window")
+				continue
+			}
 			m.RunEviction()
 		}
 	}
 }
 
+// Healthy reports whether the background loop is still making progress.
+//
+// It returns false if the loop hasn't completed an iteration in twice the
+// eviction interval, e.g. because a sweep is stuck on a hung filesystem.
+func (m *Manager) Healthy() bool {
+	last := m.heartbeat.Load()
+	if last == 0 {
+		return true
+	}
+	return time.Since(time.Unix(0, last)) < 2*m.interval
+}
+
 // Add registers a new item with the eviction strategy and updates the total cache size.
 //
 // It should be called whenever a new item is successfully committed to the cache.
 func (m *Manager) Add(key string, size int64) {
 	diff := m.strategy.OnAdd(key, size)
 	m.currentBytes.Add(diff)
+	now := time.Now()
+	m.recordAccess(key, now)
+
+	if m.grace > 0 {
+		m.addedMu.Lock()
+		if m.added == nil {
+			m.added = make(map[string]time.Time)
+		}
+		m.added[key] = now
+		m.addedMu.Unlock()
+	}
+}
+
+// Remove forgets an item deleted from the cache outside of eviction.
+//
+// Removing an alias frees nothing, and removing an object that still has
+// aliases keeps its bytes tracked under one of them.
+func (m *Manager) Remove(key string, size int64) {
+	promoted, isAlias := m.unlink(key)
+	if isAlias {
+		return
+	}
+	m.strategy.Remove(key)
+	m.forgetAccess(key)
+	if promoted != "" {
+		m.strategy.OnAdd(promoted, size)
+		m.recordAccess(promoted, time.Now())
+		return
+	}
+	m.currentBytes.Add(-size)
 }
 
 // Touch notifies the strategy that an item has been accessed.
 //
 // For strategies like LRU, this promotes the item to prevent it from being evicted.
 func (m *Manager) Touch(key string) {
+	key = m.primaryKey(key)
 	m.strategy.OnAccess(key)
+	m.recordAccess(key, time.Now())
 }
 
-// RunEviction enforces eviction policies by removing files if thresholds are exceeded.
+// Stats summarizes the cache contents and the evictions since start.
+type Stats struct {
+	Objects      int   `json:"objects"`
+	Bytes        int64 `json:"bytes"`
+	Evicted      int64 `json:"evicted"`
+	EvictedBytes int64 `json:"evicted_bytes"`
+}
+
+// Stats returns the current cache usage and eviction totals.
 //
-// The process is:
-// 1. Check all policies to determine how many bytes need to be freed.
-// 2. If space needs to be freed, query the strategy for victim files.
-// 3. Delete the victim files from disk.
-// 4. Update the strategy and total size to reflect the deletions.
-func (m *Manager) RunEviction() {
-	current := m.currentBytes.Load()
+// Aliases of an object are counted once, with the object.
+func (m *Manager) Stats() Stats {
+	m.accessMu.Lock()
+	objects := len(m.access)
+	m.accessMu.Unlock()
+	return Stats{
+		Objects:      objects,
+		Bytes:        m.currentBytes.Load(),
+		Evicted:      m.evicted.Load(),
+		EvictedBytes: m.evictedBytes.Load(),
+	}
+}
+
+// PolicyDemand is the space one policy asks to free.
+type PolicyDemand struct {
+	Policy      string `json:"policy"`
+	BytesToFree int64  `json:"bytes_to_free"`
+}
+
+// Plan describes what an eviction sweep would do.
+type Plan struct {
+	CurrentBytes int64 `json:"current_bytes"`
+	TargetBytes  int64 `json:"target_bytes"`
+	// Demands lists the policies that require space to be freed. The largest one wins.
+	Demands []PolicyDemand `json:"demands"`
+	Victims []Victim       `json:"victims"`
+}
+
+// Plan computes the victims the next sweep would delete, and which policies
+// asked for it, without deleting anything.
+func (m *Manager) Plan() Plan {
+	plan := Plan{CurrentBytes: m.currentBytes.Load()}
+	plan.TargetBytes = plan.CurrentBytes
 	var maxToFree int64
 
 	for _, p := range m.policies {
-		toFree, err := p.BytesToFree(current)
+		toFree, err := p.BytesToFree(plan.CurrentBytes)
 		if err != nil {
 			errutil.ReportError(err, "Failed to check capacity policy")
 			continue
 		}
+		if toFree > 0 {
+			plan.Demands = append(plan.Demands, PolicyDemand{Policy: policyName(p), BytesToFree: toFree})
+		}
 		if toFree > maxToFree {
 			maxToFree = toFree
 		}
 	}
 
 	if maxToFree <= 0 {
-		return
+		return plan
 	}
 
-	targetSize := current - maxToFree
 	// Ensure target is not negative (though Strategy logic should handle it)
-	if targetSize < 0 {
-		targetSize = 0
+	plan.TargetBytes = max(plan.CurrentBytes-maxToFree, 0)
+	if m.grace <= 0 {
+		plan.Victims = m.strategy.GetVictims(plan.CurrentBytes, plan.TargetBytes)
+		return plan
 	}
 
-	victims := m.strategy.GetVictims(current, targetSize)
-	if len(victims) == 0 {
-		return
+	// Walk the whole eviction order, passing over entries still in their grace period
+	young := m.youngEntries(time.Now())
+	size := plan.CurrentBytes
+	for _, v := range m.strategy.GetVictims(plan.CurrentBytes, 0) {
+		if size <= plan.TargetBytes {
+			break
+		}
+		if young[v.Key] {
+			continue
+		}
+		plan.Victims = append(plan.Victims, v)
+		size -= v.Size
+	}
+	return plan
+}
+
+// youngEntries returns the keys added less than the grace period ago, forgetting older ones.
+func (m *Manager) youngEntries(now time.Time) map[string]bool {
+	m.addedMu.Lock()
+	defer m.addedMu.Unlock()
+
+	young := make(map[string]bool, len(m.added))
+	for key, t := range m.added {
+		if now.Sub(t) < m.grace {
+			young[key] = true
+		} else {
+			delete(m.added, key)
+		}
+	}
+	return young
+}
+
+func policyName(p policy.Policy) string {
+	if s, ok := p.(fmt.Stringer); ok {
+		return s.String()
 	}
+	return fmt.Sprintf("%T", p)
+}
+
+// Summary reports the outcome of an eviction sweep.
+type Summary struct {
+	Evicted      int   `json:"evicted"`
+	Failed       int   `json:"failed"`
+	FreedBytes   int64 `json:"freed_bytes"`
+	CurrentBytes int64 `json:"current_bytes"`
+}
+
+// RunEviction enforces eviction policies by removing files if thresholds are exceeded.
+//
+// The process is:
+// 1. Plan: check all policies and query the strategy for victim files.
+// 2. Delete the victim files from disk.
+// 3. Update the strategy and total size to reflect the deletions.
+func (m *Manager) RunEviction() Summary {
+	plan := m.Plan()
+	summary := Summary{CurrentBytes: plan.CurrentBytes}
+	if len(plan.Victims) == 0 {
+		return summary
+	}
+	victims := plan.Victims
+
+	slog.Info("Evicting files", "count", len(victims), "current_size", plan.CurrentBytes, "to_free", plan.CurrentBytes-plan.TargetBytes, "target", plan.TargetBytes)
 
-	slog.Info("Evicting files", "count", len(victims), "current_size", current, "to_free", maxToFree, "target", targetSize)
+	// Keep commits from any process sharing the cache dir out while deleting
+	unlock, err := cachelock.Exclusive(m.cacheDir)
+	if err != nil {
+		errutil.ReportError(err, "Failed to lock cache for eviction")
+		return summary
+	}
+	defer func() {
+		errutil.LogMsg(unlock(), "Failed to release cache lock")
+	}()
 
 	for _, victim := range victims {
 		path := filepath.Join(m.cacheDir, victim.Key)
@@ -171,10 +426,43 @@ func (m *Manager) RunEviction() {
 		}
 
 		m.strategy.Remove(victim.Key)
+		m.forgetAccess(victim.Key)
+
+		if err == nil || os.IsNotExist(err) {
+			m.evictedKey(victim.Key)
+		}
+
+		// The bytes are only freed once every link is gone
+		for _, alias := range m.takeLinks(victim.Key) {
+			aliasPath := filepath.Join(m.cacheDir, alias)
+			if aliasErr := os.Remove(aliasPath); aliasErr != nil && !os.IsNotExist(aliasErr) {
+				errutil.ReportError(aliasErr, "Failed to remove alias", "path", aliasPath)
+				if err == nil || os.IsNotExist(err) {
+					err = aliasErr
+				}
+				continue
+			}
+			m.evictedKey(alias)
+		}
 
 		// If remove succeeded (or file didn't exist), we consider it gone.
 		if err == nil || os.IsNotExist(err) {
 			m.currentBytes.Add(-victim.Size)
+			m.evicted.Add(1)
+			m.evictedBytes.Add(victim.Size)
+			summary.Evicted++
+			summary.FreedBytes += victim.Size
+		} else {
+			summary.Failed++
 		}
 	}
+	summary.CurrentBytes = m.currentBytes.Load()
+	return summary
+}
+
+// evictedKey tells the OnEvict callback, if any, that key was deleted.
+func (m *Manager) evictedKey(key string) {
+	if m.onEvict != nil {
+		m.onEvict(key)
+	}
 }
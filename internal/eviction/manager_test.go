@@ -3,6 +3,8 @@ package eviction_test
 import (
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -42,7 +44,7 @@ func TestManager(t *testing.T) {
 	// So first file read is "oldest" conceptually if we consider Add order.
 	// But actually, checking if *any* file was deleted and size is correct.
 
-	remaining, err := os.ReadDir(cacheDir)
+	remaining, err := readObjects(cacheDir)
 	if err != nil {
 		t.Fatalf("ReadDir failed: %v", err)
 	}
@@ -59,7 +61,7 @@ func TestManager(t *testing.T) {
 
 	mgr.RunEviction()
 
-	remaining, err = os.ReadDir(cacheDir)
+	remaining, err = readObjects(cacheDir)
 	if err != nil {
 		t.Fatalf("ReadDir failed: %v", err)
 	}
@@ -68,6 +70,253 @@ func TestManager(t *testing.T) {
 	}
 }
 
+func TestManagerSaveStateMerges(t *testing.T) {
+	cacheDir := t.TempDir()
+	policies := []policy.Policy{&maxsize.Policy{MaxBytes: 50}}
+	for _, name := range []string{"a", "b"} {
+		createFile(t, cacheDir, name, 10)
+		old := time.Now().Add(-time.Hour)
+		if err := os.Chtimes(filepath.Join(cacheDir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a server and fetchurl gc sharing the cache dir
+	server := eviction.NewManager(cacheDir, policies, time.Minute, lru.New())
+	gc := eviction.NewManager(cacheDir, policies, time.Minute, lru.New())
+	for _, m := range []*eviction.Manager{server, gc} {
+		if err := m.LoadInitialState(); err != nil {
+			t.Fatalf("LoadInitialState failed: %v", err)
+		}
+	}
+
+	server.Touch("a")
+	if err := server.SaveState(); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	gc.Touch("b")
+	if err := gc.SaveState(); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	touchedA, _ := server.LastAccess("a")
+	touchedB, _ := gc.LastAccess("b")
+
+	restarted := eviction.NewManager(cacheDir, policies, time.Minute, lru.New())
+	if err := restarted.LoadInitialState(); err != nil {
+		t.Fatalf("LoadInitialState failed: %v", err)
+	}
+	if got, _ := restarted.LastAccess("a"); !got.Equal(touchedA) {
+		t.Errorf("expected the server's access to a to survive, got %v want %v", got, touchedA)
+	}
+	if got, _ := restarted.LastAccess("b"); !got.Equal(touchedB) {
+		t.Errorf("expected gc's access to b, got %v want %v", got, touchedB)
+	}
+}
+
+func TestManagerSaveStateRetriesAfterFailure(t *testing.T) {
+	cacheDir := t.TempDir()
+	createFile(t, cacheDir, "a", 10)
+	m := eviction.NewManager(cacheDir, nil, time.Minute, lru.New())
+	if err := m.LoadInitialState(); err != nil {
+		t.Fatalf("LoadInitialState failed: %v", err)
+	}
+	m.Touch("a")
+
+	// a directory in the way of the temp file makes the write fail
+	tmp := filepath.Join(cacheDir, eviction.StateFileName+".tmp")
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SaveState(); err == nil {
+		t.Fatal("expected SaveState to fail")
+	}
+	if err := os.Remove(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SaveState(); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, eviction.StateFileName)); err != nil {
+		t.Errorf("expected the failed save to be retried: %v", err)
+	}
+}
+
+func TestManagerPersistsRecency(t *testing.T) {
+	cacheDir := t.TempDir()
+	policies := []policy.Policy{&maxsize.Policy{MaxBytes: 50}}
+
+	now := time.Now()
+	for i, name := range []string{"a", "b", "c"} {
+		createFile(t, cacheDir, name, 20)
+		mtime := now.Add(time.Duration(i-3) * time.Hour)
+		if err := os.Chtimes(filepath.Join(cacheDir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// "a" is the oldest file but was just used
+	first := eviction.NewManager(cacheDir, policies, time.Minute, lru.New())
+	if err := first.LoadInitialState(); err != nil {
+		t.Fatalf("LoadInitialState failed: %v", err)
+	}
+	first.Touch("a")
+	if err := first.SaveState(); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+
+	restarted := eviction.NewManager(cacheDir, policies, time.Minute, lru.New())
+	if err := restarted.LoadInitialState(); err != nil {
+		t.Fatalf("LoadInitialState failed: %v", err)
+	}
+	restarted.RunEviction()
+
+	if _, err := os.Stat(filepath.Join(cacheDir, "a")); err != nil {
+		t.Errorf("recently used file was evicted after restart: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "b")); !os.IsNotExist(err) {
+		t.Errorf("expected least recently used file to be evicted, got %v", err)
+	}
+}
+
+func TestManagerPlan(t *testing.T) {
+	cacheDir := t.TempDir()
+	policies := []policy.Policy{&maxsize.Policy{MaxBytes: 50}}
+	mgr := eviction.NewManager(cacheDir, policies, time.Minute, lru.New())
+
+	createFile(t, cacheDir, "file1", 20)
+	createFile(t, cacheDir, "file2", 20)
+	createFile(t, cacheDir, "file3", 20)
+	if err := mgr.LoadInitialState(); err != nil {
+		t.Fatalf("LoadInitialState failed: %v", err)
+	}
+
+	plan := mgr.Plan()
+	if len(plan.Demands) != 1 || plan.Demands[0].BytesToFree != 10 {
+		t.Errorf("expected one policy asking for 10 bytes, got %+v", plan.Demands)
+	}
+	if len(plan.Victims) != 1 || plan.TargetBytes != 50 {
+		t.Errorf("expected 1 victim and target 50, got %+v", plan)
+	}
+
+	remaining, err := readObjects(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 3 {
+		t.Errorf("Plan must not delete anything, %d files left", len(remaining))
+	}
+}
+
+func TestManagerGracePeriod(t *testing.T) {
+	cacheDir := t.TempDir()
+	policies := []policy.Policy{&maxsize.Policy{MaxBytes: 10}}
+	mgr := eviction.NewManager(cacheDir, policies, time.Minute, lru.New())
+	mgr.SetGracePeriod(time.Hour)
+
+	createFile(t, cacheDir, "old1", 20)
+	createFile(t, cacheDir, "old2", 20)
+	if err := mgr.LoadInitialState(); err != nil {
+		t.Fatalf("LoadInitialState failed: %v", err)
+	}
+	createFile(t, cacheDir, "new", 20)
+	mgr.Add("new", 20)
+
+	summary := mgr.RunEviction()
+	if summary.Evicted != 2 {
+		t.Errorf("expected 2 evictions, got %+v", summary)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "new")); err != nil {
+		t.Errorf("entry within grace period was evicted: %v", err)
+	}
+}
+
+func TestManagerLinks(t *testing.T) {
+	cacheDir := t.TempDir()
+	policies := []policy.Policy{&maxsize.Policy{MaxBytes: 30}}
+	mgr := eviction.NewManager(cacheDir, policies, time.Minute, lru.New())
+
+	createFile(t, cacheDir, "a", 20)
+	createFile(t, cacheDir, "b", 20)
+	for _, alias := range []string{"a1", "a2"} {
+		if err := os.Link(filepath.Join(cacheDir, "a"), filepath.Join(cacheDir, alias)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mgr.LoadInitialState(); err != nil {
+		t.Fatalf("LoadInitialState failed: %v", err)
+	}
+	if stats := mgr.Stats(); stats.Objects != 2 || stats.Bytes != 40 {
+		t.Fatalf("expected hard links to count once, got %+v", stats)
+	}
+
+	// Touching an alias keeps its object, so b is the least recently used
+	mgr.Touch("b")
+	mgr.Touch("a2")
+	summary := mgr.RunEviction()
+	if summary.Evicted != 1 || summary.FreedBytes != 20 {
+		t.Errorf("expected one 20 byte eviction, got %+v", summary)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "b")); !os.IsNotExist(err) {
+		t.Errorf("expected b to be evicted, got %v", err)
+	}
+
+	// Deleting names one by one frees the bytes once, with the last name
+	mgr.Remove("a", 20)
+	if stats := mgr.Stats(); stats.Bytes != 20 {
+		t.Errorf("removing one name of a linked object freed its bytes: %+v", stats)
+	}
+	mgr.Remove("a1", 20)
+	mgr.Remove("a2", 20)
+	if stats := mgr.Stats(); stats.Objects != 0 || stats.Bytes != 0 {
+		t.Errorf("expected an empty cache, got %+v", stats)
+	}
+}
+
+func TestManagerEvictsLinks(t *testing.T) {
+	cacheDir := t.TempDir()
+	policies := []policy.Policy{&maxsize.Policy{MaxBytes: 10}}
+	mgr := eviction.NewManager(cacheDir, policies, time.Minute, lru.New())
+
+	createFile(t, cacheDir, "a", 20)
+	mgr.Add("a", 20)
+	if err := os.Link(filepath.Join(cacheDir, "a"), filepath.Join(cacheDir, "a1")); err != nil {
+		t.Fatal(err)
+	}
+	mgr.Link("a", "a1")
+	var evicted []string
+	mgr.SetOnEvict(func(key string) { evicted = append(evicted, key) })
+
+	summary := mgr.RunEviction()
+	if summary.Evicted != 1 || summary.CurrentBytes != 0 {
+		t.Errorf("expected the object to be evicted once, got %+v", summary)
+	}
+	remaining, err := readObjects(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 0 {
+		t.Errorf("expected the alias to be evicted with its object, %d files left", len(remaining))
+	}
+	if !slices.Equal(evicted, []string{"a", "a1"}) {
+		t.Errorf("expected OnEvict to see the object and its alias, got %v", evicted)
+	}
+}
+
+// readObjects lists cached objects, leaving out hidden bookkeeping files like the cache lock.
+func readObjects(dir string) ([]os.DirEntry, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var objects []os.DirEntry
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ".") {
+			objects = append(objects, e)
+		}
+	}
+	return objects, nil
+}
+
 func createFile(t *testing.T, dir, name string, size int64) {
 	path := filepath.Join(dir, name)
 	f, err := os.Create(path)
@@ -1,5 +1,7 @@
 package maxsize
 
+import "fmt"
+
 // Policy triggers eviction when cache exceeds a fixed size.
 type Policy struct {
 	MaxBytes int64
@@ -11,3 +13,7 @@ func (m *Policy) BytesToFree(currentSize int64) (int64, error) {
 	}
 	return 0, nil
 }
+
+func (m *Policy) String() string {
+	return fmt.Sprintf("max-cache-size %d bytes", m.MaxBytes)
+}
@@ -29,3 +29,7 @@ func (m *Policy) BytesToFree(currentSize int64) (int64, error) {
 	}
 	return 0, nil
 }
+
+func (m *Policy) String() string {
+	return fmt.Sprintf("min-free-space %d bytes on %s", m.MinFreeBytes, m.Path)
+}
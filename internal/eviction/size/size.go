@@ -0,0 +1,109 @@
+package size
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/lucasew/fetchurl/internal/eviction"
+)
+
+// Size implements the eviction.Strategy interface by evicting the biggest,
+// least recently used items first.
+//
+// Each item is scored by its size multiplied by the number of accesses to
+// other items since it was last used. A few large stale objects therefore go
+// before many small ones, while a large object that is still in use survives.
+type Size struct {
+	mu    sync.Mutex
+	clock uint64
+	items map[string]*entry
+}
+
+type entry struct {
+	size     int64
+	lastUsed uint64
+}
+
+func init() {
+	eviction.Register("size", func() eviction.Strategy {
+		return New()
+	})
+}
+
+func New() *Size {
+	return &Size{
+		items: make(map[string]*entry),
+	}
+}
+
+// OnAdd adds a new item or updates an existing one, marking it as just used.
+//
+// Returns the difference in size (new size - old size, or just new size if added).
+func (s *Size) OnAdd(key string, size int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clock++
+	if ent, ok := s.items[key]; ok {
+		oldSize := ent.size
+		ent.size = size
+		ent.lastUsed = s.clock
+		return size - oldSize
+	}
+	s.items[key] = &entry{size: size, lastUsed: s.clock}
+	return size
+}
+
+// OnAccess marks an item as recently used.
+func (s *Size) OnAccess(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ent, ok := s.items[key]; ok {
+		s.clock++
+		ent.lastUsed = s.clock
+	}
+}
+
+func (s *Size) Remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.items, key)
+}
+
+// GetVictims returns the highest scoring items until the target size is reached.
+//
+// Note: This method does NOT remove the items; the caller must explicitly call Remove().
+func (s *Size) GetVictims(currentSize int64, targetSize int64) []eviction.Victim {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type candidate struct {
+		key   string
+		size  int64
+		score float64
+	}
+	candidates := make([]candidate, 0, len(s.items))
+	for key, ent := range s.items {
+		age := float64(s.clock-ent.lastUsed) + 1
+		candidates = append(candidates, candidate{key: key, size: ent.size, score: float64(ent.size) * age})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].key < candidates[j].key
+	})
+
+	var victims []eviction.Victim
+	size := currentSize
+	for _, c := range candidates {
+		if size <= targetSize {
+			break
+		}
+		victims = append(victims, eviction.Victim{Key: c.key, Size: c.size})
+		size -= c.size
+	}
+	return victims
+}
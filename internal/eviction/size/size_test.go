@@ -0,0 +1,38 @@
+package size
+
+import (
+	"testing"
+)
+
+func TestSize(t *testing.T) {
+	s := New()
+
+	// Many small packages and one big image, all used once
+	s.OnAdd("iso", 1000)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		s.OnAdd(key, 10)
+	}
+
+	// Total 1040, need to get under 500: the image goes, small files stay
+	victims := s.GetVictims(1040, 500)
+	if len(victims) != 1 || victims[0].Key != "iso" {
+		t.Fatalf("expected only iso to be evicted, got %v", victims)
+	}
+
+	// A big object that keeps being used outlives stale small ones
+	s.Remove("iso")
+	s.OnAdd("model", 40)
+	for range 10 {
+		s.OnAccess("model")
+	}
+	// Total 80, need to free 30: the stale small files go first
+	victims = s.GetVictims(80, 50)
+	if len(victims) != 3 {
+		t.Fatalf("expected 3 victims, got %v", victims)
+	}
+	for _, v := range victims {
+		if v.Key == "model" {
+			t.Errorf("recently used big object should not be evicted")
+		}
+	}
+}
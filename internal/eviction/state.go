@@ -0,0 +1,148 @@
+package eviction
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/cachelock"
+	"github.com/lucasew/fetchurl/internal/errutil"
+)
+
+// StateFileName is the sidecar, relative to the cache dir, where last access
+// times are persisted so eviction order survives restarts.
+const StateFileName = ".access"
+
+// recordAccess notes that key was used at now.
+func (m *Manager) recordAccess(key string, now time.Time) {
+	m.accessMu.Lock()
+	defer m.accessMu.Unlock()
+	if m.access == nil {
+		m.access = make(map[string]int64)
+	}
+	m.access[key] = now.UnixNano()
+	m.accessVersion++
+}
+
+// LastAccess returns when key was last added or read, if known.
+func (m *Manager) LastAccess(key string) (time.Time, bool) {
+	key = m.primaryKey(key)
+	m.accessMu.Lock()
+	defer m.accessMu.Unlock()
+	ts, ok := m.access[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ts), true
+}
+
+func (m *Manager) forgetAccess(key string) {
+	m.accessMu.Lock()
+	defer m.accessMu.Unlock()
+	delete(m.access, key)
+	m.accessVersion++
+}
+
+// SaveState persists last access times to StateFileName if they changed since the last save.
+//
+// Other processes sharing the cache dir, like fetchurl gc next to a server,
+// save to the same file, so it is rewritten under the cache lock and merged
+// with what they saved: the latest access of each key wins, and keys this
+// manager doesn't track are kept while their file exists.
+func (m *Manager) SaveState() error {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+
+	m.accessMu.Lock()
+	if m.accessVersion == m.savedVersion {
+		m.accessMu.Unlock()
+		return nil
+	}
+	version := m.accessVersion
+	times := maps.Clone(m.access)
+	m.accessMu.Unlock()
+	if times == nil {
+		times = make(map[string]int64)
+	}
+
+	unlock, err := cachelock.Exclusive(m.cacheDir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errutil.LogMsg(unlock(), "Failed to release cache lock")
+	}()
+
+	saved, err := m.loadState()
+	if err != nil {
+		errutil.LogMsg(err, "Failed to load eviction state, overwriting it")
+		saved = nil
+	}
+	for key, ts := range saved {
+		if ours, ok := times[key]; ok {
+			times[key] = max(ours, ts)
+		} else if _, err := os.Stat(filepath.Join(m.cacheDir, key)); err == nil {
+			times[key] = ts
+		}
+	}
+
+	var b strings.Builder
+	for key, ts := range times {
+		fmt.Fprintf(&b, "%d %s\n", ts, key)
+	}
+	path := filepath.Join(m.cacheDir, StateFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write eviction state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		errutil.LogMsg(os.Remove(tmp), "Failed to remove temp eviction state", "path", tmp)
+		return fmt.Errorf("failed to write eviction state: %w", err)
+	}
+
+	m.accessMu.Lock()
+	m.savedVersion = version
+	m.accessMu.Unlock()
+	return nil
+}
+
+// loadState reads the persisted access times, returning an empty map if there are none.
+func (m *Manager) loadState() (map[string]int64, error) {
+	f, err := os.Open(filepath.Join(m.cacheDir, StateFileName))
+	if os.IsNotExist(err) {
+		return map[string]int64{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		errutil.LogMsg(f.Close(), "Failed to close eviction state")
+	}()
+
+	times := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		tsStr, key, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		ts, err := strconv.ParseInt(tsStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		times[key] = ts
+	}
+	return times, scanner.Err()
+}
+
+type loadedFile struct {
+	key  string
+	size int64
+	ts   int64
+	info os.FileInfo
+}
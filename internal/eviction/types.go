@@ -8,8 +8,8 @@ type FileMetadata struct {
 
 // Victim represents a file to be evicted.
 type Victim struct {
-	Key  string
-	Size int64
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
 }
 
 // Strategy defines the interface for eviction strategies.
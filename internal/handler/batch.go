@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/hashutil"
+	"github.com/lucasew/fetchurl/internal/sourceurls"
+)
+
+// BatchPath is where batch fetches are posted, relative to the handler.
+const BatchPath = "/batch"
+
+const (
+	maxBatchItems    = 1000
+	maxBatchBody     = 4 << 20
+	batchConcurrency = 8
+)
+
+// BatchItem is one object requested in a batch.
+type BatchItem struct {
+	Algo string `json:"algo"`
+	// Hash is a hex digest or a Subresource Integrity string.
+	Hash string `json:"hash"`
+	// Size, if positive, is the size the object must have.
+	Size int64    `json:"size,omitempty"`
+	URLs []string `json:"urls"`
+}
+
+// handleBatch answers a JSON list of BatchItem with a tar stream holding each
+// object as {algo}/{hash}, in request order. Objects that could not be
+// fetched are left out and listed with their error in a trailing errors.json.
+//
+// Up to batchConcurrency objects are fetched at once while earlier ones are
+// being streamed.
+func (h *CASHandler) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var items []BatchItem
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody)).Decode(&items); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid batch: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(items) > maxBatchItems {
+		http.Error(w, fmt.Sprintf("Too many objects in batch, at most %d are allowed", maxBatchItems), http.StatusBadRequest)
+		return
+	}
+	for i, item := range items {
+		if algo, hash, ok := hashutil.ParseSRI(item.Hash); ok {
+			items[i].Algo, items[i].Hash = algo, hash
+			continue
+		}
+		items[i].Algo = hashutil.NormalizeAlgo(item.Algo)
+		if !hashutil.IsSupported(items[i].Algo) || item.Hash == "" || path.Base(item.Hash) != item.Hash {
+			http.Error(w, fmt.Sprintf("Invalid object %s/%s", item.Algo, item.Hash), http.StatusBadRequest)
+			return
+		}
+	}
+
+	results := make([]chan error, len(items))
+	for i := range results {
+		results[i] = make(chan error, 1)
+	}
+	sem := make(chan struct{}, batchConcurrency)
+	go func() {
+		for i, item := range items {
+			select {
+			case sem <- struct{}{}:
+			case <-r.Context().Done():
+				results[i] <- r.Context().Err()
+				continue
+			}
+			go func(i int, item BatchItem) {
+				defer func() { <-sem }()
+				results[i] <- h.ensureCached(r.Context(), item.Algo, item.Hash, item.Size, item.URLs)
+			}(i, item)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.WriteHeader(http.StatusOK)
+	tw := tar.NewWriter(w)
+	failures := map[string]string{}
+	for i, item := range items {
+		name := item.Algo + "/" + item.Hash
+		err := <-results[i]
+		if err == nil {
+			err = h.writeBatchEntry(r.Context(), tw, name, item.Algo, item.Hash)
+		}
+		if errors.Is(err, errBatchStream) {
+			// Part of an entry is already out, the stream can't be recovered
+			errutil.LogMsg(err, "Batch stream failed", "object", name)
+			panic(http.ErrAbortHandler)
+		}
+		if err != nil {
+			errutil.LogMsg(err, "Batch fetch failed", "object", name)
+			failures[name] = err.Error()
+		}
+	}
+	if len(failures) > 0 {
+		data, err := json.Marshal(failures)
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: "errors.json", Mode: 0644, Size: int64(len(data))})
+		}
+		if err == nil {
+			_, err = tw.Write(data)
+		}
+		if err != nil {
+			errutil.LogMsg(err, "Failed to write batch errors")
+			panic(http.ErrAbortHandler)
+		}
+	}
+	errutil.LogMsg(tw.Close(), "Failed to finish batch stream")
+}
+
+var errBatchStream = errors.New("batch stream failed")
+
+// writeBatchEntry copies a cached object into tw as name.
+func (h *CASHandler) writeBatchEntry(ctx context.Context, tw *tar.Writer, name, algo, hash string) error {
+	reader, size, err := h.Local.Get(ctx, algo, hash)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errutil.LogMsg(reader.Close(), "Failed to close cache reader")
+	}()
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size}); err != nil {
+		return fmt.Errorf("%w: %w", errBatchStream, err)
+	}
+	if _, err := io.CopyN(tw, reader, size); err != nil {
+		return fmt.Errorf("%w: %w", errBatchStream, err)
+	}
+	return nil
+}
+
+// ensureCached fetches algo/hash into the cache from urls unless it's already
+// there. size, if positive, is the size the object must have.
+func (h *CASHandler) ensureCached(ctx context.Context, algo, hash string, size int64, urls []string) (err error) {
+	exists, err := h.Local.Exists(ctx, algo, hash)
+	if err != nil {
+		return err
+	}
+	if exists {
+		h.stats.hits.Add(1)
+		return nil
+	}
+	h.stats.misses.Add(1)
+
+	candidates := make([]sourceurls.Source, len(urls))
+	for i, url := range urls {
+		candidates[i] = sourceurls.Source{URL: url}
+	}
+	sources, refused := h.collectSources(algo, hash, candidates)
+	if len(sources) == 0 {
+		if refused > 0 {
+			return fmt.Errorf("all sources point to disallowed hosts")
+		}
+		return fmt.Errorf("not found and no sources provided")
+	}
+
+	defer func() {
+		// Sources failing verification abort the download with a panic
+		if p := recover(); p != nil {
+			err = fmt.Errorf("fetch aborted: %v", p)
+		}
+	}()
+	headersWritten := false
+	_, err, _ = h.do(algo+":"+hash, func() (interface{}, error) {
+		return nil, h.fetchAndStream(h.fetchContext(ctx), &discardResponse{}, algo, hash, size, sources, candidates, &headersWritten)
+	})
+	return err
+}
+
+// discardResponse is a ResponseWriter for fetches that only fill the cache.
+type discardResponse struct {
+	header http.Header
+}
+
+func (d *discardResponse) Header() http.Header {
+	if d.header == nil {
+		d.header = make(http.Header)
+	}
+	return d.header
+}
+
+func (d *discardResponse) Write(p []byte) (int, error) { return len(p), nil }
+
+func (d *discardResponse) WriteHeader(int) {}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/repository"
+)
+
+var errDownloadFailed = errors.New("download failed")
+
+// download tracks an in-progress fetch so concurrent requests for the same
+// object can stream it from the temp file as it is written, instead of
+// waiting for the whole download to finish.
+type download struct {
+	path  string // temp file being written
+	total int64
+	meta  repository.Metadata
+	// status and source are reported to followers in X-Cache and X-Fetch-Source
+	status string
+	source string
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	written   int64
+	followers int64
+	done      bool
+	err       error
+}
+
+// Write records that p has been written to the temp file and wakes followers.
+func (d *download) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	d.written += int64(len(p))
+	d.mu.Unlock()
+	d.cond.Broadcast()
+	return len(p), nil
+}
+
+func (d *download) finish(err error) {
+	d.mu.Lock()
+	d.done = true
+	d.err = err
+	d.mu.Unlock()
+	d.cond.Broadcast()
+}
+
+// wait blocks until more than pos bytes are written or the download ends.
+func (d *download) wait(pos int64) (written int64, done bool, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for d.written <= pos && !d.done {
+		d.cond.Wait()
+	}
+	return d.written, d.done, d.err
+}
+
+// startDownload registers the download of key into the temp file at path,
+// which already holds offset bytes. The returned function unregisters it and
+// reports the outcome to followers.
+func (h *CASHandler) startDownload(key, path string, offset, total int64, meta repository.Metadata, status, source string) (*download, func(err error)) {
+	d := &download{path: path, total: total, meta: meta, status: status, source: source, written: offset}
+	d.cond = sync.NewCond(&d.mu)
+
+	h.downloadsMu.Lock()
+	if h.downloads == nil {
+		h.downloads = make(map[string]*download)
+	}
+	h.downloads[key] = d
+	h.downloadsMu.Unlock()
+
+	return d, func(err error) {
+		h.downloadsMu.Lock()
+		delete(h.downloads, key)
+		h.downloadsMu.Unlock()
+		d.finish(err)
+	}
+}
+
+func (h *CASHandler) activeDownload(key string) *download {
+	h.downloadsMu.Lock()
+	defer h.downloadsMu.Unlock()
+	return h.downloads[key]
+}
+
+// follow streams an in-progress download to w as the leader writes it.
+//
+// Like the leader, it aborts the connection if the download fails, so clients
+// never mistake a truncated or mismatched stream for a complete one.
+func (h *CASHandler) follow(w http.ResponseWriter, r *http.Request, algo, hash string, d *download) {
+	f, err := os.Open(d.path)
+	if err != nil {
+		// The leader already committed and moved the temp file away
+		if _, _, err := d.wait(math.MaxInt64); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to fetch: %v", err), http.StatusBadGateway)
+			return
+		}
+		h.serveFromCache(w, r, algo, hash)
+		return
+	}
+	defer func() {
+		errutil.LogMsg(f.Close(), "Failed to close temp file")
+	}()
+	d.mu.Lock()
+	d.followers++
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.followers--
+		d.mu.Unlock()
+	}()
+
+	h.setCacheHeaders(w, algo, hash)
+	setMetadataHeaders(w, d.meta)
+	setCacheStatus(w, d.status, d.source)
+	if d.total > 0 {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", d.total))
+	}
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	var pos int64
+	defer func() {
+		h.stats.recordSaved(pos)
+	}()
+	for {
+		written, done, err := d.wait(pos)
+		if written > pos {
+			n, copyErr := io.Copy(w, io.NewSectionReader(f, pos, written-pos))
+			pos += n
+			if copyErr != nil {
+				errutil.LogMsg(copyErr, "Failed to stream download to follower")
+				return
+			}
+			// Push what we have now instead of waiting for the buffer to fill
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				errutil.LogMsg(err, "Failed to flush download to follower")
+			}
+			continue
+		}
+		if done {
+			if err != nil {
+				panic(http.ErrAbortHandler)
+			}
+			return
+		}
+	}
+}
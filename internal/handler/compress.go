@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+)
+
+// compressibleTypes are the media types, or type prefixes ending in "/",
+// worth compressing. Archives and images are usually compressed already.
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/x-tar",
+	"image/svg+xml",
+}
+
+// compressible reports whether content of the given type is worth compressing.
+// Opaque types are decided by sniffing the first bytes of br.
+func compressible(contentType string, br *bufio.Reader) bool {
+	if contentType == "" || contentType == "application/octet-stream" {
+		head, err := br.Peek(512)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			return false
+		}
+		contentType = http.DetectContentType(head)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range compressibleTypes {
+		if mediaType == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip reports whether r's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if coding = strings.TrimSpace(coding); coding != "gzip" && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// serveGzip answers r with content compressed on the fly.
+func serveGzip(w http.ResponseWriter, r *http.Request, content io.Reader, hash string) {
+	// The compressed representation gets its own validator
+	etag := fmt.Sprintf("%q", hash+"+gzip")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Encoding", "gzip")
+	if match := r.Header.Get("If-None-Match"); match == etag || match == "*" {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := io.Copy(gz, content); err != nil {
+		errutil.LogMsg(err, "Failed to stream compressed file", "hash", hash)
+		panic(http.ErrAbortHandler)
+	}
+	errutil.LogMsg(gz.Close(), "Failed to finish compressed stream", "hash", hash)
+}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/repository"
+)
+
+// handleDelete purges algo/hash and its aliases from the cache, e.g. when a
+// bad artifact got cached. It requires the same token as uploads.
+func (h *CASHandler) handleDelete(w http.ResponseWriter, r *http.Request, algo, hash string) {
+	deleter, ok := h.Local.(repository.DeletableRepository)
+	if !h.writesEnabled() || !ok {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Deletes are disabled", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizedUpload(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="fetchurl"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Wait for fetches of the object to finish, so it isn't recommitted after the delete
+	err := h.exclusive(algo+":"+hash, func() error {
+		return deleter.Delete(r.Context(), algo, hash)
+	})
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "Not found", http.StatusNotFound)
+	default:
+		errutil.ReportError(err, "Delete failed", "hash", hash)
+		http.Error(w, fmt.Sprintf("Delete failed: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -1,32 +1,83 @@
 package handler
 
 import (
+	"bufio"
 	"context"
+	"encoding"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/lucasew/fetchurl/internal/errutil"
 	"github.com/lucasew/fetchurl/internal/hashutil"
+	"github.com/lucasew/fetchurl/internal/hostfilter"
+	"github.com/lucasew/fetchurl/internal/ipfs"
+	"github.com/lucasew/fetchurl/internal/magnet"
+	"github.com/lucasew/fetchurl/internal/ratelimit"
 	"github.com/lucasew/fetchurl/internal/repository"
-	"github.com/shogo82148/go-sfv"
+	"github.com/lucasew/fetchurl/internal/requestid"
+	"github.com/lucasew/fetchurl/internal/sourceurls"
+	"github.com/lucasew/fetchurl/internal/urltemplate"
 	"golang.org/x/sync/singleflight"
 )
 
 type CASHandler struct {
-	Local     *repository.LocalRepository
+	Local     repository.WritableRepository
 	Client    *http.Client
 	Upstreams []string
 	AppCtx    context.Context // Application context (from Cobra), not request context
-	g         singleflight.Group
+	// IPFSGateway resolves ipfs:// and ipns:// sources. Defaults to ipfs.DefaultGateway.
+	IPFSGateway string
+	// OnStored, if set, is called after an object is committed to Local.
+	OnStored func(algo, hash string)
+	// Hosts, if set, restricts which hosts X-Source-Urls candidates may point to.
+	// Configured upstreams are trusted and not checked.
+	Hosts *hostfilter.Filter
+	// UpstreamBandwidth, if set, caps how fast objects are downloaded from
+	// sources, shared by all downloads.
+	UpstreamBandwidth *ratelimit.Bandwidth
+	// Compress gzips cached objects that look like text for clients accepting it.
+	// Only gzip is offered; zstd has no encoder in the standard library.
+	Compress bool
+	// RedirectMinSize, if positive, makes GET requests for objects at least
+	// this big answer with a redirect instead of proxying the bytes: to a
+	// presigned storage URL when cached, or to an upstream that has them.
+	RedirectMinSize int64
+	// RedirectExpiry is how long presigned URLs stay valid. Defaults to 15 minutes.
+	RedirectExpiry time.Duration
+	// SlowSource, if positive, is the mean time to response headers over the
+	// latest fetches at which a source is reported as degraded. Sources
+	// failing half of their latest fetches are reported regardless.
+	SlowSource time.Duration
+	// ProbeOnHead makes HEAD requests for uncached objects ask the sources
+	// whether they have it instead of downloading it.
+	ProbeOnHead bool
+	// UploadToken enables PUT uploads and DELETE for clients sending it as a
+	// bearer token. Both are refused when empty.
+	UploadToken string
+	// AuthorizeWrite, if set, replaces UploadToken to decide which requests
+	// may PUT and DELETE.
+	AuthorizeWrite func(r *http.Request) bool
+	g              singleflight.Group
+	stats          stats
+
+	downloadsMu sync.Mutex
+	downloads   map[string]*download // in-progress fetches by singleflight key
+	flights     map[string]int       // callers of h.g by key
+	keyLocks    map[string]*keyLock  // serializes fetches, uploads and deletes by key
 }
 
-func NewCASHandler(local *repository.LocalRepository, client *http.Client, upstreams []string, appCtx context.Context) *CASHandler {
+func NewCASHandler(local repository.WritableRepository, client *http.Client, upstreams []string, appCtx context.Context) *CASHandler {
 	if client == nil {
 		client = http.DefaultClient
 	}
@@ -39,81 +90,113 @@ func NewCASHandler(local *repository.LocalRepository, client *http.Client, upstr
 }
 
 func (h *CASHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == BatchPath {
+		h.handleBatch(w, r)
+		return
+	}
+
 	// Expected path: /{algo}/{hash} (stripped prefix)
-	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
-	if len(parts) != 2 {
+	path, verify := strings.CutSuffix(r.URL.Path, "/verify")
+	algo, hash, ok := parseCASPath(path)
+	if !ok {
 		http.Error(w, "Invalid path format. Expected /{algo}/{hash}", http.StatusBadRequest)
 		return
 	}
-	algo := hashutil.NormalizeAlgo(parts[0])
-	hash := parts[1]
 
 	if !hashutil.IsSupported(algo) {
 		http.Error(w, fmt.Sprintf("Unsupported hash algorithm: %s", algo), http.StatusBadRequest)
 		return
 	}
 
+	if verify {
+		h.handleVerify(w, r, algo, hash)
+		return
+	}
+
+	size, err := parseSize(r.URL.Query().Get("size"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		h.handleUpload(w, r, algo, hash)
+		return
+	case http.MethodDelete:
+		h.handleDelete(w, r, algo, hash)
+		return
+	}
+
+	if r.Method == http.MethodGet && h.RedirectMinSize > 0 && h.redirect(w, r, algo, hash) {
+		return
+	}
+
 	// 1. Try Local Cache
+	lookupStart := time.Now()
 	exists, err := h.Local.Exists(r.Context(), algo, hash)
 	if err != nil {
 		errutil.ReportError(err, "Failed to check cache existence")
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	addServerTiming(w, "cache", lookupStart)
 
 	if exists {
+		h.stats.hits.Add(1)
 		h.serveFromCache(w, r, algo, hash)
 		return
 	}
 
 	// 2. Cache Miss -> Fetch & Stream
+	h.stats.misses.Add(1)
 
 	// Collect candidates
 	candidateSources := h.parseSourceUrls(r.Header)
-
-	// Collect sources to try (Upstreams + Candidates)
-	var sourcesToTry []string
-
-	// Add configured upstreams first
-	for _, u := range h.Upstreams {
-		// Construct CAS URL for upstream
-		// Assume upstream is a base URL like http://cache.local:8080
-		// We need to append /api/fetchurl/{algo}/{hash}
-		// Ensure trailing slash handling
-		base := strings.TrimRight(u, "/")
-		sourceUrl := fmt.Sprintf("%s/api/fetchurl/%s/%s", base, algo, hash)
-		sourcesToTry = append(sourcesToTry, sourceUrl)
-	}
-
-	// Add dynamic sources from headers (shuffled per DESIGN.md constraint 3)
-	rand.Shuffle(len(candidateSources), func(i, j int) {
-		candidateSources[i], candidateSources[j] = candidateSources[j], candidateSources[i]
-	})
-	sourcesToTry = append(sourcesToTry, candidateSources...)
+	sourcesToTry, refused := h.collectSources(algo, hash, candidateSources)
 
 	if len(sourcesToTry) == 0 {
+		if refused > 0 {
+			http.Error(w, "Not found and all X-Source-Urls point to disallowed hosts", http.StatusForbidden)
+			return
+		}
 		http.Error(w, "Not found and no X-Source-Urls provided", http.StatusNotFound)
 		return
 	}
 
+	if r.Method == http.MethodHead && h.ProbeOnHead {
+		h.serveProbe(w, r, algo, hash, size, sourcesToTry, candidateSources)
+		return
+	}
+
 	sfKey := algo + ":" + hash
 
+	// Stream along with a download that is already flowing rather than wait for it to finish
+	if d := h.activeDownload(sfKey); d != nil {
+		h.follow(w, r, algo, hash, d)
+		return
+	}
+
 	// Capture if headers were written inside the leader execution
 	headersWritten := false
 
-	_, err, shared := h.g.Do(sfKey, func() (interface{}, error) {
-		err := h.fetchAndStream(h.AppCtx, w, algo, hash, sourcesToTry, candidateSources, &headersWritten)
+	_, err, shared := h.do(sfKey, func() (interface{}, error) {
+		err := h.fetchAndStream(h.fetchContext(r.Context()), w, algo, hash, size, sourcesToTry, candidateSources, &headersWritten)
 		return nil, err
 	})
 
 	if err != nil {
 		// If error occurred and we haven't written headers yet, send error response
 		if !headersWritten {
-			errutil.ReportError(err, "Fetch failed")
-			http.Error(w, fmt.Sprintf("Failed to fetch: %v", err), http.StatusBadGateway)
+			errutil.ReportErrorContext(r.Context(), err, "Fetch failed")
+			status := http.StatusBadGateway
+			if errors.Is(err, repository.ErrInsufficientSpace) {
+				status = http.StatusInsufficientStorage
+			}
+			http.Error(w, fmt.Sprintf("Failed to fetch: %v", err), status)
 		} else {
 			// Headers already written, connection might be aborted or partial.
-			errutil.ReportError(err, "Fetch failed after headers written")
+			errutil.ReportErrorContext(r.Context(), err, "Fetch failed after headers written")
 		}
 		return
 	}
@@ -125,6 +208,94 @@ func (h *CASHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// davPrefix marks upstreams that are plain file servers (WebDAV, Artifactory
+// generic repos, nginx autoindex) laid out as {algo}/{hash}, rather than fetchurl servers.
+const davPrefix = "dav+"
+
+// collectSources returns the sources to try for algo/hash: the configured
+// upstreams first, then the allowed candidates in random order. It also
+// reports how many candidates the host filter refused.
+//
+// candidateSources is shuffled in place.
+func (h *CASHandler) collectSources(algo, hash string, candidateSources []sourceurls.Source) ([]string, int) {
+	var sourcesToTry []string
+
+	// Add configured upstreams first
+	for _, u := range h.Upstreams {
+		sourcesToTry = append(sourcesToTry, upstreamURL(u, algo, hash))
+	}
+
+	// Add dynamic sources from headers (shuffled per DESIGN.md constraint 3)
+	rand.Shuffle(len(candidateSources), func(i, j int) {
+		candidateSources[i], candidateSources[j] = candidateSources[j], candidateSources[i]
+	})
+	// Magnet URIs are forwarded as-is but fetched through their HTTP web seeds
+	refused := 0
+	for _, source := range magnet.Expand(sourceurls.URLs(candidateSources)) {
+		if err := h.Hosts.CheckURL(ipfs.ResolveURL(source, h.IPFSGateway)); err != nil {
+			errutil.LogMsg(err, "Refusing source", "url", source)
+			refused++
+			continue
+		}
+		sourcesToTry = append(sourcesToTry, source)
+	}
+	return sourcesToTry, refused
+}
+
+// upstreamURL builds the URL of an object on an upstream.
+//
+// A fetchurl upstream is a base URL like http://cache.local:8080 and objects
+// live under /api/fetchurl/{algo}/{hash}. A plain file server upstream is
+// written as dav+https://mirror/path and objects live under /path/{algo}/{hash}.
+// Any other layout is given as a template like https://mirror/{hash:0:2}/{hash}.
+func upstreamURL(upstream, algo, hash string) string {
+	if urltemplate.IsTemplate(upstream) {
+		return urltemplate.Expand(strings.TrimPrefix(upstream, davPrefix), algo, hash)
+	}
+	if base, ok := strings.CutPrefix(upstream, davPrefix); ok {
+		return fmt.Sprintf("%s/%s/%s", strings.TrimRight(base, "/"), algo, hash)
+	}
+	base := strings.TrimRight(upstream, "/")
+	return fmt.Sprintf("%s/api/fetchurl/%s/%s", base, algo, hash)
+}
+
+// errSizeMismatch is returned for sources whose content isn't of the size
+// the client expects.
+var errSizeMismatch = errors.New("size mismatch")
+
+// parseSize parses the optional size query parameter, returning 0 if absent.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return size, nil
+}
+
+// parseCASPath extracts the algorithm and hex digest from a request path.
+// Besides /{algo}/{hash}, the digest may be given as a Subresource Integrity
+// string, either alone (/{sri}) or after its algorithm (/{algo}/{sri}).
+// Base64 digests may contain '/', so SRI forms are checked on the whole path.
+func parseCASPath(path string) (algo, hash string, ok bool) {
+	path = strings.Trim(path, "/")
+	if algo, hash, ok := hashutil.ParseSRI(path); ok {
+		return algo, hash, true
+	}
+	if prefix, rest, found := strings.Cut(path, "/"); found {
+		if algo, hash, ok := hashutil.ParseSRI(rest); ok && algo == hashutil.NormalizeAlgo(prefix) {
+			return algo, hash, true
+		}
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return hashutil.NormalizeAlgo(parts[0]), parts[1], true
+}
+
 func (h *CASHandler) serveFromCache(w http.ResponseWriter, r *http.Request, algo, hash string) {
 	reader, size, err := h.Local.Get(r.Context(), algo, hash)
 	if err != nil {
@@ -135,75 +306,298 @@ func (h *CASHandler) serveFromCache(w http.ResponseWriter, r *http.Request, algo
 	defer func() {
 		errutil.LogMsg(reader.Close(), "Failed to close cache reader")
 	}()
+	cw := &countingResponse{ResponseWriter: w}
+	w = cw
+	defer func() {
+		h.stats.recordSaved(cw.n)
+	}()
 
 	h.setCacheHeaders(w, algo, hash)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
-	if _, err := io.Copy(w, reader); err != nil {
-		errutil.LogMsg(err, "Failed to copy from cache to response")
+	setCacheStatus(w, cacheHit, "")
+	// Without a recorded type objects are opaque blobs; setting the type also
+	// keeps ServeContent from seeking back after sniffing
+	var meta repository.Metadata
+	if m := h.loadMetadata(algo, hash); m != nil {
+		meta = *m
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = "application/octet-stream"
+	}
+	setMetadataHeaders(w, meta)
+	w.Header().Set("ETag", fmt.Sprintf("%q", hash))
+
+	content, ok := reader.(io.ReadSeeker)
+	if !ok {
+		content = &forwardSeeker{r: reader, size: size}
 	}
+	if h.Compress {
+		w.Header().Set("Vary", "Accept-Encoding")
+		// Ranges address the uncompressed bytes, so they are served as is
+		if r.Header.Get("Range") == "" && acceptsGzip(r) {
+			br := bufio.NewReader(reader)
+			if compressible(meta.ContentType, br) {
+				serveGzip(w, r, br, hash)
+				return
+			}
+			content = &forwardSeeker{r: br, size: size}
+		}
+	}
+	// ServeContent handles Range, If-Range and HEAD, and sets Accept-Ranges and Content-Length
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+// forwardSeeker adapts a reader of known size for http.ServeContent.
+//
+// Seeking forward discards bytes; seeking backwards fails once reading has
+// started. That is enough for single ranges and for multiple ranges requested
+// in ascending order, which covers resuming downloads from remote or encrypted storage.
+type forwardSeeker struct {
+	r      io.Reader
+	size   int64
+	pos    int64 // bytes consumed from r
+	offset int64 // position requested by Seek
+}
+
+func (s *forwardSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+func (s *forwardSeeker) Read(p []byte) (int, error) {
+	if s.offset < s.pos {
+		return 0, fmt.Errorf("cannot seek backwards to %d after reading %d bytes", s.offset, s.pos)
+	}
+	if s.offset > s.pos {
+		n, err := io.CopyN(io.Discard, s.r, s.offset-s.pos)
+		s.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.r.Read(p)
+	s.pos += int64(n)
+	s.offset = s.pos
+	return n, err
 }
 
-func (h *CASHandler) fetchAndStream(ctx context.Context, w http.ResponseWriter, algo, hash string, sources []string, candidateSources []string, headersWritten *bool) error {
+// fetchContext returns the context for fetches done on behalf of a request
+// with context ctx. They outlive the request, as other clients may be
+// following them, but keep its request ID for the logs.
+func (h *CASHandler) fetchContext(ctx context.Context) context.Context {
+	return requestid.NewContext(h.AppCtx, requestid.FromContext(ctx))
+}
+
+func (h *CASHandler) fetchAndStream(ctx context.Context, w http.ResponseWriter, algo, hash string, size int64, sources []string, candidateSources []sourceurls.Source, headersWritten *bool) error {
 	for _, source := range sources {
-		err := h.tryFetchFromSource(ctx, w, algo, hash, source, candidateSources, headersWritten)
+		err := h.tryFetchFromSource(ctx, w, algo, hash, size, source, candidateSources, headersWritten)
 		if err == nil {
 			return nil
 		}
-		errutil.LogMsg(err, "Fetch from source failed", "url", source)
+		errutil.LogMsgContext(ctx, err, "Fetch from source failed", "url", source)
 		if *headersWritten {
 			return fmt.Errorf("fetch failed after headers already written: %w", err)
 		}
+		if errors.Is(err, repository.ErrInsufficientSpace) {
+			// Other sources would hit the same wall, don't waste their bandwidth.
+			return err
+		}
 	}
 	return fmt.Errorf("all sources failed")
 }
 
-func (h *CASHandler) tryFetchFromSource(ctx context.Context, w http.ResponseWriter, algo, hash, source string, candidateSources []string, headersWritten *bool) error {
-	slog.Info("Fetching from source", "url", source, "hash", hash)
+// serveProbe answers a HEAD request for an uncached object by sending HEAD
+// requests to the sources in turn, reporting the size of the first one that has it.
+func (h *CASHandler) serveProbe(w http.ResponseWriter, r *http.Request, algo, hash string, expectedSize int64, sources []string, candidateSources []sourceurls.Source) {
+	for _, source := range sources {
+		probeStart := time.Now()
+		size, err := h.probeSource(r.Context(), algo, hash, source, candidateSources)
+		if err == nil && expectedSize > 0 && size != expectedSize {
+			err = fmt.Errorf("%w: expected %d bytes, source has %d", errSizeMismatch, expectedSize, size)
+		}
+		if err != nil {
+			errutil.LogMsgContext(r.Context(), err, "Probe of source failed", "url", source)
+			continue
+		}
+		h.setCacheHeaders(w, algo, hash)
+		setCacheStatus(w, h.fetchStatus(source, algo, hash), source)
+		addServerTiming(w, "fetch", probeStart)
+		if size >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+// probeSource sends a HEAD request to source and returns the advertised size, or -1 if unknown.
+func (h *CASHandler) probeSource(ctx context.Context, algo, hash, source string, candidateSources []sourceurls.Source) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, ipfs.ResolveURL(source, h.IPFSGateway), nil)
 	if err != nil {
-		return fmt.Errorf("invalid source URL: %w", err)
+		return 0, fmt.Errorf("invalid source URL: %w", err)
+	}
+	h.prepareSourceRequest(req, algo, hash, source, candidateSources)
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("request failed: %w", err)
 	}
+	errutil.LogMsg(resp.Body.Close(), "Failed to close response body")
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return resp.ContentLength, nil
+}
 
-	// Forward X-Source-Urls using sfv
-	if len(candidateSources) > 0 {
-		list := make(sfv.List, len(candidateSources))
-		for i, url := range candidateSources {
-			list[i] = sfv.Item{Value: url}
+// prepareSourceRequest adds the headers the X-Source-Urls entry of source
+// asked for to req, and forwards the candidate sources to it.
+//
+// The headers of the other candidates are forwarded only to configured
+// upstreams, which may have to fetch from them; origins never see them.
+// Upstreams also get the request ID, so their logs can be matched with ours.
+//
+// The content is asked for uncompressed: Go's transport would otherwise ask for
+// gzip on its own, and a transparently decompressed reply has no Content-Length.
+func (h *CASHandler) prepareSourceRequest(req *http.Request, algo, hash, source string, candidateSources []sourceurls.Source) {
+	req.Header.Set("Accept-Encoding", "identity")
+	toUpstream := h.fetchStatus(source, algo, hash) == cacheUpstream
+	if id := requestid.FromContext(req.Context()); id != "" && toUpstream {
+		req.Header.Set(requestid.Header, id)
+	}
+	if len(candidateSources) == 0 {
+		return
+	}
+	forwarded := make([]sourceurls.Source, len(candidateSources))
+	for i, c := range candidateSources {
+		if c.URL == source {
+			for name, values := range c.Header {
+				for _, value := range values {
+					req.Header.Add(name, value)
+				}
+			}
 		}
-		val, err := sfv.EncodeList(list)
-		if err == nil {
-			req.Header.Set("X-Source-Urls", val)
-		} else {
-			errutil.LogMsg(err, "Failed to encode X-Source-Urls header")
+		forwarded[i] = sourceurls.Source{URL: c.URL}
+		if toUpstream {
+			forwarded[i].Header = c.Header
+		}
+	}
+	val, err := sourceurls.Encode(forwarded)
+	if err != nil {
+		errutil.LogMsg(err, "Failed to encode X-Source-Urls header")
+		return
+	}
+	req.Header.Set(sourceurls.Header, val)
+}
+
+// tryFetchFromSource streams algo/hash from source to w and the cache. size,
+// if positive, is the size the content must have; sources announcing another
+// are skipped before anything is written.
+func (h *CASHandler) tryFetchFromSource(ctx context.Context, w http.ResponseWriter, algo, hash string, size int64, source string, candidateSources []sourceurls.Source, headersWritten *bool) error {
+	slog.InfoContext(ctx, "Fetching from source", "url", source, "hash", hash)
+
+	// Mismatches abort with a panic, so the outcome is read from committed
+	var written int64
+	var latency time.Duration
+	committed := false
+	defer func() {
+		upstream := h.fetchStatus(source, algo, hash) == cacheUpstream
+		h.stats.recordFetch(source, upstream, written, fetchSample{latency: latency, ok: committed}, h.SlowSource)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ipfs.ResolveURL(source, h.IPFSGateway), nil)
+	if err != nil {
+		return fmt.Errorf("invalid source URL: %w", err)
+	}
+
+	h.prepareSourceRequest(req, algo, hash, source, candidateSources)
+
+	// Resume an interrupted download of the same object if we kept one
+	resumable, _ := h.Local.(repository.ResumableRepository)
+	var partial *repository.Partial
+	if resumable != nil {
+		partial, err = resumable.LoadPartial(algo, hash)
+		if err != nil {
+			errutil.LogMsgContext(ctx, err, "Failed to load partial download", "hash", hash)
 		}
 	}
+	if partial != nil {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", partial.Offset))
+	}
 
+	fetchStart := time.Now()
 	resp, err := h.Client.Do(req)
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
+	latency = time.Since(fetchStart)
 	defer func() {
 		errutil.LogMsg(resp.Body.Close(), "Failed to close response body")
 	}()
 
-	if resp.StatusCode != http.StatusOK {
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && partial != nil:
+		if start, ok := parseContentRangeStart(resp.Header.Get("Content-Range")); !ok || start != partial.Offset {
+			return fmt.Errorf("source returned unexpected range %q", resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode == http.StatusOK:
+		if partial != nil {
+			// Source ignored the Range header, start over
+			resumable.DiscardPartial(algo, hash)
+			partial = nil
+		}
+	default:
 		return fmt.Errorf("status %d", resp.StatusCode)
 	}
 
 	if resp.ContentLength == -1 {
 		return fmt.Errorf("source did not provide Content-Length")
 	}
+	if announced := resp.ContentLength; size > 0 {
+		if partial != nil {
+			announced += partial.Offset
+		}
+		if announced != size {
+			return fmt.Errorf("%w: expected %d bytes, source has %d", errSizeMismatch, size, announced)
+		}
+	}
 
 	// Found it! Start streaming.
 
+	hasher, err := hashutil.GetHasher(algo)
+	if err != nil {
+		return err
+	}
+
 	// 1. Prepare Storage
-	tmpFile, commit, err := h.Local.BeginWrite(algo, hash)
+	var offset int64
+	var tmpFile io.WriteCloser
+	var commit func() error
+	if partial != nil {
+		if err := restoreHashState(hasher, partial.HashState); err != nil {
+			resumable.DiscardPartial(algo, hash)
+			return fmt.Errorf("failed to restore hash state: %w", err)
+		}
+		offset = partial.Offset
+		tmpFile, commit, err = resumable.ResumeWrite(algo, hash, partial, offset+resp.ContentLength)
+	} else {
+		tmpFile, commit, err = h.Local.BeginWrite(algo, hash, resp.ContentLength)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to create temp file: %w", err)
 	}
 
-	committed := false
 	defer func() {
 		if !committed {
 			errutil.LogMsg(tmpFile.Close(), "Failed to close temp file")
@@ -213,24 +607,59 @@ func (h *CASHandler) tryFetchFromSource(ctx context.Context, w http.ResponseWrit
 		}
 	}()
 
+	total := offset + resp.ContentLength
+	meta := metadataFromHeader(resp.Header)
+	status := h.fetchStatus(source, algo, hash)
+	var progress io.Writer = io.Discard
+	if f, ok := tmpFile.(*os.File); ok {
+		d, finish := h.startDownload(algo+":"+hash, f.Name(), offset, total, meta, status, source)
+		defer func() {
+			if committed {
+				finish(nil)
+			} else {
+				finish(errDownloadFailed)
+			}
+		}()
+		progress = d
+	}
+
 	// 2. Set Headers
 	h.setCacheHeaders(w, algo, hash)
-	if resp.ContentLength > 0 {
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", resp.ContentLength))
+	setMetadataHeaders(w, meta)
+	setCacheStatus(w, status, source)
+	addServerTiming(w, "fetch", fetchStart)
+	if total > 0 {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", total))
 	}
 	w.WriteHeader(http.StatusOK)
 	*headersWritten = true
 
 	// 3. Stream
-	hasher, err := hashutil.GetHasher(algo)
+	if offset > 0 {
+		// Replay the prefix we already have before continuing with the source
+		if _, err := io.Copy(w, io.NewSectionReader(tmpFile.(io.ReaderAt), 0, offset)); err != nil {
+			h.keepPartial(algo, hash, tmpFile, offset, hasher, &committed)
+			return fmt.Errorf("streaming partial prefix failed: %w", err)
+		}
+	}
+
+	// Digest fresh downloads under every other algorithm too, so the content
+	// can be aliased instead of fetched and stored again under another digest
+	aliaser, _ := h.Local.(repository.AliasRepository)
+	aliasHashers, err := newAliasHashers(algo, aliaser != nil && offset == 0)
 	if err != nil {
 		return err
 	}
+	// progress must follow tmpFile so followers only see bytes already on disk
+	writers := []io.Writer{w, tmpFile, progress, hasher}
+	for _, hh := range aliasHashers {
+		writers = append(writers, hh)
+	}
+	mw := io.MultiWriter(writers...)
 
-	mw := io.MultiWriter(w, tmpFile, hasher)
-
-	written, err := io.Copy(mw, resp.Body)
+	written, err = io.Copy(mw, h.UpstreamBandwidth.Reader(ctx, resp.Body))
 	if err != nil {
+		h.keepPartial(algo, hash, tmpFile, offset+written, hasher, &committed)
 		return fmt.Errorf("streaming failed: %w", err)
 	}
 
@@ -252,29 +681,154 @@ func (h *CASHandler) tryFetchFromSource(ctx context.Context, w http.ResponseWrit
 		return err
 	}
 	committed = true
+	h.afterCommit(algo, hash, aliaser, aliasHashers, meta)
 
 	return nil // Success
 }
 
-func (h *CASHandler) parseSourceUrls(headers http.Header) []string {
-	var urls []string
-	values := headers.Values("X-Source-Urls")
+// afterCommit records the other digests and the metadata of a newly stored
+// object and notifies OnStored.
+func (h *CASHandler) afterCommit(algo, hash string, aliaser repository.AliasRepository, aliasHashers map[string]hash.Hash, meta repository.Metadata) {
+	aliases := make(map[string]string, len(aliasHashers))
+	for name, hh := range aliasHashers {
+		aliases[name] = hex.EncodeToString(hh.Sum(nil))
+	}
+	if len(aliases) > 0 {
+		if err := aliaser.Alias(algo, hash, aliases); err != nil {
+			errutil.LogMsg(err, "Failed to alias cached file", "hash", hash)
+		}
+	}
+	if mr, ok := h.Local.(repository.MetadataRepository); ok {
+		// Aliases get their own sidecar so they are served the same way. It
+		// is written even when empty, to clear what an earlier copy left
+		aliases[algo] = hash
+		for name, digest := range aliases {
+			errutil.LogMsg(mr.SetMetadata(name, digest, meta), "Failed to store metadata", "algo", name, "hash", digest)
+		}
+	}
+	if h.OnStored != nil {
+		h.OnStored(algo, hash)
+	}
+}
+
+// newAliasHashers returns a hasher for every supported algorithm except algo,
+// or nil if enabled is false.
+func newAliasHashers(algo string, enabled bool) (map[string]hash.Hash, error) {
+	if !enabled {
+		return nil, nil
+	}
+	hashers := make(map[string]hash.Hash)
+	for _, name := range hashutil.Names() {
+		if name == algo {
+			continue
+		}
+		hh, err := hashutil.GetHasher(name)
+		if err != nil {
+			return nil, err
+		}
+		hashers[name] = hh
+	}
+	return hashers, nil
+}
+
+// keepPartial stores the bytes received so far so the next request for the
+// same object can resume instead of starting from zero.
+//
+// It marks the temp file as handled so the caller doesn't remove it.
+func (h *CASHandler) keepPartial(algo, hash string, w io.WriteCloser, offset int64, hasher hash.Hash, handled *bool) {
+	resumable, ok := h.Local.(repository.ResumableRepository)
+	if !ok || offset <= 0 {
+		return
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return
+	}
+	m, ok := hasher.(encoding.BinaryMarshaler)
+	if !ok {
+		return
+	}
+	state, err := m.MarshalBinary()
+	if err != nil {
+		errutil.LogMsg(err, "Failed to marshal hash state")
+		return
+	}
+	if err := resumable.SavePartial(algo, hash, f, offset, state); err != nil {
+		errutil.LogMsg(err, "Failed to keep partial download", "hash", hash)
+		// SavePartial closes the file, only removal is left to do
+		errutil.LogMsg(os.Remove(f.Name()), "Failed to remove temp file", "path", f.Name())
+	}
+	*handled = true
+}
+
+func restoreHashState(hasher hash.Hash, state []byte) error {
+	u, ok := hasher.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("hasher does not support state restore")
+	}
+	return u.UnmarshalBinary(state)
+}
+
+// parseContentRangeStart returns the first byte position of a "bytes start-end/total" Content-Range.
+func parseContentRangeStart(value string) (int64, bool) {
+	rest, ok := strings.CutPrefix(value, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	startStr, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return start, true
+}
+
+func (h *CASHandler) parseSourceUrls(headers http.Header) []sourceurls.Source {
+	values := headers.Values(sourceurls.Header)
 	if len(values) == 0 {
-		return urls
+		return nil
 	}
 
-	list, err := sfv.DecodeList(values)
+	sources, err := sourceurls.Decode(values)
 	if err != nil {
 		errutil.LogMsg(err, "Failed to parse X-Source-Urls header")
-		return urls
+		return nil
 	}
+	return sources
+}
 
-	for _, item := range list {
-		if s, ok := item.Value.(string); ok {
-			urls = append(urls, s)
-		}
+// metadataFromHeader picks the origin response headers that are replayed from cache.
+func metadataFromHeader(header http.Header) repository.Metadata {
+	return repository.Metadata{
+		ContentType:        header.Get("Content-Type"),
+		ContentDisposition: header.Get("Content-Disposition"),
+	}
+}
+
+func setMetadataHeaders(w http.ResponseWriter, meta repository.Metadata) {
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	if meta.ContentDisposition != "" {
+		w.Header().Set("Content-Disposition", meta.ContentDisposition)
+	}
+}
+
+// loadMetadata returns the recorded metadata of algo/hash, or nil if there is none.
+func (h *CASHandler) loadMetadata(algo, hash string) *repository.Metadata {
+	mr, ok := h.Local.(repository.MetadataRepository)
+	if !ok {
+		return nil
+	}
+	m, err := mr.GetMetadata(algo, hash)
+	if err != nil {
+		errutil.LogMsg(err, "Failed to load metadata", "algo", algo, "hash", hash)
+		return nil
 	}
-	return urls
+	return m
 }
 
 func (h *CASHandler) setCacheHeaders(w http.ResponseWriter, algo, hash string) {
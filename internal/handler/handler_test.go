@@ -1,16 +1,29 @@
 package handler
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/lucasew/fetchurl/internal/hostfilter"
+	"github.com/lucasew/fetchurl/internal/httpclient"
 	"github.com/lucasew/fetchurl/internal/repository"
+	"github.com/lucasew/fetchurl/internal/requestid"
 )
 
 func TestCASHandler(t *testing.T) {
@@ -84,6 +97,24 @@ func TestCASHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("Range Request", func(t *testing.T) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/sha256/%s", hash1), nil)
+		req.Header.Set("Range", "bytes=3-")
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		if w.Code != http.StatusPartialContent {
+			t.Errorf("expected status 206, got %d", w.Code)
+		}
+		if w.Body.String() != "tent1" {
+			t.Errorf("expected body tent1, got %s", w.Body.String())
+		}
+		if w.Header().Get("Accept-Ranges") != "bytes" {
+			t.Errorf("expected Accept-Ranges bytes, got %q", w.Header().Get("Accept-Ranges"))
+		}
+	})
+
 	t.Run("Cache Hit", func(t *testing.T) {
 		// Should be in cache from previous test
 		req := httptest.NewRequest("GET", fmt.Sprintf("/sha256/%s", hash1), nil)
@@ -103,6 +134,54 @@ func TestCASHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("SRI Path", func(t *testing.T) {
+		sum := sha256.Sum256([]byte("content1"))
+		sri := "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+		for _, path := range []string{"/" + sri, "/sha256/" + sri} {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.URL.Path = path
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("%s: expected status 200, got %d", path, w.Code)
+			}
+			if w.Body.String() != "content1" {
+				t.Errorf("%s: expected body content1, got %s", path, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("Alias Hit", func(t *testing.T) {
+		// Downloaded as sha256 above, also reachable as sha1 without a source
+		sum := sha1.Sum([]byte("content1"))
+		sha1Hash := hex.EncodeToString(sum[:])
+		req := httptest.NewRequest("GET", fmt.Sprintf("/sha1/%s", sha1Hash), nil)
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+		if w.Body.String() != "content1" {
+			t.Errorf("expected body content1, got %s", w.Body.String())
+		}
+
+		a, err := os.Stat(filepath.Join(cacheDir, "sha256", hash1[:2], hash1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.Stat(filepath.Join(cacheDir, "sha1", sha1Hash[:2], sha1Hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(a, b) {
+			t.Errorf("expected alias to share storage with the original")
+		}
+	})
+
 	t.Run("Hash Mismatch", func(t *testing.T) {
 		// Requesting hash2 but pointing to content1 (hash1)
 
@@ -172,7 +251,1223 @@ func TestCASHandler(t *testing.T) {
 	})
 }
 
+func TestCASHandlerResumesPartialDownload(t *testing.T) {
+	cacheDir := t.TempDir()
+	localRepo := repository.NewLocalRepository(cacheDir, nil)
+	h := NewCASHandler(localRepo, nil, nil, t.Context())
+
+	content := []byte("0123456789")
+	hash := sha256Sum(content)
+	var ranges []string
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) == 1 {
+			// Drop the connection halfway through
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(content)))
+			if _, err := w.Write(content[:5]); err != nil {
+				t.Errorf("failed to write: %v", err)
+			}
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		if r.Header.Get("Range") != "bytes=5-" {
+			t.Errorf("expected resume from byte 5, got %q", r.Header.Get("Range"))
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 5-9/%d", len(content)))
+		w.Header().Set("Content-Length", "5")
+		w.WriteHeader(http.StatusPartialContent)
+		if _, err := w.Write(content[5:]); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+	defer origin.Close()
+
+	// First attempt fails mid-stream and leaves a partial behind
+	req := httptest.NewRequest("GET", fmt.Sprintf("/sha256/%s", hash), nil)
+	req.Header.Set("X-Source-Urls", "\""+origin.URL+"/file\"")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	partial, err := localRepo.LoadPartial("sha256", hash)
+	if err != nil || partial == nil {
+		t.Fatalf("expected partial download to be kept, got %v, %v", partial, err)
+	}
+	if partial.Offset != 5 {
+		t.Errorf("expected partial offset 5, got %d", partial.Offset)
+	}
+
+	// Second attempt resumes and serves the full content
+	req = httptest.NewRequest("GET", fmt.Sprintf("/sha256/%s", hash), nil)
+	req.Header.Set("X-Source-Urls", "\""+origin.URL+"/file\"")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Body.String() != string(content) {
+		t.Errorf("expected body %q, got %q", content, w.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "sha256", hash[:2], hash)); err != nil {
+		t.Errorf("file not found in cache: %v", err)
+	}
+	if partial, _ := localRepo.LoadPartial("sha256", hash); partial != nil {
+		t.Errorf("expected partial download to be consumed")
+	}
+}
+
 func sha256Sum(b []byte) string {
 	sum := sha256.Sum256(b)
 	return hex.EncodeToString(sum[:])
 }
+
+func TestUpstreamURL(t *testing.T) {
+	tests := []struct {
+		upstream string
+		want     string
+	}{
+		{"http://cache.local:8080", "http://cache.local:8080/api/fetchurl/sha256/abcd"},
+		{"http://cache.local:8080/", "http://cache.local:8080/api/fetchurl/sha256/abcd"},
+		{"dav+https://mirror.local/generic/cas/", "https://mirror.local/generic/cas/sha256/abcd"},
+		{"https://mirror.local/{algo}/{hash:0:2}/{hash}", "https://mirror.local/sha256/ab/abcd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.upstream, func(t *testing.T) {
+			if got := upstreamURL(tt.upstream, "sha256", "abcd"); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCASHandlerHostFilter(t *testing.T) {
+	content := []byte("filtered")
+	hash := sha256Sum(content)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+	defer origin.Close()
+
+	hosts, err := hostfilter.New(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("hostfilter.New failed: %v", err)
+	}
+	h := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, nil, t.Context())
+	h.Hosts = hosts
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/sha256/%s", hash), nil)
+	req.Header.Set("X-Source-Urls", "\""+origin.URL+"/file\"")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected status 403, got %d", w.Code)
+	}
+	if exists, _ := h.Local.Exists(t.Context(), "sha256", hash); exists {
+		t.Error("expected nothing to be fetched from a denied host")
+	}
+}
+
+func TestCASHandlerFileSource(t *testing.T) {
+	content := []byte("from mounted media")
+	hash := sha256Sum(content)
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := func(h *CASHandler) int {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/sha256/%s", hash), nil)
+		req.Header.Set("X-Source-Urls", "\"file:///file\"")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Refused unless opted into
+	h := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), http.DefaultClient, nil, t.Context())
+	if code := fetch(h); code == http.StatusOK {
+		t.Error("expected file:// sources to be refused by default")
+	}
+
+	h = NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), httpclient.WithFileSources(http.DefaultClient, root), nil, t.Context())
+	if code := fetch(h); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if exists, _ := h.Local.Exists(t.Context(), "sha256", hash); !exists {
+		t.Error("expected the file to be cached")
+	}
+}
+
+func TestForwardSeeker(t *testing.T) {
+	content := "0123456789"
+	tests := []struct {
+		rangeHeader string
+		status      int
+		body        string
+	}{
+		{"", http.StatusOK, content},
+		{"bytes=4-6", http.StatusPartialContent, "456"},
+		{"bytes=-3", http.StatusPartialContent, "789"},
+		{"bytes=20-", http.StatusRequestedRangeNotSatisfiable, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rangeHeader, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			w := httptest.NewRecorder()
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeContent(w, req, "", time.Time{}, &forwardSeeker{r: strings.NewReader(content), size: int64(len(content))})
+
+			if w.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, w.Code)
+			}
+			if tt.status != http.StatusRequestedRangeNotSatisfiable && w.Body.String() != tt.body {
+				t.Errorf("expected body %q, got %q", tt.body, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCASHandlerProbeOnHead(t *testing.T) {
+	content := []byte("probed")
+	hash := sha256Sum(content)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("expected only HEAD requests, got %s", r.Method)
+		}
+		if r.URL.Path != "/file" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(content)))
+	}))
+	defer origin.Close()
+
+	h := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, nil, t.Context())
+	h.ProbeOnHead = true
+
+	t.Run("Available", func(t *testing.T) {
+		req := httptest.NewRequest("HEAD", fmt.Sprintf("/sha256/%s", hash), nil)
+		req.Header.Set("X-Source-Urls", "\""+origin.URL+"/missing\", \""+origin.URL+"/file\"")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+		if w.Header().Get("Content-Length") != fmt.Sprintf("%d", len(content)) {
+			t.Errorf("expected Content-Length %d, got %q", len(content), w.Header().Get("Content-Length"))
+		}
+		if exists, _ := h.Local.Exists(t.Context(), "sha256", hash); exists {
+			t.Error("expected probe not to download the object")
+		}
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		req := httptest.NewRequest("HEAD", fmt.Sprintf("/sha256/%s", hash), nil)
+		req.Header.Set("X-Source-Urls", "\""+origin.URL+"/missing\"")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+}
+
+func TestCASHandlerReplaysMetadata(t *testing.T) {
+	content := []byte("archive")
+	hash := sha256Sum(content)
+	const contentType = "application/gzip"
+	const disposition = `attachment; filename="archive.tar.gz"`
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", disposition)
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+	defer origin.Close()
+
+	h := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, nil, t.Context())
+
+	check := func(name string, w *httptest.ResponseRecorder) {
+		if got := w.Header().Get("Content-Type"); got != contentType {
+			t.Errorf("%s: expected Content-Type %q, got %q", name, contentType, got)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != disposition {
+			t.Errorf("%s: expected Content-Disposition %q, got %q", name, disposition, got)
+		}
+	}
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/sha256/%s", hash), nil)
+	req.Header.Set("X-Source-Urls", "\""+origin.URL+"/archive\"")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	check("fetch", w)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/sha256/%s", hash), nil))
+	check("cache hit", w)
+
+	sum := sha1.Sum(content)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/sha1/%s", hex.EncodeToString(sum[:])), nil))
+	check("alias hit", w)
+}
+
+func TestCASHandlerUpload(t *testing.T) {
+	content := "uploaded content"
+	hash := sha256Sum([]byte(content))
+	h := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, nil, t.Context())
+
+	put := func(hash, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", fmt.Sprintf("/sha256/%s", hash), strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		if w := put(hash, "secret", content); w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("expected status 405, got %d", w.Code)
+		}
+	})
+
+	h.UploadToken = "secret"
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		if w := put(hash, "wrong", content); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("Digest Mismatch", func(t *testing.T) {
+		if w := put(hash, "secret", "other content"); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+		if exists, _ := h.Local.Exists(t.Context(), "sha256", hash); exists {
+			t.Error("expected mismatched upload not to be stored")
+		}
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		if w := put(hash, "secret", content); w.Code != http.StatusCreated {
+			t.Errorf("expected status 201, got %d: %s", w.Code, w.Body.String())
+		}
+
+		req := httptest.NewRequest("GET", fmt.Sprintf("/sha256/%s", hash), nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Body.String() != content {
+			t.Errorf("expected body %q, got %q", content, w.Body.String())
+		}
+	})
+
+	t.Run("Already Cached", func(t *testing.T) {
+		if w := put(hash, "secret", content); w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+	})
+
+	del := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", fmt.Sprintf("/sha256/%s", hash), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Delete Unauthorized", func(t *testing.T) {
+		if w := del("wrong"); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if w := del("secret"); w.Code != http.StatusNoContent {
+			t.Errorf("expected status 204, got %d: %s", w.Code, w.Body.String())
+		}
+		if exists, _ := h.Local.Exists(t.Context(), "sha256", hash); exists {
+			t.Error("expected object to be deleted")
+		}
+		if w := del("secret"); w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+}
+
+func TestCASHandlerStreamsToFollowers(t *testing.T) {
+	content := []byte("0123456789")
+	hash := sha256Sum(content)
+	release := make(chan struct{})
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(content)))
+		if _, err := w.Write(content[:5]); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+		w.(http.Flusher).Flush()
+		<-release
+		if _, err := w.Write(content[5:]); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+	defer origin.Close()
+
+	h := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, nil, t.Context())
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	get := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(t.Context(), "GET", fmt.Sprintf("%s/sha256/%s", srv.URL, hash), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Source-Urls", "\""+origin.URL+"/file\"")
+		return http.DefaultClient.Do(req)
+	}
+
+	leaderBody := make(chan string, 1)
+	go func() {
+		resp, err := get()
+		if err != nil {
+			t.Errorf("leader request failed: %v", err)
+			leaderBody <- ""
+			return
+		}
+		defer func() {
+			if err := resp.Body.Close(); err != nil {
+				t.Errorf("failed to close leader body: %v", err)
+			}
+		}()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Errorf("leader read failed: %v", err)
+		}
+		leaderBody <- string(body)
+	}()
+
+	// Wait for the leader to have the first half on disk
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if d := h.activeDownload("sha256:" + hash); d != nil {
+			if written, _, _ := d.wait(4); written >= 5 {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			close(release)
+			t.Fatal("leader download did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := get()
+	if err != nil {
+		close(release)
+		t.Fatalf("follower request failed: %v", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			t.Errorf("failed to close follower body: %v", err)
+		}
+	}()
+
+	// The follower gets the first half while the origin is still stalled
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, head); err != nil {
+		close(release)
+		t.Fatalf("follower read failed: %v", err)
+	}
+	in := h.Inflight()
+	if got := in.Flights["sha256:"+hash]; got != 1 {
+		t.Errorf("expected 1 caller in flight, got %d", got)
+	}
+	want := DownloadProgress{Written: 5, Total: int64(len(content)), Followers: 1}
+	if got := in.Downloads["sha256:"+hash]; got != want {
+		t.Errorf("expected download progress %+v, got %+v", want, got)
+	}
+	close(release)
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("follower read failed: %v", err)
+	}
+
+	if got := string(head) + string(rest); got != string(content) {
+		t.Errorf("expected follower body %q, got %q", content, got)
+	}
+	if got := <-leaderBody; got != string(content) {
+		t.Errorf("expected leader body %q, got %q", content, got)
+	}
+	// Handlers may still be returning after the bodies are read
+	deadline = time.Now().Add(5 * time.Second)
+	for in := h.Inflight(); len(in.Flights) != 0 || len(in.Downloads) != 0; in = h.Inflight() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected nothing in flight, got %+v", in)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCASHandlerDeleteWaitsForFetch(t *testing.T) {
+	content := []byte("deleted while downloading")
+	hash := sha256Sum(content)
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+	defer origin.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	h := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, nil, t.Context())
+	h.UploadToken = "secret"
+	key := "sha256:" + hash
+
+	fetched := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/sha256/%s", hash), nil)
+		req.Header.Set("X-Source-Urls", "\""+origin.URL+"/file\"")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		fetched <- w
+	}()
+	waitForFlights(t, h, key, 1)
+
+	deleted := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		req := httptest.NewRequest("DELETE", fmt.Sprintf("/sha256/%s", hash), nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		deleted <- w
+	}()
+	waitForFlights(t, h, key, 2)
+	select {
+	case w := <-deleted:
+		t.Fatalf("delete returned %d before the fetch finished", w.Code)
+	default:
+	}
+
+	close(release)
+	if w := <-fetched; w.Code != http.StatusOK || w.Body.String() != string(content) {
+		t.Errorf("expected fetch to succeed, got %d: %q", w.Code, w.Body.String())
+	}
+	if w := <-deleted; w.Code != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if exists, _ := h.Local.Exists(t.Context(), "sha256", hash); exists {
+		t.Error("expected the object committed by the fetch to be deleted")
+	}
+}
+
+func TestCASHandlerUploadDuringFetch(t *testing.T) {
+	content := []byte("uploaded while downloading")
+	hash := sha256Sum(content)
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+	defer origin.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	h := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, nil, t.Context())
+	h.UploadToken = "secret"
+	key := "sha256:" + hash
+
+	fetched := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/sha256/%s", hash), nil)
+		req.Header.Set("X-Source-Urls", "\""+origin.URL+"/file\"")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		fetched <- w
+	}()
+	waitForFlights(t, h, key, 1)
+
+	// The upload waits for the fetch but is still checked against its own body
+	uploaded := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		bogus := strings.Repeat("x", len(content))
+		req := httptest.NewRequest("PUT", fmt.Sprintf("/sha256/%s", hash), strings.NewReader(bogus))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		uploaded <- w
+	}()
+	waitForFlights(t, h, key, 2)
+
+	close(release)
+	if w := <-fetched; w.Code != http.StatusOK || w.Body.String() != string(content) {
+		t.Errorf("expected fetch to succeed, got %d: %q", w.Code, w.Body.String())
+	}
+	if w := <-uploaded; w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a mismatched upload, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// waitForFlights waits until n callers are working on or waiting for key.
+func waitForFlights(t *testing.T, h *CASHandler, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Inflight().Flights[key] != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d callers in flight, got %+v", n, h.Inflight())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCASHandlerStats(t *testing.T) {
+	content := []byte("counted")
+	hash := sha256Sum(content)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/file" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+	defer origin.Close()
+
+	h := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, nil, t.Context())
+	get := func(sources string) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/sha256/%s", hash), nil)
+		if sources != "" {
+			req.Header.Set("X-Source-Urls", sources)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	get(`"` + origin.URL + `/missing"`)
+	get(`"` + origin.URL + `/file"`)
+	get("")
+
+	stats := h.Stats()
+	if stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("expected 1 hit and 2 misses, got %d and %d", stats.Hits, stats.Misses)
+	}
+	got := stats.Sources[origin.URL]
+	if got.Fetches != 2 || got.Failures != 1 || got.Bytes != int64(len(content)) {
+		t.Errorf("expected 2 fetches, 1 failure and %d bytes, got %+v", len(content), got)
+	}
+	if got.RecentFetches != 2 || got.RecentErrorRate != 0.5 || got.RecentLatencyMs <= 0 || got.Degraded || got.Upstream {
+		t.Errorf("unexpected recent source stats %+v", got)
+	}
+}
+
+func TestCASHandlerTraffic(t *testing.T) {
+	content := []byte("bytes we only fetch once")
+	hash := sha256Sum(content)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+	defer origin.Close()
+
+	h := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, nil, t.Context())
+	for range 3 {
+		req := httptest.NewRequest("GET", "/sha256/"+hash, nil)
+		req.Header.Set("X-Source-Urls", "\""+origin.URL+"/file\"")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	n := int64(len(content))
+	traffic := h.Stats().Traffic
+	if traffic.FetchedBytes != n || traffic.SavedBytes != 2*n {
+		t.Errorf("expected %d bytes fetched and %d saved, got %+v", n, 2*n, traffic)
+	}
+	if got := traffic.Origins[origin.URL]; got != (OriginTraffic{Fetches: 1, Bytes: n}) {
+		t.Errorf("unexpected origin traffic %+v", got)
+	}
+	today := time.Now().UTC().Format(time.DateOnly)
+	if got := traffic.Days[today]; got != (DayTraffic{FetchedBytes: n, SavedBytes: 2 * n}) {
+		t.Errorf("unexpected traffic for today %+v", got)
+	}
+
+	path := filepath.Join(t.TempDir(), TrafficFileName)
+	if err := h.SaveTraffic(path); err != nil {
+		t.Fatalf("SaveTraffic failed: %v", err)
+	}
+	restarted := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, nil, t.Context())
+	if err := restarted.LoadTraffic(path); err != nil {
+		t.Fatalf("LoadTraffic failed: %v", err)
+	}
+	if got := restarted.Stats().Traffic; got.FetchedBytes != n || got.SavedBytes != 2*n || !got.Since.Equal(traffic.Since) || len(got.Origins) != 1 {
+		t.Errorf("expected the totals to survive a restart, got %+v", got)
+	}
+}
+
+func TestTrafficDays(t *testing.T) {
+	var traffic Traffic
+	now := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+	traffic.add(now.AddDate(0, 0, -trafficDays), 100, 0)
+	traffic.add(now.AddDate(0, 0, 1-trafficDays), 10, 0)
+	traffic.add(now, 1, 2)
+
+	if _, ok := traffic.Days["2025-12-31"]; ok {
+		t.Errorf("expected the day out of the window to be dropped, got %v", traffic.Days)
+	}
+	if len(traffic.Days) != 2 || traffic.Days["2026-03-31"] != (DayTraffic{FetchedBytes: 1, SavedBytes: 2}) {
+		t.Errorf("unexpected days %v", traffic.Days)
+	}
+	if traffic.FetchedBytes != 111 || traffic.SavedBytes != 2 || !traffic.Since.Equal(now.AddDate(0, 0, -trafficDays)) {
+		t.Errorf("unexpected totals %+v", traffic)
+	}
+}
+
+func TestSourceStatsFoldOrigins(t *testing.T) {
+	var s stats
+	s.recordFetch("https://upstream.example/file", true, 1, fetchSample{ok: true}, 0)
+	for i := range 2*maxOrigins + 10 {
+		// Earlier origins transfer more, so they are the ones kept
+		s.recordFetch(fmt.Sprintf("https://%d.example/file", i), false, int64(10000-i), fetchSample{ok: true}, 0)
+	}
+
+	st := Stats{Sources: make(map[string]SourceStats)}
+	for origin, src := range s.sources {
+		st.Sources[origin] = src.SourceStats
+	}
+	for name, origins := range map[string]int{"sources": len(st.Sources), "traffic": len(s.traffic.Origins)} {
+		if origins > 2*maxOrigins+2 {
+			t.Errorf("expected %s to stay bounded, got %d origins", name, origins)
+		}
+	}
+	if _, ok := st.Sources["https://upstream.example"]; !ok {
+		t.Error("expected the upstream to be kept despite its few bytes")
+	}
+	if _, ok := st.Sources["https://0.example"]; !ok {
+		t.Error("expected the busiest origin to be kept")
+	}
+	var fetches int64
+	for _, src := range st.Sources {
+		fetches += src.Fetches
+	}
+	if fetches != 2*maxOrigins+11 || st.Sources[otherOrigin].Fetches == 0 {
+		t.Errorf("expected folded origins to count under %q, got %d fetches in total", otherOrigin, fetches)
+	}
+	if o := s.traffic.Origins[otherOrigin]; o.Fetches != st.Sources[otherOrigin].Fetches {
+		t.Errorf("expected traffic to fold the same origins, got %+v", o)
+	}
+}
+
+func TestSourceStatsDegraded(t *testing.T) {
+	var s stats
+	record := func(latency time.Duration, ok bool) SourceStats {
+		s.recordFetch("https://mirror.example/file", true, 0, fetchSample{latency: latency, ok: ok}, time.Second)
+		return s.sources["https://mirror.example"].SourceStats
+	}
+
+	var st SourceStats
+	for range minRecentFetches - 1 {
+		st = record(0, false)
+	}
+	if !st.Upstream || st.Degraded {
+		t.Errorf("expected too few fetches to degrade, got %+v", st)
+	}
+	if st := record(0, false); !st.Degraded || st.RecentErrorRate != 1 {
+		t.Errorf("expected failures to degrade, got %+v", st)
+	}
+
+	// Enough fast successes push the failures out of the window
+	for range recentFetches {
+		st = record(10*time.Millisecond, true)
+	}
+	if st.Degraded || st.RecentErrorRate != 0 || st.RecentLatencyMs != 10 || st.Fetches != recentFetches+minRecentFetches {
+		t.Errorf("expected recovery, got %+v", st)
+	}
+
+	for range recentFetches {
+		st = record(2*time.Second, true)
+	}
+	if !st.Degraded || st.RecentErrorRate != 0 || st.RecentLatencyMs != 2000 {
+		t.Errorf("expected slowness to degrade, got %+v", st)
+	}
+}
+
+func TestCASHandlerVerify(t *testing.T) {
+	cacheDir := t.TempDir()
+	h := NewCASHandler(repository.NewTieredRepository(repository.NewLocalRepository(cacheDir, nil), 1<<20), nil, nil, t.Context())
+
+	store := func(content string) string {
+		hash := sha256Sum([]byte(content))
+		w, commit, err := h.Local.BeginWrite("sha256", hash, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := commit(); err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	verifyAs := func(hash, token string) (*httptest.ResponseRecorder, VerifyResult) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", fmt.Sprintf("/sha256/%s/verify", hash), nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		h.ServeHTTP(w, req)
+		var result VerifyResult
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+		}
+		return w, result
+	}
+	verify := func(hash string) (*httptest.ResponseRecorder, VerifyResult) {
+		return verifyAs(hash, "secret")
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		if w, _ := verifyAs(store("disabled"), ""); w.Code != http.StatusForbidden {
+			t.Errorf("expected status 403, got %d", w.Code)
+		}
+	})
+
+	h.UploadToken = "secret"
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		if w, _ := verifyAs(store("unauthorized"), "wrong"); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("Intact", func(t *testing.T) {
+		hash := store("intact")
+		w, result := verify(hash)
+		if w.Code != http.StatusOK || !result.OK || result.Deleted {
+			t.Errorf("expected intact result, got %d %+v", w.Code, result)
+		}
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		hash := store("corrupted")
+		// Reading it back puts the intact copy in the memory tier
+		reader, _, err := h.Local.Get(t.Context(), "sha256", hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := reader.Close(); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(cacheDir, "sha256", hash[:2], hash)
+		if err := os.WriteFile(path, []byte("bit rot"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		w, result := verify(hash)
+		if w.Code != http.StatusOK || result.OK || !result.Deleted {
+			t.Errorf("expected corrupted result, got %d %+v", w.Code, result)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected corrupted file to be deleted, got %v", err)
+		}
+	})
+
+	t.Run("Not Cached", func(t *testing.T) {
+		if w, _ := verify(sha256Sum([]byte("missing"))); w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+}
+
+func TestCASHandlerBatch(t *testing.T) {
+	files := map[string]string{"/a": "first", "/b": "second"}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+	defer origin.Close()
+
+	h := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, nil, t.Context())
+	missing := sha256Sum([]byte("missing"))
+	items := []BatchItem{
+		{Algo: "sha256", Hash: sha256Sum([]byte("first")), URLs: []string{origin.URL + "/a"}},
+		{Algo: "sha256", Hash: missing, URLs: []string{origin.URL + "/missing"}},
+		{Algo: "sha256", Hash: sha256Sum([]byte("second")), URLs: []string{origin.URL + "/b"}},
+	}
+	body, err := json.Marshal(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", BatchPath, strings.NewReader(string(body))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	got := map[string]string{}
+	var names []string
+	tr := tar.NewReader(w.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read tar: %v", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("failed to read tar entry: %v", err)
+		}
+		names = append(names, hdr.Name)
+		got[hdr.Name] = string(data)
+	}
+
+	want := []string{"sha256/" + items[0].Hash, "sha256/" + items[2].Hash, "errors.json"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("expected entries %v, got %v", want, names)
+	}
+	if got[want[0]] != "first" || got[want[1]] != "second" {
+		t.Errorf("unexpected contents %v", got)
+	}
+	if !strings.Contains(got["errors.json"], missing) {
+		t.Errorf("expected errors.json to list the missing object, got %s", got["errors.json"])
+	}
+}
+
+func TestCASHandlerCompress(t *testing.T) {
+	text := []byte(strings.Repeat("hello, compressible world\n", 100))
+	binary := []byte{0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content := text
+		if r.URL.Path == "/binary" {
+			content = binary
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+	defer origin.Close()
+
+	h := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, nil, t.Context())
+	h.Compress = true
+
+	get := func(hash, source string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/sha256/"+hash, nil)
+		if source != "" {
+			req.Header.Set("X-Source-Urls", "\""+origin.URL+source+"\"")
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	textHash, binaryHash := sha256Sum(text), sha256Sum(binary)
+	get(textHash, "/text", nil)
+	get(binaryHash, "/binary", nil)
+
+	w := get(textHash, "", map[string]string{"Accept-Encoding": "zstd, gzip"})
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("expected gzip encoding, got %q", got)
+	}
+	if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("expected Vary: Accept-Encoding, got %q", got)
+	}
+	if w.Body.Len() >= len(text) {
+		t.Errorf("expected compressed body smaller than %d bytes, got %d", len(text), w.Body.Len())
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("failed to open gzip stream: %v", err)
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("failed to decompress: %v", err)
+	}
+	if !slices.Equal(body, text) {
+		t.Error("decompressed body does not match")
+	}
+
+	etag := w.Header().Get("ETag")
+	if w := get(textHash, "", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": etag}); w.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for matching ETag, got %d", w.Code)
+	}
+
+	for name, header := range map[string]map[string]string{
+		"no accept-encoding": nil,
+		"gzip refused":       {"Accept-Encoding": "gzip;q=0"},
+		"range":              {"Accept-Encoding": "gzip", "Range": "bytes=0-4"},
+	} {
+		if w := get(textHash, "", header); w.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s: expected identity encoding, got %q", name, w.Header().Get("Content-Encoding"))
+		}
+	}
+
+	w = get(binaryHash, "", map[string]string{"Accept-Encoding": "gzip"})
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("expected binary content uncompressed, got %q", got)
+	}
+	if !slices.Equal(w.Body.Bytes(), binary) {
+		t.Error("binary body does not match")
+	}
+
+	// A fetchurl server using this one as upstream must get the plain bytes
+	srv := httptest.NewServer(http.StripPrefix("/api/fetchurl", h))
+	defer srv.Close()
+	downstream := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, []string{srv.URL}, t.Context())
+	w = httptest.NewRecorder()
+	downstream.ServeHTTP(w, httptest.NewRequest("GET", "/sha256/"+textHash, nil))
+	if w.Code != http.StatusOK || !slices.Equal(w.Body.Bytes(), text) {
+		t.Errorf("expected the downstream to fetch the text from its upstream, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// presigningRepository serves presigned URLs for whatever its local repository holds.
+type presigningRepository struct {
+	*repository.LocalRepository
+}
+
+func (r presigningRepository) PresignGet(ctx context.Context, algo, hash string, expires time.Duration) (string, int64, error) {
+	reader, size, err := r.Get(ctx, algo, hash)
+	if err != nil {
+		return "", 0, err
+	}
+	return "https://storage.example/" + hash, size, reader.Close()
+}
+
+func TestCASHandlerRedirect(t *testing.T) {
+	content := []byte("a rather large artifact")
+	hash := sha256Sum(content)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+	defer upstream.Close()
+
+	local := repository.NewLocalRepository(t.TempDir(), nil)
+	h := NewCASHandler(presigningRepository{local}, nil, []string{upstream.URL}, t.Context())
+	h.RedirectMinSize = int64(len(content))
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/sha256/"+hash, nil))
+		return w
+	}
+
+	w := get()
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect to upstream, got %d", w.Code)
+	}
+	if want := upstream.URL + "/api/fetchurl/sha256/" + hash; w.Header().Get("Location") != want {
+		t.Errorf("expected Location %q, got %q", want, w.Header().Get("Location"))
+	}
+
+	// Small objects are proxied, which also caches them
+	h.RedirectMinSize = int64(len(content)) + 1
+	if w := get(); w.Code != http.StatusOK || w.Body.String() != string(content) {
+		t.Fatalf("expected proxied content, got %d %q", w.Code, w.Body.String())
+	}
+
+	h.RedirectMinSize = int64(len(content))
+	w = get()
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect to storage, got %d", w.Code)
+	}
+	if want := "https://storage.example/" + hash; w.Header().Get("Location") != want {
+		t.Errorf("expected Location %q, got %q", want, w.Header().Get("Location"))
+	}
+}
+
+func TestCASHandlerCacheStatus(t *testing.T) {
+	content := []byte("where did this come from")
+	hash := sha256Sum(content)
+
+	newServer := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			if _, err := w.Write(content); err != nil {
+				t.Errorf("failed to write: %v", err)
+			}
+		}))
+	}
+	origin, upstream := newServer(), newServer()
+	defer origin.Close()
+	defer upstream.Close()
+
+	check := func(h *CASHandler, wantStatus, wantSource string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/sha256/"+hash, nil)
+		req.Header.Set("X-Source-Urls", "\""+origin.URL+"/file?token=secret\"")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if got := w.Header().Get("X-Cache"); got != wantStatus {
+			t.Errorf("expected X-Cache %s, got %q", wantStatus, got)
+		}
+		if got := w.Header().Get("X-Fetch-Source"); got != wantSource {
+			t.Errorf("expected X-Fetch-Source %q, got %q", wantSource, got)
+		}
+		if got := w.Header().Get("Server-Timing"); !strings.Contains(got, "cache;dur=") {
+			t.Errorf("expected cache timing, got %q", got)
+		}
+	}
+
+	h := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, nil, t.Context())
+	check(h, "MISS", origin.URL+"/file")
+	check(h, "HIT", "")
+
+	h = NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, []string{upstream.URL}, t.Context())
+	check(h, "UPSTREAM", upstream.URL+"/api/fetchurl/sha256/"+hash)
+}
+
+func TestCASHandlerForwardsRequestID(t *testing.T) {
+	content := []byte("whose request was this")
+	hash := sha256Sum(content)
+
+	var originID, upstreamID string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get(requestid.Header)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer upstream.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originID = r.Header.Get(requestid.Header)
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+	defer origin.Close()
+
+	h := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, []string{upstream.URL}, t.Context())
+	req := httptest.NewRequest("GET", "/sha256/"+hash, nil)
+	req.Header.Set("X-Source-Urls", "\""+origin.URL+"/file\"")
+	req = req.WithContext(requestid.NewContext(req.Context(), "req-42"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if originID != "" {
+		t.Errorf("expected no request ID at the origin, got %q", originID)
+	}
+	if upstreamID != "req-42" {
+		t.Errorf("expected request ID req-42 at the upstream, got %q", upstreamID)
+	}
+}
+
+func TestCASHandlerSourceHeaders(t *testing.T) {
+	content := []byte("private artifact")
+	hash := sha256Sum(content)
+
+	var publicHeaders http.Header
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		publicHeaders = r.Header.Clone()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer public.Close()
+	private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+	defer private.Close()
+
+	h := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, nil, t.Context())
+
+	req := httptest.NewRequest("GET", "/sha256/"+hash, nil)
+	// Listed on its own so the public source is always tried first
+	req.Header.Set("X-Source-Urls", fmt.Sprintf(`%q;h-authorization="Bearer secret"`, private.URL))
+	req.Header.Add("X-Source-Urls", fmt.Sprintf("%q", public.URL))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != string(content) {
+		t.Fatalf("expected the private source to be fetched with its header, got %d %q", w.Code, w.Body.String())
+	}
+
+	if publicHeaders == nil {
+		// The shuffle put the private source first
+		return
+	}
+	if publicHeaders.Get("Authorization") != "" {
+		t.Error("the private source's credentials were sent to another source")
+	}
+	if strings.Contains(publicHeaders.Get("X-Source-Urls"), "secret") {
+		t.Errorf("the private source's credentials were forwarded: %s", publicHeaders.Get("X-Source-Urls"))
+	}
+}
+
+func TestCASHandlerSize(t *testing.T) {
+	content := []byte("sized content")
+	hash := sha256Sum(content)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+	defer origin.Close()
+
+	h := NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, nil, t.Context())
+	fetch := func(query string) int {
+		req := httptest.NewRequest("GET", "/sha256/"+hash+query, nil)
+		req.Header.Set("X-Source-Urls", "\""+origin.URL+"\"")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := fetch("?size=abc"); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid size, got %d", code)
+	}
+	if code := fetch("?size=5"); code != http.StatusBadGateway {
+		t.Errorf("expected status 502 for the wrong size, got %d", code)
+	}
+	if exists, _ := h.Local.Exists(t.Context(), "sha256", hash); exists {
+		t.Error("expected nothing to be cached from a source of the wrong size")
+	}
+	if code := fetch(fmt.Sprintf("?size=%d", len(content))); code != http.StatusOK {
+		t.Errorf("expected status 200 for the right size, got %d", code)
+	}
+}
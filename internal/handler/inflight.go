@@ -0,0 +1,109 @@
+package handler
+
+import "sync"
+
+// Inflight is a snapshot of the work in progress, keyed by algo:hash.
+type Inflight struct {
+	// Flights counts the requests working on or waiting for each object:
+	// fetches sharing a singleflight call, batch fetches, uploads and deletes.
+	Flights map[string]int `json:"flights"`
+	// Downloads are the fetches streaming into a temp file.
+	Downloads map[string]DownloadProgress `json:"downloads"`
+}
+
+// DownloadProgress is how far along a download is.
+type DownloadProgress struct {
+	Written int64 `json:"written"`
+	// Total is 0 if the source didn't say.
+	Total     int64 `json:"total"`
+	Followers int64 `json:"followers"`
+}
+
+// Inflight returns what the handler is doing right now, to troubleshoot
+// memory and connection growth.
+func (h *CASHandler) Inflight() Inflight {
+	h.downloadsMu.Lock()
+	defer h.downloadsMu.Unlock()
+	in := Inflight{
+		Flights:   make(map[string]int, len(h.flights)),
+		Downloads: make(map[string]DownloadProgress, len(h.downloads)),
+	}
+	for key, n := range h.flights {
+		in.Flights[key] = n
+	}
+	for key, d := range h.downloads {
+		d.mu.Lock()
+		in.Downloads[key] = DownloadProgress{Written: d.written, Total: d.total, Followers: d.followers}
+		d.mu.Unlock()
+	}
+	return in
+}
+
+// do runs a fetch of key through the singleflight group, counting its callers.
+//
+// The leader holds the object's lock while fn runs, so fetches never overlap
+// an upload or delete of the same object. Only fetches share results.
+func (h *CASHandler) do(key string, fn func() (interface{}, error)) (interface{}, error, bool) {
+	defer h.track(key)()
+	return h.g.Do(key, func() (interface{}, error) {
+		defer h.lockKey(key)()
+		return fn()
+	})
+}
+
+// exclusive runs fn holding the object's lock, after any fetch, upload or
+// delete of key in progress. Its result is never shared with other callers.
+func (h *CASHandler) exclusive(key string, fn func() error) error {
+	defer h.track(key)()
+	defer h.lockKey(key)()
+	return fn()
+}
+
+// track counts a caller of key until the returned func is called.
+func (h *CASHandler) track(key string) func() {
+	h.downloadsMu.Lock()
+	if h.flights == nil {
+		h.flights = make(map[string]int)
+	}
+	h.flights[key]++
+	h.downloadsMu.Unlock()
+
+	return func() {
+		h.downloadsMu.Lock()
+		if h.flights[key]--; h.flights[key] <= 0 {
+			delete(h.flights, key)
+		}
+		h.downloadsMu.Unlock()
+	}
+}
+
+// keyLock serializes the writers of one object.
+type keyLock struct {
+	mu   sync.Mutex
+	refs int // holders and waiters, guarded by downloadsMu
+}
+
+// lockKey takes the lock of key, returning the func that releases it.
+func (h *CASHandler) lockKey(key string) func() {
+	h.downloadsMu.Lock()
+	if h.keyLocks == nil {
+		h.keyLocks = make(map[string]*keyLock)
+	}
+	l := h.keyLocks[key]
+	if l == nil {
+		l = &keyLock{}
+		h.keyLocks[key] = l
+	}
+	l.refs++
+	h.downloadsMu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		h.downloadsMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(h.keyLocks, key)
+		}
+		h.downloadsMu.Unlock()
+	}
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/repository"
+)
+
+// defaultRedirectExpiry is how long presigned URLs stay valid when
+// RedirectExpiry is not set.
+const defaultRedirectExpiry = 15 * time.Minute
+
+// redirect answers a GET with a redirect when the object is big enough and
+// can be downloaded without going through this server: from the storage
+// backend through a presigned URL if cached, or else from a configured
+// upstream that has it. It reports whether it handled the request.
+func (h *CASHandler) redirect(w http.ResponseWriter, r *http.Request, algo, hash string) bool {
+	location, size, err := h.presign(r, algo, hash)
+	switch {
+	case err == nil:
+		if size < h.RedirectMinSize {
+			return false
+		}
+		h.stats.hits.Add(1)
+		setCacheStatus(w, cacheHit, "")
+		http.Redirect(w, r, location, http.StatusFound)
+		return true
+	case errors.Is(err, fs.ErrNotExist):
+	case errors.Is(err, errors.ErrUnsupported):
+		exists, err := h.Local.Exists(r.Context(), algo, hash)
+		if err != nil || exists {
+			// Serving normally reports the error
+			return false
+		}
+	default:
+		errutil.LogMsg(err, "Failed to presign cached object", "algo", algo, "hash", hash)
+		return false
+	}
+
+	for _, u := range h.Upstreams {
+		source := upstreamURL(u, algo, hash)
+		size, err := h.probeSource(r.Context(), algo, hash, source, nil)
+		if err != nil {
+			errutil.LogMsg(err, "Probe of upstream failed", "url", source)
+			continue
+		}
+		if size < h.RedirectMinSize {
+			// Unknown or small: fetching it ourselves also fills the cache
+			return false
+		}
+		slog.Info("Redirecting to upstream", "url", source, "hash", hash, "size", size)
+		h.stats.misses.Add(1)
+		setCacheStatus(w, cacheUpstream, source)
+		http.Redirect(w, r, source, http.StatusFound)
+		return true
+	}
+	return false
+}
+
+func (h *CASHandler) presign(r *http.Request, algo, hash string) (string, int64, error) {
+	presigner, ok := h.Local.(repository.PresigningRepository)
+	if !ok {
+		return "", 0, errors.ErrUnsupported
+	}
+	expiry := h.RedirectExpiry
+	if expiry <= 0 {
+		expiry = defaultRedirectExpiry
+	}
+	return presigner.PresignGet(r.Context(), algo, hash, expiry)
+}
@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"cmp"
+	"log/slog"
+	"maps"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// recentFetches is how many of the latest attempts from a source the
+	// rolling figures cover.
+	recentFetches = 20
+	// minRecentFetches is how many attempts a source needs before it can be
+	// called degraded, so one failure doesn't flag it.
+	minRecentFetches = 5
+	// degradedErrorRate is the share of recent attempts failing that marks
+	// a source as degraded.
+	degradedErrorRate = 0.5
+	// maxOrigins is how many source origins are tracked by name, besides
+	// the configured upstreams. Past twice as many, those with the fewest
+	// bytes are folded into otherOrigin.
+	maxOrigins = 100
+)
+
+// otherOrigin collects the fetches of origins that aren't tracked by name.
+const otherOrigin = "other"
+
+// stats counts how requests were served since start.
+type stats struct {
+	hits   atomic.Int64
+	misses atomic.Int64
+
+	mu           sync.Mutex
+	sources      map[string]*sourceState // by source origin
+	traffic      Traffic
+	trafficDirty bool       // traffic changed since the last SaveTraffic
+	saveMu       sync.Mutex // serializes SaveTraffic
+}
+
+// sourceState is what is known about one source origin.
+type sourceState struct {
+	SourceStats
+	recent [recentFetches]fetchSample // ring buffer of the latest attempts
+	next   int
+}
+
+// fetchSample is the outcome of one attempt. latency is 0 when the source
+// never answered.
+type fetchSample struct {
+	latency time.Duration
+	ok      bool
+}
+
+// SourceStats counts the fetches made from one source origin.
+type SourceStats struct {
+	Fetches  int64 `json:"fetches"`
+	Failures int64 `json:"failures"`
+	Bytes    int64 `json:"bytes"`
+	// Upstream tells whether the origin is a configured upstream.
+	Upstream bool `json:"upstream"`
+	// The Recent figures cover the latest attempts only, so they follow a
+	// mirror going bad or recovering. RecentLatencyMs is the mean time to
+	// response headers of the attempts that got any.
+	RecentFetches   int     `json:"recent_fetches"`
+	RecentErrorRate float64 `json:"recent_error_rate"`
+	RecentLatencyMs float64 `json:"recent_latency_ms"`
+	// Degraded is set while the recent error rate or latency is too high.
+	Degraded bool `json:"degraded"`
+}
+
+// Stats is a snapshot of the request counters.
+type Stats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	// Sources is keyed by scheme://host. Only the busiest origins are kept
+	// by name, the rest are counted under "other", so arbitrary
+	// X-Source-Urls don't grow it without bound.
+	Sources map[string]SourceStats `json:"sources"`
+	Traffic Traffic                `json:"traffic"`
+}
+
+// Stats returns the request counters since the handler was created.
+func (h *CASHandler) Stats() Stats {
+	h.stats.mu.Lock()
+	defer h.stats.mu.Unlock()
+	sources := make(map[string]SourceStats, len(h.stats.sources))
+	for origin, s := range h.stats.sources {
+		sources[origin] = s.SourceStats
+	}
+	return Stats{
+		Hits:    h.stats.hits.Load(),
+		Misses:  h.stats.misses.Load(),
+		Sources: sources,
+		Traffic: h.stats.traffic.clone(),
+	}
+}
+
+// recordFetch counts a fetch attempt from source that transferred n bytes,
+// and logs when it makes the source degrade or recover. slow, if positive,
+// is the mean latency at which a source counts as degraded.
+func (s *stats) recordFetch(source string, upstream bool, n int64, sample fetchSample, slow time.Duration) {
+	origin := source
+	if u, parseErr := url.Parse(source); parseErr == nil && u.Host != "" {
+		origin = u.Scheme + "://" + u.Host
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recordFetched(origin, upstream, n)
+	if s.sources == nil {
+		s.sources = make(map[string]*sourceState)
+	}
+	st, found := s.sources[origin]
+	if !found {
+		st = &sourceState{SourceStats: SourceStats{Upstream: upstream}}
+		s.sources[origin] = st
+		s.foldSources()
+		if _, kept := s.sources[origin]; !kept {
+			origin = otherOrigin
+			st = s.sources[origin]
+		}
+	}
+	st.Fetches++
+	st.Bytes += n
+	if !sample.ok {
+		st.Failures++
+	}
+	st.Upstream = st.Upstream || upstream
+
+	st.recent[st.next] = sample
+	st.next = (st.next + 1) % recentFetches
+	st.RecentFetches = min(st.RecentFetches+1, recentFetches)
+	var failures, answered int
+	var latency time.Duration
+	for _, r := range st.recent[:st.RecentFetches] {
+		if !r.ok {
+			failures++
+		}
+		if r.latency > 0 {
+			answered++
+			latency += r.latency
+		}
+	}
+	st.RecentErrorRate = float64(failures) / float64(st.RecentFetches)
+	st.RecentLatencyMs = 0
+	if answered > 0 {
+		latency /= time.Duration(answered)
+		st.RecentLatencyMs = float64(latency.Microseconds()) / 1000
+	}
+
+	degraded := st.RecentFetches >= minRecentFetches &&
+		(st.RecentErrorRate >= degradedErrorRate || slow > 0 && latency >= slow)
+	if degraded != st.Degraded {
+		st.Degraded = degraded
+		if degraded {
+			slog.Warn("Source degraded", "origin", origin, "upstream", st.Upstream, "error_rate", st.RecentErrorRate, "latency", latency)
+		} else {
+			slog.Info("Source recovered", "origin", origin, "upstream", st.Upstream, "error_rate", st.RecentErrorRate, "latency", latency)
+		}
+	}
+}
+
+// foldSources merges the least busy origins into otherOrigin once there are
+// too many. It must be called with s.mu held.
+func (s *stats) foldSources() {
+	bytes := make(map[string]int64, len(s.sources))
+	for origin, st := range s.sources {
+		if !st.Upstream {
+			bytes[origin] = st.Bytes
+		}
+	}
+	fold := originsToFold(bytes)
+	if len(fold) == 0 {
+		return
+	}
+	other, ok := s.sources[otherOrigin]
+	if !ok {
+		other = &sourceState{}
+		s.sources[otherOrigin] = other
+	}
+	for _, origin := range fold {
+		st := s.sources[origin]
+		other.Fetches += st.Fetches
+		other.Failures += st.Failures
+		other.Bytes += st.Bytes
+		delete(s.sources, origin)
+	}
+}
+
+// originsToFold returns the origins to merge into otherOrigin once there
+// are over twice maxOrigins of them: all but the maxOrigins with the most
+// bytes. bytes holds the origins that may be folded.
+func originsToFold(bytes map[string]int64) []string {
+	delete(bytes, otherOrigin)
+	if len(bytes) <= 2*maxOrigins {
+		return nil
+	}
+	origins := slices.Collect(maps.Keys(bytes))
+	slices.SortFunc(origins, func(a, b string) int {
+		return cmp.Compare(bytes[b], bytes[a])
+	})
+	return origins[maxOrigins:]
+}
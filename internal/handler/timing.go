@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Values of the X-Cache header, telling clients where a response came from.
+const (
+	cacheHit      = "HIT"      // served from the local cache
+	cacheMiss     = "MISS"     // fetched from an origin source
+	cacheUpstream = "UPSTREAM" // fetched from a configured upstream
+)
+
+// setCacheStatus sets X-Cache, and X-Fetch-Source if the bytes come from a source.
+func setCacheStatus(w http.ResponseWriter, status, source string) {
+	w.Header().Set("X-Cache", status)
+	if source != "" {
+		w.Header().Set("X-Fetch-Source", displaySource(source))
+	}
+}
+
+// addServerTiming adds the duration of the phase that began at start to Server-Timing.
+func addServerTiming(w http.ResponseWriter, phase string, start time.Time) {
+	ms := float64(time.Since(start).Microseconds()) / 1000
+	w.Header().Add("Server-Timing", fmt.Sprintf("%s;dur=%.1f", phase, ms))
+}
+
+// fetchStatus tells whether source is one of the configured upstreams.
+func (h *CASHandler) fetchStatus(source, algo, hash string) string {
+	for _, u := range h.Upstreams {
+		if upstreamURL(u, algo, hash) == source {
+			return cacheUpstream
+		}
+	}
+	return cacheMiss
+}
+
+// displaySource strips credentials and query strings, which may hold
+// tokens, from source before it is echoed back to clients.
+func displaySource(source string) string {
+	u, err := url.Parse(source)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
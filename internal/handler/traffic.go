@@ -0,0 +1,210 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+)
+
+// TrafficFileName is the sidecar, relative to the cache dir, where traffic
+// totals are persisted so they survive restarts.
+const TrafficFileName = ".traffic.json"
+
+// trafficDays is how many days of daily totals are kept.
+const trafficDays = 90
+
+// Traffic accounts for the external bandwidth used and saved since Since,
+// across restarts if persisted with SaveTraffic.
+type Traffic struct {
+	Since time.Time `json:"since"`
+	// FetchedBytes were downloaded from sources and upstreams, failed
+	// attempts included.
+	FetchedBytes int64 `json:"fetched_bytes"`
+	// SavedBytes were sent to clients from the cache or from a download
+	// another request started, without fetching them again.
+	SavedBytes int64 `json:"saved_bytes"`
+	// Origins is keyed by scheme://host and folds the least busy ones into
+	// "other", like Stats.Sources.
+	Origins map[string]OriginTraffic `json:"origins"`
+	// Days is keyed by UTC date, like 2006-01-02, for the last 90 days.
+	Days map[string]DayTraffic `json:"days"`
+}
+
+// OriginTraffic is the bandwidth used on one source origin.
+type OriginTraffic struct {
+	Upstream bool  `json:"upstream"`
+	Fetches  int64 `json:"fetches"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// DayTraffic is the bandwidth used and saved in one day.
+type DayTraffic struct {
+	FetchedBytes int64 `json:"fetched_bytes"`
+	SavedBytes   int64 `json:"saved_bytes"`
+}
+
+// clone returns a deep copy of t.
+func (t Traffic) clone() Traffic {
+	t.Origins = maps.Clone(t.Origins)
+	t.Days = maps.Clone(t.Days)
+	return t
+}
+
+// add adds bytes fetched and saved at now to the totals, dropping the days
+// that fell out of the window.
+func (t *Traffic) add(now time.Time, fetched, saved int64) {
+	if t.Since.IsZero() {
+		t.Since = now
+	}
+	t.FetchedBytes += fetched
+	t.SavedBytes += saved
+
+	key := now.UTC().Format(time.DateOnly)
+	if _, ok := t.Days[key]; !ok {
+		if t.Days == nil {
+			t.Days = make(map[string]DayTraffic)
+		}
+		oldest := now.UTC().AddDate(0, 0, 1-trafficDays).Format(time.DateOnly)
+		for k := range t.Days {
+			// Dates in this format sort lexically
+			if k < oldest {
+				delete(t.Days, k)
+			}
+		}
+	}
+	d := t.Days[key]
+	d.FetchedBytes += fetched
+	d.SavedBytes += saved
+	t.Days[key] = d
+}
+
+// foldOrigins merges the least busy origins into otherOrigin once there are too many.
+func (t *Traffic) foldOrigins() {
+	bytes := make(map[string]int64, len(t.Origins))
+	for origin, o := range t.Origins {
+		if !o.Upstream {
+			bytes[origin] = o.Bytes
+		}
+	}
+	for _, origin := range originsToFold(bytes) {
+		other := t.Origins[otherOrigin]
+		other.Fetches += t.Origins[origin].Fetches
+		other.Bytes += t.Origins[origin].Bytes
+		t.Origins[otherOrigin] = other
+		delete(t.Origins, origin)
+	}
+}
+
+// recordFetched adds n bytes fetched from origin to the traffic. It must be
+// called with s.mu held.
+func (s *stats) recordFetched(origin string, upstream bool, n int64) {
+	if s.traffic.Origins == nil {
+		s.traffic.Origins = make(map[string]OriginTraffic)
+	}
+	o, found := s.traffic.Origins[origin]
+	o.Upstream = o.Upstream || upstream
+	o.Fetches++
+	o.Bytes += n
+	s.traffic.Origins[origin] = o
+	if !found {
+		s.traffic.foldOrigins()
+	}
+	s.traffic.add(time.Now(), n, 0)
+	s.trafficDirty = true
+}
+
+// recordSaved adds n bytes sent to clients without fetching them.
+func (s *stats) recordSaved(n int64) {
+	if n == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.traffic.add(time.Now(), 0, n)
+	s.trafficDirty = true
+}
+
+// LoadTraffic resumes the traffic totals saved at path. A missing file
+// starts them from now.
+func (h *CASHandler) LoadTraffic(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read traffic totals: %w", err)
+	}
+	var t Traffic
+	if err := json.Unmarshal(data, &t); err != nil {
+		return fmt.Errorf("failed to parse traffic totals: %w", err)
+	}
+	t.foldOrigins()
+	h.stats.mu.Lock()
+	defer h.stats.mu.Unlock()
+	h.stats.traffic = t
+	return nil
+}
+
+// SaveTraffic persists the traffic totals to path if they changed since the last save.
+func (h *CASHandler) SaveTraffic(path string) error {
+	h.stats.saveMu.Lock()
+	defer h.stats.saveMu.Unlock()
+	h.stats.mu.Lock()
+	if !h.stats.trafficDirty {
+		h.stats.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(h.stats.traffic)
+	h.stats.trafficDirty = false
+	h.stats.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode traffic totals: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write traffic totals: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		errutil.LogMsg(os.Remove(tmp), "Failed to remove temp traffic totals", "path", tmp)
+		return fmt.Errorf("failed to write traffic totals: %w", err)
+	}
+	return nil
+}
+
+// countingResponse counts the body bytes written to a ResponseWriter.
+type countingResponse struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countingResponse) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps sendfile working for cached files.
+func (c *countingResponse) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := c.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{c.ResponseWriter}, r)
+	}
+	c.n += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (c *countingResponse) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
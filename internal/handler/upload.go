@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/hashutil"
+	"github.com/lucasew/fetchurl/internal/repository"
+)
+
+// handleUpload stores the request body under algo/hash after verifying its digest.
+//
+// It answers 201 when the object was stored and 200 when it was already cached.
+func (h *CASHandler) handleUpload(w http.ResponseWriter, r *http.Request, algo, hash string) {
+	if !h.writesEnabled() {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Uploads are disabled", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizedUpload(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="fetchurl"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	exists, err := h.Local.Exists(r.Context(), algo, hash)
+	if err != nil {
+		errutil.ReportError(err, "Failed to check cache existence")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length is required", http.StatusLengthRequired)
+		return
+	}
+
+	// Wait for fetches of the same object rather than race them, each upload
+	// still reads and verifies its own body
+	err = h.exclusive(algo+":"+hash, func() error {
+		return h.storeUpload(r, algo, hash)
+	})
+	switch {
+	case err == nil:
+		slog.Info("Stored uploaded file", "algo", algo, "hash", hash, "size", r.ContentLength)
+		w.WriteHeader(http.StatusCreated)
+	case errors.Is(err, errDigestMismatch):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, repository.ErrInsufficientSpace):
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	default:
+		errutil.ReportError(err, "Upload failed", "hash", hash)
+		http.Error(w, fmt.Sprintf("Upload failed: %v", err), http.StatusInternalServerError)
+	}
+}
+
+var errDigestMismatch = errors.New("uploaded content does not match")
+
+func (h *CASHandler) writesEnabled() bool {
+	return h.UploadToken != "" || h.AuthorizeWrite != nil
+}
+
+func (h *CASHandler) authorizedUpload(r *http.Request) bool {
+	if h.AuthorizeWrite != nil {
+		return h.AuthorizeWrite(r)
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(h.UploadToken)) == 1
+}
+
+func (h *CASHandler) storeUpload(r *http.Request, algo, hash string) error {
+	hasher, err := hashutil.GetHasher(algo)
+	if err != nil {
+		return err
+	}
+	tmpFile, commit, err := h.Local.BeginWrite(algo, hash, r.ContentLength)
+	if err != nil {
+		return err
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			errutil.LogMsg(tmpFile.Close(), "Failed to close temp file")
+			if f, ok := tmpFile.(*os.File); ok {
+				errutil.LogMsg(os.Remove(f.Name()), "Failed to remove temp file", "path", f.Name())
+			}
+		}
+	}()
+
+	aliaser, _ := h.Local.(repository.AliasRepository)
+	aliasHashers, err := newAliasHashers(algo, aliaser != nil)
+	if err != nil {
+		return err
+	}
+	writers := []io.Writer{tmpFile, hasher}
+	for _, hh := range aliasHashers {
+		writers = append(writers, hh)
+	}
+
+	written, err := io.Copy(io.MultiWriter(writers...), r.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read upload: %w", err)
+	}
+	if written != r.ContentLength {
+		return fmt.Errorf("%w: got %d bytes, expected %d", errDigestMismatch, written, r.ContentLength)
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); actual != hash {
+		return fmt.Errorf("%w: %s digest is %s", errDigestMismatch, algo, actual)
+	}
+
+	if err := commit(); err != nil {
+		return fmt.Errorf("failed to commit file: %w", err)
+	}
+	committed = true
+	// Uploaders describe the object the same way an origin would
+	h.afterCommit(algo, hash, aliaser, aliasHashers, metadataFromHeader(r.Header))
+	return nil
+}
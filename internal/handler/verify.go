@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/hashutil"
+	"github.com/lucasew/fetchurl/internal/repository"
+)
+
+// VerifyResult reports the outcome of re-hashing a stored object.
+type VerifyResult struct {
+	Algo   string `json:"algo"`
+	Hash   string `json:"hash"`
+	Actual string `json:"actual"`
+	OK     bool   `json:"ok"`
+	// Deleted is set when a corrupted object was removed from the cache.
+	Deleted bool `json:"deleted"`
+}
+
+// handleVerify re-hashes a stored object and deletes it if its content no
+// longer matches its digest, so the next request fetches it again. It reads
+// the whole object and may delete it, so it requires the same token as uploads.
+func (h *CASHandler) handleVerify(w http.ResponseWriter, r *http.Request, algo, hash string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.writesEnabled() {
+		http.Error(w, "Verification is disabled", http.StatusForbidden)
+		return
+	}
+	if !h.authorizedUpload(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="fetchurl"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var result VerifyResult
+	err := h.exclusive(algo+":"+hash, func() error {
+		var err error
+		result, err = h.verifyStored(r, algo, hash)
+		return err
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errutil.ReportError(err, "Failed to verify cached file", "hash", hash)
+		http.Error(w, fmt.Sprintf("Failed to verify: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		errutil.LogMsg(err, "Failed to write verify response")
+	}
+}
+
+// verifyStored re-hashes algo/hash and deletes it if corrupted.
+func (h *CASHandler) verifyStored(r *http.Request, algo, hash string) (VerifyResult, error) {
+	actual, err := h.digestStored(r, algo, hash)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+
+	result := VerifyResult{Algo: algo, Hash: hash, Actual: actual, OK: actual == hash}
+	if !result.OK {
+		errutil.ReportError(fmt.Errorf("cached file is corrupted"), "Verification failed", "algo", algo, "hash", hash, "actual", actual)
+		if deleter, ok := h.Local.(repository.DeletableRepository); ok {
+			if err := deleter.Delete(r.Context(), algo, hash); err != nil {
+				errutil.ReportError(err, "Failed to delete corrupted file", "hash", hash)
+			} else {
+				slog.Info("Deleted corrupted file", "algo", algo, "hash", hash)
+				result.Deleted = true
+			}
+		}
+	}
+	return result, nil
+}
+
+// digestStored returns the hex digest of the stored content of algo/hash.
+//
+// The memory tier keeps what was read before any corruption, so the backing
+// store is read instead.
+func (h *CASHandler) digestStored(r *http.Request, algo, hash string) (string, error) {
+	var store repository.Repository = h.Local
+	if tiered, ok := store.(*repository.TieredRepository); ok {
+		store = tiered.Next
+	}
+	reader, _, err := store.Get(r.Context(), algo, hash)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		errutil.LogMsg(reader.Close(), "Failed to close cache reader")
+	}()
+
+	hasher, err := hashutil.GetHasher(algo)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -4,8 +4,11 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"hash"
+	"sort"
 	"strings"
 )
 
@@ -49,3 +52,52 @@ func IsSupported(name string) bool {
 	_, ok := registry[NormalizeAlgo(name)]
 	return ok
 }
+
+// Names returns the supported algorithm names in sorted order.
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GuessAlgo returns the first supported algorithm whose hex digest has the
+// given length, or an empty string if none matches.
+func GuessAlgo(hexLen int) string {
+	for _, name := range Names() {
+		if registry[name]().Size()*2 == hexLen {
+			return name
+		}
+	}
+	return ""
+}
+
+// ParseSRI parses a Subresource Integrity string such as "sha256-<base64>"
+// into an algorithm name and hex digest. When the string lists several
+// digests, as npm lockfiles may, the first supported one is used.
+func ParseSRI(sri string) (algo, hexHash string, ok bool) {
+	for _, token := range strings.Fields(sri) {
+		// Options after '?' carry no digest information
+		token, _, _ = strings.Cut(token, "?")
+		name, digest, found := strings.Cut(token, "-")
+		if !found {
+			continue
+		}
+		name = NormalizeAlgo(name)
+		factory, supported := registry[name]
+		if !supported {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(digest)
+		if err != nil {
+			raw, err = base64.RawStdEncoding.DecodeString(digest)
+		}
+		if err != nil || len(raw) != factory().Size() {
+			continue
+		}
+		return name, hex.EncodeToString(raw), true
+	}
+	return "", "", false
+}
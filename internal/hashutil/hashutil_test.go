@@ -0,0 +1,31 @@
+package hashutil
+
+import "testing"
+
+func TestParseSRI(t *testing.T) {
+	// sha256 of the empty string
+	const emptyHex = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	const emptySRI = "sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+
+	tests := []struct {
+		in       string
+		wantAlgo string
+		wantHash string
+		wantOK   bool
+	}{
+		{emptySRI, "sha256", emptyHex, true},
+		{"sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU", "sha256", emptyHex, true},
+		{emptySRI + "?opt", "sha256", emptyHex, true},
+		{"md5-1B2M2Y8AsgTpgAmY7PhCfg== " + emptySRI, "sha256", emptyHex, true},
+		{"sha256-AAAA", "", "", false},
+		{"sha256-not base64!", "", "", false},
+		{emptyHex, "", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		algo, hash, ok := ParseSRI(tt.in)
+		if algo != tt.wantAlgo || hash != tt.wantHash || ok != tt.wantOK {
+			t.Errorf("ParseSRI(%q) = %q, %q, %v; want %q, %q, %v", tt.in, algo, hash, ok, tt.wantAlgo, tt.wantHash, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Package hostfilter decides which hosts the server may fetch sources from.
+package hostfilter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Filter holds allow and deny lists of host patterns.
+//
+// A pattern is a hostname ("example.com"), a wildcard matching any subdomain
+// ("*.example.com", which does not match example.com itself) or a CIDR range
+// matched against IP literals ("10.0.0.0/8"). Deny wins over allow. An empty
+// allow list allows every host that is not denied.
+//
+// CheckURL doesn't resolve hostnames, so a CIDR rule there only stops URLs
+// that name the IP directly. Transport enforces the denied ranges on the
+// resolved address of every connection as well.
+type Filter struct {
+	allow []pattern
+	deny  []pattern
+}
+
+type pattern struct {
+	host     string
+	wildcard bool
+	network  *net.IPNet
+}
+
+// New parses the allow and deny patterns.
+func New(allow, deny []string) (*Filter, error) {
+	f := &Filter{}
+	var err error
+	if f.allow, err = parsePatterns(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parsePatterns(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parsePatterns(specs []string) ([]pattern, error) {
+	var patterns []pattern
+	for _, spec := range specs {
+		spec = strings.ToLower(strings.TrimSpace(spec))
+		if spec == "" {
+			continue
+		}
+		if strings.Contains(spec, "/") {
+			_, network, err := net.ParseCIDR(spec)
+			if err != nil {
+				return nil, fmt.Errorf("invalid host pattern %q: %w", spec, err)
+			}
+			patterns = append(patterns, pattern{network: network})
+			continue
+		}
+		if rest, ok := strings.CutPrefix(spec, "*."); ok {
+			patterns = append(patterns, pattern{host: rest, wildcard: true})
+			continue
+		}
+		patterns = append(patterns, pattern{host: spec})
+	}
+	return patterns, nil
+}
+
+func (p pattern) matches(host string) bool {
+	if p.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && p.network.Contains(ip)
+	}
+	if p.wildcard {
+		return strings.HasSuffix(host, "."+p.host)
+	}
+	return host == p.host
+}
+
+func matchAny(patterns []pattern, host string) bool {
+	for _, p := range patterns {
+		if p.matches(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsHost reports whether host (without port) may be fetched from.
+func (f *Filter) AllowsHost(host string) bool {
+	if f == nil {
+		return true
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if matchAny(f.deny, host) {
+		return false
+	}
+	return len(f.allow) == 0 || matchAny(f.allow, host)
+}
+
+// CheckURL returns an error unless rawURL points to an allowed host.
+//
+// file:// URLs have no host and are let through; whether they can be fetched
+// at all is up to the client's transport.
+func (f *Filter) CheckURL(rawURL string) error {
+	if f == nil {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid source URL: %w", err)
+	}
+	if u.Scheme == "file" {
+		return nil
+	}
+	if !f.AllowsHost(u.Hostname()) {
+		return fmt.Errorf("host %q is not allowed", u.Hostname())
+	}
+	return nil
+}
+
+// CheckRedirect is an http.Client CheckRedirect function that refuses
+// redirects to disallowed hosts, keeping Go's default limit of 10 redirects.
+func (f *Filter) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	if err := f.CheckURL(req.URL.String()); err != nil {
+		return fmt.Errorf("refusing redirect: %w", err)
+	}
+	return nil
+}
+
+// Transport returns a copy of base that refuses to connect to addresses in a
+// denied CIDR range. The check runs on the resolved IP, so hostnames pointing
+// at internal addresses, redirects and DNS rebinding can't get around it.
+//
+// Connections to the hosts of trusted URLs, such as configured upstreams, and
+// to the proxies base picks are not checked; a proxy resolves the names itself.
+func (f *Filter) Transport(base *http.Transport, trusted []string) *http.Transport {
+	t := base.Clone()
+	exempt := &sync.Map{}
+	for _, raw := range trusted {
+		if u, err := url.Parse(raw); err == nil && u.Host != "" {
+			exempt.Store(dialAddr(u), true)
+		}
+	}
+	if base.Proxy != nil {
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			u, err := base.Proxy(req)
+			if u != nil {
+				exempt.Store(dialAddr(u), true)
+			}
+			return u, err
+		}
+	}
+
+	// Same settings as http.DefaultTransport
+	plain := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	checked := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: f.control}
+	dial := plain.DialContext
+	if base.DialContext != nil {
+		dial = base.DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if _, ok := exempt.Load(addr); ok {
+			return dial(ctx, network, addr)
+		}
+		return checked.DialContext(ctx, network, addr)
+	}
+	return t
+}
+
+// control is a net.Dialer Control function refusing IPs in a denied range.
+func (f *Filter) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	for _, p := range f.deny {
+		if p.network != nil && p.network.Contains(ip) {
+			return fmt.Errorf("address %s is not allowed", host)
+		}
+	}
+	return nil
+}
+
+// dialAddr returns the host:port a transport dials to reach u.
+func dialAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
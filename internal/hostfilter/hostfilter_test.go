@@ -0,0 +1,103 @@
+package hostfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	f, err := New([]string{"example.com", "*.mirror.org", "203.0.113.0/24"}, []string{"bad.mirror.org"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	cases := map[string]bool{
+		"https://example.com/file":     true,
+		"https://EXAMPLE.com./file":    true,
+		"https://sub.example.com/file": false,
+		"https://a.mirror.org/file":    true,
+		"https://mirror.org/file":      false,
+		"https://bad.mirror.org/file":  false,
+		"http://203.0.113.7:8080/file": true,
+		"http://198.51.100.1/file":     false,
+		"http://[::1]/file":            false,
+		"https://other.net/file":       false,
+		"://not a url":                 false,
+		"file:///mnt/media/file":       true,
+	}
+	for u, want := range cases {
+		if got := f.CheckURL(u) == nil; got != want {
+			t.Errorf("CheckURL(%q) allowed = %v, want %v", u, got, want)
+		}
+	}
+
+	t.Run("Deny Only", func(t *testing.T) {
+		f, err := New(nil, []string{"10.0.0.0/8", "localhost"})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		if err := f.CheckURL("https://example.com/file"); err != nil {
+			t.Errorf("expected unlisted host to be allowed: %v", err)
+		}
+		if f.CheckURL("http://10.1.2.3/file") == nil || f.CheckURL("http://localhost:8080/file") == nil {
+			t.Error("expected denied hosts to be refused")
+		}
+	})
+
+	t.Run("Nil Filter", func(t *testing.T) {
+		var f *Filter
+		if err := f.CheckURL("http://10.1.2.3/file"); err != nil {
+			t.Errorf("expected nil filter to allow everything: %v", err)
+		}
+	})
+
+	t.Run("Invalid CIDR", func(t *testing.T) {
+		if _, err := New([]string{"10.0.0.0/99"}, nil); err == nil {
+			t.Error("expected error for invalid CIDR")
+		}
+	})
+}
+
+func TestFilterTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A hostname passes CheckURL, the address it resolves to must not
+	byName := "http://localhost:" + u.Port() + "/file"
+
+	f, err := New(nil, []string{"127.0.0.0/8", "::1/128"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := f.CheckURL(byName); err != nil {
+		t.Fatalf("expected hostname to pass the URL check: %v", err)
+	}
+
+	get := func(client *http.Client, rawURL string) error {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, rawURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	base := http.DefaultTransport.(*http.Transport)
+	client := &http.Client{Transport: f.Transport(base, nil)}
+	if err := get(client, byName); err == nil {
+		t.Error("expected a connection to a denied address to be refused")
+	}
+
+	trusted := &http.Client{Transport: f.Transport(base, []string{"http://localhost:" + u.Port()})}
+	if err := get(trusted, byName); err != nil {
+		t.Errorf("expected trusted hosts to be dialed: %v", err)
+	}
+}
@@ -34,6 +34,7 @@ func NewClient(caCert *tls.Certificate) *http.Client {
 
 	return &http.Client{
 		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
 			TLSClientConfig: &tls.Config{
 				RootCAs: rootCAs,
 			},
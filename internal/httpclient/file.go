@@ -0,0 +1,66 @@
+package httpclient
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// fileTransport serves file:// URLs from a directory and sends anything else
+// through next.
+type fileTransport struct {
+	files http.RoundTripper
+	next  http.RoundTripper
+}
+
+func (t *fileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "file" {
+		return t.next.RoundTrip(req)
+	}
+	resp, err := t.files.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	// The file transport only sets the header, but sources must report a size
+	if resp.ContentLength < 0 {
+		if n, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+			resp.ContentLength = n
+		}
+	}
+	return resp, nil
+}
+
+// FileTransport returns a RoundTripper that serves file:// URLs from the
+// directory root, with Range support, and sends other requests through next,
+// or http.DefaultTransport if next is nil. The path of a file URL is
+// relative to root, so file:///a/b is root/a/b.
+func FileTransport(root string, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &fileTransport{
+		files: http.NewFileTransport(http.Dir(root)),
+		next:  next,
+	}
+}
+
+// WithFileSources returns a copy of client that also serves file:// URLs
+// from the directory root. Redirects to file:// URLs are refused, so remote
+// sources can't point at local files.
+func WithFileSources(client *http.Client, root string) *http.Client {
+	c := *client
+	c.Transport = FileTransport(root, client.Transport)
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Scheme == "file" {
+			return errors.New("refusing redirect to a file:// URL")
+		}
+		if client.CheckRedirect != nil {
+			return client.CheckRedirect(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &c
+}
@@ -0,0 +1,49 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// NewOutboundClient returns a client for requests to sources, upstreams and
+// storage.
+//
+// proxy, if set, is used for every request instead of whatever HTTPS_PROXY,
+// HTTP_PROXY and NO_PROXY say; HTTPS URLs are tunneled through it with
+// CONNECT, and credentials in its userinfo are sent to it. caFile, if set,
+// is a PEM bundle trusted on top of the system roots, e.g. for a proxy that
+// intercepts TLS. With neither, http.DefaultClient is returned, which
+// already honors the environment.
+func NewOutboundClient(proxy, caFile string) (*http.Client, error) {
+	if proxy == "" && caFile == "" {
+		return http.DefaultClient, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid outbound proxy %q", proxy)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read outbound CA file: %w", err)
+		}
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	}
+	return &http.Client{Transport: transport}, nil
+}
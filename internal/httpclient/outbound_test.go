@@ -0,0 +1,51 @@
+package httpclient
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewOutboundClient(t *testing.T) {
+	if c, err := NewOutboundClient("", ""); err != nil || c != http.DefaultClient {
+		t.Errorf("expected the default client, got %v, %v", c, err)
+	}
+
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		if _, err := io.WriteString(w, "via proxy"); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+	defer proxy.Close()
+
+	c, err := NewOutboundClient(proxy.URL, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp, err := c.Get("http://origin.invalid/file")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Errorf("failed to close body: %v", err)
+	}
+	if proxied != "http://origin.invalid/file" {
+		t.Errorf("expected the request to go through the proxy, got %q", proxied)
+	}
+
+	if _, err := NewOutboundClient("not a url", ""); err == nil {
+		t.Error("expected an error for an invalid proxy")
+	}
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewOutboundClient("", empty); err == nil {
+		t.Error("expected an error for a CA file without certificates")
+	}
+}
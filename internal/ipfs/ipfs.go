@@ -0,0 +1,105 @@
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/repository"
+)
+
+// DefaultGateway is used to resolve ipfs:// and ipns:// URLs when none is configured.
+const DefaultGateway = "https://ipfs.io"
+
+// ResolveURL rewrites ipfs://CID/path and ipns://name/path into a gateway URL.
+// Other URLs are returned unchanged.
+func ResolveURL(source, gateway string) string {
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "ipfs" && u.Scheme != "ipns") || u.Host == "" {
+		return source
+	}
+	if gateway == "" {
+		gateway = DefaultGateway
+	}
+	return fmt.Sprintf("%s/%s/%s%s", strings.TrimRight(gateway, "/"), u.Scheme, u.Host, u.EscapedPath())
+}
+
+// Client talks to the HTTP RPC API of a local IPFS node (e.g. http://127.0.0.1:5001).
+type Client struct {
+	HTTP *http.Client
+	API  string
+}
+
+func NewClient(api string, client *http.Client) *Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Client{HTTP: client, API: strings.TrimRight(api, "/")}
+}
+
+// Add uploads r to the node, pins it and returns its CID.
+func (c *Client) Add(ctx context.Context, name string, r io.Reader) (string, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(part, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.API+"/api/v0/add?pin=true&cid-version=1", pr)
+	if err != nil {
+		errutil.LogMsg(pr.Close(), "Failed to close upload pipe")
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		errutil.LogMsg(resp.Body.Close(), "Failed to close IPFS response body")
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("ipfs add returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Hash string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode ipfs add response: %w", err)
+	}
+	return result.Hash, nil
+}
+
+// Publish adds the object stored as algo/hash in repo to the node.
+func (c *Client) Publish(ctx context.Context, repo repository.Repository, algo, hash string) error {
+	rc, _, err := repo.Get(ctx, algo, hash)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errutil.LogMsg(rc.Close(), "Failed to close cache reader")
+	}()
+
+	cid, err := c.Add(ctx, hash, rc)
+	if err != nil {
+		return fmt.Errorf("failed to publish %s/%s to ipfs: %w", algo, hash, err)
+	}
+	slog.Info("Published to IPFS", "algo", algo, "hash", hash, "cid", cid)
+	return nil
+}
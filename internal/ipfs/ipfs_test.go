@@ -0,0 +1,60 @@
+package ipfs
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResolveURL(t *testing.T) {
+	tests := []struct {
+		source  string
+		gateway string
+		want    string
+	}{
+		{"ipfs://bafybeigdyrzt/file.tar.gz", "http://127.0.0.1:8080/", "http://127.0.0.1:8080/ipfs/bafybeigdyrzt/file.tar.gz"},
+		{"ipns://example.com", "", "https://ipfs.io/ipns/example.com"},
+		{"https://example.com/file", "http://127.0.0.1:8080", "https://example.com/file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			if got := ResolveURL(tt.source, tt.gateway); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientAdd(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v0/add" || r.URL.Query().Get("pin") != "true" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, err := io.ReadAll(f)
+		if err != nil || string(data) != "content" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, err := w.Write([]byte(`{"Name":"x","Hash":"bafkreitest","Size":"7"}`)); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+	defer node.Close()
+
+	c := NewClient(node.URL, nil)
+	cid, err := c.Add(t.Context(), "x", strings.NewReader("content"))
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if cid != "bafkreitest" {
+		t.Errorf("got cid %q", cid)
+	}
+}
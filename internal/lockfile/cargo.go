@@ -0,0 +1,45 @@
+package lockfile
+
+import (
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// cratesDownload is where crates from crates.io are downloaded from.
+const cratesDownload = "https://static.crates.io/crates/"
+
+type cargoLock struct {
+	Package []struct {
+		Name     string `toml:"name"`
+		Version  string `toml:"version"`
+		Source   string `toml:"source"`
+		Checksum string `toml:"checksum"`
+	} `toml:"package"`
+}
+
+func parseCargo(data []byte) ([]Artifact, error) {
+	var lock cargoLock
+	if err := toml.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	var artifacts []Artifact
+	for _, p := range lock.Package {
+		if p.Checksum == "" || !cratesIO(p.Source) {
+			continue
+		}
+		artifacts = append(artifacts, Artifact{
+			URL:  cratesDownload + p.Name + "/" + p.Name + "-" + p.Version + ".crate",
+			Algo: "sha256",
+			Hash: p.Checksum,
+		})
+	}
+	return artifacts, nil
+}
+
+// cratesIO reports whether a Cargo.lock source is the crates.io registry,
+// through either its git or its sparse index.
+func cratesIO(source string) bool {
+	return strings.HasPrefix(source, "registry+https://github.com/rust-lang/crates.io-index") ||
+		strings.HasPrefix(source, "sparse+https://index.crates.io/")
+}
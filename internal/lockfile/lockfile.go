@@ -0,0 +1,111 @@
+// Package lockfile extracts downloadable artifacts and their digests from
+// package manager lockfiles, so they can be prefetched into a cache.
+//
+// Supported are npm's package-lock.json (and npm-shrinkwrap.json), yarn.lock
+// from Yarn 1, pnpm-lock.yaml, Cargo.lock and poetry.lock. Registry packages
+// whose lockfile entry has no URL are assumed to come from the default public
+// registry. Entries without a digest or a fetchable URL, such as git or local
+// path dependencies, are skipped.
+//
+// Files not covered by a lockfile format can be listed in a generic manifest,
+// either a .json array of {"url", "algo", "hash"} objects or a .csv file of
+// url,algo,hash rows.
+package lockfile
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/lucasew/fetchurl/internal/hashutil"
+)
+
+// Artifact is a file a lockfile pins by digest.
+type Artifact struct {
+	URL  string
+	Algo string
+	// Hash is the hex digest of the file.
+	Hash string
+}
+
+// ErrUnsupported is returned for lockfiles whose digests can't be used to
+// fetch anything.
+var ErrUnsupported = errors.New("unsupported lockfile")
+
+var parsers = map[string]func([]byte) ([]Artifact, error){
+	"package-lock.json":   parseNPM,
+	"npm-shrinkwrap.json": parseNPM,
+	"yarn.lock":           parseYarn,
+	"pnpm-lock.yaml":      parsePNPM,
+	"Cargo.lock":          parseCargo,
+	"poetry.lock":         parsePoetry,
+	"go.sum":              parseGoSum,
+}
+
+// manifestParsers parse generic manifests by file extension, for names that
+// aren't a known lockfile.
+var manifestParsers = map[string]func([]byte) ([]Artifact, error){
+	".json": parseJSONManifest,
+	".csv":  parseCSVManifest,
+}
+
+func parser(name string) (func([]byte) ([]Artifact, error), bool) {
+	if parse, ok := parsers[path.Base(name)]; ok {
+		return parse, true
+	}
+	parse, ok := manifestParsers[strings.ToLower(path.Ext(name))]
+	return parse, ok
+}
+
+// Supported reports whether name, a file path, is a lockfile or manifest
+// Parse knows.
+func Supported(name string) bool {
+	_, ok := parser(name)
+	return ok
+}
+
+// Parse returns the artifacts pinned by the lockfile or manifest data, picking
+// the format from the base name of name. Artifacts are returned in file order,
+// with duplicates removed.
+func Parse(name string, data []byte) ([]Artifact, error) {
+	parse, ok := parser(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupported, path.Base(name))
+	}
+	artifacts, err := parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path.Base(name), err)
+	}
+
+	seen := make(map[Artifact]bool, len(artifacts))
+	unique := artifacts[:0]
+	for _, a := range artifacts {
+		if !seen[a] {
+			seen[a] = true
+			unique = append(unique, a)
+		}
+	}
+	return unique, nil
+}
+
+// fetchable reports whether u is a URL the fetcher can download.
+func fetchable(u string) bool {
+	return strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://")
+}
+
+// fromSRI builds an Artifact from a Subresource Integrity string, reporting
+// false if it has no supported digest.
+func fromSRI(u, sri string) (Artifact, bool) {
+	algo, hash, ok := hashutil.ParseSRI(sri)
+	if !ok {
+		return Artifact{}, false
+	}
+	return Artifact{URL: u, Algo: algo, Hash: hash}, true
+}
+
+// parseGoSum rejects go.sum: its h1: hashes cover the extracted module tree,
+// not the zip the module proxy serves, so no file can be fetched by them.
+func parseGoSum([]byte) ([]Artifact, error) {
+	return nil, fmt.Errorf("%w: go.sum hashes cover extracted module trees, not downloadable files", ErrUnsupported)
+}
@@ -0,0 +1,210 @@
+package lockfile
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	// SRI and hex forms of the SHA-512 of the empty string
+	emptySRI    = "sha512-z4PhNX7vuL3xVChQ1m2AB9Yg5AULVxXcg/SpIdNs6c5H0NE8XYXysP+DGNKHfuwvY7kxvUdBeoGlODJ6+SfaPg=="
+	emptySHA512 = "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e"
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	emptySHA1   = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []Artifact
+	}{
+		{
+			name: "package-lock.json",
+			data: `{
+				"lockfileVersion": 3,
+				"packages": {
+					"": {"name": "app"},
+					"node_modules/a": {"resolved": "https://registry.npmjs.org/a/-/a-1.0.0.tgz", "integrity": "` + emptySRI + `"},
+					"node_modules/b": {"resolved": "https://registry.npmjs.org/a/-/a-1.0.0.tgz", "integrity": "` + emptySRI + `"},
+					"node_modules/local": {"resolved": "file:../local"}
+				}
+			}`,
+			want: []Artifact{{URL: "https://registry.npmjs.org/a/-/a-1.0.0.tgz", Algo: "sha512", Hash: emptySHA512}},
+		},
+		{
+			name: "npm-shrinkwrap.json",
+			data: `{
+				"lockfileVersion": 1,
+				"dependencies": {
+					"a": {
+						"resolved": "https://registry.npmjs.org/a/-/a-1.0.0.tgz",
+						"integrity": "` + emptySRI + `",
+						"dependencies": {
+							"b": {"resolved": "https://registry.npmjs.org/b/-/b-2.0.0.tgz", "integrity": "` + emptySRI + `"}
+						}
+					}
+				}
+			}`,
+			want: []Artifact{
+				{URL: "https://registry.npmjs.org/a/-/a-1.0.0.tgz", Algo: "sha512", Hash: emptySHA512},
+				{URL: "https://registry.npmjs.org/b/-/b-2.0.0.tgz", Algo: "sha512", Hash: emptySHA512},
+			},
+		},
+		{
+			name: "yarn.lock",
+			data: `# THIS IS AN AUTOGENERATED FILE. DO NOT EDIT THIS FILE DIRECTLY.
+# yarn lockfile v1
+
+
+a@^1.0.0, a@^1.0.1:
+  version "1.0.0"
+  resolved "https://registry.yarnpkg.com/a/-/a-1.0.0.tgz#` + emptySHA1 + `"
+  integrity ` + emptySRI + `
+
+"@scope/b@2":
+  version "2.0.0"
+  resolved "https://registry.yarnpkg.com/@scope/b/-/b-2.0.0.tgz#` + emptySHA1 + `"
+  dependencies:
+    a "^1.0.0"
+
+c@github:user/c:
+  version "0.0.0"
+  resolved "git+https://github.com/user/c.git"
+`,
+			want: []Artifact{
+				{URL: "https://registry.yarnpkg.com/a/-/a-1.0.0.tgz", Algo: "sha512", Hash: emptySHA512},
+				{URL: "https://registry.yarnpkg.com/@scope/b/-/b-2.0.0.tgz", Algo: "sha1", Hash: emptySHA1},
+			},
+		},
+		{
+			name: "pnpm-lock.yaml",
+			data: `lockfileVersion: '9.0'
+packages:
+  '@scope/a@1.0.0':
+    resolution: {integrity: ` + emptySRI + `}
+  b@2.0.0:
+    resolution: {integrity: ` + emptySRI + `, tarball: https://example.com/b.tgz}
+  c@git+https://github.com/user/c.git#abc:
+    resolution: {commit: abc, repo: https://github.com/user/c.git, type: git}
+`,
+			want: []Artifact{
+				{URL: "https://registry.npmjs.org/@scope/a/-/a-1.0.0.tgz", Algo: "sha512", Hash: emptySHA512},
+				{URL: "https://example.com/b.tgz", Algo: "sha512", Hash: emptySHA512},
+			},
+		},
+		{
+			name: "pnpm-lock.yaml",
+			data: `lockfileVersion: 5.4
+packages:
+  /@scope/a/1.0.0_react@17.0.0:
+    resolution: {integrity: ` + emptySRI + `}
+`,
+			want: []Artifact{{URL: "https://registry.npmjs.org/@scope/a/-/a-1.0.0.tgz", Algo: "sha512", Hash: emptySHA512}},
+		},
+		{
+			name: "Cargo.lock",
+			data: `version = 3
+
+[[package]]
+name = "app"
+version = "0.1.0"
+
+[[package]]
+name = "serde"
+version = "1.0.0"
+source = "registry+https://github.com/rust-lang/crates.io-index"
+checksum = "` + emptySHA256 + `"
+
+[[package]]
+name = "forked"
+version = "0.2.0"
+source = "git+https://github.com/user/forked#abc"
+`,
+			want: []Artifact{{URL: "https://static.crates.io/crates/serde/serde-1.0.0.crate", Algo: "sha256", Hash: emptySHA256}},
+		},
+		{
+			name: "poetry.lock",
+			data: `[[package]]
+name = "requests"
+version = "2.31.0"
+files = [
+    {file = "requests-2.31.0-py3-none-any.whl", hash = "sha256:` + emptySHA256 + `"},
+    {file = "requests-2.31.0.tar.gz", hash = "sha256:` + emptySHA256 + `"},
+]
+
+[[package]]
+name = "private"
+version = "1.0.0"
+files = [
+    {file = "private-1.0.0.tar.gz", hash = "sha256:` + emptySHA256 + `"},
+]
+
+[package.source]
+type = "legacy"
+url = "https://pypi.example.com/simple"
+reference = "private"
+`,
+			want: []Artifact{
+				{URL: "https://files.pythonhosted.org/packages/py3/r/requests/requests-2.31.0-py3-none-any.whl", Algo: "sha256", Hash: emptySHA256},
+				{URL: "https://files.pythonhosted.org/packages/source/r/requests/requests-2.31.0.tar.gz", Algo: "sha256", Hash: emptySHA256},
+			},
+		},
+		{
+			name: "artifacts.json",
+			data: `[
+				{"url": "https://example.com/a.tar.gz", "algo": "SHA-256", "hash": "` + strings.ToUpper(emptySHA256) + `"},
+				{"url": "https://example.com/b.tar.gz", "hash": "` + emptySRI + `"}
+			]`,
+			want: []Artifact{
+				{URL: "https://example.com/a.tar.gz", Algo: "sha256", Hash: emptySHA256},
+				{URL: "https://example.com/b.tar.gz", Algo: "sha512", Hash: emptySHA512},
+			},
+		},
+		{
+			name: "artifacts.CSV",
+			data: "url,algo,hash\n# vendored tools\nhttps://example.com/a.tar.gz, sha256, " + emptySHA256 + "\n",
+			want: []Artifact{{URL: "https://example.com/a.tar.gz", Algo: "sha256", Hash: emptySHA256}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse("/src/"+tt.name, []byte(tt.data))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInvalidManifest(t *testing.T) {
+	tests := []struct {
+		name, data string
+	}{
+		{"a.json", `[{"url": "https://example.com/a", "algo": "md4", "hash": "00"}]`},
+		{"a.json", `[{"algo": "sha256", "hash": "` + emptySHA256 + `"}]`},
+		{"a.csv", "https://example.com/a,sha256,\n"},
+		{"a.csv", "https://example.com/a,sha256\n"},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(tt.name, []byte(tt.data)); err == nil {
+			t.Errorf("Parse(%q, %q) succeeded, want an error", tt.name, tt.data)
+		}
+	}
+}
+
+func TestParseUnsupported(t *testing.T) {
+	for _, name := range []string{"go.sum", "Gemfile.lock"} {
+		if _, err := Parse(name, nil); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("Parse(%q) error = %v, want ErrUnsupported", name, err)
+		}
+	}
+	if _, err := Parse("yarn.lock", []byte("__metadata:\n  version: 6\n")); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Parse of a Yarn 2 lockfile error = %v, want ErrUnsupported", err)
+	}
+}
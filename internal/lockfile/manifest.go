@@ -0,0 +1,83 @@
+package lockfile
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lucasew/fetchurl/internal/hashutil"
+)
+
+// manifestEntry is one file of a generic manifest. Hash may also be a
+// Subresource Integrity string, in which case Algo can be left out.
+type manifestEntry struct {
+	URL  string `json:"url"`
+	Algo string `json:"algo"`
+	Hash string `json:"hash"`
+}
+
+// parseJSONManifest reads a JSON array of {"url", "algo", "hash"} objects.
+func parseJSONManifest(data []byte) ([]Artifact, error) {
+	var entries []manifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	artifacts := make([]Artifact, 0, len(entries))
+	for i, e := range entries {
+		a, err := e.artifact()
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		artifacts = append(artifacts, a)
+	}
+	return artifacts, nil
+}
+
+// parseCSVManifest reads url,algo,hash rows. A first row starting with "url"
+// is taken as a header, and lines starting with # are comments.
+func parseCSVManifest(data []byte) ([]Artifact, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comment = '#'
+	r.FieldsPerRecord = 3
+	r.TrimLeadingSpace = true
+	var artifacts []Artifact
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first && strings.EqualFold(record[0], "url") {
+			continue
+		}
+		line, _ := r.FieldPos(0)
+		a, err := manifestEntry{URL: record[0], Algo: record[1], Hash: record[2]}.artifact()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		artifacts = append(artifacts, a)
+	}
+	return artifacts, nil
+}
+
+func (e manifestEntry) artifact() (Artifact, error) {
+	if e.URL == "" {
+		return Artifact{}, fmt.Errorf("missing url")
+	}
+	if algo, hash, ok := hashutil.ParseSRI(e.Hash); ok {
+		return Artifact{URL: e.URL, Algo: algo, Hash: hash}, nil
+	}
+	algo := hashutil.NormalizeAlgo(e.Algo)
+	if !hashutil.IsSupported(algo) {
+		return Artifact{}, fmt.Errorf("unsupported hash algorithm: %q", e.Algo)
+	}
+	if e.Hash == "" {
+		return Artifact{}, fmt.Errorf("missing hash")
+	}
+	return Artifact{URL: e.URL, Algo: algo, Hash: strings.ToLower(e.Hash)}, nil
+}
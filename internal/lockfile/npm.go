@@ -0,0 +1,69 @@
+package lockfile
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// defaultNPMRegistry is where pnpm packages without a tarball URL come from.
+const defaultNPMRegistry = "https://registry.npmjs.org/"
+
+type npmPackage struct {
+	Resolved     string                `json:"resolved"`
+	Integrity    string                `json:"integrity"`
+	Dependencies map[string]npmPackage `json:"dependencies"`
+}
+
+type npmLock struct {
+	// Packages is set from lockfileVersion 2 on
+	Packages map[string]npmPackage `json:"packages"`
+	// Dependencies is the nested tree of lockfileVersion 1
+	Dependencies map[string]npmPackage `json:"dependencies"`
+}
+
+func parseNPM(data []byte) ([]Artifact, error) {
+	var lock npmLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	var artifacts []Artifact
+	add := func(p npmPackage) {
+		if !fetchable(p.Resolved) {
+			return
+		}
+		if a, ok := fromSRI(p.Resolved, p.Integrity); ok {
+			artifacts = append(artifacts, a)
+		}
+	}
+	if len(lock.Packages) > 0 {
+		for _, key := range sortedKeys(lock.Packages) {
+			add(lock.Packages[key])
+		}
+		return artifacts, nil
+	}
+	var walk func(deps map[string]npmPackage)
+	walk = func(deps map[string]npmPackage) {
+		for _, key := range sortedKeys(deps) {
+			add(deps[key])
+			walk(deps[key].Dependencies)
+		}
+	}
+	walk(lock.Dependencies)
+	return artifacts, nil
+}
+
+// npmTarball is the registry URL of an npm package tarball.
+func npmTarball(registry, name, version string) string {
+	base := name[strings.LastIndex(name, "/")+1:]
+	return strings.TrimSuffix(registry, "/") + "/" + name + "/-/" + base + "-" + version + ".tgz"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
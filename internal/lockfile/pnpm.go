@@ -0,0 +1,72 @@
+package lockfile
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+type pnpmLock struct {
+	LockfileVersion string `yaml:"lockfileVersion"`
+	Packages        map[string]struct {
+		Resolution struct {
+			Integrity string `yaml:"integrity"`
+			Tarball   string `yaml:"tarball"`
+		} `yaml:"resolution"`
+	} `yaml:"packages"`
+}
+
+func parsePNPM(data []byte) ([]Artifact, error) {
+	var lock pnpmLock
+	if err := yaml.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	major, _, _ := strings.Cut(lock.LockfileVersion, ".")
+	version, err := strconv.Atoi(major)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lockfileVersion %q", lock.LockfileVersion)
+	}
+
+	var artifacts []Artifact
+	for _, key := range sortedKeys(lock.Packages) {
+		res := lock.Packages[key].Resolution
+		u := res.Tarball
+		if u == "" {
+			name, ver, ok := pnpmPackageKey(key, version)
+			if !ok {
+				continue
+			}
+			u = npmTarball(defaultNPMRegistry, name, ver)
+		}
+		if !fetchable(u) {
+			continue
+		}
+		if a, ok := fromSRI(u, res.Integrity); ok {
+			artifacts = append(artifacts, a)
+		}
+	}
+	return artifacts, nil
+}
+
+// pnpmPackageKey splits a packages key into name and version. Version 5
+// lockfiles use /name/version_peers, later ones /name@version(peers), and
+// version 9 drops the leading slash.
+func pnpmPackageKey(key string, lockfileVersion int) (name, version string, ok bool) {
+	key = strings.TrimPrefix(key, "/")
+	if lockfileVersion < 6 {
+		i := strings.LastIndex(key, "/")
+		if i <= 0 {
+			return "", "", false
+		}
+		version, _, _ = strings.Cut(key[i+1:], "_")
+		return key[:i], version, version != ""
+	}
+	key, _, _ = strings.Cut(key, "(")
+	i := strings.LastIndex(key, "@")
+	if i <= 0 {
+		return "", "", false
+	}
+	return key[:i], key[i+1:], key[i+1:] != ""
+}
@@ -0,0 +1,83 @@
+package lockfile
+
+import (
+	"strings"
+
+	"github.com/lucasew/fetchurl/internal/hashutil"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// pypiFiles is where PyPI files can be downloaded from by name alone.
+const pypiFiles = "https://files.pythonhosted.org/packages/"
+
+type poetryFile struct {
+	File string `toml:"file"`
+	Hash string `toml:"hash"`
+}
+
+type poetryLock struct {
+	Package []struct {
+		Name   string       `toml:"name"`
+		Files  []poetryFile `toml:"files"`
+		Source struct {
+			Type string `toml:"type"`
+			URL  string `toml:"url"`
+		} `toml:"source"`
+	} `toml:"package"`
+	Metadata struct {
+		// Files is where Poetry before 1.5 keeps the files of each package
+		Files map[string][]poetryFile `toml:"files"`
+	} `toml:"metadata"`
+}
+
+func parsePoetry(data []byte) ([]Artifact, error) {
+	var lock poetryLock
+	if err := toml.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	var artifacts []Artifact
+	for _, p := range lock.Package {
+		files := p.Files
+		if len(files) == 0 {
+			files = lock.Metadata.Files[p.Name]
+		}
+		for _, f := range files {
+			algo, hash, ok := strings.Cut(f.Hash, ":")
+			if !ok || !hashutil.IsSupported(algo) {
+				continue
+			}
+			var u string
+			switch p.Source.Type {
+			case "":
+				u = pypiURL(p.Name, f.File)
+			case "url":
+				u = p.Source.URL
+			default:
+				// Other indexes and VCS sources don't say where the file is
+				continue
+			}
+			if u == "" || !fetchable(u) {
+				continue
+			}
+			artifacts = append(artifacts, Artifact{URL: u, Algo: hashutil.NormalizeAlgo(algo), Hash: hash})
+		}
+	}
+	return artifacts, nil
+}
+
+// pypiURL is the PyPI download URL of a distribution file, which is keyed by
+// the wheel's Python tag, or "source" for source distributions.
+func pypiURL(project, file string) string {
+	if project == "" || file == "" {
+		return ""
+	}
+	pythonTag := "source"
+	if strings.HasSuffix(file, ".whl") {
+		parts := strings.Split(strings.TrimSuffix(file, ".whl"), "-")
+		if len(parts) < 5 {
+			return ""
+		}
+		pythonTag = parts[len(parts)-3]
+	}
+	return pypiFiles + pythonTag + "/" + project[:1] + "/" + project + "/" + file
+}
@@ -0,0 +1,63 @@
+package lockfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYarn reads a Yarn 1 lockfile, where each package is a block of
+// indented "key value" lines under an unindented header.
+func parseYarn(data []byte) ([]Artifact, error) {
+	var artifacts []Artifact
+	var resolved, integrity string
+	flush := func() {
+		defer func() { resolved, integrity = "", "" }()
+		u, fragment, _ := strings.Cut(resolved, "#")
+		if !fetchable(u) {
+			return
+		}
+		if a, ok := fromSRI(u, integrity); ok {
+			artifacts = append(artifacts, a)
+			return
+		}
+		// Old lockfiles only have the SHA-1 in the URL fragment
+		if _, err := hex.DecodeString(fragment); err == nil && len(fragment) == 40 {
+			artifacts = append(artifacts, Artifact{URL: u, Algo: "sha1", Hash: fragment})
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if line[0] != ' ' {
+			if trimmed == "__metadata:" {
+				return nil, fmt.Errorf("%w: yarn.lock from Yarn 2 or later has no download URLs", ErrUnsupported)
+			}
+			flush()
+			continue
+		}
+		key, value, _ := strings.Cut(trimmed, " ")
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		switch key {
+		case "resolved":
+			resolved = value
+		case "integrity":
+			integrity = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return artifacts, nil
+}
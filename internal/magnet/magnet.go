@@ -0,0 +1,53 @@
+// Package magnet extracts HTTP sources from magnet URIs.
+//
+// Swarm downloads are not supported: a magnet URI is usable as a source only
+// when it carries HTTP(S) locations in its ws (web seed), as (acceptable
+// source) or xs (exact source) parameters. The content is still verified
+// against the requested hash, so these locations need not be trusted.
+package magnet
+
+import (
+	"net/url"
+	"strings"
+)
+
+// IsMagnet reports whether source is a magnet URI.
+func IsMagnet(source string) bool {
+	return strings.HasPrefix(strings.ToLower(source), "magnet:")
+}
+
+// Sources returns the HTTP(S) locations carried by a magnet URI, in the order
+// xs, as, ws. It returns nil if uri is not a magnet URI or carries none.
+func Sources(uri string) []string {
+	if !IsMagnet(uri) {
+		return nil
+	}
+	_, rawQuery, _ := strings.Cut(uri, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil
+	}
+
+	var sources []string
+	for _, key := range []string{"xs", "as", "ws"} {
+		for _, v := range query[key] {
+			if strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://") {
+				sources = append(sources, v)
+			}
+		}
+	}
+	return sources
+}
+
+// Expand replaces every magnet URI in sources with its HTTP locations.
+func Expand(sources []string) []string {
+	expanded := make([]string, 0, len(sources))
+	for _, s := range sources {
+		if IsMagnet(s) {
+			expanded = append(expanded, Sources(s)...)
+			continue
+		}
+		expanded = append(expanded, s)
+	}
+	return expanded
+}
@@ -0,0 +1,22 @@
+package magnet
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	got := Expand([]string{
+		"https://example.com/a",
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&dn=model.bin&ws=https%3A%2F%2Fmirror.example%2Fmodel.bin&xs=http%3A%2F%2Fseed.example%2Fmodel.bin&tr=udp%3A%2F%2Ftracker.example%3A80",
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a",
+	})
+	want := []string{
+		"https://example.com/a",
+		"http://seed.example/model.bin",
+		"https://mirror.example/model.bin",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,242 @@
+package migrate
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lucasew/fetchurl/internal/cachelock"
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/hashutil"
+	"github.com/lucasew/fetchurl/internal/repository"
+)
+
+// Options configures a cache layout migration.
+type Options struct {
+	// SrcDir is the cache directory to read from.
+	SrcDir string
+	// DstDir is the cache directory to write to. If empty or equal to SrcDir,
+	// the migration happens in place by renaming files.
+	DstDir string
+	From   repository.Layout
+	To     repository.Layout
+	// Algo is used for flat layouts, which do not record the algorithm.
+	// If empty, the algorithm is guessed from the hash length.
+	Algo string
+	// SkipVerify disables re-hashing objects before they are migrated.
+	SkipVerify bool
+	// Key, if set, decrypts the objects of an encrypted cache to verify
+	// them. Objects are moved as they are, so they stay encrypted.
+	Key []byte
+}
+
+// ErrEncrypted is returned when verifying an encrypted cache without its key.
+var ErrEncrypted = errors.New("cache is encrypted, its key is needed to verify it")
+
+// Result summarizes a migration run.
+type Result struct {
+	Migrated int
+	Skipped  int
+	Corrupt  int
+	Bytes    int64
+}
+
+type entry struct {
+	path string
+	algo string
+	hash string
+}
+
+// Run converts every object found in the source layout to the target layout.
+//
+// Objects whose content does not match their name are left untouched and
+// counted as corrupt. Files that do not belong to the source layout (e.g.
+// temporary files) are skipped.
+func Run(ctx context.Context, opts Options) (Result, error) {
+	var res Result
+
+	dstDir := opts.DstDir
+	if dstDir == "" {
+		dstDir = opts.SrcDir
+	}
+	inPlace := filepath.Clean(dstDir) == filepath.Clean(opts.SrcDir)
+
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		return res, fmt.Errorf("failed to create destination dir: %w", err)
+	}
+	// Moving objects around must not race with a server committing or evicting
+	unlock, err := cachelock.Exclusive(dstDir)
+	if err != nil {
+		return res, err
+	}
+	defer func() {
+		errutil.LogMsg(unlock(), "Failed to release cache lock")
+	}()
+
+	// Collect entries up front so in-place renames don't get walked twice.
+	var entries []entry
+	err = filepath.WalkDir(opts.SrcDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Hidden entries hold bookkeeping (partial downloads, locks), not objects
+		if path != opts.SrcDir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(opts.SrcDir, path)
+		if err != nil {
+			return err
+		}
+		algo, hash, ok := opts.From.Parse(rel)
+		if ok && algo == "" {
+			algo = opts.Algo
+			if algo == "" {
+				algo = hashutil.GuessAlgo(len(hash))
+			}
+		}
+		if !ok || !hashutil.IsSupported(algo) {
+			res.Skipped++
+			return nil
+		}
+		entries = append(entries, entry{path: path, algo: hashutil.NormalizeAlgo(algo), hash: hash})
+		return nil
+	})
+	if err != nil {
+		return res, fmt.Errorf("failed to walk cache dir: %w", err)
+	}
+
+	if !opts.SkipVerify && opts.Key == nil {
+		// Ciphertext never matches its digest, refuse before moving anything
+		for _, e := range entries {
+			encrypted, err := repository.IsEncrypted(e.path)
+			if err != nil {
+				return res, err
+			}
+			if encrypted {
+				return res, fmt.Errorf("%w: %s", ErrEncrypted, e.path)
+			}
+		}
+	}
+
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+
+		if !opts.SkipVerify {
+			valid, err := verifyFile(e.path, e.algo, e.hash, opts.Key)
+			if err != nil {
+				return res, err
+			}
+			if !valid {
+				errutil.LogMsg(fmt.Errorf("hash mismatch"), "Skipping corrupt cache entry", "path", e.path)
+				res.Corrupt++
+				continue
+			}
+		}
+
+		dst := filepath.Join(dstDir, opts.To.RelPath(e.algo, e.hash))
+		if dst == e.path {
+			res.Skipped++
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return res, fmt.Errorf("failed to create destination dir: %w", err)
+		}
+
+		var size int64
+		if inPlace {
+			size, err = moveFile(e.path, dst)
+		} else {
+			size, err = copyFile(e.path, dst, dstDir)
+		}
+		if err != nil {
+			return res, err
+		}
+		res.Migrated++
+		res.Bytes += size
+	}
+
+	slog.Info("Cache migration finished", "migrated", res.Migrated, "skipped", res.Skipped, "corrupt", res.Corrupt, "bytes", res.Bytes)
+	return res, nil
+}
+
+// verifyFile reports whether the content of path hashes to expected,
+// decrypting it with key if set. Caches encrypted after the fact also hold
+// plaintext objects, which are hashed as they are.
+func verifyFile(path, algo, expected string, key []byte) (bool, error) {
+	var f io.ReadCloser
+	var err error
+	if key != nil {
+		f, err = repository.OpenEncrypted(path, key)
+	}
+	if key == nil || errors.Is(err, repository.ErrNotEncrypted) {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		errutil.LogMsg(f.Close(), "Failed to close file", "path", path)
+	}()
+
+	hasher, err := hashutil.GetHasher(algo)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(hasher, f); err != nil {
+		return false, fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)) == expected, nil
+}
+
+func moveFile(src, dst string) (int64, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return 0, fmt.Errorf("failed to move %s: %w", src, err)
+	}
+	return info.Size(), nil
+}
+
+// copyFile copies src into dst atomically through a temp file in tmpDir.
+func copyFile(src, dst, tmpDir string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		errutil.LogMsg(in.Close(), "Failed to close file", "path", src)
+	}()
+
+	tmp, err := os.CreateTemp(tmpDir, "put-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	n, err := io.Copy(tmp, in)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		errutil.LogMsg(os.Remove(tmp.Name()), "Failed to remove temp file", "path", tmp.Name())
+		return 0, fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,126 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lucasew/fetchurl/internal/repository"
+)
+
+func TestRun(t *testing.T) {
+	content := []byte("content")
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	badHash := hex.EncodeToString(make([]byte, 32))
+
+	t.Run("Flat To Sharded In Place", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, hash), content)
+		writeFile(t, filepath.Join(dir, badHash), content)
+		writeFile(t, filepath.Join(dir, "put-123"), content)
+
+		res, err := Run(t.Context(), Options{
+			SrcDir: dir,
+			From:   repository.LayoutFlat,
+			To:     repository.LayoutSharded,
+		})
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if res.Migrated != 1 || res.Corrupt != 1 || res.Skipped != 1 {
+			t.Errorf("unexpected result: %+v", res)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "sha256", hash[:2], hash)); err != nil {
+			t.Errorf("migrated file not found: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, hash)); !os.IsNotExist(err) {
+			t.Errorf("expected source file to be moved, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, badHash)); err != nil {
+			t.Errorf("corrupt file should be left in place: %v", err)
+		}
+	})
+
+	t.Run("Sharded To Algo New Dir", func(t *testing.T) {
+		src := t.TempDir()
+		dst := filepath.Join(t.TempDir(), "out")
+		writeFile(t, filepath.Join(src, repository.LayoutSharded.RelPath("sha256", hash)), content)
+
+		res, err := Run(t.Context(), Options{
+			SrcDir: src,
+			DstDir: dst,
+			From:   repository.LayoutSharded,
+			To:     repository.LayoutAlgo,
+		})
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if res.Migrated != 1 || res.Bytes != int64(len(content)) {
+			t.Errorf("unexpected result: %+v", res)
+		}
+		got, err := os.ReadFile(filepath.Join(dst, "sha256", hash))
+		if err != nil {
+			t.Fatalf("migrated file not found: %v", err)
+		}
+		if string(got) != string(content) {
+			t.Errorf("got %q, want %q", got, content)
+		}
+		if _, err := os.Stat(filepath.Join(src, "sha256", hash[:2], hash)); err != nil {
+			t.Errorf("source file should be kept when copying: %v", err)
+		}
+	})
+
+	t.Run("Encrypted", func(t *testing.T) {
+		dir := t.TempDir()
+		key := make([]byte, 32)
+		repo := repository.NewLocalRepository(dir, nil)
+		if err := repo.SetEncryptionKey(key); err != nil {
+			t.Fatal(err)
+		}
+		w, commit, err := repo.BeginWrite("sha256", hash, int64(len(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := commit(); err != nil {
+			t.Fatal(err)
+		}
+		// Written before the cache was encrypted
+		plain := []byte("plaintext")
+		plainSum := sha256.Sum256(plain)
+		plainHash := hex.EncodeToString(plainSum[:])
+		writeFile(t, filepath.Join(dir, repository.LayoutSharded.RelPath("sha256", plainHash)), plain)
+
+		opts := Options{SrcDir: dir, From: repository.LayoutSharded, To: repository.LayoutAlgo}
+		if _, err := Run(t.Context(), opts); !errors.Is(err, ErrEncrypted) {
+			t.Fatalf("expected ErrEncrypted without the key, got %v", err)
+		}
+
+		opts.Key = key
+		res, err := Run(t.Context(), opts)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if res.Migrated != 2 || res.Corrupt != 0 {
+			t.Errorf("unexpected result: %+v", res)
+		}
+		if encrypted, err := repository.IsEncrypted(filepath.Join(dir, "sha256", hash)); err != nil || !encrypted {
+			t.Errorf("expected the object to stay encrypted, got %v, %v", encrypted, err)
+		}
+	})
+}
+
+func writeFile(t *testing.T, path string, content []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package nixcache
+
+import "fmt"
+
+// alphabet is Nix's base32 alphabet, which omits e, o, u and t.
+const alphabet = "0123456789abcdfghijklmnpqrsvwxyz"
+
+// DecodeBase32 decodes a hash in Nix's base32 encoding.
+//
+// Nix encodes from the last character backwards, so this is not RFC 4648 base32.
+func DecodeBase32(s string) ([]byte, error) {
+	out := make([]byte, len(s)*5/8)
+	for n := 0; n < len(s); n++ {
+		c := s[len(s)-n-1]
+		digit := -1
+		for i := 0; i < len(alphabet); i++ {
+			if alphabet[i] == c {
+				digit = i
+				break
+			}
+		}
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid nix base32 character %q", c)
+		}
+
+		b := n * 5
+		i, j := b/8, uint(b%8)
+		out[i] |= byte(digit << j)
+		carry := byte(digit >> (8 - j))
+		if i+1 < len(out) {
+			out[i+1] |= carry
+		} else if carry != 0 {
+			return nil, fmt.Errorf("invalid nix base32 hash %q", s)
+		}
+	}
+	return out, nil
+}
+
+// EncodeBase32 encodes data in Nix's base32 encoding.
+func EncodeBase32(data []byte) string {
+	size := (len(data)*8-1)/5 + 1
+	out := make([]byte, size)
+	for n := size - 1; n >= 0; n-- {
+		b := n * 5
+		i, j := b/8, uint(b%8)
+		c := int(data[i]) >> j
+		if i+1 < len(data) {
+			c |= int(data[i+1]) << (8 - j)
+		}
+		out[size-n-1] = alphabet[c&0x1f]
+	}
+	return string(out)
+}
@@ -0,0 +1,27 @@
+package nixcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestBase32(t *testing.T) {
+	sum := sha256.Sum256(nil)
+	// nix-hash --type sha256 --to-base32 e3b0c442...
+	want := "0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73"
+
+	if got := EncodeBase32(sum[:]); got != want {
+		t.Errorf("EncodeBase32 = %s, want %s", got, want)
+	}
+	decoded, err := DecodeBase32(want)
+	if err != nil {
+		t.Fatalf("DecodeBase32 failed: %v", err)
+	}
+	if hex.EncodeToString(decoded) != hex.EncodeToString(sum[:]) {
+		t.Errorf("DecodeBase32 = %x, want %x", decoded, sum)
+	}
+	if _, err := DecodeBase32("0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c7e"); err == nil {
+		t.Error("expected error for invalid character")
+	}
+}
@@ -0,0 +1,112 @@
+// Package nixcache serves a Nix binary cache backed by the CAS.
+//
+// Narinfo files are passed through from an upstream substituter, since they
+// are small and keyed by store path rather than content. The NAR files they
+// point to are named after the sha256 of their (compressed) content, e.g.
+// nar/{FileHash}.nar.xz on cache.nixos.org, so they are fetched through the
+// CAS and verified like any other object.
+package nixcache
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/sourceurls"
+)
+
+// Handler implements the Nix binary cache HTTP protocol.
+type Handler struct {
+	// CAS serves /{algo}/{hash} requests, honoring X-Source-Urls.
+	CAS      http.Handler
+	Upstream string
+	Client   *http.Client
+	// Priority is advertised in nix-cache-info. Lower is preferred by Nix.
+	Priority int
+}
+
+func NewHandler(cas http.Handler, upstream string, client *http.Client) *Handler {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Handler{
+		CAS:      cas,
+		Upstream: strings.TrimRight(upstream, "/"),
+		Client:   client,
+		Priority: 30,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case path == "nix-cache-info":
+		w.Header().Set("Content-Type", "text/x-nix-cache-info")
+		if _, err := fmt.Fprintf(w, "StoreDir: /nix/store\nWantMassQuery: 1\nPriority: %d\n", h.Priority); err != nil {
+			errutil.LogMsg(err, "Failed to write nix-cache-info")
+		}
+	case strings.HasSuffix(path, ".narinfo") && !strings.Contains(path, "/"):
+		h.serveNarinfo(w, r, path)
+	case strings.HasPrefix(path, "nar/"):
+		h.serveNar(w, r, path)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Handler) serveNarinfo(w http.ResponseWriter, r *http.Request, path string) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, h.Upstream+"/"+path, nil)
+	if err != nil {
+		http.Error(w, "Invalid narinfo path", http.StatusBadRequest)
+		return
+	}
+	start := time.Now()
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		errutil.LogMsg(err, "Failed to fetch narinfo", "path", path)
+		http.Error(w, "Failed to fetch narinfo", http.StatusBadGateway)
+		return
+	}
+	defer func() {
+		errutil.LogMsg(resp.Body.Close(), "Failed to close response body")
+	}()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	// Narinfos are never cached, see the package doc
+	w.Header().Set("X-Cache", "MISS")
+	w.Header().Set("X-Fetch-Source", req.URL.Redacted())
+	w.Header().Set("Server-Timing", fmt.Sprintf("fetch;dur=%.1f", float64(time.Since(start).Microseconds())/1000))
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		errutil.LogMsg(err, "Failed to copy narinfo", "path", path)
+	}
+}
+
+func (h *Handler) serveNar(w http.ResponseWriter, r *http.Request, path string) {
+	name := strings.TrimPrefix(path, "nar/")
+	fileHash, _, _ := strings.Cut(name, ".")
+	sum, err := DecodeBase32(fileHash)
+	if err != nil || len(sum) != 32 || !strings.HasPrefix(strings.TrimPrefix(name, fileHash), ".nar") {
+		http.NotFound(w, r)
+		return
+	}
+
+	source, err := sourceurls.Encode([]sourceurls.Source{{URL: h.Upstream + "/" + path}})
+	if err != nil {
+		errutil.ReportError(err, "Failed to encode NAR source")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	casReq := r.Clone(r.Context())
+	casReq.URL.Path = "/sha256/" + hex.EncodeToString(sum)
+	casReq.URL.RawPath = ""
+	casReq.Header.Set(sourceurls.Header, source)
+	h.CAS.ServeHTTP(w, casReq)
+}
@@ -0,0 +1,85 @@
+package nixcache
+
+import (
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lucasew/fetchurl/internal/handler"
+	"github.com/lucasew/fetchurl/internal/repository"
+)
+
+func TestHandler(t *testing.T) {
+	nar := []byte("compressed nar contents")
+	sum := sha256.Sum256(nar)
+	narPath := "/nar/" + EncodeBase32(sum[:]) + ".nar.xz"
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/abc.narinfo":
+			if _, err := w.Write([]byte("StorePath: /nix/store/abc-hello\nURL: " + narPath[1:] + "\n")); err != nil {
+				t.Errorf("failed to write: %v", err)
+			}
+		case narPath:
+			if _, err := w.Write(nar); err != nil {
+				t.Errorf("failed to write: %v", err)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	cas := handler.NewCASHandler(repository.NewLocalRepository(t.TempDir(), nil), nil, nil, t.Context())
+	h := NewHandler(cas, upstream.URL, nil)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	t.Run("nix-cache-info", func(t *testing.T) {
+		w := get("/nix-cache-info")
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("narinfo passthrough", func(t *testing.T) {
+		w := get("/abc.narinfo")
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+		if got := w.Header().Get("X-Cache"); got != "MISS" {
+			t.Errorf("expected X-Cache MISS, got %q", got)
+		}
+		if w := get("/missing.narinfo"); w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("NAR through the CAS", func(t *testing.T) {
+		for i := range 2 {
+			w := get(narPath)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+			body, err := io.ReadAll(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != string(nar) {
+				t.Errorf("unexpected body %q", body)
+			}
+			if want := []string{"MISS", "HIT"}[i]; w.Header().Get("X-Cache") != want {
+				t.Errorf("fetch %d: expected X-Cache %s, got %q", i, want, w.Header().Get("X-Cache"))
+			}
+			if i == 0 {
+				upstream.Close() // second fetch must come from the cache
+			}
+		}
+	})
+}
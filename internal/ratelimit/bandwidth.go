@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Bandwidth is a byte budget shared by all the streams going through it.
+// Bursts of up to one second worth of bytes are allowed.
+type Bandwidth struct {
+	// Rate is the sustained number of bytes per second.
+	Rate int64
+
+	mu     sync.Mutex
+	bucket bucket
+}
+
+// NewBandwidth returns a Bandwidth of rate bytes per second, or nil if rate
+// is not positive. A nil Bandwidth does not throttle.
+func NewBandwidth(rate int64) *Bandwidth {
+	if rate <= 0 {
+		return nil
+	}
+	return &Bandwidth{Rate: rate}
+}
+
+// wait blocks until n more bytes fit in the budget.
+func (b *Bandwidth) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	wait := b.bucket.take(time.Now(), float64(b.Rate), float64(b.Rate), float64(n))
+	b.mu.Unlock()
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Reader returns r slowed down to stay within the budget.
+func (b *Bandwidth) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &throttledReader{r: r, b: b, ctx: ctx}
+}
+
+// Writer returns w slowed down to stay within the budget.
+func (b *Bandwidth) Writer(ctx context.Context, w io.Writer) io.Writer {
+	if b == nil {
+		return w
+	}
+	return &bandwidthWriter{w: w, b: b, ctx: ctx}
+}
+
+type throttledReader struct {
+	r   io.Reader
+	b   *Bandwidth
+	ctx context.Context
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Reads no larger than the burst keep the stream smooth
+	n, err := t.r.Read(p[:min(int64(len(p)), t.b.Rate)])
+	if n > 0 {
+		if waitErr := t.b.wait(t.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+type bandwidthWriter struct {
+	w   io.Writer
+	b   *Bandwidth
+	ctx context.Context
+}
+
+func (t *bandwidthWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(int64(len(p)), t.b.Rate)]
+		if err := t.b.wait(t.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
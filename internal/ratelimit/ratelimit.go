@@ -0,0 +1,182 @@
+// Package ratelimit throttles HTTP clients with per-client token buckets.
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idleTimeout is how long a client must be idle before its buckets are dropped.
+const idleTimeout = 10 * time.Minute
+
+// bucket is a token bucket holding up to burst tokens, refilled at rate per second.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills b up to now and removes n tokens, going negative if needed.
+// It returns how long until the balance is back to zero.
+func (b *bucket) take(now time.Time, rate, burst, n float64) time.Duration {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+type client struct {
+	requests bucket
+	bytes    bucket
+	seen     time.Time
+}
+
+// Limiter limits requests and response bytes per second for each client.
+//
+// Clients are told apart by their bearer token when they send one, and by
+// their IP address otherwise. A zero rate disables that limit.
+type Limiter struct {
+	// RequestRate is the sustained number of requests per second.
+	RequestRate float64
+	// RequestBurst is how many requests may be made at once. Defaults to 1.
+	RequestBurst int
+	// ByteRate is the sustained number of response bytes per second.
+	// Responses are slowed down rather than refused. Bursts of up to one
+	// second worth of bytes are allowed.
+	ByteRate int64
+
+	mu        sync.Mutex
+	clients   map[string]*client
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func (l *Limiter) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// clientKey identifies the client making r.
+func clientKey(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+		return "token:" + token
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// reserve takes n tokens from one of key's buckets and returns how long the
+// client must wait before the tokens are really available.
+func (l *Limiter) reserve(key string, requests bool, n float64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock()
+	if l.clients == nil {
+		l.clients = make(map[string]*client)
+	}
+	if now.Sub(l.lastSweep) > idleTimeout {
+		for k, c := range l.clients {
+			if now.Sub(c.seen) > idleTimeout {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	c, ok := l.clients[key]
+	if !ok {
+		c = &client{}
+		l.clients[key] = c
+	}
+	c.seen = now
+
+	if requests {
+		return c.requests.take(now, l.RequestRate, float64(max(l.RequestBurst, 1)), n)
+	}
+	return c.bytes.take(now, float64(l.ByteRate), float64(l.ByteRate), n)
+}
+
+// allowRequest reports whether key may make a request now, or how long to
+// wait before retrying.
+func (l *Limiter) allowRequest(key string) (bool, time.Duration) {
+	if l.RequestRate <= 0 {
+		return true, 0
+	}
+	wait := l.reserve(key, true, 1)
+	if wait == 0 {
+		return true, 0
+	}
+	// Refused requests don't consume a token
+	l.reserve(key, true, -1)
+	return false, wait
+}
+
+// Handler applies the limits to next. Requests over the rate are refused with
+// 429 Too Many Requests; responses over the byte rate are slowed down.
+func (l *Limiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := clientKey(r)
+		if ok, wait := l.allowRequest(key); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		if l.ByteRate > 0 {
+			w = &throttledWriter{ResponseWriter: w, limiter: l, key: key, ctx: r.Context()}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// throttledWriter delays writes so the client stays under the byte rate.
+type throttledWriter struct {
+	http.ResponseWriter
+	limiter *Limiter
+	key     string
+	ctx     context.Context
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Chunks no larger than the burst keep the output smooth
+		chunk := p[:min(int64(len(p)), t.limiter.ByteRate)]
+		if wait := t.limiter.reserve(t.key, false, float64(len(chunk))); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-t.ctx.Done():
+				timer.Stop()
+				return written, t.ctx.Err()
+			case <-timer.C:
+			}
+		}
+		n, err := t.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
@@ -0,0 +1,97 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiterRequests(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := &Limiter{RequestRate: 1, RequestBurst: 2, now: func() time.Time { return now }}
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	do := func(remote, token string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := do("10.0.0.1:1234", ""); code != http.StatusOK {
+			t.Fatalf("request %d within burst: expected 200, got %d", i, code)
+		}
+	}
+	if code := do("10.0.0.1:5678", ""); code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 once the burst is spent, got %d", code)
+	}
+	if code := do("10.0.0.2:1234", ""); code != http.StatusOK {
+		t.Errorf("expected other clients to be unaffected, got %d", code)
+	}
+	if code := do("10.0.0.1:1234", "ci"); code != http.StatusOK {
+		t.Errorf("expected token clients to have their own bucket, got %d", code)
+	}
+
+	now = now.Add(time.Second)
+	if code := do("10.0.0.1:1234", ""); code != http.StatusOK {
+		t.Errorf("expected a refilled token after 1s, got %d", code)
+	}
+}
+
+func TestLimiterBytes(t *testing.T) {
+	l := &Limiter{ByteRate: 1000}
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write(make([]byte, 1500)); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}))
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	elapsed := time.Since(start)
+
+	if w.Body.Len() != 1500 {
+		t.Errorf("expected 1500 bytes, got %d", w.Body.Len())
+	}
+	// The first 1000 bytes are the burst, the rest takes half a second
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("expected the response to be throttled, took %v", elapsed)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	b := NewBandwidth(1000)
+	var out bytes.Buffer
+
+	start := time.Now()
+	// Both streams share the budget
+	for range 2 {
+		if _, err := io.Copy(b.Writer(t.Context(), &out), b.Reader(t.Context(), bytes.NewReader(make([]byte, 400)))); err != nil {
+			t.Fatalf("copy failed: %v", err)
+		}
+	}
+	elapsed := time.Since(start)
+
+	if out.Len() != 800 {
+		t.Errorf("expected 800 bytes, got %d", out.Len())
+	}
+	// 1600 bytes of budget are used: the 1000 byte burst, then 0.6 seconds
+	if elapsed < 500*time.Millisecond {
+		t.Errorf("expected the streams to be throttled, took %v", elapsed)
+	}
+
+	if NewBandwidth(0) != nil {
+		t.Error("expected no Bandwidth for a zero rate")
+	}
+}
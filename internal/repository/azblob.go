@@ -0,0 +1,231 @@
+package repository
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+)
+
+const azureAPIVersion = "2021-08-06"
+
+// AzureBlobRepository implements a WritableRepository backed by an Azure Blob Storage container.
+//
+// Objects are stored as block blobs under {prefix}/{algo}/{shard}/{hash}.
+// Requests are authorized either with a SAS token or with the account key (Shared Key).
+type AzureBlobRepository struct {
+	Client *http.Client
+	// Endpoint is the blob service URL, e.g. https://{account}.blob.core.windows.net
+	Endpoint  *url.URL
+	Account   string
+	Container string
+	Prefix    string
+	// SpoolDir holds uploads in progress. Defaults to the system temp dir.
+	SpoolDir string
+
+	accountKey []byte
+	sasToken   url.Values
+}
+
+// NewAzureBlobRepositoryFromURL builds an AzureBlobRepository from a URL like azblob://container/prefix.
+//
+// The account and credentials come from AZURE_STORAGE_ACCOUNT and either
+// AZURE_STORAGE_SAS_TOKEN or AZURE_STORAGE_KEY. The service endpoint defaults
+// to the public cloud and can be overridden with AZURE_STORAGE_ENDPOINT or the
+// "endpoint" query parameter (e.g. for Azurite).
+func NewAzureBlobRepositoryFromURL(u *url.URL, client *http.Client) (*AzureBlobRepository, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("azblob storage URL must include a container: %s", u)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
+	if account == "" {
+		return nil, fmt.Errorf("AZURE_STORAGE_ACCOUNT must be set for azblob storage")
+	}
+
+	repo := &AzureBlobRepository{
+		Client:    client,
+		Account:   account,
+		Container: u.Host,
+		Prefix:    strings.Trim(u.Path, "/"),
+	}
+
+	if sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		values, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid AZURE_STORAGE_SAS_TOKEN: %w", err)
+		}
+		repo.sasToken = values
+	} else if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AZURE_STORAGE_KEY: %w", err)
+		}
+		repo.accountKey = decoded
+	} else {
+		return nil, fmt.Errorf("AZURE_STORAGE_SAS_TOKEN or AZURE_STORAGE_KEY must be set for azblob storage")
+	}
+
+	endpoint := firstNonEmpty(u.Query().Get("endpoint"), os.Getenv("AZURE_STORAGE_ENDPOINT"), fmt.Sprintf("https://%s.blob.core.windows.net", account))
+	ep, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid azblob endpoint: %w", err)
+	}
+	repo.Endpoint = ep
+	return repo, nil
+}
+
+func init() {
+	Register("azblob", func(u *url.URL, client *http.Client) (WritableRepository, error) {
+		return NewAzureBlobRepositoryFromURL(u, client)
+	})
+}
+
+func (r *AzureBlobRepository) blobURL(algo, hash string) *url.URL {
+	key := path.Join(r.Prefix, strings.ReplaceAll(LayoutSharded.RelPath(algo, hash), "\\", "/"))
+	u := *r.Endpoint
+	u.Path = "/" + path.Join(strings.Trim(r.Endpoint.Path, "/"), r.Container, key)
+	if r.sasToken != nil {
+		u.RawQuery = r.sasToken.Encode()
+	}
+	return &u
+}
+
+func (r *AzureBlobRepository) do(ctx context.Context, method string, u *url.URL, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	if r.accountKey != nil {
+		r.signSharedKey(req)
+	}
+	return r.Client.Do(req)
+}
+
+// signSharedKey authorizes req with the account key, see
+// https://learn.microsoft.com/rest/api/storageservices/authorize-with-shared-key
+func (r *AzureBlobRepository) signSharedKey(req *http.Request) {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var msHeaders []string
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower+":"+strings.TrimSpace(req.Header.Get(name)))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + r.Account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		vs := append([]string(nil), query[k]...)
+		sort.Strings(vs)
+		resource += "\n" + strings.ToLower(k) + ":" + strings.Join(vs, ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(msHeaders, "\n"),
+		resource,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, r.accountKey)
+	mac.Write([]byte(stringToSign))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", r.Account, signature))
+}
+
+func (r *AzureBlobRepository) Exists(ctx context.Context, algo, hash string) (bool, error) {
+	resp, err := r.do(ctx, http.MethodHead, r.blobURL(algo, hash), nil, 0, nil)
+	if err != nil {
+		return false, err
+	}
+	errutil.LogMsg(resp.Body.Close(), "Failed to close Azure response body")
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("azblob HEAD returned status %d", resp.StatusCode)
+	}
+}
+
+func (r *AzureBlobRepository) Get(ctx context.Context, algo, hash string) (io.ReadCloser, int64, error) {
+	resp, err := r.do(ctx, http.MethodGet, r.blobURL(algo, hash), nil, 0, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		errutil.LogMsg(resp.Body.Close(), "Failed to close Azure response body")
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, 0, os.ErrNotExist
+		}
+		return nil, 0, fmt.Errorf("azblob GET returned status %d", resp.StatusCode)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// BeginWrite spools the object to a local temp file; commit uploads it as a block blob.
+func (r *AzureBlobRepository) BeginWrite(algo, hash string, size int64) (io.WriteCloser, func() error, error) {
+	return beginSpooledWrite(r.SpoolDir, func(body io.Reader, size int64) error {
+		header := http.Header{}
+		header.Set("X-Ms-Blob-Type", "BlockBlob")
+		// The context is detached from the request: once verified, the upload should finish.
+		resp, err := r.do(context.Background(), http.MethodPut, r.blobURL(algo, hash), body, size, header)
+		if err != nil {
+			return fmt.Errorf("azblob upload failed: %w", err)
+		}
+		errutil.LogMsg(resp.Body.Close(), "Failed to close Azure response body")
+		if resp.StatusCode != http.StatusCreated {
+			return fmt.Errorf("azblob PUT returned status %d", resp.StatusCode)
+		}
+		slog.Info("Stored file", "algo", algo, "hash", hash, "size", size, "container", r.Container)
+		return nil
+	})
+}
@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAzureBlobRepository(t *testing.T) {
+	objects := map[string][]byte{}
+	var lastAuth, lastQuery string
+
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastAuth = r.Header.Get("Authorization")
+		lastQuery = r.URL.RawQuery
+		switch r.Method {
+		case http.MethodPut:
+			if r.Header.Get("X-Ms-Blob-Type") != "BlockBlob" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("failed to read body: %v", err)
+			}
+			objects[r.URL.Path] = data
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodHead, http.MethodGet:
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Method == http.MethodGet {
+				if _, err := w.Write(data); err != nil {
+					t.Errorf("failed to write: %v", err)
+				}
+			}
+		}
+	}))
+	defer service.Close()
+
+	u, err := url.Parse("azblob://container/prefix?endpoint=" + url.QueryEscape(service.URL+"/devstoreaccount1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Shared Key", func(t *testing.T) {
+		t.Setenv("AZURE_STORAGE_ACCOUNT", "devstoreaccount1")
+		t.Setenv("AZURE_STORAGE_KEY", "c2VjcmV0")
+		repo, err := NewAzureBlobRepositoryFromURL(u, nil)
+		if err != nil {
+			t.Fatalf("NewAzureBlobRepositoryFromURL failed: %v", err)
+		}
+		repo.SpoolDir = t.TempDir()
+
+		w, commit, err := repo.BeginWrite("sha256", "deadbeef", 4)
+		if err != nil {
+			t.Fatalf("BeginWrite failed: %v", err)
+		}
+		if _, err := w.Write([]byte("test")); err != nil {
+			t.Fatal(err)
+		}
+		if err := commit(); err != nil {
+			t.Fatalf("commit failed: %v", err)
+		}
+		if !strings.HasPrefix(lastAuth, "SharedKey devstoreaccount1:") {
+			t.Errorf("expected SharedKey authorization, got %q", lastAuth)
+		}
+		if _, ok := objects["/devstoreaccount1/container/prefix/sha256/de/deadbeef"]; !ok {
+			t.Errorf("blob not stored under expected path, have %v", objects)
+		}
+	})
+
+	t.Run("SAS Token", func(t *testing.T) {
+		t.Setenv("AZURE_STORAGE_ACCOUNT", "devstoreaccount1")
+		t.Setenv("AZURE_STORAGE_SAS_TOKEN", "?sv=2021-08-06&sig=abc")
+		repo, err := NewAzureBlobRepositoryFromURL(u, nil)
+		if err != nil {
+			t.Fatalf("NewAzureBlobRepositoryFromURL failed: %v", err)
+		}
+		exists, err := repo.Exists(t.Context(), "sha256", "missing")
+		if err != nil || exists {
+			t.Errorf("expected missing blob, got %v, %v", exists, err)
+		}
+		if lastAuth != "" || !strings.Contains(lastQuery, "sig=abc") {
+			t.Errorf("expected SAS query auth, got auth %q query %q", lastAuth, lastQuery)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/lucasew/fetchurl/internal/cachelock"
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/hashutil"
+)
+
+// Delete removes an object from the cache together with the aliases under
+// the other algorithms' digests, their metadata and any partial download.
+//
+// Aliases are found by digesting the object, so they are removed even if
+// they ended up as separate copies instead of links.
+func (r *LocalRepository) Delete(ctx context.Context, algo, hash string) error {
+	digests, err := r.digests(ctx, algo, hash)
+	if err != nil {
+		return err
+	}
+
+	// Deleting races with commits like eviction does
+	unlock, err := cachelock.Exclusive(r.CacheDir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errutil.LogMsg(unlock(), "Failed to release cache lock")
+	}()
+
+	for name, digest := range digests {
+		path := r.getPath(name, digest)
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to remove %s/%s: %w", name, digest, err)
+		}
+		if r.eviction != nil {
+			r.eviction.Remove(r.getRelPath(name, digest), info.Size())
+		}
+		if err := os.Remove(r.metadataPath(name, digest)); err != nil && !os.IsNotExist(err) {
+			errutil.LogMsg(err, "Failed to remove metadata", "algo", name, "hash", digest)
+		}
+		slog.Info("Deleted file", "algo", name, "hash", digest)
+	}
+	r.DiscardPartial(algo, hash)
+	return nil
+}
+
+// digests reads algo/digest and returns its digest under every supported algorithm.
+func (r *LocalRepository) digests(ctx context.Context, algo, digest string) (map[string]string, error) {
+	reader, _, err := r.Get(ctx, algo, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		errutil.LogMsg(reader.Close(), "Failed to close cache reader")
+	}()
+
+	hashers := make(map[string]hash.Hash)
+	writers := make([]io.Writer, 0, len(hashutil.Names()))
+	for _, name := range hashutil.Names() {
+		if name == algo {
+			continue
+		}
+		hh, err := hashutil.GetHasher(name)
+		if err != nil {
+			return nil, err
+		}
+		hashers[name] = hh
+		writers = append(writers, hh)
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), reader); err != nil {
+		return nil, fmt.Errorf("failed to digest %s/%s: %w", algo, digest, err)
+	}
+
+	digests := map[string]string{algo: digest}
+	for name, hh := range hashers {
+		digests[name] = hex.EncodeToString(hh.Sum(nil))
+	}
+	return digests, nil
+}
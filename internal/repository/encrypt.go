@@ -0,0 +1,250 @@
+package repository
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+)
+
+// Encrypted objects are stored as a header (magic + random nonce prefix)
+// followed by AES-GCM sealed chunks of encChunkSize plaintext bytes. The last
+// chunk is always shorter than encChunkSize (possibly empty) and is sealed
+// with a distinct additional data byte, so truncation is detected.
+const (
+	encMagic     = "FUENC\x00\x00\x01"
+	encNonceSize = 12
+	encChunkSize = 64 * 1024
+	encHeader    = len(encMagic) + encNonceSize
+	aesOverhead  = 16 // GCM tag size
+)
+
+// ErrNotEncrypted is returned when reading a plaintext object from an encrypted cache.
+var ErrNotEncrypted = errors.New("cache object is not encrypted")
+
+// LoadCacheKey reads a 256-bit AES key from path, either as 32 raw bytes or as 64 hex characters.
+func LoadCacheKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("cache key in %s must be 32 raw bytes or 64 hex characters", path)
+	}
+	return key, nil
+}
+
+// SetEncryptionKey enables encryption at rest for objects written from now on.
+//
+// Resuming partial downloads is disabled while encryption is enabled, as
+// partial files would hold plaintext.
+func (r *LocalRepository) SetEncryptionKey(key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	r.aead = aead
+	return nil
+}
+
+// OpenEncrypted returns the plaintext of the object file at path, encrypted
+// with key, for tools working on cache files directly. A plaintext file,
+// e.g. written before the cache was encrypted, fails with ErrNotEncrypted.
+func OpenEncrypted(path string, key []byte) (io.ReadCloser, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newDecryptReader(f, aead)
+	if err != nil {
+		errutil.LogMsg(f.Close(), "Failed to close file", "path", path)
+		return nil, err
+	}
+	return reader, nil
+}
+
+// IsEncrypted reports whether the object file at path was written encrypted.
+func IsEncrypted(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		errutil.LogMsg(f.Close(), "Failed to close file", "path", path)
+	}()
+	magic := make([]byte, len(encMagic))
+	if _, err := io.ReadFull(f, magic); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return string(magic) == encMagic, nil
+}
+
+func encryptedSize(size int64) int64 {
+	return int64(encHeader) + size + int64(aesOverhead)*(size/encChunkSize+1)
+}
+
+func decryptedSize(size int64) (int64, error) {
+	n := size - int64(encHeader)
+	chunks, rem := n/(encChunkSize+aesOverhead), n%(encChunkSize+aesOverhead)
+	if n < 0 || rem < aesOverhead {
+		return 0, fmt.Errorf("invalid encrypted object size %d", size)
+	}
+	return chunks*encChunkSize + rem - aesOverhead, nil
+}
+
+func chunkNonce(prefix []byte, index uint64) []byte {
+	nonce := append([]byte(nil), prefix...)
+	counter := binary.BigEndian.Uint64(nonce[encNonceSize-8:])
+	binary.BigEndian.PutUint64(nonce[encNonceSize-8:], counter^index)
+	return nonce
+}
+
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptWriter seals data into f. Close abandons the write and removes f;
+// finish seals the last chunk and closes f for committing.
+type encryptWriter struct {
+	f      *os.File
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint64
+	buf    []byte
+	sealed bool
+}
+
+func newEncryptWriter(f *os.File, aead cipher.AEAD) (*encryptWriter, error) {
+	prefix := make([]byte, encNonceSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(append([]byte(encMagic), prefix...)); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{f: f, aead: aead, prefix: prefix, buf: make([]byte, 0, encChunkSize)}, nil
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), encChunkSize-len(w.buf))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(w.buf) == encChunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *encryptWriter) seal(final bool) error {
+	out := w.aead.Seal(nil, chunkNonce(w.prefix, w.index), w.buf, chunkAD(final))
+	w.index++
+	w.buf = w.buf[:0]
+	_, err := w.f.Write(out)
+	return err
+}
+
+func (w *encryptWriter) finish() error {
+	if w.sealed {
+		return nil
+	}
+	if err := w.seal(true); err != nil {
+		return err
+	}
+	w.sealed = true
+	return nil
+}
+
+func (w *encryptWriter) Close() error {
+	err := w.f.Close()
+	errutil.LogMsg(os.Remove(w.f.Name()), "Failed to remove temp file", "path", w.f.Name())
+	return err
+}
+
+// decryptReader opens objects written by encryptWriter.
+type decryptReader struct {
+	f      *os.File
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint64
+	chunk  []byte
+	buf    []byte
+	done   bool
+}
+
+func newDecryptReader(f *os.File, aead cipher.AEAD) (*decryptReader, error) {
+	header := make([]byte, encHeader)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:len(encMagic)]) != encMagic {
+		return nil, fmt.Errorf("%w: %s", ErrNotEncrypted, f.Name())
+	}
+	return &decryptReader{
+		f:      f,
+		aead:   aead,
+		prefix: header[len(encMagic):],
+		chunk:  make([]byte, encChunkSize+aesOverhead),
+	}, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.f, r.chunk)
+		final := false
+		switch {
+		case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+			final = true
+		case err != nil:
+			return 0, err
+		}
+		plain, err := r.aead.Open(nil, chunkNonce(r.prefix, r.index), r.chunk[:n], chunkAD(final))
+		if err != nil {
+			return 0, fmt.Errorf("failed to decrypt %s: %w", r.f.Name(), err)
+		}
+		r.index++
+		r.buf = plain
+		r.done = final
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.f.Close()
+}
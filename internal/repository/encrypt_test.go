@@ -0,0 +1,106 @@
+package repository
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedLocalRepository(t *testing.T) {
+	tempDir := t.TempDir()
+	repo := NewLocalRepository(tempDir, nil)
+	if err := repo.SetEncryptionKey(bytes.Repeat([]byte{0x42}, 32)); err != nil {
+		t.Fatalf("SetEncryptionKey failed: %v", err)
+	}
+	ctx := t.Context()
+
+	for _, size := range []int{0, 5, encChunkSize, 2*encChunkSize + 123} {
+		content := bytes.Repeat([]byte("secret!"), size/7+1)[:size]
+		hash := fmt.Sprintf("%08x", size)
+
+		w, commit, err := repo.BeginWrite("sha256", hash, int64(size))
+		if err != nil {
+			t.Fatalf("BeginWrite failed: %v", err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := commit(); err != nil {
+			t.Fatalf("commit failed: %v", err)
+		}
+
+		path := repo.getPath("sha256", hash)
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(raw)) != encryptedSize(int64(size)) {
+			t.Errorf("size %d: on-disk size %d, want %d", size, len(raw), encryptedSize(int64(size)))
+		}
+		if size > 0 && bytes.Contains(raw, content[:min(size, 7)]) {
+			t.Errorf("size %d: plaintext found on disk", size)
+		}
+
+		rc, gotSize, err := repo.Get(ctx, "sha256", hash)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		data, err := io.ReadAll(rc)
+		if closeErr := rc.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatalf("size %d: read failed: %v", size, err)
+		}
+		if gotSize != int64(size) || !bytes.Equal(data, content) {
+			t.Errorf("size %d: round trip mismatch (reported size %d, read %d bytes)", size, gotSize, len(data))
+		}
+	}
+
+	t.Run("Detects truncation", func(t *testing.T) {
+		hash := fmt.Sprintf("%08x", 2*encChunkSize+123)
+		path := repo.getPath("sha256", hash)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Cut exactly at a chunk boundary, dropping the final chunk
+		if err := os.Truncate(path, int64(encHeader)+2*(encChunkSize+aesOverhead)); err != nil {
+			t.Fatal(err)
+		}
+		rc, _, err := repo.Get(ctx, "sha256", hash)
+		if err == nil {
+			_, err = io.ReadAll(rc)
+			errClose := rc.Close()
+			if errClose != nil {
+				t.Error(errClose)
+			}
+		}
+		if err == nil {
+			t.Errorf("expected error reading truncated object (was %d bytes)", info.Size())
+		}
+	})
+
+	t.Run("Abandoned write leaves no temp file", func(t *testing.T) {
+		w, _, err := repo.BeginWrite("sha256", "abandoned", -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("partial")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		matches, err := filepath.Glob(filepath.Join(tempDir, "put-*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) != 0 {
+			t.Errorf("expected temp files to be removed, found %v", matches)
+		}
+	})
+}
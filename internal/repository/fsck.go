@@ -0,0 +1,205 @@
+package repository
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/cachelock"
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/hashutil"
+)
+
+// quarantineDir holds corrupt objects set aside by Fsck. It is hidden so
+// it's not mistaken for cached objects by the eviction manager.
+const quarantineDir = ".quarantine"
+
+// fsckPageSize is how many objects Fsck lists at a time.
+const fsckPageSize = 1000
+
+// FsckOptions controls Fsck.
+type FsckOptions struct {
+	// Quarantine moves corrupt objects under .quarantine instead of deleting them.
+	Quarantine bool
+	// TempAge is how old a temp file must be to be removed as orphaned.
+	TempAge time.Duration
+}
+
+// FsckResult summarizes what Fsck found.
+type FsckResult struct {
+	Checked     int
+	Corrupt     int
+	Temp        int
+	OrphanMeta  int
+	CheckedSize int64
+}
+
+// Fsck re-hashes every stored object and removes, or quarantines, those that
+// don't match their digest, along with orphaned temp files and the metadata
+// sidecars of objects that are gone.
+//
+// Corrupt objects are also dropped from the eviction manager, if any, but
+// persisted access times are only pruned when the eviction state is next loaded.
+func (r *LocalRepository) Fsck(ctx context.Context, opts FsckOptions) (FsckResult, error) {
+	var res FsckResult
+	for _, algo := range hashutil.Names() {
+		after := ""
+		for {
+			entries, err := r.List(algo, after, fsckPageSize)
+			if err != nil {
+				return res, err
+			}
+			for _, e := range entries {
+				if err := ctx.Err(); err != nil {
+					return res, err
+				}
+				ok, err := r.check(ctx, algo, e.Hash)
+				if err != nil {
+					return res, err
+				}
+				res.Checked++
+				res.CheckedSize += e.Size
+				if ok {
+					continue
+				}
+				res.Corrupt++
+				if err := r.discardCorrupt(algo, e.Hash, opts.Quarantine); err != nil {
+					return res, err
+				}
+			}
+			if len(entries) < fsckPageSize {
+				break
+			}
+			after = entries[len(entries)-1].Hash
+		}
+	}
+
+	temp, err := r.RemoveStaleTemp(opts.TempAge)
+	if err != nil {
+		return res, err
+	}
+	res.Temp = temp
+
+	orphans, err := r.removeOrphanMetadata()
+	if err != nil {
+		return res, err
+	}
+	res.OrphanMeta = orphans
+
+	slog.Info("Cache check finished", "checked", res.Checked, "corrupt", res.Corrupt, "temp", res.Temp, "orphan_metadata", res.OrphanMeta)
+	return res, nil
+}
+
+// check reports whether the stored content of algo/hash matches hash.
+func (r *LocalRepository) check(ctx context.Context, algo, hash string) (bool, error) {
+	reader, _, err := r.Get(ctx, algo, hash)
+	if os.IsNotExist(err) {
+		// Evicted while checking
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		errutil.LogMsg(reader.Close(), "Failed to close cache reader")
+	}()
+
+	hasher, err := hashutil.GetHasher(algo)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(hasher, reader); err != nil {
+		if r.aead != nil {
+			// Tampered ciphertext fails to decrypt rather than to verify
+			errutil.LogMsg(err, "Failed to decrypt cached file", "algo", algo, "hash", hash)
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read %s/%s: %w", algo, hash, err)
+	}
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if actual != hash {
+		errutil.LogMsg(fmt.Errorf("hash mismatch"), "Found corrupt cache entry", "algo", algo, "hash", hash, "actual", actual)
+		return false, nil
+	}
+	return true, nil
+}
+
+// discardCorrupt removes algo/hash and its metadata, or moves it under
+// quarantineDir if quarantine is set.
+func (r *LocalRepository) discardCorrupt(algo, hash string, quarantine bool) error {
+	unlock, err := cachelock.Exclusive(r.CacheDir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errutil.LogMsg(unlock(), "Failed to release cache lock")
+	}()
+
+	path := r.getPath(algo, hash)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if quarantine {
+		dst := filepath.Join(r.CacheDir, quarantineDir, r.getRelPath(algo, hash))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return fmt.Errorf("failed to create quarantine dir: %w", err)
+		}
+		if err := os.Rename(path, dst); err != nil {
+			return fmt.Errorf("failed to quarantine %s/%s: %w", algo, hash, err)
+		}
+		slog.Info("Quarantined corrupt file", "algo", algo, "hash", hash, "path", dst)
+	} else {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove %s/%s: %w", algo, hash, err)
+		}
+		slog.Info("Deleted corrupt file", "algo", algo, "hash", hash)
+	}
+	if r.eviction != nil {
+		r.eviction.Remove(r.getRelPath(algo, hash), info.Size())
+	}
+	if err := os.Remove(r.metadataPath(algo, hash)); err != nil && !os.IsNotExist(err) {
+		errutil.LogMsg(err, "Failed to remove metadata", "algo", algo, "hash", hash)
+	}
+	return nil
+}
+
+// removeOrphanMetadata deletes the sidecars of objects that are no longer stored.
+func (r *LocalRepository) removeOrphanMetadata() (int, error) {
+	root := filepath.Join(r.CacheDir, metadataDir)
+	removed := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, strings.TrimSuffix(path, ".json"))
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(r.CacheDir, rel)); !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
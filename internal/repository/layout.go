@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Layout describes how cached objects are arranged inside a cache directory.
+type Layout string
+
+const (
+	// LayoutFlat stores every object as {hash} directly in the cache root.
+	LayoutFlat Layout = "flat"
+	// LayoutAlgo stores objects as {algo}/{hash}.
+	LayoutAlgo Layout = "algo"
+	// LayoutSharded stores objects as {algo}/{shard}/{hash}, where shard is
+	// the first two characters of the hash. This is the layout used by LocalRepository.
+	LayoutSharded Layout = "sharded"
+)
+
+// ParseLayout validates a layout name.
+func ParseLayout(name string) (Layout, error) {
+	switch l := Layout(name); l {
+	case LayoutFlat, LayoutAlgo, LayoutSharded:
+		return l, nil
+	default:
+		return "", fmt.Errorf("unknown cache layout: %s", name)
+	}
+}
+
+// RelPath returns the path of an object relative to the cache root.
+func (l Layout) RelPath(algo, hash string) string {
+	switch l {
+	case LayoutFlat:
+		return hash
+	case LayoutAlgo:
+		return filepath.Join(algo, hash)
+	default:
+		if len(hash) < 2 {
+			return filepath.Join(algo, hash)
+		}
+		return filepath.Join(algo, hash[:2], hash)
+	}
+}
+
+// Parse extracts the algorithm and hash from a path relative to the cache root.
+//
+// Flat layouts carry no algorithm, so algo is returned empty for them.
+// ok is false if the path does not belong to the layout.
+func (l Layout) Parse(rel string) (algo, hash string, ok bool) {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	switch l {
+	case LayoutFlat:
+		if len(parts) != 1 {
+			return "", "", false
+		}
+		return "", parts[0], true
+	case LayoutAlgo:
+		if len(parts) != 2 {
+			return "", "", false
+		}
+		return parts[0], parts[1], true
+	default:
+		if len(parts) != 3 || !strings.HasPrefix(parts[2], parts[1]) {
+			return "", "", false
+		}
+		return parts[0], parts[2], true
+	}
+}
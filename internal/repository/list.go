@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Entry describes a stored object.
+type Entry struct {
+	Hash string
+	Size int64
+}
+
+// List returns up to limit objects stored under algo whose hash sorts after
+// after, in hash order. Pass the last returned hash as after to get the next page.
+func (r *LocalRepository) List(algo, after string, limit int) ([]Entry, error) {
+	shards, err := os.ReadDir(filepath.Join(r.CacheDir, algo))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, shard := range shards {
+		// Shards are hash prefixes, so whole shards before after can be skipped
+		if !shard.IsDir() || shard.Name() < after[:min(len(after), len(shard.Name()))] {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(r.CacheDir, algo, shard.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			name := file.Name()
+			if file.IsDir() || name <= after || strings.HasPrefix(name, ".") {
+				continue
+			}
+			info, err := file.Info()
+			if os.IsNotExist(err) {
+				// Evicted while listing
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			size := info.Size()
+			if r.aead != nil {
+				if size, err = decryptedSize(size); err != nil {
+					return nil, err
+				}
+			}
+			entries = append(entries, Entry{Hash: name, Size: size})
+			if len(entries) >= limit {
+				return entries, nil
+			}
+		}
+	}
+	return entries, nil
+}
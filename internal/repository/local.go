@@ -2,16 +2,24 @@ package repository
 
 import (
 	"context"
+	"crypto/cipher"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/lucasew/fetchurl/internal/cachelock"
 	"github.com/lucasew/fetchurl/internal/errutil"
 	"github.com/lucasew/fetchurl/internal/eviction"
 )
 
+// ErrInsufficientSpace is returned by BeginWrite when the disk can't hold the object.
+var ErrInsufficientSpace = errors.New("insufficient disk space")
+
 // LocalRepository implements a Repository backed by the local filesystem.
 //
 // It uses a directory structure of {cacheDir}/{algo}/{shard}/{hash} to store files.
@@ -19,6 +27,7 @@ import (
 type LocalRepository struct {
 	CacheDir string
 	eviction *eviction.Manager
+	aead     cipher.AEAD
 }
 
 func NewLocalRepository(cacheDir string, eviction *eviction.Manager) *LocalRepository {
@@ -29,10 +38,7 @@ func NewLocalRepository(cacheDir string, eviction *eviction.Manager) *LocalRepos
 }
 
 func (r *LocalRepository) getRelPath(algo, hash string) string {
-	if len(hash) < 2 {
-		return filepath.Join(algo, hash)
-	}
-	return filepath.Join(algo, hash[:2], hash)
+	return LayoutSharded.RelPath(algo, hash)
 }
 
 func (r *LocalRepository) getPath(algo, hash string) string {
@@ -64,15 +70,28 @@ func (r *LocalRepository) Get(ctx context.Context, algo, hash string) (io.ReadCl
 	if r.eviction != nil {
 		r.eviction.Touch(r.getRelPath(algo, hash))
 	}
+	if r.aead != nil {
+		size, err := decryptedSize(info.Size())
+		var reader io.ReadCloser
+		if err == nil {
+			reader, err = newDecryptReader(f, r.aead)
+		}
+		if err != nil {
+			errutil.LogMsg(f.Close(), "Failed to close file", "path", path)
+			return nil, 0, err
+		}
+		return reader, size, nil
+	}
 	return f, info.Size(), nil
 }
 
 // BeginWrite initiates a write operation for a file.
 // It creates a temporary file and returns it along with a commit function.
 // The commit function should be called after the file is fully written and verified.
-func (r *LocalRepository) BeginWrite(algo, hash string) (io.WriteCloser, func() error, error) {
-	finalPath := r.getPath(algo, hash)
-
+//
+// size is the expected object size, or -1 if unknown. When known, the space is
+// reserved up front and ErrInsufficientSpace is returned if the disk is too full.
+func (r *LocalRepository) BeginWrite(algo, hash string, size int64) (io.WriteCloser, func() error, error) {
 	// Create temp file in the same filesystem/dir as final destination (or at least same volume)
 	// We can use CacheDir root or a tmp subdir inside it.
 	tmpFile, err := os.CreateTemp(r.CacheDir, "put-*")
@@ -80,9 +99,73 @@ func (r *LocalRepository) BeginWrite(algo, hash string) (io.WriteCloser, func()
 		return nil, nil, fmt.Errorf("failed to create temp file: %w", err)
 	}
 
+	if size > 0 {
+		if r.aead != nil {
+			size = encryptedSize(size)
+		}
+		if err := preallocate(tmpFile, size); err != nil {
+			errutil.LogMsg(tmpFile.Close(), "Failed to close temp file")
+			errutil.LogMsg(os.Remove(tmpFile.Name()), "Failed to remove temp file", "path", tmpFile.Name())
+			return nil, nil, err
+		}
+	}
+
+	commit := r.commitFunc(algo, hash, tmpFile)
+	if r.aead == nil {
+		return tmpFile, commit, nil
+	}
+
+	w, err := newEncryptWriter(tmpFile, r.aead)
+	if err != nil {
+		errutil.LogMsg(tmpFile.Close(), "Failed to close temp file")
+		errutil.LogMsg(os.Remove(tmpFile.Name()), "Failed to remove temp file", "path", tmpFile.Name())
+		return nil, nil, fmt.Errorf("failed to start encrypted write: %w", err)
+	}
+	return w, func() error {
+		if err := w.finish(); err != nil {
+			return fmt.Errorf("failed to finish encrypted write: %w", err)
+		}
+		return commit()
+	}, nil
+}
+
+// RemoveStaleTemp deletes temp files left in the cache dir by writers that died
+// mid-download. Younger files may belong to a live writer, possibly in another
+// process sharing the cache dir, and are kept.
+func (r *LocalRepository) RemoveStaleTemp(maxAge time.Duration) (int, error) {
+	matches, err := filepath.Glob(filepath.Join(r.CacheDir, "put-*"))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			// Committed or cleaned up by its writer in the meantime
+			continue
+		}
+		if err != nil {
+			errutil.LogMsg(err, "Failed to stat temp file", "path", path)
+			continue
+		}
+		if time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errutil.LogMsg(err, "Failed to remove stale temp file", "path", path)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// commitFunc returns a function that moves a fully written temp file into its final place.
+func (r *LocalRepository) commitFunc(algo, hash string, tmpFile *os.File) func() error {
+	finalPath := r.getPath(algo, hash)
 	committed := false
 
-	commit := func() error {
+	return func() error {
 		if committed {
 			return nil
 		}
@@ -91,13 +174,29 @@ func (r *LocalRepository) BeginWrite(algo, hash string) (io.WriteCloser, func()
 			return fmt.Errorf("failed to close temp file: %w", err)
 		}
 
+		// Other processes sharing the cache dir must not evict while we commit
+		unlock, err := cachelock.Shared(r.CacheDir)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			errutil.LogMsg(unlock(), "Failed to release cache lock")
+		}()
+
 		// Ensure destination directory exists
 		if err := os.MkdirAll(filepath.Dir(finalPath), 0755); err != nil {
 			return fmt.Errorf("failed to create algo/shard dir: %w", err)
 		}
 
-		// Move to final path
-		if err := os.Rename(tmpFile.Name(), finalPath); err != nil {
+		// Publish without clobbering: if another writer sharing the cache dir
+		// committed the same object first, keep theirs since the content is identical
+		if err := os.Link(tmpFile.Name(), finalPath); err == nil || errors.Is(err, fs.ErrExist) {
+			if err != nil {
+				slog.Debug("Object already committed by another writer", "algo", algo, "hash", hash)
+			}
+			errutil.LogMsg(os.Remove(tmpFile.Name()), "Failed to remove temp file", "path", tmpFile.Name())
+		} else if err := os.Rename(tmpFile.Name(), finalPath); err != nil {
+			// The filesystem may not support hard links, renaming is the fallback
 			return fmt.Errorf("failed to rename to final path: %w", err)
 		}
 
@@ -116,6 +215,74 @@ func (r *LocalRepository) BeginWrite(algo, hash string) (io.WriteCloser, func()
 
 		return nil
 	}
+}
+
+// Alias makes the object stored as algo/hash reachable under other digests of the same content.
+//
+// Aliases are hard links, so the bytes are stored once. An alias that already
+// exists as a separate copy is replaced by a link to the same file.
+func (r *LocalRepository) Alias(algo, hash string, aliases map[string]string) error {
+	src := r.getPath(algo, hash)
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := cachelock.Shared(r.CacheDir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errutil.LogMsg(unlock(), "Failed to release cache lock")
+	}()
+
+	for aliasAlgo, aliasHash := range aliases {
+		if aliasAlgo == algo {
+			continue
+		}
+		dst := r.getPath(aliasAlgo, aliasHash)
+		existing, err := os.Stat(dst)
+		if err == nil && os.SameFile(info, existing) {
+			continue
+		}
+		if err := r.link(src, dst); err != nil {
+			return fmt.Errorf("failed to alias %s/%s as %s/%s: %w", algo, hash, aliasAlgo, aliasHash, err)
+		}
+		if r.eviction != nil {
+			aliasKey := r.getRelPath(aliasAlgo, aliasHash)
+			if err == nil {
+				// The separate copy the link replaced is gone
+				r.eviction.Remove(aliasKey, existing.Size())
+			}
+			r.eviction.Link(r.getRelPath(algo, hash), aliasKey)
+		}
+		slog.Debug("Aliased file", "algo", algo, "hash", hash, "alias_algo", aliasAlgo, "alias_hash", aliasHash)
+	}
+	return nil
+}
 
-	return tmpFile, commit, nil
+// link atomically points dst at the same file as src, replacing dst if it exists.
+func (r *LocalRepository) link(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	// Reserve a unique temp name, then replace it with the link
+	tmp, err := os.CreateTemp(r.CacheDir, "put-*")
+	if err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(tmp.Name()); err != nil {
+		return err
+	}
+	if err := os.Link(src, tmp.Name()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		errutil.LogMsg(os.Remove(tmp.Name()), "Failed to remove temp link", "path", tmp.Name())
+		return err
+	}
+	return nil
 }
@@ -6,8 +6,10 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestLocalRepository(t *testing.T) {
@@ -19,7 +21,7 @@ func TestLocalRepository(t *testing.T) {
 	content := ""
 
 	t.Run("BeginWrite and Commit", func(t *testing.T) {
-		w, commit, err := repo.BeginWrite(algo, hash)
+		w, commit, err := repo.BeginWrite(algo, hash, -1)
 		if err != nil {
 			t.Fatalf("BeginWrite failed: %v", err)
 		}
@@ -91,7 +93,7 @@ func TestLocalRepository(t *testing.T) {
 	t.Run("Commit without Close", func(t *testing.T) {
 		// Test that commit closes the writer if not closed
 		hash2 := "deadbeef"
-		w, commit, err := repo.BeginWrite(algo, hash2)
+		w, commit, err := repo.BeginWrite(algo, hash2, -1)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -121,4 +123,263 @@ func TestLocalRepository(t *testing.T) {
 			t.Errorf("Content mismatch")
 		}
 	})
+	t.Run("BeginWrite with known size", func(t *testing.T) {
+		hash3 := "cafebabe"
+		w, commit, err := repo.BeginWrite(algo, hash3, 4)
+		if err != nil {
+			t.Fatalf("BeginWrite failed: %v", err)
+		}
+		if _, err := fmt.Fprintf(w, "test"); err != nil {
+			t.Fatalf("Fprintf failed: %v", err)
+		}
+		if err := commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		rc, size, err := repo.Get(ctx, algo, hash3)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		defer func() {
+			if err := rc.Close(); err != nil {
+				t.Errorf("failed to close rc: %v", err)
+			}
+		}()
+		if size != 4 {
+			t.Errorf("Expected size 4, got %d", size)
+		}
+	})
+	t.Run("Concurrent writers of the same object", func(t *testing.T) {
+		hash4 := "0badf00d"
+		w1, commit1, err := repo.BeginWrite(algo, hash4, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w2, commit2, err := repo.BeginWrite(algo, hash4, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range []io.Writer{w1, w2} {
+			if _, err := fmt.Fprintf(w, "same"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := commit1(); err != nil {
+			t.Fatalf("first commit failed: %v", err)
+		}
+		if err := commit2(); err != nil {
+			t.Fatalf("losing commit should succeed, got %v", err)
+		}
+		temps, err := filepath.Glob(filepath.Join(cacheDir, "put-*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(temps) != 0 {
+			t.Errorf("expected temp files to be cleaned up, found %v", temps)
+		}
+	})
+	t.Run("Metadata", func(t *testing.T) {
+		m, err := repo.GetMetadata(algo, hash)
+		if err != nil || m != nil {
+			t.Fatalf("expected no metadata, got %v, %v", m, err)
+		}
+		want := Metadata{ContentType: "application/gzip", ContentDisposition: `attachment; filename="a.tgz"`}
+		if err := repo.SetMetadata(algo, hash, want); err != nil {
+			t.Fatalf("SetMetadata failed: %v", err)
+		}
+		m, err = repo.GetMetadata(algo, hash)
+		if err != nil {
+			t.Fatalf("GetMetadata failed: %v", err)
+		}
+		if m == nil || *m != want {
+			t.Errorf("expected %+v, got %+v", want, m)
+		}
+
+		// Storing the object again without metadata clears the old one
+		if err := repo.SetMetadata(algo, hash, Metadata{}); err != nil {
+			t.Fatalf("SetMetadata failed: %v", err)
+		}
+		if m, err := repo.GetMetadata(algo, hash); err != nil || m != nil {
+			t.Errorf("expected metadata to be cleared, got %v, %v", m, err)
+		}
+
+		if err := repo.SetMetadata(algo, hash, want); err != nil {
+			t.Fatalf("SetMetadata failed: %v", err)
+		}
+		if err := RemoveMetadata(cacheDir, LayoutSharded.RelPath(algo, hash)); err != nil {
+			t.Fatalf("RemoveMetadata failed: %v", err)
+		}
+		if m, err := repo.GetMetadata(algo, hash); err != nil || m != nil {
+			t.Errorf("expected metadata to be removed, got %v, %v", m, err)
+		}
+	})
+
+	t.Run("RemoveStaleTemp", func(t *testing.T) {
+		stale := filepath.Join(cacheDir, "put-stale")
+		fresh := filepath.Join(cacheDir, "put-fresh")
+		for _, p := range []string{stale, fresh} {
+			if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		old := time.Now().Add(-48 * time.Hour)
+		if err := os.Chtimes(stale, old, old); err != nil {
+			t.Fatal(err)
+		}
+		removed, err := repo.RemoveStaleTemp(24 * time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != 1 {
+			t.Errorf("expected 1 removed, got %d", removed)
+		}
+		if _, err := os.Stat(fresh); err != nil {
+			t.Errorf("fresh temp file should be kept: %v", err)
+		}
+	})
+}
+
+func TestLocalRepositoryList(t *testing.T) {
+	repo := NewLocalRepository(t.TempDir(), nil)
+	hashes := []string{"aa01", "aa02", "bb01", "cc01"}
+	for i, hash := range hashes {
+		w, commit, err := repo.BeginWrite("sha256", hash, -1)
+		if err != nil {
+			t.Fatalf("BeginWrite failed: %v", err)
+		}
+		if _, err := w.Write([]byte(strings.Repeat("x", i+1))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+	}
+
+	var got []string
+	after := ""
+	for {
+		page, err := repo.List("sha256", after, 3)
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		for _, e := range page {
+			if want := int64(slices.Index(hashes, e.Hash) + 1); e.Size != want {
+				t.Errorf("expected size %d for %s, got %d", want, e.Hash, e.Size)
+			}
+			got = append(got, e.Hash)
+		}
+		if len(page) < 3 {
+			break
+		}
+		after = page[len(page)-1].Hash
+	}
+	if !slices.Equal(got, hashes) {
+		t.Errorf("expected %v, got %v", hashes, got)
+	}
+
+	if page, err := repo.List("sha1", "", 10); err != nil || len(page) != 0 {
+		t.Errorf("expected empty listing for missing algo, got %v, %v", page, err)
+	}
+}
+
+func TestLocalRepositoryDelete(t *testing.T) {
+	cacheDir := t.TempDir()
+	repo := NewLocalRepository(cacheDir, nil)
+	ctx := context.Background()
+	// sha256 and sha1 of the empty string
+	const sha256Hash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	const sha1Hash = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+
+	_, commit, err := repo.BeginWrite("sha256", sha256Hash, -1)
+	if err != nil {
+		t.Fatalf("BeginWrite failed: %v", err)
+	}
+	if err := commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := repo.Alias("sha256", sha256Hash, map[string]string{"sha1": sha1Hash}); err != nil {
+		t.Fatalf("Alias failed: %v", err)
+	}
+	if err := repo.SetMetadata("sha256", sha256Hash, Metadata{ContentType: "text/plain"}); err != nil {
+		t.Fatalf("SetMetadata failed: %v", err)
+	}
+
+	if err := repo.Delete(ctx, "sha256", sha256Hash); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	for algo, hash := range map[string]string{"sha256": sha256Hash, "sha1": sha1Hash} {
+		if exists, _ := repo.Exists(ctx, algo, hash); exists {
+			t.Errorf("expected %s/%s to be deleted", algo, hash)
+		}
+	}
+	if m, _ := repo.GetMetadata("sha256", sha256Hash); m != nil {
+		t.Errorf("expected metadata to be deleted, got %+v", m)
+	}
+
+	if err := repo.Delete(ctx, "sha256", sha256Hash); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
+
+func TestLocalRepositoryFsck(t *testing.T) {
+	ctx := context.Background()
+	for _, quarantine := range []bool{false, true} {
+		t.Run(fmt.Sprintf("quarantine=%v", quarantine), func(t *testing.T) {
+			cacheDir := t.TempDir()
+			repo := NewLocalRepository(cacheDir, nil)
+			good := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" // Empty string hash
+			bad := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"  // "hello", stored as something else
+			for _, hash := range []string{good, bad} {
+				w, commit, err := repo.BeginWrite("sha256", hash, -1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hash == bad {
+					if _, err := io.WriteString(w, "bitrot"); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := commit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := repo.SetMetadata("sha256", bad, Metadata{ContentType: "text/plain"}); err != nil {
+				t.Fatal(err)
+			}
+			orphan := "0000000000000000000000000000000000000000000000000000000000000000"
+			if err := repo.SetMetadata("sha256", orphan, Metadata{ContentType: "text/plain"}); err != nil {
+				t.Fatal(err)
+			}
+			tmp, err := os.CreateTemp(cacheDir, "put-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tmp.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := repo.Fsck(ctx, FsckOptions{Quarantine: quarantine})
+			if err != nil {
+				t.Fatalf("Fsck failed: %v", err)
+			}
+			if res.Checked != 2 || res.Corrupt != 1 || res.Temp != 1 || res.OrphanMeta != 1 {
+				t.Errorf("unexpected result %+v", res)
+			}
+			if exists, _ := repo.Exists(ctx, "sha256", good); !exists {
+				t.Error("expected the good object to be kept")
+			}
+			if exists, _ := repo.Exists(ctx, "sha256", bad); exists {
+				t.Error("expected the corrupt object to be removed")
+			}
+			if _, err := os.Stat(repo.metadataPath("sha256", bad)); !os.IsNotExist(err) {
+				t.Errorf("expected the corrupt object's metadata to be removed, got %v", err)
+			}
+			_, err = os.Stat(filepath.Join(cacheDir, quarantineDir, "sha256", bad[:2], bad))
+			if quarantine && err != nil {
+				t.Errorf("expected the corrupt object to be quarantined: %v", err)
+			}
+			if !quarantine && !os.IsNotExist(err) {
+				t.Errorf("expected nothing to be quarantined, got %v", err)
+			}
+		})
+	}
 }
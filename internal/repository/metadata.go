@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+)
+
+// metadataDir holds the metadata sidecars of cached objects. It is hidden so
+// it's not mistaken for cached objects by the eviction manager.
+const metadataDir = ".meta"
+
+// Metadata holds the origin response headers worth replaying from cache.
+type Metadata struct {
+	ContentType        string `json:"content_type,omitempty"`
+	ContentDisposition string `json:"content_disposition,omitempty"`
+}
+
+// IsZero reports whether m carries nothing worth storing.
+func (m Metadata) IsZero() bool {
+	return m == Metadata{}
+}
+
+func (r *LocalRepository) metadataPath(algo, hash string) string {
+	return metadataPath(r.CacheDir, r.getRelPath(algo, hash))
+}
+
+func metadataPath(cacheDir, key string) string {
+	return filepath.Join(cacheDir, metadataDir, key+".json")
+}
+
+// RemoveMetadata deletes the sidecar of the object stored at key, relative to
+// cacheDir, e.g. once the eviction manager deleted the object.
+func RemoveMetadata(cacheDir, key string) error {
+	if err := os.Remove(metadataPath(cacheDir, key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// SetMetadata writes the sidecar for algo/hash atomically. A zero m removes
+// it, so an object stored again doesn't replay the headers of an earlier copy.
+func (r *LocalRepository) SetMetadata(algo, hash string, m Metadata) error {
+	if m.IsZero() {
+		return RemoveMetadata(r.CacheDir, r.getRelPath(algo, hash))
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	path := r.metadataPath(algo, hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create metadata dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		errutil.LogMsg(os.Remove(tmp.Name()), "Failed to remove temp file", "path", tmp.Name())
+		return fmt.Errorf("failed to store metadata: %w", err)
+	}
+	return nil
+}
+
+// GetMetadata reads the sidecar for algo/hash, returning nil if there is none.
+func (r *LocalRepository) GetMetadata(algo, hash string) (*Metadata, error) {
+	data, err := os.ReadFile(r.metadataPath(algo, hash))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m Metadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("unreadable metadata for %s/%s: %w", algo, hash, err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+)
+
+// partialDir holds interrupted downloads. It is hidden so it's not
+// mistaken for cached objects by the eviction manager.
+const partialDir = ".partial"
+
+// Partial is the verified prefix of an interrupted download.
+//
+// HashState is the marshaled state of the hasher after consuming the first
+// Offset bytes, so the download can be resumed without re-reading the prefix.
+type Partial struct {
+	Offset    int64  `json:"offset"`
+	HashState []byte `json:"hash_state"`
+}
+
+func (r *LocalRepository) partialPath(algo, hash string) string {
+	return filepath.Join(r.CacheDir, partialDir, algo, hash)
+}
+
+// LoadPartial returns the interrupted download for an object, or nil if there is none.
+func (r *LocalRepository) LoadPartial(algo, hash string) (*Partial, error) {
+	if r.aead != nil {
+		// Partial files are plaintext, so they are never kept or resumed
+		return nil, nil
+	}
+	path := r.partialPath(algo, hash)
+	data, err := os.ReadFile(path + ".json")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var p Partial
+	if err := json.Unmarshal(data, &p); err != nil {
+		errutil.LogMsg(err, "Discarding unreadable partial download state", "path", path)
+		r.DiscardPartial(algo, hash)
+		return nil, nil
+	}
+
+	info, err := os.Stat(path)
+	if err == nil && info.Size() < p.Offset {
+		err = fmt.Errorf("partial file is shorter than recorded offset %d", p.Offset)
+	}
+	if err != nil {
+		errutil.LogMsg(err, "Discarding inconsistent partial download", "path", path)
+		r.DiscardPartial(algo, hash)
+		return nil, nil
+	}
+	return &p, nil
+}
+
+// ResumeWrite reopens an interrupted download so more data can be appended after p.Offset.
+//
+// The partial file is taken out of the partial area, so if the write is
+// abandoned without calling SavePartial again the prefix is lost.
+// size is the expected final object size, or -1 if unknown.
+func (r *LocalRepository) ResumeWrite(algo, hash string, p *Partial, size int64) (*os.File, func() error, error) {
+	path := r.partialPath(algo, hash)
+
+	tmpFile, err := os.CreateTemp(r.CacheDir, "put-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	errutil.LogMsg(tmpFile.Close(), "Failed to close temp file")
+
+	if err := os.Rename(path, tmpFile.Name()); err != nil {
+		errutil.LogMsg(os.Remove(tmpFile.Name()), "Failed to remove temp file", "path", tmpFile.Name())
+		return nil, nil, fmt.Errorf("failed to claim partial download: %w", err)
+	}
+	errutil.LogMsg(os.Remove(path+".json"), "Failed to remove partial download state", "path", path)
+
+	f, err := os.OpenFile(tmpFile.Name(), os.O_RDWR, 0)
+	if err == nil {
+		err = f.Truncate(p.Offset)
+		if err == nil && size > 0 {
+			err = preallocate(f, size)
+		}
+		if err == nil {
+			_, err = f.Seek(p.Offset, 0)
+		}
+		if err != nil {
+			errutil.LogMsg(f.Close(), "Failed to close temp file")
+		}
+	}
+	if err != nil {
+		errutil.LogMsg(os.Remove(tmpFile.Name()), "Failed to remove temp file", "path", tmpFile.Name())
+		return nil, nil, err
+	}
+
+	slog.Info("Resuming partial download", "algo", algo, "hash", hash, "offset", p.Offset)
+	return f, r.commitFunc(algo, hash, f), nil
+}
+
+// SavePartial keeps the first offset bytes of an aborted write so a later request can resume it.
+//
+// f must be the file returned by BeginWrite or ResumeWrite. It is closed by this call.
+func (r *LocalRepository) SavePartial(algo, hash string, f *os.File, offset int64, hashState []byte) error {
+	path := r.partialPath(algo, hash)
+
+	err := f.Truncate(offset)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to finalize partial file: %w", err)
+	}
+
+	state, err := json.Marshal(Partial{Offset: offset, HashState: hashState})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create partial dir: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to store partial file: %w", err)
+	}
+	if err := os.WriteFile(path+".json", state, 0644); err != nil {
+		errutil.LogMsg(os.Remove(path), "Failed to remove partial file", "path", path)
+		return fmt.Errorf("failed to store partial state: %w", err)
+	}
+
+	slog.Info("Kept partial download", "algo", algo, "hash", hash, "offset", offset)
+	return nil
+}
+
+// DiscardPartial removes any interrupted download for an object.
+func (r *LocalRepository) DiscardPartial(algo, hash string) {
+	path := r.partialPath(algo, hash)
+	for _, p := range []string{path + ".json", path} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			errutil.LogMsg(err, "Failed to remove partial download", "path", p)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+//go:build linux
+
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocate reserves size bytes for f so that running out of disk space
+// is detected before any data is transferred.
+func preallocate(f *os.File, size int64) error {
+	err := unix.Fallocate(int(f.Fd()), 0, 0, size)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.ENOSPC), errors.Is(err, unix.EDQUOT):
+		return fmt.Errorf("%w: need %d bytes", ErrInsufficientSpace, size)
+	case errors.Is(err, unix.EOPNOTSUPP), errors.Is(err, unix.ENOSYS):
+		// Filesystem can't preallocate; fall back to allocating on write.
+		return nil
+	default:
+		return fmt.Errorf("failed to preallocate: %w", err)
+	}
+}
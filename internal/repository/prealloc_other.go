@@ -0,0 +1,10 @@
+//go:build !linux
+
+package repository
+
+import "os"
+
+// preallocate is a no-op on platforms without fallocate.
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
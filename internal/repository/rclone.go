@@ -0,0 +1,156 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+)
+
+// rclone exit codes for missing directories and files
+const (
+	rcloneDirNotFound  = 3
+	rcloneFileNotFound = 4
+)
+
+// RcloneRepository implements a WritableRepository on top of any rclone
+// remote (B2, SFTP, Drive, ...) by running the rclone binary.
+//
+// Remotes are configured with rclone itself (rclone config, RCLONE_CONFIG_*
+// environment variables). Objects are stored under {prefix}/{algo}/{shard}/{hash}.
+type RcloneRepository struct {
+	// Binary is the rclone executable. Defaults to "rclone" in PATH.
+	Binary string
+	Remote string
+	Prefix string
+	// SpoolDir holds uploads in progress. Defaults to the system temp dir.
+	SpoolDir string
+}
+
+// NewRcloneRepositoryFromURL builds an RcloneRepository from a URL like
+// rclone://remote/path, which maps to the rclone path remote:path.
+//
+// The rclone binary can be overridden with the "binary" query parameter.
+func NewRcloneRepositoryFromURL(u *url.URL) (*RcloneRepository, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("rclone storage URL must include a remote: %s", u)
+	}
+	binary := firstNonEmpty(u.Query().Get("binary"), "rclone")
+	if _, err := exec.LookPath(binary); err != nil {
+		return nil, fmt.Errorf("rclone storage needs the rclone binary: %w", err)
+	}
+	return &RcloneRepository{
+		Binary: binary,
+		Remote: u.Host,
+		Prefix: strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+func init() {
+	Register("rclone", func(u *url.URL, client *http.Client) (WritableRepository, error) {
+		return NewRcloneRepositoryFromURL(u)
+	})
+}
+
+func (r *RcloneRepository) remotePath(algo, hash string) string {
+	key := path.Join(r.Prefix, strings.ReplaceAll(LayoutSharded.RelPath(algo, hash), "\\", "/"))
+	return r.Remote + ":" + key
+}
+
+func (r *RcloneRepository) command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, r.Binary, args...)
+	cmd.Stderr = &bytes.Buffer{}
+	return cmd
+}
+
+// commandError adds rclone's stderr to err and maps "not found" exit codes to os.ErrNotExist.
+func commandError(cmd *exec.Cmd, err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		switch exitErr.ExitCode() {
+		case rcloneDirNotFound, rcloneFileNotFound:
+			return os.ErrNotExist
+		}
+	}
+	stderr := strings.TrimSpace(cmd.Stderr.(*bytes.Buffer).String())
+	return fmt.Errorf("rclone %s failed: %w: %s", cmd.Args[1], err, stderr)
+}
+
+func (r *RcloneRepository) stat(ctx context.Context, algo, hash string) (int64, error) {
+	cmd := r.command(ctx, "lsjson", "--stat", "--no-modtime", "--no-mimetype", r.remotePath(algo, hash))
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, commandError(cmd, err)
+	}
+	var entry struct {
+		Size int64
+	}
+	if err := json.Unmarshal(out, &entry); err != nil {
+		return 0, fmt.Errorf("failed to parse rclone lsjson output: %w", err)
+	}
+	return entry.Size, nil
+}
+
+func (r *RcloneRepository) Exists(ctx context.Context, algo, hash string) (bool, error) {
+	_, err := r.stat(ctx, algo, hash)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *RcloneRepository) Get(ctx context.Context, algo, hash string) (io.ReadCloser, int64, error) {
+	size, err := r.stat(ctx, algo, hash)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cmd := r.command(ctx, "cat", r.remotePath(algo, hash))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, 0, fmt.Errorf("failed to start rclone: %w", err)
+	}
+	return &rcloneReader{ReadCloser: stdout, cmd: cmd}, size, nil
+}
+
+// rcloneReader waits for the rclone process when closed.
+type rcloneReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *rcloneReader) Close() error {
+	errutil.LogMsg(r.ReadCloser.Close(), "Failed to close rclone output")
+	if err := r.cmd.Wait(); err != nil {
+		return commandError(r.cmd, err)
+	}
+	return nil
+}
+
+// BeginWrite spools the object to a local temp file; commit uploads it with rclone rcat.
+func (r *RcloneRepository) BeginWrite(algo, hash string, size int64) (io.WriteCloser, func() error, error) {
+	return beginSpooledWrite(r.SpoolDir, func(body io.Reader, size int64) error {
+		// The context is detached from the request: once verified, the upload should finish.
+		cmd := r.command(context.Background(), "rcat", "--size", fmt.Sprint(size), r.remotePath(algo, hash))
+		cmd.Stdin = body
+		if err := cmd.Run(); err != nil {
+			return commandError(cmd, err)
+		}
+		slog.Info("Stored file", "algo", algo, "hash", hash, "size", size, "remote", r.Remote)
+		return nil
+	})
+}
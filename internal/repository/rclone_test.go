@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeRclone maps remote:path to $FAKE_RCLONE_ROOT/path for the subcommands RcloneRepository uses.
+const fakeRclone = `#!/bin/sh
+cmd=$1
+for last; do :; done
+file="$FAKE_RCLONE_ROOT/${last#*:}"
+case "$cmd" in
+lsjson)
+	[ -f "$file" ] || exit 4
+	printf '{"Path":"x","Size":%d}' "$(wc -c < "$file")"
+	;;
+cat)
+	[ -f "$file" ] || exit 4
+	cat "$file"
+	;;
+rcat)
+	mkdir -p "$(dirname "$file")" && cat > "$file"
+	;;
+*)
+	exit 1
+	;;
+esac
+`
+
+func TestRcloneRepository(t *testing.T) {
+	binDir := t.TempDir()
+	binary := filepath.Join(binDir, "rclone")
+	if err := os.WriteFile(binary, []byte(fakeRclone), 0755); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	t.Setenv("FAKE_RCLONE_ROOT", root)
+
+	u, err := url.Parse("rclone://b2/bucket/cache?binary=" + url.QueryEscape(binary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := Open(u, nil)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	ctx := t.Context()
+
+	exists, err := repo.Exists(ctx, "sha256", "deadbeef")
+	if err != nil || exists {
+		t.Fatalf("expected missing object, got %v, %v", exists, err)
+	}
+
+	w, commit, err := repo.BeginWrite("sha256", "deadbeef", 4)
+	if err != nil {
+		t.Fatalf("BeginWrite failed: %v", err)
+	}
+	if _, err := w.Write([]byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "bucket/cache/sha256/de/deadbeef")); err != nil {
+		t.Errorf("object not stored under expected path: %v", err)
+	}
+
+	rc, size, err := repo.Get(ctx, "sha256", "deadbeef")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	data, err := io.ReadAll(rc)
+	if closeErr := rc.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "test" || size != 4 {
+		t.Errorf("got %q (%d bytes), want \"test\"", data, size)
+	}
+}
@@ -0,0 +1,34 @@
+package repository
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Factory builds a storage backend from a URL like scheme://bucket/prefix.
+type Factory func(u *url.URL, client *http.Client) (WritableRepository, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register registers a storage backend factory for a URL scheme.
+func Register(scheme string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[scheme] = factory
+}
+
+// Open returns the storage backend for the given URL.
+func Open(u *url.URL, client *http.Client) (WritableRepository, error) {
+	registryMu.RLock()
+	factory, ok := registry[u.Scheme]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported storage backend: %s", u.Scheme)
+	}
+	return factory(u, client)
+}
@@ -3,9 +3,64 @@ package repository
 import (
 	"context"
 	"io"
+	"os"
+	"time"
 )
 
 type Repository interface {
 	Exists(ctx context.Context, algo, hash string) (bool, error)
 	Get(ctx context.Context, algo, hash string) (io.ReadCloser, int64, error)
 }
+
+// WritableRepository is a Repository that objects can be stored into.
+type WritableRepository interface {
+	Repository
+
+	// BeginWrite returns a writer for the object and a function that commits
+	// it once fully written and verified. size is -1 if unknown.
+	// Callers abandon a write by closing the writer and, if it is an
+	// *os.File, removing it.
+	BeginWrite(algo, hash string, size int64) (io.WriteCloser, func() error, error)
+}
+
+// ResumableRepository can keep interrupted writes and continue them later.
+type ResumableRepository interface {
+	LoadPartial(algo, hash string) (*Partial, error)
+	ResumeWrite(algo, hash string, p *Partial, size int64) (*os.File, func() error, error)
+	SavePartial(algo, hash string, f *os.File, offset int64, hashState []byte) error
+	DiscardPartial(algo, hash string)
+}
+
+// AliasRepository can make a stored object reachable under the digests of
+// other algorithms without storing the bytes again.
+type AliasRepository interface {
+	// Alias links algo/hash to every algo/digest pair in aliases.
+	Alias(algo, hash string, aliases map[string]string) error
+}
+
+// MetadataRepository can keep what the origin said about an object, so it
+// can be served back the same way from cache.
+type MetadataRepository interface {
+	// SetMetadata records m for algo/hash, replacing what was there. A zero
+	// m clears it.
+	SetMetadata(algo, hash string, m Metadata) error
+	// GetMetadata returns the metadata recorded for algo/hash, or nil if there is none.
+	GetMetadata(algo, hash string) (*Metadata, error)
+}
+
+// DeletableRepository can remove stored objects, e.g. a bad artifact that got cached.
+type DeletableRepository interface {
+	// Delete removes algo/hash and every alias of it. It returns an error
+	// matching fs.ErrNotExist if the object is not stored.
+	Delete(ctx context.Context, algo, hash string) error
+}
+
+// PresigningRepository can hand out time-limited URLs that let clients
+// download objects straight from the storage backend.
+type PresigningRepository interface {
+	// PresignGet returns a URL for algo/hash that stays valid for expires,
+	// along with the object size. It returns an error matching
+	// fs.ErrNotExist if the object is not stored, and errors.ErrUnsupported
+	// if the backend cannot presign.
+	PresignGet(ctx context.Context, algo, hash string, expires time.Duration) (string, int64, error)
+}
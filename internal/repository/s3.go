@@ -0,0 +1,190 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+)
+
+// S3Repository implements a WritableRepository backed by an S3 compatible bucket.
+//
+// Objects are stored under {prefix}/{algo}/{shard}/{hash}, mirroring the
+// local layout. Writes are spooled to a local temp file and uploaded on commit,
+// so nothing is visible in the bucket until the content has been verified.
+type S3Repository struct {
+	Client   *http.Client
+	Endpoint *url.URL
+	Bucket   string
+	Prefix   string
+	Region   string
+	// PathStyle addresses the bucket as {endpoint}/{bucket} instead of {bucket}.{endpoint},
+	// as needed by most self-hosted implementations (MinIO, Ceph).
+	PathStyle bool
+	// SpoolDir holds uploads in progress. Defaults to the system temp dir.
+	SpoolDir string
+
+	creds awsCredentials
+}
+
+// NewS3RepositoryFromURL builds an S3Repository from a URL like s3://bucket/prefix.
+//
+// Credentials and defaults come from the standard AWS environment variables
+// (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION,
+// AWS_ENDPOINT_URL). The region and endpoint can be overridden with the
+// "region" and "endpoint" query parameters. A custom endpoint implies path-style addressing.
+func NewS3RepositoryFromURL(u *url.URL, client *http.Client) (*S3Repository, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("s3 storage URL must include a bucket: %s", u)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	q := u.Query()
+	region := firstNonEmpty(q.Get("region"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+
+	repo := &S3Repository{
+		Client: client,
+		Bucket: u.Host,
+		Prefix: strings.Trim(u.Path, "/"),
+		Region: region,
+		creds: awsCredentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		},
+	}
+	if repo.creds.AccessKeyID == "" || repo.creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for s3 storage")
+	}
+
+	endpoint := firstNonEmpty(q.Get("endpoint"), os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"))
+	if endpoint != "" {
+		ep, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+		}
+		repo.Endpoint = ep
+		repo.PathStyle = true
+	} else {
+		repo.Endpoint = &url.URL{Scheme: "https", Host: fmt.Sprintf("s3.%s.amazonaws.com", region)}
+	}
+	return repo, nil
+}
+
+func init() {
+	Register("s3", func(u *url.URL, client *http.Client) (WritableRepository, error) {
+		return NewS3RepositoryFromURL(u, client)
+	})
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (r *S3Repository) objectURL(algo, hash string) *url.URL {
+	key := path.Join(r.Prefix, strings.ReplaceAll(LayoutSharded.RelPath(algo, hash), "\\", "/"))
+	u := *r.Endpoint
+	if r.PathStyle {
+		u.Path = "/" + path.Join(strings.Trim(r.Endpoint.Path, "/"), r.Bucket, key)
+	} else {
+		u.Host = r.Bucket + "." + r.Endpoint.Host
+		u.Path = "/" + key
+	}
+	return &u
+}
+
+func (r *S3Repository) do(ctx context.Context, method string, u *url.URL, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signV4(req, r.creds, r.Region, "s3", payloadHash, time.Now())
+	return r.Client.Do(req)
+}
+
+func (r *S3Repository) Exists(ctx context.Context, algo, hash string) (bool, error) {
+	resp, err := r.do(ctx, http.MethodHead, r.objectURL(algo, hash), nil, 0, emptySHA256)
+	if err != nil {
+		return false, err
+	}
+	errutil.LogMsg(resp.Body.Close(), "Failed to close S3 response body")
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("s3 HEAD returned status %d", resp.StatusCode)
+	}
+}
+
+func (r *S3Repository) Get(ctx context.Context, algo, hash string) (io.ReadCloser, int64, error) {
+	resp, err := r.do(ctx, http.MethodGet, r.objectURL(algo, hash), nil, 0, emptySHA256)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		errutil.LogMsg(resp.Body.Close(), "Failed to close S3 response body")
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, 0, os.ErrNotExist
+		}
+		return nil, 0, fmt.Errorf("s3 GET returned status %d", resp.StatusCode)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// PresignGet returns a SigV4 presigned URL for the object.
+func (r *S3Repository) PresignGet(ctx context.Context, algo, hash string, expires time.Duration) (string, int64, error) {
+	u := r.objectURL(algo, hash)
+	resp, err := r.do(ctx, http.MethodHead, u, nil, 0, emptySHA256)
+	if err != nil {
+		return "", 0, err
+	}
+	errutil.LogMsg(resp.Body.Close(), "Failed to close S3 response body")
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return presignV4(u, r.creds, r.Region, "s3", expires, time.Now()).String(), resp.ContentLength, nil
+	case http.StatusNotFound:
+		return "", 0, os.ErrNotExist
+	default:
+		return "", 0, fmt.Errorf("s3 HEAD returned status %d", resp.StatusCode)
+	}
+}
+
+// BeginWrite spools the object to a local temp file; commit uploads it to the bucket.
+func (r *S3Repository) BeginWrite(algo, hash string, size int64) (io.WriteCloser, func() error, error) {
+	return beginSpooledWrite(r.SpoolDir, func(body io.Reader, size int64) error {
+		// The context is detached from the request: once verified, the upload should finish.
+		resp, err := r.do(context.Background(), http.MethodPut, r.objectURL(algo, hash), body, size, unsignedPayload)
+		if err != nil {
+			return fmt.Errorf("s3 upload failed: %w", err)
+		}
+		errutil.LogMsg(resp.Body.Close(), "Failed to close S3 response body")
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("s3 PUT returned status %d", resp.StatusCode)
+		}
+		slog.Info("Stored file", "algo", algo, "hash", hash, "size", size, "bucket", r.Bucket)
+		return nil
+	})
+}
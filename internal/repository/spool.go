@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+)
+
+// beginSpooledWrite implements BeginWrite for remote backends.
+//
+// Data is written to a temp file in dir (the system temp dir if empty) and
+// handed to upload from the start only when the commit function is called.
+// The spool file is removed after a successful upload.
+func beginSpooledWrite(dir string, upload func(body io.Reader, size int64) error) (io.WriteCloser, func() error, error) {
+	spool, err := os.CreateTemp(dir, "fetchurl-spool-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+
+	committed := false
+	commit := func() error {
+		if committed {
+			return nil
+		}
+		info, err := spool.Stat()
+		if err != nil {
+			return err
+		}
+		// A section reader keeps the HTTP client from closing the spool file
+		if err := upload(io.NewSectionReader(spool, 0, info.Size()), info.Size()); err != nil {
+			return err
+		}
+		committed = true
+
+		errutil.LogMsg(spool.Close(), "Failed to close spool file")
+		errutil.LogMsg(os.Remove(spool.Name()), "Failed to remove spool file", "path", spool.Name())
+		return nil
+	}
+
+	return spool, commit, nil
+}
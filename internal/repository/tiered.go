@@ -0,0 +1,189 @@
+package repository
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultMaxMemoryBlobSize is the largest blob kept in memory by default.
+const DefaultMaxMemoryBlobSize = 1024 * 1024
+
+// TieredRepository keeps the most recently served small blobs in memory and
+// falls through to Next for everything else.
+//
+// Writes go straight to Next; blobs enter the memory tier the first time they
+// are read back.
+type TieredRepository struct {
+	Next WritableRepository
+	// MaxBytes is the memory budget shared by all cached blobs.
+	MaxBytes int64
+	// MaxBlobSize is the largest blob that is kept in memory.
+	MaxBlobSize int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	order   *list.List // front is most recently used
+}
+
+type memoryBlob struct {
+	key  string
+	data []byte
+}
+
+func NewTieredRepository(next WritableRepository, maxBytes int64) *TieredRepository {
+	return &TieredRepository{
+		Next:        next,
+		MaxBytes:    maxBytes,
+		MaxBlobSize: min(maxBytes, DefaultMaxMemoryBlobSize),
+		entries:     make(map[string]*list.Element),
+		order:       list.New(),
+	}
+}
+
+func (r *TieredRepository) lookup(key string) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	elem, ok := r.entries[key]
+	if !ok {
+		return nil, false
+	}
+	r.order.MoveToFront(elem)
+	return elem.Value.(*memoryBlob).data, true
+}
+
+func (r *TieredRepository) store(key string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.entries[key]; ok {
+		return
+	}
+	r.entries[key] = r.order.PushFront(&memoryBlob{key: key, data: data})
+	r.size += int64(len(data))
+
+	for r.size > r.MaxBytes {
+		oldest := r.order.Back()
+		blob := r.order.Remove(oldest).(*memoryBlob)
+		delete(r.entries, blob.key)
+		r.size -= int64(len(blob.data))
+	}
+}
+
+func (r *TieredRepository) Exists(ctx context.Context, algo, hash string) (bool, error) {
+	if _, ok := r.lookup(algo + ":" + hash); ok {
+		return true, nil
+	}
+	return r.Next.Exists(ctx, algo, hash)
+}
+
+func (r *TieredRepository) Get(ctx context.Context, algo, hash string) (io.ReadCloser, int64, error) {
+	key := algo + ":" + hash
+	if data, ok := r.lookup(key); ok {
+		return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+	}
+
+	reader, size, err := r.Next.Get(ctx, algo, hash)
+	if err != nil || size < 0 || size > r.MaxBlobSize {
+		return reader, size, err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(reader, size))
+	if closeErr := reader.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if int64(len(data)) != size {
+		return nil, 0, fmt.Errorf("short read from cache: got %d of %d bytes", len(data), size)
+	}
+	r.store(key, data)
+	return io.NopCloser(bytes.NewReader(data)), size, nil
+}
+
+func (r *TieredRepository) BeginWrite(algo, hash string, size int64) (io.WriteCloser, func() error, error) {
+	return r.Next.BeginWrite(algo, hash, size)
+}
+
+// The memory tier is transparent to resumable downloads: partial state is
+// delegated to Next when it supports it.
+
+func (r *TieredRepository) LoadPartial(algo, hash string) (*Partial, error) {
+	if next, ok := r.Next.(ResumableRepository); ok {
+		return next.LoadPartial(algo, hash)
+	}
+	return nil, nil
+}
+
+func (r *TieredRepository) ResumeWrite(algo, hash string, p *Partial, size int64) (*os.File, func() error, error) {
+	if next, ok := r.Next.(ResumableRepository); ok {
+		return next.ResumeWrite(algo, hash, p, size)
+	}
+	return nil, nil, fmt.Errorf("storage backend does not support resuming downloads")
+}
+
+func (r *TieredRepository) SavePartial(algo, hash string, f *os.File, offset int64, hashState []byte) error {
+	if next, ok := r.Next.(ResumableRepository); ok {
+		return next.SavePartial(algo, hash, f, offset, hashState)
+	}
+	return fmt.Errorf("storage backend does not support resuming downloads")
+}
+
+func (r *TieredRepository) DiscardPartial(algo, hash string) {
+	if next, ok := r.Next.(ResumableRepository); ok {
+		next.DiscardPartial(algo, hash)
+	}
+}
+
+func (r *TieredRepository) Alias(algo, hash string, aliases map[string]string) error {
+	if next, ok := r.Next.(AliasRepository); ok {
+		return next.Alias(algo, hash, aliases)
+	}
+	return nil
+}
+
+func (r *TieredRepository) SetMetadata(algo, hash string, m Metadata) error {
+	if next, ok := r.Next.(MetadataRepository); ok {
+		return next.SetMetadata(algo, hash, m)
+	}
+	return nil
+}
+
+func (r *TieredRepository) GetMetadata(algo, hash string) (*Metadata, error) {
+	if next, ok := r.Next.(MetadataRepository); ok {
+		return next.GetMetadata(algo, hash)
+	}
+	return nil, nil
+}
+
+func (r *TieredRepository) PresignGet(ctx context.Context, algo, hash string, expires time.Duration) (string, int64, error) {
+	if next, ok := r.Next.(PresigningRepository); ok {
+		return next.PresignGet(ctx, algo, hash, expires)
+	}
+	return "", 0, errors.ErrUnsupported
+}
+
+// Delete empties the memory tier before deleting from Next. Deletes are rare,
+// and the tier doesn't know which of its entries are aliases of the object.
+func (r *TieredRepository) Delete(ctx context.Context, algo, hash string) error {
+	r.mu.Lock()
+	r.entries = make(map[string]*list.Element)
+	r.order.Init()
+	r.size = 0
+	r.mu.Unlock()
+
+	next, ok := r.Next.(DeletableRepository)
+	if !ok {
+		return fmt.Errorf("storage backend does not support deleting objects")
+	}
+	return next.Delete(ctx, algo, hash)
+}
@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTieredRepository(t *testing.T) {
+	tempDir := t.TempDir()
+	local := NewLocalRepository(tempDir, nil)
+	repo := NewTieredRepository(local, 8)
+	ctx := t.Context()
+
+	put := func(hash, content string) {
+		w, commit, err := repo.BeginWrite("sha256", hash, int64(len(content)))
+		if err != nil {
+			t.Fatalf("BeginWrite failed: %v", err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := commit(); err != nil {
+			t.Fatalf("commit failed: %v", err)
+		}
+	}
+	get := func(hash string) string {
+		rc, _, err := repo.Get(ctx, "sha256", hash)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		defer func() {
+			if err := rc.Close(); err != nil {
+				t.Errorf("failed to close rc: %v", err)
+			}
+		}()
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	t.Run("Serves from memory after first read", func(t *testing.T) {
+		put("aaaa", "test")
+		if got := get("aaaa"); got != "test" {
+			t.Fatalf("got %q", got)
+		}
+		if err := os.Remove(filepath.Join(tempDir, local.getRelPath("sha256", "aaaa"))); err != nil {
+			t.Fatal(err)
+		}
+		if got := get("aaaa"); got != "test" {
+			t.Errorf("expected memory hit, got %q", got)
+		}
+	})
+
+	t.Run("Evicts least recently used over budget", func(t *testing.T) {
+		put("bbbb", "five!")
+		get("bbbb") // 4 + 5 bytes > 8, evicts aaaa
+		if _, ok := repo.lookup("sha256:aaaa"); ok {
+			t.Error("expected aaaa to be evicted from memory")
+		}
+		if _, ok := repo.lookup("sha256:bbbb"); !ok {
+			t.Error("expected bbbb in memory")
+		}
+	})
+
+	t.Run("Skips blobs larger than the limit", func(t *testing.T) {
+		put("cccc", "way too large")
+		if got := get("cccc"); got != "way too large" {
+			t.Fatalf("got %q", got)
+		}
+		if _, ok := repo.lookup("sha256:cccc"); ok {
+			t.Error("expected large blob to stay on disk only")
+		}
+	})
+}
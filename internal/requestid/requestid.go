@@ -0,0 +1,78 @@
+// Package requestid tags each server request with an ID that follows it
+// into the logs of the fetches it triggers.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"log/slog"
+)
+
+// Header carries the request ID. Clients and proxies may set it, and the
+// server echoes it back and forwards it to upstreams.
+const Header = "X-Request-Id"
+
+// maxLen bounds IDs taken from clients, which end up in every log line.
+const maxLen = 128
+
+type contextKey struct{}
+
+// New returns a random ID.
+func New() string {
+	return rand.Text()
+}
+
+// Valid reports whether id, taken from a client, is safe to log and echo:
+// non-empty, short and made of printable ASCII without spaces.
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewContext returns a copy of ctx carrying id. An empty id leaves ctx as is.
+func NewContext(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the ID in ctx, or "" if there is none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// LogHandler adds a request_id attribute to records logged with a context
+// carrying an ID, such as with slog.InfoContext.
+type LogHandler struct {
+	slog.Handler
+}
+
+// NewLogHandler wraps next.
+func NewLogHandler(next slog.Handler) *LogHandler {
+	return &LogHandler{Handler: next}
+}
+
+func (h *LogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := FromContext(ctx); id != "" {
+		r = r.Clone()
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &LogHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+	return &LogHandler{Handler: h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,48 @@
+package requestid
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestValid(t *testing.T) {
+	cases := map[string]bool{
+		"0123456789abcdef":       true,
+		"req-1/upstream:2":       true,
+		"":                       false,
+		"has space":              false,
+		"new\nline":              false,
+		"café":                   false,
+		strings.Repeat("a", 129): false,
+	}
+	for id, want := range cases {
+		if got := Valid(id); got != want {
+			t.Errorf("Valid(%q) = %v, want %v", id, got, want)
+		}
+	}
+	if id := New(); !Valid(id) {
+		t.Errorf("New returned invalid ID %q", id)
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewLogHandler(slog.NewTextHandler(&buf, nil))).With("component", "test")
+
+	logger.InfoContext(NewContext(context.Background(), "abc123"), "tagged")
+	logger.InfoContext(context.Background(), "untagged")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+	if !strings.Contains(lines[0], "request_id=abc123") || !strings.Contains(lines[0], "component=test") {
+		t.Errorf("expected request ID and attrs in %q", lines[0])
+	}
+	if strings.Contains(lines[1], "request_id") {
+		t.Errorf("unexpected request ID in %q", lines[1])
+	}
+}
@@ -0,0 +1,138 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a recurring time range on a set of weekdays.
+//
+// Windows whose end is before their start wrap around midnight and belong
+// to the day they start on (e.g. "fri 22:00-06:00" covers Saturday 03:00).
+type Window struct {
+	Days  [7]bool
+	Start int // minutes since midnight
+	End   int // minutes since midnight
+}
+
+// Schedule is a set of windows. An empty schedule allows everything.
+type Schedule []Window
+
+// Parse parses window specs of the form "[days] HH:MM-HH:MM".
+//
+// Days are a comma separated list of three letter day names or ranges
+// ("mon-fri", "sat,sun") or "*" for every day, which is also the default.
+func Parse(specs []string) (Schedule, error) {
+	var s Schedule
+	for _, spec := range specs {
+		w, err := parseWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance window %q: %w", spec, err)
+		}
+		s = append(s, w)
+	}
+	return s, nil
+}
+
+func parseWindow(spec string) (Window, error) {
+	var w Window
+	fields := strings.Fields(spec)
+	var days, times string
+	switch len(fields) {
+	case 1:
+		days, times = "*", fields[0]
+	case 2:
+		days, times = fields[0], fields[1]
+	default:
+		return w, fmt.Errorf("expected \"[days] HH:MM-HH:MM\"")
+	}
+
+	if err := parseDays(strings.ToLower(days), &w.Days); err != nil {
+		return w, err
+	}
+
+	start, end, ok := strings.Cut(times, "-")
+	if !ok {
+		return w, fmt.Errorf("expected time range HH:MM-HH:MM")
+	}
+	var err error
+	if w.Start, err = parseClock(start); err != nil {
+		return w, err
+	}
+	if w.End, err = parseClock(end); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+func parseDays(spec string, days *[7]bool) error {
+	if spec == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := dayNames[from]
+		if !ok {
+			return fmt.Errorf("unknown day %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = dayNames[to]; !ok {
+				return fmt.Errorf("unknown day %q", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports whether t falls inside the window.
+func (w Window) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.Start <= w.End {
+		return w.Days[day] && m >= w.Start && m < w.End
+	}
+	prev := (day + 6) % 7
+	return (w.Days[day] && m >= w.Start) || (w.Days[prev] && m < w.End)
+}
+
+// Allows reports whether maintenance may run at t.
+func (s Schedule) Allows(t time.Time) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for _, w := range s {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	// 2024-01-01 is a Monday.
+	at := func(day int, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	t.Run("Empty Allows Everything", func(t *testing.T) {
+		var s Schedule
+		if !s.Allows(at(1, 12, 0)) {
+			t.Error("empty schedule should allow maintenance")
+		}
+	})
+
+	t.Run("Weekday Window", func(t *testing.T) {
+		s, err := Parse([]string{"mon-fri 01:00-05:00"})
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		cases := []struct {
+			t    time.Time
+			want bool
+		}{
+			{at(1, 1, 0), true},
+			{at(1, 5, 0), false},
+			{at(1, 12, 0), false},
+			{at(6, 2, 0), false}, // Saturday
+		}
+		for _, c := range cases {
+			if got := s.Allows(c.t); got != c.want {
+				t.Errorf("Allows(%s) = %v, want %v", c.t, got, c.want)
+			}
+		}
+	})
+
+	t.Run("Overnight Window", func(t *testing.T) {
+		s, err := Parse([]string{"fri 22:00-06:00"})
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		if !s.Allows(at(5, 23, 0)) {
+			t.Error("expected Friday 23:00 to be allowed")
+		}
+		if !s.Allows(at(6, 3, 0)) {
+			t.Error("expected Saturday 03:00 to be allowed")
+		}
+		if s.Allows(at(5, 3, 0)) {
+			t.Error("expected Friday 03:00 to be denied")
+		}
+	})
+
+	t.Run("Invalid Spec", func(t *testing.T) {
+		for _, spec := range []string{"funday 01:00-02:00", "01:00", "mon 25:00-26:00"} {
+			if _, err := Parse([]string{spec}); err == nil {
+				t.Errorf("expected error for %q", spec)
+			}
+		}
+	})
+}
@@ -0,0 +1,126 @@
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+)
+
+const (
+	// Ready tells the service manager that startup is finished.
+	Ready = "READY=1"
+	// Stopping tells the service manager that the service is shutting down.
+	Stopping = "STOPPING=1"
+	// Watchdog updates the watchdog timestamp.
+	Watchdog = "WATCHDOG=1"
+)
+
+// Notify sends a state update to the service manager (sd_notify protocol).
+//
+// It returns false without error if NOTIFY_SOCKET is not set, i.e. the
+// process is not supervised by systemd.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// Abstract namespace sockets are announced with a leading @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	_, err = conn.Write([]byte(state))
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the watchdog timeout configured by the service
+// manager, or 0 if the watchdog is disabled for this process.
+func WatchdogInterval() (time.Duration, error) {
+	usecStr := os.Getenv("WATCHDOG_USEC")
+	if usecStr == "" {
+		return 0, nil
+	}
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil {
+			return 0, err
+		}
+		if pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+	usec, err := strconv.ParseInt(usecStr, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// listenFDsStart is the first file descriptor passed with socket activation.
+const listenFDsStart = 3
+
+// Listeners returns the sockets the service manager passed with socket
+// activation (sd_listen_fds), in order.
+//
+// It returns nil without error if there are none or they are meant for
+// another process. The LISTEN_* variables are unset so that child processes
+// don't take them for their own.
+func Listeners() ([]net.Listener, error) {
+	return listeners(listenFDsStart)
+}
+
+func listeners(start int) ([]net.Listener, error) {
+	fdsStr := os.Getenv("LISTEN_FDS")
+	if fdsStr == "" {
+		return nil, nil
+	}
+	if pidStr := os.Getenv("LISTEN_PID"); pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil {
+			return nil, err
+		}
+		if pid != os.Getpid() {
+			return nil, nil
+		}
+	}
+	n, err := strconv.Atoi(fdsStr)
+	if err != nil {
+		return nil, err
+	}
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if err := os.Unsetenv(env); err != nil {
+			return nil, err
+		}
+	}
+
+	var lns []net.Listener
+	for fd := start; fd < start+n; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		// FileListener works on a duplicate, so the original is closed either way
+		ln, err := net.FileListener(file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			for _, ln := range lns {
+				errutil.LogMsg(ln.Close(), "Failed to close activated listener")
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
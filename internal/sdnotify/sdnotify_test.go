@@ -0,0 +1,131 @@
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	t.Run("Not Supervised", func(t *testing.T) {
+		t.Setenv("NOTIFY_SOCKET", "")
+		sent, err := Notify(Ready)
+		if err != nil || sent {
+			t.Errorf("expected no-op, got sent=%v err=%v", sent, err)
+		}
+	})
+
+	t.Run("Sends State", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "notify.sock")
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+		if err != nil {
+			t.Fatalf("listen failed: %v", err)
+		}
+		defer func() {
+			if err := conn.Close(); err != nil {
+				t.Errorf("close failed: %v", err)
+			}
+		}()
+
+		t.Setenv("NOTIFY_SOCKET", path)
+		sent, err := Notify(Ready)
+		if err != nil || !sent {
+			t.Fatalf("Notify failed: sent=%v err=%v", sent, err)
+		}
+
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if string(buf[:n]) != Ready {
+			t.Errorf("got %q, want %q", buf[:n], Ready)
+		}
+	})
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	d, err := WatchdogInterval()
+	if err != nil {
+		t.Fatalf("WatchdogInterval failed: %v", err)
+	}
+	if d != 30*time.Second {
+		t.Errorf("got %s, want 30s", d)
+	}
+
+	t.Setenv("WATCHDOG_PID", "1")
+	d, err = WatchdogInterval()
+	if err != nil || d != 0 {
+		t.Errorf("expected watchdog disabled for another pid, got %s, %v", d, err)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	t.Run("Not Activated", func(t *testing.T) {
+		t.Setenv("LISTEN_FDS", "")
+		lns, err := Listeners()
+		if err != nil || lns != nil {
+			t.Errorf("expected no listeners, got %v err=%v", lns, err)
+		}
+	})
+
+	t.Run("Other Process", func(t *testing.T) {
+		t.Setenv("LISTEN_FDS", "1")
+		t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+		lns, err := Listeners()
+		if err != nil || lns != nil {
+			t.Errorf("expected no listeners, got %v err=%v", lns, err)
+		}
+	})
+
+	t.Run("Activated", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen failed: %v", err)
+		}
+		file, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatalf("File failed: %v", err)
+		}
+		// listeners takes over the descriptor, so it gets one of its own
+		fd, err := syscall.Dup(int(file.Fd()))
+		if err != nil {
+			t.Fatalf("dup failed: %v", err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatalf("close failed: %v", err)
+		}
+		if err := ln.Close(); err != nil {
+			t.Fatalf("close failed: %v", err)
+		}
+
+		t.Setenv("LISTEN_FDS", "1")
+		t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		lns, err := listeners(fd)
+		if err != nil || len(lns) != 1 {
+			t.Fatalf("expected one listener, got %v err=%v", lns, err)
+		}
+		defer func() {
+			if err := lns[0].Close(); err != nil {
+				t.Errorf("close failed: %v", err)
+			}
+		}()
+		if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+			t.Error("expected LISTEN_FDS to be unset")
+		}
+
+		conn, err := net.Dial("tcp", lns[0].Addr().String())
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		if err := conn.Close(); err != nil {
+			t.Errorf("close failed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,113 @@
+// Package sourceurls encodes and decodes the X-Source-Urls header.
+//
+// The header is a Structured Field list of URL strings. A source that needs
+// credentials or other headers carries them as parameters named "h-" followed
+// by the lowercase header name:
+//
+//	X-Source-Urls: "https://public/file", "https://private/file";h-authorization="Basic dTpw"
+package sourceurls
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/shogo82148/go-sfv"
+)
+
+// Header is the name of the header listing candidate sources.
+const Header = "X-Source-Urls"
+
+const headerParamPrefix = "h-"
+
+// forbidden are the headers a source may not ask for, because the fetch
+// itself controls them.
+var forbidden = []string{
+	"connection",
+	"content-length",
+	"host",
+	"if-range",
+	"range",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+	"x-source-urls",
+}
+
+// Source is a candidate URL and the headers to send when fetching it.
+type Source struct {
+	URL    string
+	Header http.Header
+}
+
+// Allowed reports whether a source may ask for the header name to be sent.
+func Allowed(name string) bool {
+	return !slices.Contains(forbidden, strings.ToLower(name))
+}
+
+// Encode serializes sources for the X-Source-Urls header.
+func Encode(sources []Source) (string, error) {
+	list := make(sfv.List, len(sources))
+	for i, s := range sources {
+		item := sfv.Item{Value: s.URL}
+		names := make([]string, 0, len(s.Header))
+		for name := range s.Header {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			if !Allowed(name) {
+				return "", fmt.Errorf("header %s cannot be set for a source", name)
+			}
+			for _, value := range s.Header[name] {
+				item.Parameters = append(item.Parameters, sfv.Parameter{
+					Key:   headerParamPrefix + strings.ToLower(name),
+					Value: value,
+				})
+			}
+		}
+		list[i] = item
+	}
+	return sfv.EncodeList(list)
+}
+
+// Decode parses the values of X-Source-Urls headers. Entries that are not
+// strings are skipped, as are parameters other than allowed headers.
+func Decode(values []string) ([]Source, error) {
+	list, err := sfv.DecodeList(values)
+	if err != nil {
+		return nil, err
+	}
+	var sources []Source
+	for _, item := range list {
+		url, ok := item.Value.(string)
+		if !ok {
+			continue
+		}
+		source := Source{URL: url}
+		for _, param := range item.Parameters {
+			name, ok := strings.CutPrefix(param.Key, headerParamPrefix)
+			value, isString := param.Value.(string)
+			if !ok || !isString || !Allowed(name) {
+				continue
+			}
+			if source.Header == nil {
+				source.Header = make(http.Header)
+			}
+			source.Header.Add(name, value)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// URLs returns the URLs of sources.
+func URLs(sources []Source) []string {
+	urls := make([]string, len(sources))
+	for i, s := range sources {
+		urls[i] = s.URL
+	}
+	return urls
+}
@@ -0,0 +1,53 @@
+package sourceurls
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	sources := []Source{
+		{URL: "https://public.example/file"},
+		{URL: "https://private.example/file", Header: http.Header{
+			"Authorization": {"Bearer secret"},
+			"User-Agent":    {"fetchurl"},
+		}},
+	}
+	encoded, err := Encode(sources)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	want := `"https://public.example/file", "https://private.example/file";h-authorization="Bearer secret";h-user-agent="fetchurl"`
+	if encoded != want {
+		t.Errorf("got %s\nwant %s", encoded, want)
+	}
+
+	decoded, err := Decode([]string{encoded})
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if !slices.Equal(URLs(decoded), URLs(sources)) {
+		t.Errorf("got URLs %v", URLs(decoded))
+	}
+	if decoded[0].Header != nil {
+		t.Errorf("expected no headers for the public source, got %v", decoded[0].Header)
+	}
+	if got := decoded[1].Header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("expected Authorization to survive, got %q", got)
+	}
+}
+
+func TestForbiddenHeaders(t *testing.T) {
+	if _, err := Encode([]Source{{URL: "https://example/file", Header: http.Header{"Range": {"bytes=0-1"}}}}); err == nil {
+		t.Error("expected Range to be refused")
+	}
+
+	decoded, err := Decode([]string{`"https://example/file";h-host="evil";h-range="bytes=0-1";other=1;h-accept="*/*"`})
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if h := decoded[0].Header; len(h) != 1 || h.Get("Accept") != "*/*" {
+		t.Errorf("expected only Accept to be kept, got %v", h)
+	}
+}
@@ -0,0 +1,86 @@
+// Package urltemplate expands mirror URL templates such as
+// https://mirror.example/{algo}/{hash:0:2}/{hash}.
+//
+// A template may use {algo} for the algorithm name, {hash} for the hex digest
+// and {hash:start:end} or {hash:start} for a slice of it, which is how static
+// mirrors shard objects into directories. Slice bounds past the end of the
+// digest are clamped to it.
+package urltemplate
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IsTemplate reports whether s uses any placeholder.
+func IsTemplate(s string) bool {
+	return strings.Contains(s, "{algo}") || strings.Contains(s, "{hash")
+}
+
+// Validate checks that every placeholder in tmpl is well formed.
+func Validate(tmpl string) error {
+	_, err := expand(tmpl, "", "")
+	return err
+}
+
+// Expand fills in the placeholders of tmpl. Malformed placeholders are left
+// as-is; use Validate to reject them up front.
+func Expand(tmpl, algo, hash string) string {
+	s, err := expand(tmpl, algo, hash)
+	if err != nil {
+		return tmpl
+	}
+	return s
+}
+
+func expand(tmpl, algo, hash string) (string, error) {
+	var b strings.Builder
+	rest := tmpl
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			b.WriteString(rest)
+			return b.String(), nil
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated placeholder in %s", tmpl)
+		}
+		b.WriteString(rest[:open])
+		value, err := placeholder(rest[open+1:open+end], algo, hash)
+		if err != nil {
+			return "", fmt.Errorf("%w in %s", err, tmpl)
+		}
+		b.WriteString(value)
+		rest = rest[open+end+1:]
+	}
+}
+
+func placeholder(name, algo, hash string) (string, error) {
+	if name == "algo" {
+		return algo, nil
+	}
+	field, bounds, sliced := strings.Cut(name, ":")
+	if field != "hash" {
+		return "", fmt.Errorf("unknown placeholder {%s}", name)
+	}
+	if !sliced {
+		return hash, nil
+	}
+
+	startStr, endStr, hasEnd := strings.Cut(bounds, ":")
+	start, err := strconv.Atoi(startStr)
+	if err != nil || start < 0 {
+		return "", fmt.Errorf("invalid start in {%s}", name)
+	}
+	end := len(hash)
+	if hasEnd {
+		end, err = strconv.Atoi(endStr)
+		if err != nil || end < start {
+			return "", fmt.Errorf("invalid end in {%s}", name)
+		}
+	}
+	start, end = min(start, len(hash)), min(end, len(hash))
+	return hash[start:end], nil
+}
@@ -0,0 +1,46 @@
+package urltemplate
+
+import "testing"
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		{"https://mirror.example/{algo}/{hash}", "https://mirror.example/sha256/abcdef"},
+		{"https://mirror.example/{hash:0:2}/{hash:2:4}/{hash}", "https://mirror.example/ab/cd/abcdef"},
+		{"https://mirror.example/{hash:4}", "https://mirror.example/ef"},
+		{"https://mirror.example/{hash:4:100}", "https://mirror.example/ef"},
+		{"https://mirror.example/{unknown}", "https://mirror.example/{unknown}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tmpl, func(t *testing.T) {
+			if got := Expand(tt.tmpl, "sha256", "abcdef"); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tmpl := range []string{
+		"https://mirror.example/{algo}/{hash}",
+		"https://mirror.example/{hash:0:2}/{hash:2}",
+		"https://mirror.example/plain",
+	} {
+		if err := Validate(tmpl); err != nil {
+			t.Errorf("%s: unexpected error: %v", tmpl, err)
+		}
+	}
+	for _, tmpl := range []string{
+		"https://mirror.example/{algo",
+		"https://mirror.example/{size}",
+		"https://mirror.example/{hash:a:2}",
+		"https://mirror.example/{hash:4:2}",
+		"https://mirror.example/{hash:-1}",
+	} {
+		if err := Validate(tmpl); err == nil {
+			t.Errorf("%s: expected an error", tmpl)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package fetchurl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/ratelimit"
+)
+
+// Open returns a reader streaming the content described by opts, ignoring
+// opts.Out, along with its size, or -1 if unknown.
+//
+// The content is verified as it is read: the read that reaches the end
+// returns an error matching ErrHashMismatch instead of io.EOF if it doesn't
+// match, and so does Close afterwards. Content closed before the end is never
+// verified. Servers and sources are tried in order until one responds, but
+// there is no fallback once the reader is returned. Chunked and hedged
+// downloads are not used.
+func (f *Fetcher) Open(ctx context.Context, opts FetchOptions) (io.ReadCloser, int64, error) {
+	if err := normalizeOptions(&opts); err != nil {
+		return nil, 0, err
+	}
+	hasher, err := newMultiHasher(opts.digests())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	retry := f.retryPolicy(opts)
+	var lastErr error
+	for _, c := range f.candidates(opts) {
+		var resp *http.Response
+		lastErr = retry.do(ctx, nil, func() error {
+			req, err := c.newRequest(ctx)
+			if err != nil {
+				return err
+			}
+			resp, err = f.do(req)
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != http.StatusOK {
+				errutil.LogMsg(resp.Body.Close(), "Failed to close response body")
+				return &HTTPStatusError{StatusCode: resp.StatusCode}
+			}
+			if err := checkSize(opts.Size, resp.ContentLength); err != nil {
+				errutil.LogMsg(resp.Body.Close(), "Failed to close response body")
+				return err
+			}
+			return nil
+		})
+		if lastErr != nil {
+			errutil.LogMsg(lastErr, "Failed to open source", "url", c.name)
+			continue
+		}
+
+		var r io.Reader = ratelimit.NewBandwidth(opts.MaxBytesPerSecond).Reader(ctx, resp.Body)
+		if opts.Progress != nil || opts.Size > 0 {
+			r = io.TeeReader(r, &countingWriter{Writer: io.Discard, Total: resp.ContentLength, Limit: opts.Size, Progress: opts.Progress})
+		}
+		return &verifyingReader{
+			r:      r,
+			body:   resp.Body,
+			hasher: hasher,
+		}, resp.ContentLength, nil
+	}
+
+	if lastErr != nil {
+		return nil, 0, fmt.Errorf("%w: %w", ErrAllSourcesFailed, lastErr)
+	}
+	return nil, 0, ErrAllSourcesFailed
+}
+
+// verifyingReader hashes what is read through it and checks the digest at the end.
+type verifyingReader struct {
+	r      io.Reader
+	body   io.Closer
+	hasher *multiHasher
+	err    error // set once the end is reached with a mismatch
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err := v.r.Read(p)
+	v.hasher.Write(p[:n])
+	if err == io.EOF {
+		if v.err = v.hasher.verify(); v.err != nil {
+			return n, v.err
+		}
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	if err := v.body.Close(); err != nil {
+		return err
+	}
+	return v.err
+}
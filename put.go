@@ -0,0 +1,64 @@
+package fetchurl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/hashutil"
+)
+
+// Put uploads the file at path to a fetchurl server with uploads enabled,
+// authenticating with Token, and returns the URL it can then be fetched from.
+func (f *Fetcher) Put(ctx context.Context, server, algo, path string) (string, error) {
+	algo = hashutil.NormalizeAlgo(algo)
+	hash, err := Digest(path, algo)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		errutil.LogMsg(file.Close(), "Failed to close file", "path", path)
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	return f.PutReader(ctx, server, algo, hash, file, info.Size())
+}
+
+// PutReader uploads the content of r, which must have the given digest, like
+// Put. size is the content length, or -1 if unknown.
+func (f *Fetcher) PutReader(ctx context.Context, server, algo, hash string, r io.Reader, size int64) (string, error) {
+	algo = hashutil.NormalizeAlgo(algo)
+	u := fmt.Sprintf("%s/api/fetchurl/%s/%s", strings.TrimRight(server, "/"), algo, hash)
+	// The caller closes r, not the transport
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, io.NopCloser(r))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	if f.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.Token)
+	}
+	f.authenticate(req)
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	errutil.LogMsg(resp.Body.Close(), "Failed to close response body")
+	// 200 means the server had it already
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", &HTTPStatusError{StatusCode: resp.StatusCode}
+	}
+	return u, nil
+}
@@ -0,0 +1,80 @@
+package fetchurl
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+)
+
+// DefaultRetryStatuses are the response statuses retried when
+// RetryPolicy.RetryOn is empty: timeouts, rate limiting and server errors
+// that tend to go away on their own.
+var DefaultRetryStatuses = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// RetryPolicy controls how many times a source is tried before moving on to
+// the next one. The zero value tries each source once.
+//
+// Attempts stop as soon as any byte reaches Out, unless Out can be rewound;
+// see ErrPartialWrite. FetchToFile resumes where the attempt stopped instead.
+type RetryPolicy struct {
+	// MaxAttempts is how many times each source is tried. Values below 1 mean 1.
+	MaxAttempts int
+	// Backoff is the wait before the second attempt. It doubles on every
+	// attempt after that, up to MaxBackoff if set.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// RetryOn lists the response statuses worth retrying. Defaults to
+	// DefaultRetryStatuses. Network errors are always retried.
+	RetryOn []int
+}
+
+// retryable reports whether err is worth another attempt.
+func (p RetryPolicy) retryable(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		statuses := p.RetryOn
+		if len(statuses) == 0 {
+			statuses = DefaultRetryStatuses
+		}
+		return slices.Contains(statuses, statusErr.StatusCode)
+	}
+	// Content errors would repeat, and a canceled fetch must stop
+	return !errors.Is(err, ErrHashMismatch) && !errors.Is(err, ErrSizeMismatch) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// do runs attempt until it succeeds, fails for good, or the attempts run out.
+// cw, if not nil, tells whether anything was written, which rules out retrying.
+func (p RetryPolicy) do(ctx context.Context, cw *countingWriter, attempt func() error) error {
+	backoff := p.Backoff
+	for i := 1; ; i++ {
+		err := attempt()
+		if err == nil || i >= p.MaxAttempts || cw != nil && !cw.reset() || !p.retryable(err) {
+			return err
+		}
+		errutil.LogMsg(err, "Retrying fetch", "attempt", i+1, "max_attempts", p.MaxAttempts, "backoff", backoff)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package fetchurl
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lucasew/fetchurl/internal/errutil"
+	"github.com/lucasew/fetchurl/internal/hashutil"
+)
+
+// Verify checks that the file at path matches the digest, given either as
+// algo and a hex hash or as an SRI string with an empty algo. It returns an
+// error matching ErrHashMismatch if it doesn't.
+func Verify(path, algo, hash string) error {
+	opts := FetchOptions{Algo: algo, Hash: hash}
+	if err := normalizeOptions(&opts); err != nil {
+		return err
+	}
+	actual, err := Digest(path, opts.Algo)
+	if err != nil {
+		return err
+	}
+	if actual != opts.Hash {
+		return fmt.Errorf("%w: expected %s, got %s", ErrHashMismatch, opts.Hash, actual)
+	}
+	return nil
+}
+
+// Digest returns the hex digest of the file at path under algo.
+func Digest(path, algo string) (string, error) {
+	hasher, err := hashutil.GetHasher(algo)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		errutil.LogMsg(file.Close(), "Failed to close file", "path", path)
+	}()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}